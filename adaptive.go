@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// adaptiveChangeThreshold is the relative change in either threshold needed
+// before the topic handle is replaced, so small fluctuations in traffic don't
+// churn handles.
+const adaptiveChangeThreshold = 0.2
+
+// AdaptiveBatcher retunes a topic's DelayThreshold and CountThreshold from
+// the publish rate and latency observed over each interval: idle topics get
+// small, fast batches and bursting topics get large ones, within the
+// configured bounds. Batching settings are fixed once a topic handle has
+// published, so a change is applied by swapping in a new handle.
+type AdaptiveBatcher struct {
+	config AdaptiveBatchingConfig
+	topic  *RegisteredTopic
+
+	mu             sync.Mutex
+	published      int
+	totalLatency   time.Duration
+	delay          time.Duration
+	countThreshold int
+}
+
+func newAdaptiveBatcher(topic *RegisteredTopic, config AdaptiveBatchingConfig) *AdaptiveBatcher {
+	return &AdaptiveBatcher{
+		config:         config,
+		topic:          topic,
+		delay:          config.MinDelay,
+		countThreshold: config.MinCount,
+	}
+}
+
+func (b *AdaptiveBatcher) settings() pubsub.PublishSettings {
+	settings := pubsub.DefaultPublishSettings
+	settings.DelayThreshold = b.delay
+	settings.CountThreshold = b.countThreshold
+	batchDelayThreshold.WithLabelValues(b.topic.Config.Name).Set(b.delay.Seconds())
+	batchCountThreshold.WithLabelValues(b.topic.Config.Name).Set(float64(b.countThreshold))
+	return settings
+}
+
+func (b *AdaptiveBatcher) observe(latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published++
+	b.totalLatency += latency
+}
+
+func (b *AdaptiveBatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(b.config.Interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			b.adjust(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+func (b *AdaptiveBatcher) adjust(elapsed time.Duration) {
+	b.mu.Lock()
+	published, totalLatency := b.published, b.totalLatency
+	b.published, b.totalLatency = 0, 0
+	b.mu.Unlock()
+
+	rate := float64(published) / elapsed.Seconds()
+	load := min(rate/b.config.BurstRate, 1)
+	delay := b.config.MinDelay + time.Duration(load*float64(b.config.MaxDelay-b.config.MinDelay))
+	if published > 0 && b.config.LatencyTarget > 0 && totalLatency/time.Duration(published) > b.config.LatencyTarget {
+		// Batching is adding more latency than we're allowed; flush sooner.
+		delay = max(b.config.MinDelay, min(delay, b.delay)/2)
+	}
+	count := int(rate * delay.Seconds())
+	count = max(b.config.MinCount, min(b.config.MaxCount, count))
+
+	if !changed(float64(delay), float64(b.delay)) && !changed(float64(count), float64(b.countThreshold)) {
+		return
+	}
+	b.delay, b.countThreshold = delay, count
+	b.topic.swap(b.settings())
+	newLogger("adaptive").Printf("Topic %s: %.1f msg/s, batching with delay %s and count %d", b.topic.Config.Name, rate, delay, count)
+}
+
+func changed(next float64, current float64) bool {
+	if current == 0 {
+		return next != 0
+	}
+	difference := (next - current) / current
+	return difference > adaptiveChangeThreshold || difference < -adaptiveChangeThreshold
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"github.com/linkedin/goavro/v2"
+	"go.uber.org/fx"
+)
+
+const archiveSchema = `{
+	"type": "record",
+	"name": "PubSubMessage",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "publish_time", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "ordering_key", "type": "string"},
+		{"name": "attributes", "type": {"type": "map", "values": "string"}},
+		{"name": "data", "type": "bytes"}
+	]
+}`
+
+const (
+	// archiveBlockRecords and archiveBlockBytes bound the records buffered
+	// before they're appended to a file as one Avro block, which is the unit
+	// the codec compresses.
+	archiveBlockRecords = 1000
+	archiveBlockBytes   = 1 << 20
+	// archiveOutstandingFiles is how many files' worth of raw message bytes
+	// may be held unacked, leaving room for compression and for a partition
+	// boundary to open a second file while the first fills.
+	archiveOutstandingFiles = 4
+)
+
+type ArchiverParams struct {
+	Config struct {
+		Subscription string
+		Bucket       string
+		Prefix       string
+		Codec        string
+		MaxFileBytes int64
+		MaxFileAge   time.Duration
+	}
+	Logger *log.Logger
+}
+
+// ArchiveManifest describes a single committed archive file. One manifest is
+// written next to every data file so replay tooling can discover what a
+// partition contains without opening the Avro files themselves.
+type ArchiveManifest struct {
+	Object           string    `json:"object"`
+	Subscription     string    `json:"subscription"`
+	Partition        string    `json:"partition"`
+	Codec            string    `json:"codec"`
+	Messages         int       `json:"messages"`
+	Bytes            int64     `json:"bytes"`
+	FirstMessageId   string    `json:"first_message_id"`
+	LastMessageId    string    `json:"last_message_id"`
+	MinPublishTime   time.Time `json:"min_publish_time"`
+	MaxPublishTime   time.Time `json:"max_publish_time"`
+	CreatedAt        time.Time `json:"created_at"`
+	CommittedAt      time.Time `json:"committed_at"`
+	ArchiverInstance string    `json:"archiver_instance"`
+}
+
+type archiveFile struct {
+	object  string
+	cancel  context.CancelFunc
+	writer  *storage.Writer
+	counter *countingWriter
+	ocf     *goavro.OCFWriter
+	pending []*pubsub.Message
+	// records are buffered until there are enough for a block, and
+	// recordBytes is their data size.
+	records     []interface{}
+	recordBytes int
+	manifest    ArchiveManifest
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type Archiver struct {
+	params     ArchiverParams
+	client     *pubsub.Client
+	storage    *storage.Client
+	shutdowner fx.Shutdowner
+	instance   string
+
+	mu    sync.Mutex
+	files map[string]*archiveFile
+	seq   int
+}
+
+func newArchiverParams(logger *log.Logger) ArchiverParams {
+	params := ArchiverParams{Logger: logger}
+	params.Config.Subscription = os.Getenv("ARCHIVE_SUBSCRIPTION")
+	params.Config.Bucket = os.Getenv("ARCHIVE_BUCKET")
+	params.Config.Prefix = os.Getenv("ARCHIVE_PREFIX")
+	params.Config.Codec = envOrDefault("ARCHIVE_CODEC", goavro.CompressionDeflateLabel)
+	params.Config.MaxFileBytes = 128 << 20
+	if value, err := strconv.ParseInt(os.Getenv("ARCHIVE_MAX_FILE_BYTES"), 10, 64); err == nil {
+		params.Config.MaxFileBytes = value
+	}
+	params.Config.MaxFileAge = 10 * time.Minute
+	if value, err := time.ParseDuration(os.Getenv("ARCHIVE_MAX_FILE_AGE")); err == nil {
+		params.Config.MaxFileAge = value
+	}
+	return params
+}
+
+func newStorageClient(lifecycle fx.Lifecycle, params PubSubParams) *storage.Client {
+	client := new(storage.Client)
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(ctx context.Context) error {
+				params.Logger.Println("Connecting to Cloud Storage...")
+				newClient, err := storage.NewClient(ctx, params.clientOptions()...)
+				if err == nil {
+					*client = *newClient
+					params.Logger.Println("Successfully connected to Cloud Storage.")
+				} else {
+					params.Logger.Printf("Failed to connect to Cloud Storage: %v", err)
+				}
+				return err
+			},
+			OnStop: func(ctx context.Context) error {
+				params.Logger.Println("Closing Cloud Storage connection...")
+				return client.Close()
+			},
+		},
+	)
+	return client
+}
+
+func newArchiver(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, params ArchiverParams, client *pubsub.Client, storageClient *storage.Client) *Archiver {
+	hostname, _ := os.Hostname()
+	archiver := &Archiver{
+		params:     params,
+		client:     client,
+		storage:    storageClient,
+		shutdowner: shutdowner,
+		instance:   hostname,
+		files:      make(map[string]*archiveFile),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(context.Context) error {
+				if params.Config.Subscription == "" || params.Config.Bucket == "" {
+					return fmt.Errorf("archive subscription and bucket must be configured")
+				}
+				go archiver.receive(ctx, done)
+				go archiver.rollExpired(ctx)
+				return nil
+			},
+			OnStop: func(stopCtx context.Context) error {
+				cancel()
+				select {
+				case <-done:
+				case <-stopCtx.Done():
+					return stopCtx.Err()
+				}
+				return archiver.rollAll(stopCtx)
+			},
+		},
+	)
+	return archiver
+}
+
+// receiveSettings holds messages unacked for as long as it takes to fill
+// or age out a file: by bytes rather than count, so the size roll can fire,
+// and with leases extended past the age roll.
+func (a *Archiver) receiveSettings() pubsub.ReceiveSettings {
+	settings := pubsub.DefaultReceiveSettings
+	settings.MaxOutstandingMessages = -1
+	settings.MaxOutstandingBytes = int(min(a.params.Config.MaxFileBytes*archiveOutstandingFiles, math.MaxInt))
+	// rollExpired checks ages every minute, and committing takes a while.
+	settings.MaxExtension = a.params.Config.MaxFileAge + 5*time.Minute
+	return settings
+}
+
+// receive archives messages until ctx is done, shutting the command down
+// with a non-zero exit if receiving fails.
+func (a *Archiver) receive(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	a.params.Logger.Printf("Archiving subscription %s to gs://%s/%s", a.params.Config.Subscription, a.params.Config.Bucket, a.params.Config.Prefix)
+	subscription := a.client.Subscription(a.params.Config.Subscription)
+	subscription.ReceiveSettings = a.receiveSettings()
+	err := subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		if err := a.write(ctx, msg); err != nil {
+			a.params.Logger.Printf("Failed to archive message %s: %v", msg.ID, err)
+			msg.Nack()
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		a.params.Logger.Printf("Archive receive stopped: %v", err)
+		a.shutdowner.Shutdown(fx.ExitCode(1))
+	}
+}
+
+func (a *Archiver) rollExpired(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			for partition, file := range a.files {
+				if time.Since(file.manifest.CreatedAt) >= a.params.Config.MaxFileAge {
+					a.roll(context.Background(), partition, file)
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+func (a *Archiver) rollAll(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var err error
+	for partition, file := range a.files {
+		if rollErr := a.roll(ctx, partition, file); rollErr != nil {
+			err = rollErr
+		}
+	}
+	return err
+}
+
+func (a *Archiver) write(ctx context.Context, msg *pubsub.Message) error {
+	partition := msg.PublishTime.UTC().Format("dt=2006-01-02/hour=15")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, ok := a.files[partition]
+	if !ok {
+		var err error
+		if file, err = a.open(partition); err != nil {
+			return err
+		}
+		a.files[partition] = file
+	}
+
+	attributes := make(map[string]interface{}, len(msg.Attributes))
+	for key, value := range msg.Attributes {
+		attributes[key] = value
+	}
+	record := map[string]interface{}{
+		"id":           msg.ID,
+		"publish_time": msg.PublishTime,
+		"ordering_key": msg.OrderingKey,
+		"attributes":   attributes,
+		"data":         msg.Data,
+	}
+	file.records = append(file.records, record)
+	file.recordBytes += len(msg.Data)
+	file.pending = append(file.pending, msg)
+	if len(file.records) >= archiveBlockRecords || file.recordBytes >= archiveBlockBytes {
+		if err := a.flush(partition, file); err != nil {
+			return err
+		}
+	}
+
+	if file.manifest.FirstMessageId == "" {
+		file.manifest.FirstMessageId = msg.ID
+		file.manifest.MinPublishTime = msg.PublishTime
+	}
+	file.manifest.LastMessageId = msg.ID
+	if msg.PublishTime.Before(file.manifest.MinPublishTime) {
+		file.manifest.MinPublishTime = msg.PublishTime
+	}
+	if msg.PublishTime.After(file.manifest.MaxPublishTime) {
+		file.manifest.MaxPublishTime = msg.PublishTime
+	}
+
+	if file.counter.n >= a.params.Config.MaxFileBytes {
+		return a.roll(ctx, partition, file)
+	}
+	return nil
+}
+
+// flush appends file's buffered records as one block. If that fails the
+// file is abandoned and its messages nacked, including the one being
+// written, which its caller then nacks again to no effect. Callers must
+// hold a.mu.
+func (a *Archiver) flush(partition string, file *archiveFile) error {
+	if len(file.records) == 0 {
+		return nil
+	}
+	if err := file.ocf.Append(file.records); err != nil {
+		file.cancel()
+		delete(a.files, partition)
+		for _, pending := range file.pending {
+			pending.Nack()
+		}
+		return err
+	}
+	file.records, file.recordBytes = nil, 0
+	return nil
+}
+
+func (a *Archiver) open(partition string) (*archiveFile, error) {
+	a.seq++
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s-%s-%06d.avro", a.params.Config.Subscription, now.Format("20060102T150405Z"), a.instance, a.seq)
+	object := path.Join(a.params.Config.Prefix, a.params.Config.Subscription, partition, name)
+
+	// The object is only committed by Close, so messages are held unacked
+	// until the file they were written to is durable in GCS.
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := a.storage.Bucket(a.params.Config.Bucket).Object(object).NewWriter(ctx)
+	writer.ContentType = "avro/binary"
+	counter := &countingWriter{w: writer}
+	ocf, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:               counter,
+		Schema:          archiveSchema,
+		CompressionName: a.params.Config.Codec,
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &archiveFile{
+		object:  object,
+		cancel:  cancel,
+		writer:  writer,
+		counter: counter,
+		ocf:     ocf,
+		manifest: ArchiveManifest{
+			Object:           object,
+			Subscription:     a.params.Config.Subscription,
+			Partition:        partition,
+			Codec:            a.params.Config.Codec,
+			CreatedAt:        now,
+			ArchiverInstance: a.instance,
+		},
+	}, nil
+}
+
+// roll commits file to GCS, writes its manifest and acks the messages it
+// contains. Callers must hold a.mu.
+func (a *Archiver) roll(ctx context.Context, partition string, file *archiveFile) error {
+	if err := a.flush(partition, file); err != nil {
+		a.params.Logger.Printf("Failed to write archive file %s: %v", file.object, err)
+		return err
+	}
+	delete(a.files, partition)
+	defer file.cancel()
+
+	if err := file.writer.Close(); err != nil {
+		a.params.Logger.Printf("Failed to commit archive file %s: %v", file.object, err)
+		for _, msg := range file.pending {
+			msg.Nack()
+		}
+		return err
+	}
+
+	file.manifest.Messages = len(file.pending)
+	file.manifest.Bytes = file.counter.n
+	file.manifest.CommittedAt = time.Now().UTC()
+	if err := a.writeManifest(ctx, file.manifest); err != nil {
+		a.params.Logger.Printf("Failed to write manifest for %s: %v", file.object, err)
+		for _, msg := range file.pending {
+			msg.Nack()
+		}
+		return err
+	}
+
+	for _, msg := range file.pending {
+		msg.Ack()
+	}
+	a.params.Logger.Printf("Archived %d messages (%d bytes) to gs://%s/%s", file.manifest.Messages, file.manifest.Bytes, a.params.Config.Bucket, file.object)
+	return nil
+}
+
+func (a *Archiver) writeManifest(ctx context.Context, manifest ArchiveManifest) error {
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	object := path.Join(a.params.Config.Prefix, "_manifest", a.params.Config.Subscription, manifest.Partition, path.Base(manifest.Object)+".json")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := a.storage.Bucket(a.params.Config.Bucket).Object(object).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := io.Copy(writer, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Pub/Sub's documented limits on message attributes and ordering keys.
+const (
+	maxAttributes           = 100
+	maxAttributeKeyBytes    = 256
+	maxAttributeValueBytes  = 1024
+	maxOrderingKeyBytes     = 1024
+	reservedAttributePrefix = "goog"
+)
+
+var errInvalidAttributes = errors.New("invalid attributes")
+
+// validatePubSubLimits rejects messages Pub/Sub would fail with
+// InvalidArgument, naming the offending attribute. It runs before trace
+// context is injected, which uses the googclient_ prefix Pub/Sub allows.
+func validatePubSubLimits(msg *pubsub.Message) error {
+	if len(msg.Attributes) > maxAttributes {
+		return fmt.Errorf("%w: %d attributes, at most %d are allowed", errInvalidAttributes, len(msg.Attributes), maxAttributes)
+	}
+	for _, key := range sortedKeys(msg.Attributes) {
+		switch value := msg.Attributes[key]; {
+		case key == "":
+			return fmt.Errorf("%w: attribute keys can't be empty", errInvalidAttributes)
+		case len(key) > maxAttributeKeyBytes:
+			return fmt.Errorf("%w: attribute key %.32q... is %d bytes, at most %d are allowed", errInvalidAttributes, key, len(key), maxAttributeKeyBytes)
+		case strings.HasPrefix(strings.ToLower(key), reservedAttributePrefix):
+			return fmt.Errorf("%w: attribute %q uses the reserved prefix %q", errInvalidAttributes, key, reservedAttributePrefix)
+		case len(value) > maxAttributeValueBytes:
+			return fmt.Errorf("%w: attribute %q is %d bytes, at most %d are allowed", errInvalidAttributes, key, len(value), maxAttributeValueBytes)
+		}
+	}
+	if len(msg.OrderingKey) > maxOrderingKeyBytes {
+		return fmt.Errorf("%w: ordering key is %d bytes, at most %d are allowed", errInvalidAttributes, len(msg.OrderingKey), maxOrderingKeyBytes)
+	}
+	return nil
+}
+
+// AttributePolicy is an organization's own rules for the attributes callers
+// set, on top of Pub/Sub's limits.
+type AttributePolicy struct {
+	// KeyPattern is a regular expression every key must match.
+	KeyPattern string   `yaml:"key_pattern"`
+	Required   []string `yaml:"required"`
+	Forbidden  []string `yaml:"forbidden"`
+	// MaxValueBytes lowers the maximum attribute value size.
+	MaxValueBytes int `yaml:"max_value_bytes"`
+}
+
+// AttributeCheck validates a message's attributes against the policies it
+// was compiled from.
+type AttributeCheck func(attributes map[string]string) error
+
+// compileAttributePolicies combines policies, all of which must pass.
+func compileAttributePolicies(policies ...*AttributePolicy) (AttributeCheck, error) {
+	var checks []AttributeCheck
+	for _, policy := range policies {
+		if policy == nil {
+			continue
+		}
+		check, err := policy.compile()
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+	if len(checks) == 0 {
+		return nil, nil
+	}
+	return func(attributes map[string]string) error {
+		for _, check := range checks {
+			if err := check(attributes); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+func (p AttributePolicy) compile() (AttributeCheck, error) {
+	var pattern *regexp.Regexp
+	if p.KeyPattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(p.KeyPattern); err != nil {
+			return nil, fmt.Errorf("attribute_policy: key_pattern: %w", err)
+		}
+	}
+	if p.MaxValueBytes < 0 {
+		return nil, fmt.Errorf("attribute_policy: max_value_bytes can't be negative")
+	}
+	return func(attributes map[string]string) error {
+		for _, key := range p.Required {
+			if _, ok := attributes[key]; !ok {
+				return fmt.Errorf("%w: attribute %q is required", errInvalidAttributes, key)
+			}
+		}
+		for _, key := range p.Forbidden {
+			if _, ok := attributes[key]; ok {
+				return fmt.Errorf("%w: attribute %q isn't allowed", errInvalidAttributes, key)
+			}
+		}
+		for _, key := range sortedKeys(attributes) {
+			if pattern != nil && !pattern.MatchString(key) {
+				return fmt.Errorf("%w: attribute key %q doesn't match %s", errInvalidAttributes, key, p.KeyPattern)
+			}
+			if p.MaxValueBytes > 0 && len(attributes[key]) > p.MaxValueBytes {
+				return fmt.Errorf("%w: attribute %q is %d bytes, at most %d are allowed", errInvalidAttributes, key, len(attributes[key]), p.MaxValueBytes)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// sortedKeys makes validation errors deterministic when several attributes
+// are invalid.
+func sortedKeys(attributes map[string]string) []string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/logging"
+	"go.uber.org/fx"
+)
+
+// Audit event IDs. Log-based alerts and metrics match on them, so they
+// never change meaning: add a new one rather than renaming one.
+const (
+	auditBreakerOpened     = "circuit_breaker.opened"
+	auditBreakerClosed     = "circuit_breaker.closed"
+	auditFailoverActivated = "failover.activated"
+	auditFailoverRestored  = "failover.restored"
+	auditDeadLettered      = "dead_letter.arrived"
+	auditQuarantined       = "quarantine.arrived"
+	auditTopologyChanged   = "provisioning.changed"
+	auditAuthUnhealthy     = "credentials.unhealthy"
+	auditAuthRestored      = "credentials.restored"
+	auditClientRotated     = "client.rotated"
+
+	defaultAuditLogId = "pubsub-audit"
+)
+
+// auditLogIdPattern is what Cloud Logging accepts as a log ID.
+var auditLogIdPattern = regexp.MustCompile(`^[A-Za-z0-9/_.\-]{1,511}$`)
+
+// AuditConfig sends operational events, like a circuit breaker opening or a
+// message reaching a dead letter topic, to a log of their own, each with a
+// stable event_id, so alerts can match on jsonPayload.event_id rather than
+// on the wording of a log line.
+type AuditConfig struct {
+	// LogId is the Cloud Logging log in the Pub/Sub project that events are
+	// written to. Defaults to pubsub-audit. With the in-process Pub/Sub or
+	// the emulator, they're written to the standard log instead.
+	LogId string `yaml:"log_id"`
+}
+
+func (c *AuditConfig) validate() error {
+	if c.LogId == "" {
+		c.LogId = defaultAuditLogId
+	}
+	if !auditLogIdPattern.MatchString(c.LogId) {
+		return fmt.Errorf("log_id %q isn't a valid log ID", c.LogId)
+	}
+	return nil
+}
+
+type auditEvent struct {
+	// Id is one of the audit event IDs.
+	Id string `json:"event_id"`
+	// Resource is the topic or subscription the event happened to.
+	Resource string            `json:"resource"`
+	Message  string            `json:"message"`
+	Details  map[string]string `json:"details,omitempty"`
+	Severity logging.Severity  `json:"-"`
+}
+
+// AuditLog writes audit events to Cloud Logging once applyAuditLog has
+// connected it, and to the standard log until then.
+type AuditLog struct {
+	fallback *log.Logger
+
+	mu     sync.RWMutex
+	logger *logging.Logger
+}
+
+// auditLog is shared by everything that emits audit events.
+var auditLog = &AuditLog{fallback: newLogger("audit")}
+
+// applyAuditLog connects the shared audit log to Cloud Logging for as long
+// as the app runs, unless Pub/Sub is in-process or emulated.
+func applyAuditLog(lifecycle fx.Lifecycle, config Config, params PubSubParams) {
+	if params.Config.ProjectId == localProjectId || os.Getenv("PUBSUB_EMULATOR_HOST") != "" {
+		return
+	}
+	var client *logging.Client
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(ctx context.Context) error {
+				var err error
+				client, err = logging.NewClient(ctx, params.Config.ProjectId, params.clientOptions()...)
+				if err != nil {
+					// Events still reach the standard log, so this isn't
+					// worth failing startup over.
+					auditLog.fallback.Printf("Failed to connect to Cloud Logging, writing audit events here: %v", err)
+					return nil
+				}
+				client.OnError = func(err error) {
+					auditLog.fallback.Printf("Failed to write audit events to Cloud Logging: %v", err)
+				}
+				auditLog.connect(client.Logger(config.Audit.LogId))
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				if client == nil {
+					return nil
+				}
+				auditLog.connect(nil)
+				// Close flushes the events still buffered.
+				return client.Close()
+			},
+		},
+	)
+}
+
+func (a *AuditLog) connect(logger *logging.Logger) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.logger = logger
+}
+
+// Emit writes event to the audit log.
+func (a *AuditLog) Emit(event auditEvent) {
+	auditEvents.WithLabelValues(event.Id).Inc()
+	if event.Severity == logging.Default {
+		event.Severity = logging.Notice
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.logger != nil {
+		a.logger.Log(logging.Entry{
+			Severity: event.Severity,
+			Payload:  event,
+			Labels:   map[string]string{"event_id": event.Id},
+		})
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "event=audit event_id=%s resource=%q message=%q", event.Id, event.Resource, event.Message)
+	keys := make([]string, 0, len(event.Details))
+	for key := range event.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%q", key, event.Details[key])
+	}
+	a.fallback.Print(b.String())
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.uber.org/fx"
+	"gopkg.in/yaml.v3"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+type AuthConfig struct {
+	// Keys are the API keys allowed to call scoped routes. With no keys
+	// configured, scopes aren't enforced.
+	Keys []APIKeyConfig `yaml:"keys"`
+	// KeysPath is a YAML file with more keys in the same format, e.g. a
+	// Secret Manager secret mounted into the Cloud Run container.
+	KeysPath string `yaml:"keys_path"`
+}
+
+type APIKeyConfig struct {
+	Name string `yaml:"name"`
+	// Hash is the hex SHA-256 of the key, as printed by the api-key
+	// command. Keys themselves never appear in config.
+	Hash string `yaml:"hash"`
+	// Scopes are resource:name pairs such as publish:email-events, where
+	// the name may be * to match every resource of that kind, e.g. admin:*.
+	Scopes []string `yaml:"scopes"`
+	// Budget limits what the key publishes, instead of quotas.default.
+	Budget *PublishBudget `yaml:"budget"`
+}
+
+var (
+	apiKeyHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	apiScope   = regexp.MustCompile(`^[a-z]+:(\*|[A-Za-z0-9._-]+)$`)
+)
+
+func (k APIKeyConfig) validate() error {
+	if k.Name == "" {
+		return fmt.Errorf("key has no name")
+	}
+	if !apiKeyHash.MatchString(k.Hash) {
+		return fmt.Errorf("key %s: hash must be a hex SHA-256", k.Name)
+	}
+	for _, scope := range k.Scopes {
+		if scope != "*" && !apiScope.MatchString(scope) {
+			return fmt.Errorf("key %s: invalid scope %q", k.Name, scope)
+		}
+	}
+	if k.Budget != nil {
+		if err := k.Budget.validate(); err != nil {
+			return fmt.Errorf("key %s: %w", k.Name, err)
+		}
+	}
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authorizer enforces the scope each route declares against the API key
+// the request presents in the X-API-Key header. The Authorization header is
+// left alone so Cloud Run IAM can keep using it.
+type Authorizer struct {
+	logger *log.Logger
+	keys   map[string]APIKeyConfig
+}
+
+func newAuthorizer(config Config) (*Authorizer, error) {
+	keys := config.Auth.Keys
+	if path := config.Auth.KeysPath; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+		var fileKeys []APIKeyConfig
+		if err := yaml.Unmarshal(data, &fileKeys); err != nil {
+			return nil, fmt.Errorf("auth: parsing %s: %w", path, err)
+		}
+		for _, key := range fileKeys {
+			if err := key.validate(); err != nil {
+				return nil, fmt.Errorf("auth: %s: %w", path, err)
+			}
+		}
+		keys = append(keys[:len(keys):len(keys)], fileKeys...)
+	}
+	authorizer := &Authorizer{logger: newLogger("auth"), keys: make(map[string]APIKeyConfig, len(keys))}
+	for _, key := range keys {
+		if _, ok := authorizer.keys[key.Hash]; ok {
+			return nil, fmt.Errorf("auth: key %s has the same hash as another key", key.Name)
+		}
+		authorizer.keys[key.Hash] = key
+	}
+	if len(keys) == 0 {
+		authorizer.logger.Println("No API keys configured, scopes aren't enforced")
+	}
+	return authorizer, nil
+}
+
+// Enabled reports whether any keys are configured.
+func (a *Authorizer) Enabled() bool {
+	return len(a.keys) > 0
+}
+
+// Wrap returns route's handler, checking its scope first. Path wildcards in
+// the scope, e.g. publish:{topic}, are filled in from the request. A scope
+// of any resource, e.g. publish:*, is met by any scope of its kind, for
+// handlers that check the scopes of the resources in the request body with
+// Caller.Allows.
+func (a *Authorizer) Wrap(route Route) http.Handler {
+	if route.Scope == "" || !a.Enabled() {
+		return route.Handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := pathParameterPattern.ReplaceAllStringFunc(route.Scope, func(wildcard string) string {
+			return r.PathValue(pathParameterPattern.FindStringSubmatch(wildcard)[1])
+		})
+		logger := requestLogger(a.logger, r)
+		presented := r.Header.Get(apiKeyHeader)
+		if presented == "" {
+			logger.Printf("Denied %s %s: no API key", r.Method, r.URL.Path)
+			authDenials.WithLabelValues(route.Pattern(), "missing").Inc()
+			http.Error(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		key, ok := a.keys[hashAPIKey(presented)]
+		if !ok {
+			logger.Printf("Denied %s %s: unknown API key", r.Method, r.URL.Path)
+			authDenials.WithLabelValues(route.Pattern(), "unknown").Inc()
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if !key.allows(scope) && !(strings.HasSuffix(scope, ":*") && key.allowsKind(strings.TrimSuffix(scope, ":*"))) {
+			logger.Printf("Denied %s %s to key %s: missing scope %s", r.Method, r.URL.Path, key.Name, scope)
+			authDenials.WithLabelValues(route.Pattern(), "scope").Inc()
+			http.Error(w, "API key lacks scope "+scope, http.StatusForbidden)
+			return
+		}
+		route.Handler.ServeHTTP(w, r.WithContext(withCaller(r.Context(), Caller{Name: key.Name, Scopes: key.Scopes})))
+	})
+}
+
+func (k APIKeyConfig) allows(scope string) bool {
+	kind, _, _ := strings.Cut(scope, ":")
+	for _, granted := range k.Scopes {
+		if granted == "*" || granted == scope || granted == kind+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsKind reports whether the key has any scope of kind.
+func (k APIKeyConfig) allowsKind(kind string) bool {
+	for _, granted := range k.Scopes {
+		if granted == "*" || strings.HasPrefix(granted, kind+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the caller's key has scope.
+func (c Caller) Allows(scope string) bool {
+	return APIKeyConfig{Scopes: c.Scopes}.allows(scope)
+}
+
+// apiKeyCommand generates a random API key and prints it with the hash to
+// put in config.
+func apiKeyCommand(logger *log.Logger) fx.Option {
+	return fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner) {
+		runOnce(lifecycle, shutdowner, logger, func(context.Context) error {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return err
+			}
+			key := base64.RawURLEncoding.EncodeToString(secret)
+			_, err := fmt.Printf("key:  %s\nhash: %s\n", key, hashAPIKey(key))
+			return err
+		})
+	})
+}
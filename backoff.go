@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type BackoffConfig struct {
+	// ErrorRate is the fraction of failed messages in a Window that trips
+	// the backoff, once at least MinMessages were handled in it.
+	ErrorRate   float64       `yaml:"error_rate"`
+	Window      time.Duration `yaml:"window"`
+	MinMessages int           `yaml:"min_messages"`
+	// InitialPause is how long receiving stops for after the first trip. It
+	// doubles after every failed probe, up to MaxPause.
+	InitialPause time.Duration `yaml:"initial_pause"`
+	MaxPause     time.Duration `yaml:"max_pause"`
+}
+
+const (
+	backoffClosed  = "closed"
+	backoffOpen    = "open"
+	backoffProbing = "probing"
+)
+
+var backoffStates = map[string]float64{backoffClosed: 0, backoffOpen: 1, backoffProbing: 2}
+
+// ConsumptionBackoff stops a subscriber pulling while its handler keeps
+// failing, e.g. during a downstream outage, instead of burning delivery
+// attempts on messages that can't succeed yet. After each pause the
+// subscriber is restarted with a single outstanding message as a probe: a
+// success resumes normal receiving, a failure pauses again for twice as
+// long.
+type ConsumptionBackoff struct {
+	config BackoffConfig
+
+	mu          sync.Mutex
+	state       string
+	windowStart time.Time
+	handled     int
+	failed      int
+	pause       time.Duration
+}
+
+func newConsumptionBackoff(config BackoffConfig) *ConsumptionBackoff {
+	return &ConsumptionBackoff{config: config, state: backoffClosed}
+}
+
+// observe records a handled message and returns the state the subscriber
+// should move to, or "" to keep its current one.
+func (b *ConsumptionBackoff) observe(err error) (string, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case backoffProbing:
+		if err == nil {
+			b.reset()
+			return backoffClosed, 0
+		}
+		b.pause = min(b.pause*2, b.config.MaxPause)
+		b.state = backoffOpen
+		return backoffOpen, b.pause
+	case backoffClosed:
+		now := time.Now()
+		if now.Sub(b.windowStart) > b.config.Window {
+			b.windowStart, b.handled, b.failed = now, 0, 0
+		}
+		b.handled++
+		if err != nil {
+			b.failed++
+		}
+		if b.handled >= b.config.MinMessages && float64(b.failed) >= b.config.ErrorRate*float64(b.handled) {
+			b.pause = b.config.InitialPause
+			b.state = backoffOpen
+			return backoffOpen, b.pause
+		}
+	}
+	// Messages still finishing after a trip don't count.
+	return "", 0
+}
+
+// probe moves an open backoff to probing, reporting false if something
+// else, like an admin resume, already closed it.
+func (b *ConsumptionBackoff) probe() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != backoffOpen {
+		return false
+	}
+	b.state = backoffProbing
+	return true
+}
+
+func (b *ConsumptionBackoff) reset() {
+	b.state = backoffClosed
+	b.windowStart, b.handled, b.failed = time.Time{}, 0, 0
+	b.pause = 0
+}
+
+func (b *ConsumptionBackoff) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset()
+}
+
+func (b *ConsumptionBackoff) current() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// observeBackoff feeds a handled message's outcome to the subscriber's
+// backoff and applies the transition it asks for. Receive loops are
+// restarted from a new goroutine because the calling message callback has
+// to return before its loop can stop.
+func (set *SubscriberSet) observeBackoff(ctx context.Context, subscriber *Subscriber, err error) {
+	if subscriber.backoff == nil || (ctx.Err() != nil && err != nil) {
+		// Errors from a receive loop being cancelled aren't the handler's.
+		return
+	}
+	state, pause := subscriber.backoff.observe(err)
+	switch state {
+	case backoffOpen:
+		subscriberBackoffState.WithLabelValues(subscriber.Config.Name).Set(backoffStates[backoffOpen])
+		subscriberBackoffTrips.WithLabelValues(subscriber.Config.Name).Inc()
+		subscriber.logger.Printf("Handler is failing, backing off for %s", pause)
+		go set.restart(subscriber, pause, 1)
+	case backoffClosed:
+		subscriberBackoffState.WithLabelValues(subscriber.Config.Name).Set(backoffStates[backoffClosed])
+		subscriber.logger.Printf("Probe succeeded, resuming receiving")
+		go set.restart(subscriber, 0, subscriber.maxOutstanding)
+	}
+}
+
+// restart stops subscriber's receive loop, waits for delay and starts it
+// again with maxOutstanding messages, unless it was paused or restarted in
+// the meantime. With a delay, the new loop is the backoff's probe.
+func (set *SubscriberSet) restart(subscriber *Subscriber, delay time.Duration, maxOutstanding int) {
+	subscriber.mu.Lock()
+	cancel, done := subscriber.cancel, subscriber.done
+	subscriber.cancel = nil
+	subscriber.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-set.ctx.Done():
+		return
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-set.ctx.Done():
+			return
+		}
+		if !subscriber.backoff.probe() {
+			return
+		}
+		subscriberBackoffState.WithLabelValues(subscriber.Config.Name).Set(backoffStates[backoffProbing])
+		subscriber.logger.Printf("Probing with a single outstanding message")
+	}
+
+	subscriber.mu.Lock()
+	defer subscriber.mu.Unlock()
+	if subscriber.paused || subscriber.cancel != nil || set.ctx.Err() != nil {
+		return
+	}
+	subscriber.subscription.ReceiveSettings.MaxOutstandingMessages = maxOutstanding
+	set.run(subscriber)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// baggageKeys are the OpenTelemetry baggage members carried in message
+// attributes. Like the propagator, they're set once by newTracerProvider.
+var baggageKeys []string
+
+// injectBaggage copies the configured baggage members in ctx, e.g. a
+// campaign_id from the request's baggage header, into msg's attributes.
+// Attributes the caller set explicitly win.
+func injectBaggage(ctx context.Context, msg *pubsub.Message) {
+	bag := baggage.FromContext(ctx)
+	for _, key := range baggageKeys {
+		value := bag.Member(key).Value()
+		if value == "" {
+			continue
+		}
+		if msg.Attributes == nil {
+			msg.Attributes = make(map[string]string)
+		}
+		if _, ok := msg.Attributes[key]; !ok {
+			msg.Attributes[key] = value
+		}
+	}
+}
+
+// extractBaggage returns ctx with the configured keys found in a received
+// message's attributes added to its baggage, so handlers, their logs and
+// anything they publish carry the same business context.
+func extractBaggage(ctx context.Context, attributes map[string]string) context.Context {
+	bag := baggage.FromContext(ctx)
+	changed := false
+	for _, key := range baggageKeys {
+		value, ok := attributes[key]
+		if !ok {
+			continue
+		}
+		member, err := baggage.NewMemberRaw(key, value)
+		if err != nil {
+			continue
+		}
+		if bag, err = bag.SetMember(member); err == nil {
+			changed = true
+		}
+	}
+	if !changed {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+// baggageLabels returns the configured baggage members in ctx, which JSON
+// logs attach to entries as labels.
+func baggageLabels(ctx context.Context) map[string]string {
+	bag := baggage.FromContext(ctx)
+	var labels map[string]string
+	for _, key := range baggageKeys {
+		if value := bag.Member(key).Value(); value != "" {
+			if labels == nil {
+				labels = make(map[string]string, len(baggageKeys))
+			}
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// contextLogger returns logger labelled with the baggage in ctx, for
+// logging about a received message.
+func contextLogger(logger *log.Logger, ctx context.Context) *log.Logger {
+	writer, ok := logger.Writer().(*logWriter)
+	labels := baggageLabels(ctx)
+	if !ok || logFormat != logFormatJSON || labels == nil {
+		return logger
+	}
+	labelled := *writer
+	labelled.labels = labels
+	return log.New(&labelled, logger.Prefix(), logger.Flags())
+}
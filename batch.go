@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BatchConfig hands a subscription's messages to a batch handler in groups
+// rather than one at a time, for handlers that write to bulk APIs such as
+// BigQuery or an email provider's batch send. The subscription's handler
+// then names a BatchHandler.
+type BatchConfig struct {
+	// MaxMessages is the most messages in a batch. Defaults to 100.
+	MaxMessages int `yaml:"max_messages"`
+	// MaxDelay is the longest the first message of a batch waits for the
+	// batch to fill. Defaults to 1s.
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+// Batcher accumulates received messages into batches, handing each batch
+// to flush once it's full or its first message has waited MaxDelay.
+type Batcher struct {
+	config BatchConfig
+	flush  func(msgs []*pubsub.Message)
+
+	mu      sync.Mutex
+	pending []*pubsub.Message
+	timer   *time.Timer
+	// generation counts batches, so a timer that fires after its batch was
+	// flushed for being full doesn't flush the next one early.
+	generation int
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+func newBatcher(config BatchConfig, flush func(msgs []*pubsub.Message)) *Batcher {
+	return &Batcher{config: config, flush: flush}
+}
+
+// add queues msg, flushing the batch on the calling goroutine if that fills
+// it. Messages added after close are nacked.
+func (b *Batcher) add(msg *pubsub.Message) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		msg.Nack()
+		return
+	}
+	b.pending = append(b.pending, msg)
+	if len(b.pending) == 1 {
+		generation := b.generation
+		b.timer = time.AfterFunc(b.config.MaxDelay, func() { b.expire(generation) })
+	}
+	if len(b.pending) < b.config.MaxMessages {
+		b.mu.Unlock()
+		return
+	}
+	msgs := b.take()
+	b.mu.Unlock()
+	b.run(msgs)
+}
+
+func (b *Batcher) expire(generation int) {
+	b.mu.Lock()
+	if b.closed || generation != b.generation || len(b.pending) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	msgs := b.take()
+	b.mu.Unlock()
+	b.run(msgs)
+}
+
+// take removes the pending batch. Callers must hold b.mu.
+func (b *Batcher) take() []*pubsub.Message {
+	msgs := b.pending
+	b.pending = nil
+	b.timer.Stop()
+	b.generation++
+	// Counted while b.mu is held, so close can't miss it.
+	b.wg.Add(1)
+	return msgs
+}
+
+func (b *Batcher) run(msgs []*pubsub.Message) {
+	defer b.wg.Done()
+	b.flush(msgs)
+}
+
+// close nacks the messages still waiting for their batch to fill, so
+// they're redelivered rather than handled with a cancelled context, and
+// waits for the batches being handled to settle.
+func (b *Batcher) close() {
+	b.mu.Lock()
+	b.closed = true
+	msgs := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.mu.Unlock()
+	for _, msg := range msgs {
+		msg.Nack()
+	}
+	b.wg.Wait()
+}
+
+// receiveBatches receives like receive, but hands messages to the batch
+// handler through a Batcher.
+func (s *Subscriber) receiveBatches(ctx context.Context) error {
+	batcher := newBatcher(*s.Config.Batch, func(msgs []*pubsub.Message) {
+		s.processBatch(ctx, msgs)
+	})
+	err := s.subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		s.active()
+		if s.retryStage > 0 {
+			if err := s.retry.wait(ctx, msg); err != nil {
+				msg.Nack()
+				return
+			}
+		}
+		batcher.add(msg)
+	})
+	batcher.close()
+	return err
+}
+
+// processBatch runs the batch handler on msgs, then acks, retries,
+// quarantines or nacks each message on its own result as process does.
+func (s *Subscriber) processBatch(ctx context.Context, msgs []*pubsub.Message) {
+	kept := make([]*pubsub.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		msgCtx := extractBaggage(ctx, msg.Attributes)
+		if !s.expire(msgCtx, msg) && !s.suppress(msgCtx, msg) {
+			kept = append(kept, msg)
+		}
+	}
+	if msgs = kept; len(msgs) == 0 {
+		return
+	}
+	batchSize.WithLabelValues(s.Config.Name).Observe(float64(len(msgs)))
+	started := time.Now()
+	var results []error
+	err, stack := s.withTimeout(ctx, fmt.Sprintf("a batch of %d messages", len(msgs)), func(ctx context.Context) (error, string) {
+		var stack string
+		results, stack = s.handleBatch(ctx, msgs)
+		return nil, stack
+	})
+	duration := time.Since(started)
+	for i, msg := range msgs {
+		msgErr := err
+		if err == nil {
+			msgErr = results[i]
+		}
+		s.settle(extractBaggage(ctx, msg.Attributes), msg, msgErr, stack, duration)
+	}
+}
+
+// handleBatch runs the batch handler, failing every message if it panics or
+// doesn't return one result per message. Each message gets its own receive
+// span covering the batch.
+func (s *Subscriber) handleBatch(ctx context.Context, msgs []*pubsub.Message) (results []error, stack string) {
+	spans := make([]trace.Span, len(msgs))
+	for i, msg := range msgs {
+		_, spans[i] = startReceiveSpan(extractBaggage(ctx, msg.Attributes), s.Config.Id, msg.ID, msg.Attributes)
+	}
+	defer func() {
+		for i, span := range spans {
+			endSpan(span, results[i])
+		}
+	}()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			results = failAll(len(msgs), fmt.Errorf("batch handler panicked: %v", recovered))
+			stack = string(debug.Stack())
+		}
+	}()
+	// Messages that can't be decrypted fail on their own, and the handler
+	// gets the rest.
+	results = make([]error, len(msgs))
+	opened := make([]*pubsub.Message, 0, len(msgs))
+	positions := make([]int, 0, len(msgs))
+	for i, msg := range msgs {
+		msg, err := s.set.cipher.Open(msg)
+		if err != nil {
+			results[i] = err
+			continue
+		}
+		opened = append(opened, msg)
+		positions = append(positions, i)
+	}
+	if len(opened) == 0 {
+		return results, ""
+	}
+	handled := s.batchHandler(ctx, opened)
+	if len(handled) != len(opened) {
+		return failAll(len(msgs), fmt.Errorf("batch handler returned %d results for %d messages", len(handled), len(opened))), ""
+	}
+	for j, i := range positions {
+		results[i] = handled[j]
+	}
+	return results, ""
+}
+
+func failAll(n int, err error) []error {
+	results := make([]error, n)
+	for i := range results {
+		results[i] = err
+	}
+	return results
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+)
+
+// The benchmarks cover encoding, decoding, the HTTP middleware and
+// publishing against the in-process Pub/Sub, so regressions show up before
+// a release rather than in production latency. Compare runs with
+// benchstat, and profile them with the test flags:
+//
+//	go test -run '^$' -bench . -count 10 -cpuprofile cpu.out -memprofile mem.out
+
+const (
+	benchTopic = "bench"
+	// benchBodyBytes is the size of each message's email body.
+	benchBodyBytes = 1024
+	// benchParallelism is the number of goroutines per GOMAXPROCS
+	// publishing at once in BenchmarkPublishParallel.
+	benchParallelism = 64
+)
+
+var benchEmail = emailevents.SendEmailRequest{
+	From:     "bench@example.com",
+	To:       []string{"recipient@example.com"},
+	Subject:  "Benchmark",
+	TextBody: strings.Repeat("x", benchBodyBytes),
+}
+
+// publishBench is the publish endpoint, served against the in-process
+// Pub/Sub, and requests to it.
+type publishBench struct {
+	body []byte
+	key  string
+	// middleware is the publish route with a handler that does nothing,
+	// and pipeline the whole route.
+	middleware http.Handler
+	pipeline   http.Handler
+}
+
+// newPublishBench starts the services the publish endpoint needs, with a
+// config of one topic. Requests carry an API key scoped to it, so the
+// middleware checks scopes as it does in production.
+func newPublishBench(b *testing.B) *publishBench {
+	b.Helper()
+	// Log lines would be mixed up with the results.
+	output := logOutput
+	logOutput = io.Discard
+	b.Cleanup(func() { logOutput = output })
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		b.Fatal(err)
+	}
+	key := base64.RawURLEncoding.EncodeToString(secret)
+	path := filepath.Join(b.TempDir(), "config.yaml")
+	config := "topics:\n  - name: " + benchTopic + "\nauth:\n  keys:\n    - name: bench\n      hash: " + hashAPIKey(key) + "\n      scopes: [publish:" + benchTopic + "]\n"
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		b.Fatal(err)
+	}
+	b.Setenv("CONFIG_PATH", path)
+
+	var (
+		publish    *PublishHandler
+		authorizer *Authorizer
+		readOnly   *ReadOnly
+	)
+	app := fxtest.New(b,
+		fx.NopLogger,
+		localPubSubOptions(newLogger("bench")),
+		fx.Provide(
+			newStore,
+			newTopicExistsCache,
+			newTemplateRepository,
+			newMessageLogger,
+			newFailureStore,
+			newRecentMessages,
+			newIdentity,
+			newAttributeCipher,
+			newPublishDedup,
+			newAuthorizer,
+			newPublishQuotas,
+			newReadOnly,
+			newUsageLedger,
+			newTopicRegistry,
+			newRouter,
+			newCallbacks,
+			newPublishHandler,
+		),
+		fx.Populate(&publish, &authorizer, &readOnly),
+	)
+	app.RequireStart()
+	b.Cleanup(app.RequireStop)
+
+	msg, err := emailevents.Encode(benchEmail)
+	if err != nil {
+		b.Fatal(err)
+	}
+	body, err := json.Marshal(publishRequest{Data: msg.Data, Attributes: msg.Attributes})
+	if err != nil {
+		b.Fatal(err)
+	}
+	// The requests come from httptest's made-up address, which the
+	// configured filters would have no reason to allow.
+	firewall, err := newFirewall(Config{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	middlewareRoute := publishRoute(publish)
+	middlewareRoute.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	return &publishBench{
+		body:       body,
+		key:        key,
+		middleware: newMux([]Route{middlewareRoute}, firewall, authorizer, readOnly),
+		pipeline:   newMux([]Route{publishRoute(publish)}, firewall, authorizer, readOnly),
+	}
+}
+
+func (p *publishBench) request() *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/publish/"+benchTopic, bytes.NewReader(p.body))
+	r.Header.Set("Content-Type", mediaTypeJSON)
+	r.Header.Set(apiKeyHeader, p.key)
+	return r
+}
+
+// serve sends handler a request, failing b unless it's published.
+func (p *publishBench) serve(b *testing.B, handler http.Handler) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, p.request())
+	if w.Code != http.StatusOK {
+		b.Fatalf("%d %s", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := emailevents.Encode(benchEmail); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	bench := newPublishBench(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodePublishRequest(httptest.NewRecorder(), bench.request()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMiddleware(b *testing.B) {
+	bench := newPublishBench(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bench.serve(b, bench.middleware)
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	bench := newPublishBench(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bench.serve(b, bench.pipeline)
+	}
+}
+
+// BenchmarkPublishParallel keeps many requests in flight at once, as a busy
+// instance does, so publishes share batches rather than each waiting out
+// the batch delay.
+func BenchmarkPublishParallel(b *testing.B) {
+	bench := newPublishBench(b)
+	b.ReportAllocs()
+	b.SetParallelism(benchParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			bench.pipeline.ServeHTTP(w, bench.request())
+			if w.Code != http.StatusOK {
+				// Fatal can't be called from RunParallel's goroutines.
+				b.Errorf("%d %s", w.Code, strings.TrimSpace(w.Body.String()))
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type FlowControlConfig struct {
+	// MaxOutstandingMessages and MaxOutstandingBytes bound what's buffered
+	// for the topic but not yet published: the publish futures in flight.
+	MaxOutstandingMessages int `yaml:"max_outstanding_messages"`
+	MaxOutstandingBytes    int `yaml:"max_outstanding_bytes"`
+	// Shedding is what happens to publishes over either limit: reject,
+	// the default, answers 503 with Retry-After; block holds the request
+	// until there's room or it times out, trading latency for not turning
+	// callers away; and spill saves the message to an outbox in the store,
+	// answering 202, and publishes it once there's room, trading ordering
+	// for availability, so it can't be used on topics with ordering keys.
+	Shedding string `yaml:"shedding"`
+	// RetryAfter is suggested to rejected callers. Defaults to 1s.
+	RetryAfter time.Duration `yaml:"retry_after"`
+	// OutboxTTL is how long spilled messages wait to be published before
+	// they're dropped. Defaults to 24h.
+	OutboxTTL time.Duration `yaml:"outbox_ttl"`
+}
+
+type CircuitBreakerConfig struct {
+	// FailureThreshold consecutive failed publishes open the breaker.
+	FailureThreshold int `yaml:"failure_threshold"`
+	// Cooldown is how long publishes are rejected for once it's open, after
+	// which a single publish is let through to probe.
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+const (
+	unavailableFlowControl = "flow_control"
+	unavailableCircuitOpen = "circuit_open"
+
+	// defaultPublishRetryAfter is suggested to callers Pub/Sub throttled or
+	// was unavailable to, unless it said how long to wait.
+	defaultPublishRetryAfter = time.Second
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// UnavailableError is returned for publishes rejected without being
+// attempted, so the caller can back off and retry.
+type UnavailableError struct {
+	Reason     string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func isFlowControlError(err error) bool {
+	return errors.Is(err, pubsub.ErrFlowControllerMaxOutstandingMessages) || errors.Is(err, pubsub.ErrFlowControllerMaxOutstandingBytes)
+}
+
+// apply sets the flow control limits on settings. Without a flow_control
+// section, publishes block for room as they do by default.
+func (c *FlowControlConfig) apply(settings *pubsub.PublishSettings) {
+	if c == nil {
+		return
+	}
+	settings.FlowControlSettings.MaxOutstandingMessages = c.MaxOutstandingMessages
+	settings.FlowControlSettings.MaxOutstandingBytes = c.MaxOutstandingBytes
+	settings.FlowControlSettings.LimitExceededBehavior = pubsub.FlowControlSignalError
+	if c.Shedding == sheddingBlock {
+		settings.FlowControlSettings.LimitExceededBehavior = pubsub.FlowControlBlock
+	}
+}
+
+// CircuitBreaker rejects publishes to a topic that keeps failing, instead
+// of holding every HTTP request for the full publish timeout.
+type CircuitBreaker struct {
+	topic  string
+	config CircuitBreakerConfig
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(topic string, config CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{topic: topic, config: config}
+}
+
+// allow reports whether a publish may be attempted, and if not, how long
+// until it's worth retrying.
+func (b *CircuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.config.FailureThreshold {
+		return 0, true
+	}
+	if remaining := b.config.Cooldown - time.Since(b.openedAt); remaining > 0 {
+		return remaining, false
+	}
+	if b.probing {
+		return time.Second, false
+	}
+	b.probing = true
+	return 0, true
+}
+
+// record updates the breaker with the outcome of an allowed publish.
+// Flow control rejections and cancelled requests say nothing about the
+// topic's health, so they only end a probe.
+func (b *CircuitBreaker) record(err error, cancelled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case err == nil:
+		if b.failures >= b.config.FailureThreshold {
+			auditLog.Emit(auditEvent{
+				Id:       auditBreakerClosed,
+				Resource: b.topic,
+				Message:  fmt.Sprintf("Circuit breaker for topic %s closed after a successful probe", b.topic),
+			})
+		}
+		b.failures = 0
+		publisherCircuitOpen.WithLabelValues(b.topic).Set(0)
+	case isFlowControlError(err) || cancelled:
+	default:
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.openedAt = time.Now()
+			publisherCircuitOpen.WithLabelValues(b.topic).Set(1)
+		}
+		// Failed probes keep it open, so only the first failure opens it.
+		if b.failures == b.config.FailureThreshold {
+			auditLog.Emit(auditEvent{
+				Id:       auditBreakerOpened,
+				Resource: b.topic,
+				Message:  fmt.Sprintf("Circuit breaker for topic %s opened after %d consecutive failures", b.topic, b.failures),
+				Details:  map[string]string{"error": err.Error(), "cooldown": b.config.Cooldown.String()},
+				Severity: logging.Warning,
+			})
+		}
+	}
+	b.probing = false
+}
+
+// spilledResponse answers a publish saved to the topic's outbox, which
+// publishes it once the topic has room.
+type spilledResponse struct {
+	OutboxId string `json:"outbox_id"`
+}
+
+type unavailableResponse struct {
+	Error string `json:"error"`
+	// Reason is flow_control, circuit_open, concurrency, read_only or, with
+	// 429, quota.
+	Reason            string `json:"reason"`
+	RetryAfterSeconds int    `json:"retry_after_seconds"`
+}
+
+// writeUnavailable responds 503 with Retry-After if err is an
+// UnavailableError, reporting whether it did.
+func writeUnavailable(w http.ResponseWriter, topic string, err error) bool {
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) {
+		return false
+	}
+	publishUnavailable.WithLabelValues(topic, unavailable.Reason).Inc()
+	seconds := int(math.Ceil(unavailable.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(unavailableResponse{Error: unavailable.Error(), Reason: unavailable.Reason, RetryAfterSeconds: seconds})
+	return true
+}
+
+// publishErrorResponse is the body of a publish Pub/Sub failed.
+type publishErrorResponse struct {
+	Error string `json:"error"`
+	// Code is the gRPC status code Pub/Sub failed with, e.g.
+	// RESOURCE_EXHAUSTED, or UNKNOWN if it didn't fail with one.
+	Code string `json:"code"`
+	// RetryAfterSeconds is set, as is Retry-After, for 429 and 503.
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+}
+
+// publishErrorStatus maps the gRPC code a publish failed with to the HTTP
+// status it's reported with, and whether the caller should retry it.
+func publishErrorStatus(c codes.Code) (int, bool) {
+	switch c {
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests, true
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable, true
+	case codes.NotFound:
+		return http.StatusNotFound, false
+	case codes.PermissionDenied:
+		return http.StatusForbidden, false
+	case codes.InvalidArgument:
+		return http.StatusBadRequest, false
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout, false
+	default:
+		return http.StatusInternalServerError, false
+	}
+}
+
+// writePublishError responds to a publish that failed with err: as
+// writeUnavailable does for an UnavailableError, with 202 for a
+// SpilledError, and otherwise with the status mapped from the gRPC code
+// Pub/Sub failed with. Retryable failures
+// carry Retry-After, Pub/Sub's own suggestion if it made one.
+func writePublishError(w http.ResponseWriter, topic string, message string, err error) {
+	if writeUnavailable(w, topic, err) {
+		return
+	}
+	var spilled *SpilledError
+	if errors.As(err, &spilled) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(spilledResponse{OutboxId: spilled.OutboxId})
+		return
+	}
+	grpcStatus, _ := status.FromError(err)
+	httpStatus, retryable := publishErrorStatus(grpcStatus.Code())
+	response := publishErrorResponse{Error: message + ": " + err.Error(), Code: code.Code_name[int32(grpcStatus.Code())]}
+	if retryable {
+		retryAfter := defaultPublishRetryAfter
+		for _, detail := range grpcStatus.Details() {
+			if info, ok := detail.(*errdetails.RetryInfo); ok && info.RetryDelay != nil {
+				retryAfter = info.RetryDelay.AsDuration()
+			}
+		}
+		response.RetryAfterSeconds = max(int(math.Ceil(retryAfter.Seconds())), 1)
+		w.Header().Set("Retry-After", strconv.Itoa(response.RetryAfterSeconds))
+	}
+	publishErrors.WithLabelValues(topic, response.Code).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(response)
+}
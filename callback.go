@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	callbackUrlHeader = "X-Callback-Url"
+
+	defaultCallbackTimeout     = 10 * time.Second
+	defaultCallbackMaxAttempts = 5
+	defaultCallbackBackoff     = time.Second
+)
+
+// CallbacksConfig lets fire-and-forget callers publish with an
+// X-Callback-Url header: the publish API responds 202 with a request ID
+// straight away, and POSTs the result, the message ID or the error, to the
+// URL once the publish completes. Callbacks are signed and retried like
+// webhooks.
+type CallbacksConfig struct {
+	// AllowedHosts are the hosts callback URLs may point at, e.g.
+	// "hooks.example.com", or "*.example.com" for its subdomains. Empty,
+	// the default, rejects requests with a callback.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// Secret signs each callback with HMAC-SHA256 in the Webhook-Signature
+	// header, as webhooks are. Defaults to the WEBHOOK_SECRET environment
+	// variable; without either, callbacks aren't signed.
+	Secret string `yaml:"secret"`
+	// Timeout bounds each attempt. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxAttempts is how many times a callback is sent, with the delay
+	// between attempts doubling from Backoff, before it's given up on.
+	// Defaults to 5 attempts from 1s.
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+}
+
+func (c *CallbacksConfig) validate() error {
+	if c.Timeout == 0 {
+		c.Timeout = defaultCallbackTimeout
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = defaultCallbackMaxAttempts
+	}
+	if c.Backoff == 0 {
+		c.Backoff = defaultCallbackBackoff
+	}
+	if c.Timeout < 0 || c.MaxAttempts < 0 || c.Backoff < 0 {
+		return errors.New("timeout, max_attempts and backoff can't be negative")
+	}
+	if c.Secret == "" {
+		c.Secret = os.Getenv("WEBHOOK_SECRET")
+	}
+	for _, host := range c.AllowedHosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return fmt.Errorf("allowed host %q: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// publishCallback is what's POSTed to a callback URL once its publish
+// completes.
+type publishCallback struct {
+	RequestId   string `json:"request_id"`
+	Topic       string `json:"topic"`
+	MessageId   string `json:"message_id,omitempty"`
+	OrderingKey string `json:"ordering_key,omitempty"`
+	// Error, Code and Reason say why the publish failed: Code is the gRPC
+	// status code, as in a synchronous publish's error, and Reason that of
+	// a 503. OutboxId is set instead, with no message ID, for a message
+	// spilled to the topic's outbox, which publishes it later.
+	Error       string    `json:"error,omitempty"`
+	Code        string    `json:"code,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	OutboxId    string    `json:"outbox_id,omitempty"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// callbackAccepted is the 202 response to a publish with a callback.
+type callbackAccepted struct {
+	RequestId string `json:"request_id"`
+}
+
+// Callbacks publishes in the background for requests with a callback, and
+// delivers their results.
+type Callbacks struct {
+	logger *log.Logger
+	config CallbacksConfig
+	client *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newCallbacks takes the registry so that it's stopped first, while the
+// publishes still pending can complete.
+func newCallbacks(lifecycle fx.Lifecycle, config Config, _ *TopicRegistry) *Callbacks {
+	callbacks := &Callbacks{
+		logger: newLogger("callbacks"),
+		config: config.Callbacks,
+		client: &http.Client{Timeout: config.Callbacks.Timeout},
+	}
+	callbacks.ctx, callbacks.cancel = context.WithCancel(context.Background())
+	lifecycle.Append(
+		fx.Hook{
+			OnStop: func(ctx context.Context) error {
+				done := make(chan struct{})
+				go func() {
+					callbacks.wg.Wait()
+					close(done)
+				}()
+				select {
+				case <-done:
+				case <-ctx.Done():
+					// Out of time: give up on retrying the callbacks left.
+					callbacks.cancel()
+					<-done
+				}
+				callbacks.cancel()
+				return nil
+			},
+		},
+	)
+	return callbacks
+}
+
+// Check returns why rawURL can't be called back, if it can't.
+func (c *Callbacks) Check(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", callbackUrlHeader, err)
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return fmt.Errorf("%s must be an http or https URL", callbackUrlHeader)
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, allowed := range c.config.AllowedHosts {
+		if matched, _ := path.Match(strings.ToLower(allowed), host); matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s host %s isn't allowed", callbackUrlHeader, host)
+}
+
+// Go runs publish in the background, detached from ctx's cancellation,
+// and delivers its result to callbackURL, returning the request ID the
+// callback will carry.
+func (c *Callbacks) Go(ctx context.Context, callbackURL string, topic string, orderingKey string, publish func(context.Context) (string, error)) string {
+	var b [16]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		messageId, err := publish(context.WithoutCancel(ctx))
+		result := publishCallback{RequestId: id, Topic: topic, MessageId: messageId, OrderingKey: orderingKey, CompletedAt: time.Now().UTC()}
+		var spilled *SpilledError
+		if errors.As(err, &spilled) {
+			result.OutboxId = spilled.OutboxId
+		} else if err != nil {
+			result.Error = err.Error()
+			result.Code = code.Code_name[int32(status.Code(err))]
+			var unavailable *UnavailableError
+			if errors.As(err, &unavailable) {
+				result.Reason = unavailable.Reason
+			}
+		}
+		c.deliver(callbackURL, result)
+	}()
+	return id
+}
+
+// deliver sends result, retrying failed attempts that may succeed later.
+func (c *Callbacks) deliver(callbackURL string, result publishCallback) {
+	body, _ := json.Marshal(result)
+	retryBudget.Request(retryKindWebhook)
+	delay := c.config.Backoff
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := c.send(callbackURL, result.RequestId, body)
+		if err == nil {
+			callbackDeliveries.WithLabelValues(result.Topic, "ok").Inc()
+			return
+		}
+		if isPermanent(err) || attempt >= c.config.MaxAttempts || c.ctx.Err() != nil || !retryBudget.Retry(retryKindWebhook) {
+			callbackDeliveries.WithLabelValues(result.Topic, "failed").Inc()
+			c.logger.Printf("Giving up on the callback of publish %s to %s after %d attempts: %v", result.RequestId, result.Topic, attempt, err)
+			return
+		}
+		callbackDeliveries.WithLabelValues(result.Topic, "retry").Inc()
+		timer := time.NewTimer(max(delay, retryAfter))
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			timer.Stop()
+		}
+		delay *= 2
+	}
+}
+
+// send makes one attempt at delivering a callback, returning the
+// Retry-After the endpoint asked for, if any.
+func (c *Callbacks) send(callbackURL string, id string, body []byte) (time.Duration, error) {
+	request, err := http.NewRequestWithContext(c.ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, Permanent(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	// Lets the endpoint tell retries apart from new results.
+	request.Header.Set(webhookIdHeader, id)
+	if c.config.Secret != "" {
+		request.Header.Set(webhookSignatureHeader, signWebhook(c.config.Secret, time.Now(), body))
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 300 {
+		io.Copy(io.Discard, response.Body)
+		return 0, nil
+	}
+	excerpt, _ := io.ReadAll(io.LimitReader(response.Body, maxWebhookResponseBytes))
+	err = fmt.Errorf("callback responded %s: %s", response.Status, strings.TrimSpace(string(excerpt)))
+	switch {
+	case response.StatusCode == http.StatusRequestTimeout || response.StatusCode >= 500:
+		return 0, err
+	case response.StatusCode == http.StatusTooManyRequests:
+		seconds, _ := strconv.Atoi(response.Header.Get("Retry-After"))
+		return time.Duration(seconds) * time.Second, err
+	default:
+		return 0, Permanent(err)
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+	"go.uber.org/fx"
+)
+
+type CampaignsConfig struct {
+	// Enabled serves the campaign API and runs the scheduler, which reads
+	// recipient lists from Cloud Storage.
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often due campaigns are each sent a batch. Defaults
+	// to 10s.
+	Interval time.Duration `yaml:"interval"`
+	// MaxRate caps every campaign's rate, in messages per second. Defaults
+	// to 100.
+	MaxRate float64 `yaml:"max_rate"`
+}
+
+const (
+	campaignKeyPrefix      = "campaigns/"
+	campaignLeaseKeyPrefix = "campaign-leases/"
+	// campaignPublishers is how many of a batch's messages are published at
+	// once.
+	campaignPublishers = 16
+
+	campaignScheduled = "scheduled"
+	campaignSending   = "sending"
+	campaignCompleted = "completed"
+	campaignCancelled = "cancelled"
+	// campaignExpired campaigns ran out of send window before reaching the
+	// end of their recipient list.
+	campaignExpired = "expired"
+
+	// Attributes added to every campaign message. The offset identifies the
+	// recipient, so consumers can drop the duplicates a batch interrupted
+	// by a 503 may send.
+	attributeCampaignId     = "campaign_id"
+	attributeCampaignOffset = "campaign_offset"
+)
+
+// Campaign is a scheduled send of one email to every recipient of a list.
+type Campaign struct {
+	Id string `json:"id"`
+	// Topic is the configured topic the email events are published to.
+	Topic string `json:"topic"`
+	// Recipients is the gs:// URI of the recipient list, one recipient per
+	// line: either an address, or a JSON object with to and variables.
+	Recipients string `json:"recipients"`
+	From       string `json:"from,omitempty"`
+	Subject    string `json:"subject,omitempty"`
+	TemplateId string `json:"template_id,omitempty"`
+	TextBody   string `json:"text_body,omitempty"`
+	HtmlBody   string `json:"html_body,omitempty"`
+	// Variables apply to every recipient, under their own variables.
+	Variables map[string]string `json:"variables,omitempty"`
+	// SendAfter and SendBefore are the send window. SendAfter defaults to
+	// when the campaign is created; without SendBefore, the window never
+	// closes.
+	SendAfter  time.Time  `json:"send_after"`
+	SendBefore *time.Time `json:"send_before,omitempty"`
+	// Rate is in messages per second. Defaults to the configured maximum.
+	Rate float64 `json:"rate,omitempty"`
+
+	Status    string           `json:"status"`
+	Progress  CampaignProgress `json:"progress"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+type CampaignProgress struct {
+	Published int64 `json:"published"`
+	Failed    int64 `json:"failed"`
+	// Offset is how many bytes of the recipient list have been sent to.
+	Offset    int64  `json:"offset"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type campaignRecipient struct {
+	To        string            `json:"to"`
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+func (c Campaign) done() bool {
+	return c.Status == campaignCompleted || c.Status == campaignCancelled || c.Status == campaignExpired
+}
+
+func (c Campaign) validate() error {
+	if _, _, err := parseGCSURI(c.Recipients); err != nil {
+		return fmt.Errorf("recipients: %w", err)
+	}
+	if err := c.request(campaignRecipient{To: "recipient"}).Validate(); err != nil {
+		return err
+	}
+	if c.Rate < 0 {
+		return errors.New("rate can't be negative")
+	}
+	if c.SendBefore != nil && !c.SendBefore.After(c.SendAfter) {
+		return errors.New("send_before must be after send_after")
+	}
+	return nil
+}
+
+// message builds the email event for one line of the recipient list.
+func (c Campaign) message(line []byte, offset int64) (*pubsub.Message, error) {
+	var recipient campaignRecipient
+	if line = bytes.TrimSpace(line); bytes.HasPrefix(line, []byte("{")) {
+		if err := json.Unmarshal(line, &recipient); err != nil {
+			return nil, fmt.Errorf("recipient at offset %d: %w", offset, err)
+		}
+	} else {
+		recipient.To = string(line)
+	}
+	msg, err := emailevents.Encode(c.request(recipient))
+	if err != nil {
+		return nil, fmt.Errorf("recipient at offset %d: %w", offset, err)
+	}
+	msg.Attributes[attributeCampaignId] = c.Id
+	msg.Attributes[attributeCampaignOffset] = strconv.FormatInt(offset, 10)
+	return msg, nil
+}
+
+func (c Campaign) request(recipient campaignRecipient) emailevents.SendEmailRequest {
+	variables := make(map[string]string, len(c.Variables)+len(recipient.Variables))
+	for key, value := range c.Variables {
+		variables[key] = value
+	}
+	for key, value := range recipient.Variables {
+		variables[key] = value
+	}
+	return emailevents.SendEmailRequest{
+		From:       c.From,
+		To:         []string{recipient.To},
+		Subject:    c.Subject,
+		TemplateId: c.TemplateId,
+		Variables:  variables,
+		TextBody:   c.TextBody,
+		HtmlBody:   c.HtmlBody,
+	}
+}
+
+func parseGCSURI(uri string) (string, string, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+	if !strings.HasPrefix(uri, "gs://") || !ok || bucket == "" || object == "" {
+		return "", "", fmt.Errorf("%q isn't a gs://bucket/object URI", uri)
+	}
+	return bucket, object, nil
+}
+
+// CampaignScheduler publishes due campaigns in batches, one per interval,
+// sized by the campaign's rate. Campaigns and their progress are kept in
+// the store; instances sharing it take a lease on a campaign for each
+// batch, so only one sends it at a time.
+type CampaignScheduler struct {
+	logger    *log.Logger
+	config    CampaignsConfig
+	store     Store
+	registry  *TopicRegistry
+	templates TemplateRepository
+	storage   *storage.Client
+	instance  string
+}
+
+func newCampaignScheduler(lifecycle fx.Lifecycle, config Config, store Store, registry *TopicRegistry, templates TemplateRepository, params PubSubParams) *CampaignScheduler {
+	hostname, _ := os.Hostname()
+	scheduler := &CampaignScheduler{
+		logger:    newLogger("campaigns"),
+		config:    config.Campaigns,
+		store:     store,
+		registry:  registry,
+		templates: templates,
+		instance:  fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+	}
+	if !config.Campaigns.Enabled {
+		return scheduler
+	}
+	scheduler.storage = newStorageClient(lifecycle, params)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(context.Context) error {
+				go scheduler.run(ctx, done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				return nil
+			},
+		},
+	)
+	return scheduler
+}
+
+func (s *CampaignScheduler) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		campaigns, err := s.list(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Printf("Failed to list campaigns: %v", err)
+			}
+			continue
+		}
+		for _, campaign := range campaigns {
+			if !campaign.done() && !time.Now().Before(campaign.SendAfter) {
+				s.send(ctx, campaign)
+			}
+		}
+	}
+}
+
+func (s *CampaignScheduler) list(ctx context.Context) ([]Campaign, error) {
+	entries, err := s.store.List(ctx, campaignKeyPrefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	campaigns := make([]Campaign, 0, len(entries))
+	for _, entry := range entries {
+		var campaign Campaign
+		if err := json.Unmarshal(entry.Value, &campaign); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Key, err)
+		}
+		campaigns = append(campaigns, campaign)
+	}
+	return campaigns, nil
+}
+
+func (s *CampaignScheduler) get(ctx context.Context, id string) (Campaign, error) {
+	var campaign Campaign
+	data, err := s.store.Get(ctx, campaignKeyPrefix+id)
+	if err != nil {
+		return campaign, err
+	}
+	err = json.Unmarshal(data, &campaign)
+	return campaign, err
+}
+
+func (s *CampaignScheduler) save(ctx context.Context, campaign Campaign) error {
+	campaign.UpdatedAt = time.Now()
+	data, err := json.Marshal(campaign)
+	if err != nil {
+		return err
+	}
+	return s.store.Set(ctx, campaignKeyPrefix+campaign.Id, data, 0)
+}
+
+// send publishes the next batch of campaign, if this instance gets the
+// lease on it, and saves its progress.
+func (s *CampaignScheduler) send(ctx context.Context, campaign Campaign) {
+	leaseKey := campaignLeaseKeyPrefix + campaign.Id
+	leased, err := s.store.SetIfAbsent(ctx, leaseKey, []byte(s.instance), 3*s.config.Interval)
+	if err != nil || !leased {
+		return
+	}
+	defer s.store.Delete(context.Background(), leaseKey)
+
+	if campaign.SendBefore != nil && time.Now().After(*campaign.SendBefore) {
+		campaign.Status = campaignExpired
+		s.logger.Printf("Campaign %s expired after %d messages", campaign.Id, campaign.Progress.Published)
+	} else {
+		campaign.Status = campaignSending
+		if eof := s.sendBatch(ctx, &campaign); eof {
+			campaign.Status = campaignCompleted
+			s.logger.Printf("Campaign %s completed with %d messages published and %d failed", campaign.Id, campaign.Progress.Published, campaign.Progress.Failed)
+		}
+	}
+
+	// A cancel while the batch was sending wins over the batch's status.
+	if current, err := s.get(ctx, campaign.Id); err == nil && current.Status == campaignCancelled {
+		campaign.Status = campaignCancelled
+	}
+	if err := s.save(ctx, campaign); err != nil {
+		s.logger.Printf("Failed to save progress of campaign %s: %v", campaign.Id, err)
+	}
+}
+
+type campaignLine struct {
+	offset int64
+	next   int64
+	msg    *pubsub.Message
+	err    error
+}
+
+// sendBatch publishes to the next recipients of campaign's list, as many as
+// its rate allows per interval, advancing its progress. It reports whether
+// the list is exhausted.
+func (s *CampaignScheduler) sendBatch(ctx context.Context, campaign *Campaign) bool {
+	progress := &campaign.Progress
+	topic, ok := s.registry.Lookup(campaign.Topic)
+	if !ok {
+		progress.LastError = fmt.Sprintf("topic %s isn't configured", campaign.Topic)
+		return false
+	}
+	rate := campaign.Rate
+	if rate == 0 || rate > s.config.MaxRate {
+		rate = s.config.MaxRate
+	}
+	size := int(rate * s.config.Interval.Seconds())
+	if size < 1 {
+		size = 1
+	}
+
+	lines, eof, err := s.readRecipients(ctx, *campaign, size)
+	if err != nil {
+		progress.LastError = err.Error()
+		s.logger.Printf("Failed to read recipients of campaign %s: %v", campaign.Id, err)
+		return false
+	}
+
+	errs := make([]error, len(lines))
+	slots := make(chan struct{}, campaignPublishers)
+	var wg sync.WaitGroup
+	for i, line := range lines {
+		if line.err != nil {
+			errs[i] = line.err
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, msg *pubsub.Message) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			// Campaigns back off when the topic is full rather than
+			// spilling to its outbox.
+			_, errs[i] = topic.send(ctx, msg)
+		}(i, line.msg)
+	}
+	wg.Wait()
+
+	for i, line := range lines {
+		var unavailable *UnavailableError
+		if errors.As(errs[i], &unavailable) || ctx.Err() != nil {
+			// Leave the rest for the next batch.
+			return false
+		}
+		progress.Offset = line.next
+		if err := errs[i]; err != nil {
+			progress.Failed++
+			progress.LastError = err.Error()
+			campaignMessages.WithLabelValues("failed").Inc()
+			continue
+		}
+		progress.Published++
+		campaignMessages.WithLabelValues("published").Inc()
+	}
+	return eof
+}
+
+// readRecipients reads up to limit recipients from campaign's list, from
+// its current offset, reporting whether it reached the end of the list.
+func (s *CampaignScheduler) readRecipients(ctx context.Context, campaign Campaign, limit int) ([]campaignLine, bool, error) {
+	bucket, object, err := parseGCSURI(campaign.Recipients)
+	if err != nil {
+		return nil, false, err
+	}
+	reader, err := s.storage.Bucket(bucket).Object(object).NewRangeReader(ctx, campaign.Progress.Offset, -1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	buffered := bufio.NewReader(reader)
+	offset := campaign.Progress.Offset
+	var lines []campaignLine
+	for len(lines) < limit {
+		data, err := buffered.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		next := offset + int64(len(data))
+		if len(bytes.TrimSpace(data)) > 0 {
+			line := campaignLine{offset: offset, next: next}
+			line.msg, line.err = campaign.message(data, offset)
+			lines = append(lines, line)
+		} else if len(lines) > 0 {
+			// Skip blank lines with the recipient before them.
+			lines[len(lines)-1].next = next
+		}
+		offset = next
+		if err == io.EOF {
+			return lines, true, nil
+		}
+	}
+	// The list may end right after the last recipient read.
+	_, err = buffered.Peek(1)
+	return lines, err == io.EOF, nil
+}
+
+type CampaignHandler struct {
+	logger    *log.Logger
+	scheduler *CampaignScheduler
+}
+
+func newCampaignHandler(scheduler *CampaignScheduler) *CampaignHandler {
+	return &CampaignHandler{logger: newLogger("campaigns"), scheduler: scheduler}
+}
+
+// Create schedules a campaign. It's checked against the configured topics
+// and templates, but its recipient list is only read once it's due.
+func (h *CampaignHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var campaign Campaign
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&campaign); err != nil {
+		http.Error(w, "Invalid campaign: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if campaign.SendAfter.IsZero() {
+		campaign.SendAfter = now
+	}
+	if err := campaign.validate(); err != nil {
+		http.Error(w, "Invalid campaign: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.scheduler.registry.Lookup(campaign.Topic); !ok {
+		http.Error(w, "Invalid campaign: unknown topic "+campaign.Topic, http.StatusBadRequest)
+		return
+	}
+	if campaign.TemplateId != "" {
+		if _, err := h.scheduler.templates.Get(r.Context(), campaign.TemplateId, 0); errors.Is(err, ErrNotFound) {
+			http.Error(w, "Invalid campaign: unknown template "+campaign.TemplateId, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get template: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	campaign.Id = newCloudEventId()
+	campaign.Status = campaignScheduled
+	campaign.Progress = CampaignProgress{}
+	campaign.CreatedAt = now
+	if err := h.scheduler.save(r.Context(), campaign); err != nil {
+		http.Error(w, "Failed to save campaign: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(h.logger, r).Printf("Scheduled campaign %s to %s from %s", campaign.Id, campaign.Recipients, campaign.SendAfter.Format(time.RFC3339))
+	campaign.UpdatedAt = now
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(campaign)
+}
+
+func (h *CampaignHandler) List(w http.ResponseWriter, r *http.Request) {
+	campaigns, err := h.scheduler.list(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to list campaigns: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(campaigns, func(i, j int) bool { return campaigns[i].CreatedAt.After(campaigns[j].CreatedAt) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(campaigns)
+}
+
+func (h *CampaignHandler) Get(w http.ResponseWriter, r *http.Request) {
+	campaign, ok := h.lookup(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(campaign)
+}
+
+// Cancel stops a campaign before its next batch. A batch already sending
+// finishes.
+func (h *CampaignHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	campaign, ok := h.lookup(w, r)
+	if !ok {
+		return
+	}
+	if campaign.done() {
+		http.Error(w, "Campaign is already "+campaign.Status, http.StatusConflict)
+		return
+	}
+	campaign.Status = campaignCancelled
+	if err := h.scheduler.save(r.Context(), campaign); err != nil {
+		http.Error(w, "Failed to save campaign: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(h.logger, r).Printf("Cancelled campaign %s after %d messages", campaign.Id, campaign.Progress.Published)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(campaign)
+}
+
+func (h *CampaignHandler) lookup(w http.ResponseWriter, r *http.Request) (Campaign, bool) {
+	campaign, err := h.scheduler.get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Unknown campaign", http.StatusNotFound)
+		return campaign, false
+	} else if err != nil {
+		http.Error(w, "Failed to get campaign: "+err.Error(), http.StatusInternalServerError)
+		return campaign, false
+	}
+	return campaign, true
+}
+
+// campaignRoutes are only served with campaigns enabled.
+func campaignRoutes(campaigns *CampaignHandler) []Route {
+	const scope = "admin:campaigns"
+	notFound := ResponseDoc{Status: http.StatusNotFound, Description: "The campaign doesn't exist."}
+	return []Route{
+		{
+			Method:  http.MethodPost,
+			Path:    "/email/campaigns",
+			Scope:   scope,
+			Handler: http.HandlerFunc(campaigns.Create),
+			Doc: RouteDoc{
+				Summary:     "Schedule an email campaign to a recipient list in Cloud Storage",
+				Tag:         "email",
+				RequestBody: Campaign{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusCreated, Description: "The scheduled campaign.", Body: Campaign{}},
+					{Status: http.StatusBadRequest, Description: "The campaign is invalid, or its topic or template doesn't exist."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/email/campaigns",
+			Scope:   scope,
+			Handler: http.HandlerFunc(campaigns.List),
+			Doc: RouteDoc{
+				Summary:   "List campaigns and their progress, newest first",
+				Tag:       "email",
+				Responses: []ResponseDoc{{Status: http.StatusOK, Description: "Campaigns.", Body: []Campaign{}}},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/email/campaigns/{id}",
+			Scope:   scope,
+			Handler: http.HandlerFunc(campaigns.Get),
+			Doc: RouteDoc{
+				Summary:   "Get a campaign and its progress",
+				Tag:       "email",
+				Responses: []ResponseDoc{{Status: http.StatusOK, Description: "The campaign.", Body: Campaign{}}, notFound},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/email/campaigns/{id}/cancel",
+			Scope:   scope,
+			Handler: http.HandlerFunc(campaigns.Cancel),
+			Doc: RouteDoc{
+				Summary: "Stop a campaign before its next batch",
+				Tag:     "email",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The cancelled campaign.", Body: Campaign{}},
+					notFound,
+					{Status: http.StatusConflict, Description: "The campaign already completed, expired or was cancelled."},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+)
+
+const (
+	canaryKeyPrefix = "canary/"
+
+	defaultCanaryInterval = 30 * time.Second
+	defaultCanaryTimeout  = time.Minute
+)
+
+// CanaryConfig runs a synthetic publisher and consumer: a heartbeat is
+// published to Topic every Interval and consumed back from Subscription,
+// reporting the end-to-end latency and heartbeats lost on metrics and as
+// the canary health check, so broker or permission problems show before
+// real traffic hits them. The topic and subscription are created on startup
+// if missing.
+type CanaryConfig struct {
+	// Topic is the Pub/Sub topic ID heartbeats go to. Empty, the default,
+	// runs no canary.
+	Topic string `yaml:"topic"`
+	// Subscription is the ID of the subscription they're consumed from.
+	// Defaults to Topic. Every instance shares it, so which consumes a
+	// heartbeat doesn't matter: receipts are recorded in the store.
+	Subscription string `yaml:"subscription"`
+	// Interval defaults to 30s.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is how long a heartbeat has to come back before it's counted
+	// lost. Defaults to 1m.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *CanaryConfig) validate() error {
+	if c.Topic == "" {
+		return nil
+	}
+	if c.Subscription == "" {
+		c.Subscription = c.Topic
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultCanaryInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultCanaryTimeout
+	}
+	if c.Interval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("interval and timeout can't be negative")
+	}
+	return nil
+}
+
+type canaryHeartbeat struct {
+	Id     string    `json:"id"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+type Canary struct {
+	logger *log.Logger
+	config CanaryConfig
+	store  Store
+
+	topic        *pubsub.Topic
+	subscription *pubsub.Subscription
+
+	// pending are the heartbeats this instance sent that haven't come back,
+	// by ID, with when they were sent. Only the loop touches it.
+	pending map[string]time.Time
+
+	mu sync.Mutex
+	// err is why the last heartbeat to resolve failed, if it did.
+	err error
+}
+
+func newCanary(lifecycle fx.Lifecycle, config Config, client *pubsub.Client, store Store) *Canary {
+	canary := &Canary{
+		logger:  newLogger("canary"),
+		config:  config.Canary,
+		store:   store,
+		pending: make(map[string]time.Time),
+	}
+	if canary.config.Topic == "" {
+		return canary
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(startCtx context.Context) error {
+				if err := provisionCanary(startCtx, client, canary.config); err != nil {
+					return fmt.Errorf("canary: %w", err)
+				}
+				canary.topic = client.Topic(canary.config.Topic)
+				canary.subscription = client.Subscription(canary.config.Subscription)
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					canary.receive(ctx)
+				}()
+				go func() {
+					defer wg.Done()
+					canary.run(ctx)
+				}()
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				wg.Wait()
+				canary.topic.Stop()
+				return nil
+			},
+		},
+	)
+	return canary
+}
+
+// provisionCanary creates the canary's topic and subscription if they don't
+// exist.
+func provisionCanary(ctx context.Context, client *pubsub.Client, config CanaryConfig) error {
+	topic := client.Topic(config.Topic)
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("topic %s: %w", config.Topic, err)
+	}
+	if !exists {
+		if topic, err = client.CreateTopic(ctx, config.Topic); err != nil {
+			return fmt.Errorf("topic %s: %w", config.Topic, err)
+		}
+	}
+	exists, err = client.Subscription(config.Subscription).Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("subscription %s: %w", config.Subscription, err)
+	}
+	if !exists {
+		// Heartbeats are worthless once late, so they aren't kept long.
+		_, err = client.CreateSubscription(ctx, config.Subscription, pubsub.SubscriptionConfig{Topic: topic, RetentionDuration: 10 * time.Minute})
+		if err != nil {
+			return fmt.Errorf("subscription %s: %w", config.Subscription, err)
+		}
+	}
+	return nil
+}
+
+// receive records each heartbeat that comes back until ctx is done.
+func (c *Canary) receive(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := c.subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+			var heartbeat canaryHeartbeat
+			if err := json.Unmarshal(msg.Data, &heartbeat); err != nil || heartbeat.Id == "" {
+				c.logger.Printf("Dropping message %s, which isn't a heartbeat", msg.ID)
+				msg.Ack()
+				return
+			}
+			canaryLatency.Observe(time.Since(heartbeat.SentAt).Seconds())
+			if err := c.store.Set(ctx, canaryKeyPrefix+heartbeat.Id, []byte(time.Now().UTC().Format(time.RFC3339Nano)), 2*c.config.Timeout); err != nil {
+				c.logger.Printf("Failed to record heartbeat %s: %v", heartbeat.Id, err)
+				msg.Nack()
+				return
+			}
+			msg.Ack()
+		})
+		if err != nil && ctx.Err() == nil {
+			c.logger.Printf("Receiving heartbeats failed, retrying: %v", err)
+			c.fail(fmt.Errorf("receiving heartbeats: %w", err))
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.config.Interval):
+			}
+		}
+	}
+}
+
+// run sends a heartbeat every interval, and resolves the ones sent earlier,
+// until ctx is done.
+func (c *Canary) run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		c.send(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.resolve(ctx)
+	}
+}
+
+func (c *Canary) send(ctx context.Context) {
+	var id [8]byte
+	rand.Read(id[:])
+	heartbeat := canaryHeartbeat{Id: hex.EncodeToString(id[:]), SentAt: time.Now().UTC()}
+	data, _ := json.Marshal(heartbeat)
+	publishCtx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+	if _, err := c.topic.Publish(publishCtx, &pubsub.Message{Data: data}).Get(publishCtx); err != nil {
+		if ctx.Err() == nil {
+			c.logger.Printf("Failed to publish heartbeat: %v", err)
+			canaryHeartbeats.WithLabelValues("publish_failed").Inc()
+			c.fail(fmt.Errorf("publishing heartbeat: %w", err))
+		}
+		return
+	}
+	c.pending[heartbeat.Id] = heartbeat.SentAt
+}
+
+// resolve counts each pending heartbeat that has come back as received,
+// and each that's out of time as lost.
+func (c *Canary) resolve(ctx context.Context) {
+	// Oldest first, so the health check reflects the latest to resolve.
+	ids := make([]string, 0, len(c.pending))
+	for id := range c.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return c.pending[ids[i]].Before(c.pending[ids[j]])
+	})
+	for _, id := range ids {
+		sentAt := c.pending[id]
+		_, err := c.store.Get(ctx, canaryKeyPrefix+id)
+		switch {
+		case err == nil:
+			delete(c.pending, id)
+			canaryHeartbeats.WithLabelValues("received").Inc()
+			c.fail(nil)
+		case !errors.Is(err, ErrNotFound):
+			if ctx.Err() == nil {
+				c.logger.Printf("Failed to look up heartbeat %s: %v", id, err)
+			}
+		case time.Since(sentAt) > c.config.Timeout:
+			delete(c.pending, id)
+			c.logger.Printf("Heartbeat %s, sent at %s, didn't come back within %s", id, sentAt.Format(time.RFC3339), c.config.Timeout)
+			canaryHeartbeats.WithLabelValues("lost").Inc()
+			c.fail(fmt.Errorf("heartbeat sent at %s didn't come back within %s", sentAt.Format(time.RFC3339), c.config.Timeout))
+		}
+	}
+}
+
+func (c *Canary) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+// Check fails if the last heartbeat to resolve was lost or couldn't be
+// published, or receiving them is failing.
+func (c *Canary) Check(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
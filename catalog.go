@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+)
+
+type EventConfig struct {
+	// Type is the event_type attribute value, e.g. email.send. Entries for
+	// the event types this service defines itself add to their built-in
+	// description.
+	Type        string `yaml:"type"`
+	Version     string `yaml:"version"`
+	Description string `yaml:"description"`
+	Owner       string `yaml:"owner"`
+	// Topics are the names of the configured topics the event is published
+	// to. Subscriptions on them are listed as its consumers.
+	Topics []string `yaml:"topics"`
+	// SchemaPath is a JSON Schema file describing the payload.
+	SchemaPath string `yaml:"schema_path"`
+	// Sample is an example payload.
+	Sample interface{} `yaml:"sample"`
+}
+
+// builtinEvents are the event types defined in this repository, with
+// schemas derived from their Go types.
+var builtinEvents = []catalogEvent{
+	{
+		Type:        emailevents.EventTypeSendEmail,
+		Version:     emailevents.SchemaVersion,
+		Description: "Request to send an email, either with inline bodies or by rendering a stored template.",
+		Schema:      mustMarshal(schemaFor(reflect.TypeOf(emailevents.SendEmailRequest{}))),
+		Sample: mustMarshal(emailevents.SendEmailRequest{
+			To:         []string{"user@example.com"},
+			TemplateId: "welcome",
+			Variables:  map[string]string{"name": "Ada"},
+		}),
+	},
+}
+
+type catalogEvent struct {
+	Type        string            `json:"type"`
+	Version     string            `json:"version,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Topics      []catalogTopic    `json:"topics"`
+	Consumers   []catalogConsumer `json:"consumers"`
+	Schema      json.RawMessage   `json:"schema,omitempty"`
+	Sample      json.RawMessage   `json:"sample,omitempty"`
+}
+
+type catalogTopic struct {
+	Name string `json:"name"`
+	Id   string `json:"id"`
+	// Source is how the event reaches the topic: publish for the HTTP API,
+	// or eventarc when an Eventarc route republishes it.
+	Source string `json:"source"`
+}
+
+type catalogConsumer struct {
+	Subscription string `json:"subscription"`
+	Handler      string `json:"handler,omitempty"`
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+// Catalog serves the event types this service publishes and consumes, so
+// other teams can discover them without reading code.
+type Catalog struct {
+	events []catalogEvent
+	body   []byte
+}
+
+// newCatalog builds the event catalog from the built-in event types and
+// those in config, resolving each type's topics and the subscriptions
+// consuming them.
+func newCatalog(config Config) (*Catalog, error) {
+	events := make(map[string]*catalogEvent)
+	for _, builtin := range builtinEvents {
+		event := builtin
+		events[event.Type] = &event
+	}
+	topicIds := make(map[string]string, len(config.Topics))
+	for _, topic := range config.Topics {
+		topicIds[topic.Name] = topic.Id
+	}
+	for _, eventConfig := range config.Events {
+		event, ok := events[eventConfig.Type]
+		if !ok {
+			event = &catalogEvent{Type: eventConfig.Type}
+			events[event.Type] = event
+		}
+		if eventConfig.Version != "" {
+			event.Version = eventConfig.Version
+		}
+		if eventConfig.Description != "" {
+			event.Description = eventConfig.Description
+		}
+		event.Owner = eventConfig.Owner
+		for _, name := range eventConfig.Topics {
+			event.Topics = append(event.Topics, catalogTopic{Name: name, Id: topicIds[name], Source: "publish"})
+		}
+		if eventConfig.SchemaPath != "" {
+			schema, err := os.ReadFile(eventConfig.SchemaPath)
+			if err != nil {
+				return nil, fmt.Errorf("event %s: %w", event.Type, err)
+			}
+			if !json.Valid(schema) {
+				return nil, fmt.Errorf("event %s: %s isn't valid JSON", event.Type, eventConfig.SchemaPath)
+			}
+			event.Schema = schema
+		}
+		if eventConfig.Sample != nil {
+			sample, err := json.Marshal(eventConfig.Sample)
+			if err != nil {
+				return nil, fmt.Errorf("event %s: sample: %w", event.Type, err)
+			}
+			event.Sample = sample
+		}
+	}
+
+	catalog := make([]catalogEvent, 0, len(events))
+	for _, event := range events {
+		for _, route := range config.Eventarc.Routes {
+			if matched, _ := path.Match(route.Type, event.Type); matched {
+				event.Topics = append(event.Topics, catalogTopic{Name: route.Topic, Id: topicIds[route.Topic], Source: "eventarc"})
+			}
+		}
+		event.Consumers = []catalogConsumer{}
+		for _, subscription := range config.Subscriptions {
+			for _, topic := range event.Topics {
+				if subscription.Topic != "" && subscription.Topic == topic.Id {
+					event.Consumers = append(event.Consumers, catalogConsumer{Subscription: subscription.Name, Handler: subscription.Handler})
+					break
+				}
+			}
+		}
+		if event.Topics == nil {
+			event.Topics = []catalogTopic{}
+		}
+		catalog = append(catalog, *event)
+	}
+	sort.Slice(catalog, func(i, j int) bool { return catalog[i].Type < catalog[j].Type })
+	body, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &Catalog{events: catalog, body: body}, nil
+}
+
+func (c *Catalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(c.body)
+}
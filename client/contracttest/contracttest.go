@@ -0,0 +1,185 @@
+// Package contracttest checks that a consumer can decode every event type
+// and version gcp-pubsub-test publishes. The service's export-contracts
+// command writes golden sample messages, generated from its event catalog,
+// to a directory that consumer teams check in or fetch in CI and run their
+// decoders against:
+//
+//	func TestContracts(t *testing.T) {
+//		contracttest.Run(t, "testdata/contracts", func(msg *pubsub.Message) error {
+//			_, err := emailevents.Decode(msg)
+//			return err
+//		}, contracttest.WithTypes(emailevents.EventTypeSendEmail))
+//	}
+package contracttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// The variants of an event each golden message is.
+const (
+	// VariantSample is the sample payload registered with the event.
+	VariantSample = "sample"
+	// VariantMinimal has only the fields the event's schema requires.
+	VariantMinimal = "minimal"
+	// VariantFull has every field in the event's schema.
+	VariantFull = "full"
+)
+
+// Golden is a sample message of one event type and version, as it's kept
+// in its own file.
+type Golden struct {
+	Type       string            `json:"type"`
+	Version    string            `json:"version,omitempty"`
+	Variant    string            `json:"variant"`
+	Attributes map[string]string `json:"attributes"`
+	Data       json.RawMessage   `json:"data"`
+}
+
+// Name identifies the golden message in test names, e.g.
+// email.send/v1/minimal.
+func (g Golden) Name() string {
+	name := g.Type
+	if g.Version != "" {
+		name += "/v" + g.Version
+	}
+	return name + "/" + g.Variant
+}
+
+// FileName is the name of the file the golden message is kept in.
+func (g Golden) FileName() string {
+	return strings.ReplaceAll(g.Name(), "/", ".") + ".json"
+}
+
+// Message returns the golden message as a subscriber would receive it.
+func (g Golden) Message() *pubsub.Message {
+	attributes := make(map[string]string, len(g.Attributes))
+	for key, value := range g.Attributes {
+		attributes[key] = value
+	}
+	return &pubsub.Message{ID: g.Name(), Data: []byte(g.Data), Attributes: attributes}
+}
+
+// Load reads the golden messages in dir, sorted by name.
+func Load(dir string) ([]Golden, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	goldens := make([]Golden, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var golden Golden
+		if err := json.Unmarshal(data, &golden); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if golden.Type == "" {
+			return nil, fmt.Errorf("%s: no event type", path)
+		}
+		goldens = append(goldens, golden)
+	}
+	sort.Slice(goldens, func(i, j int) bool { return goldens[i].Name() < goldens[j].Name() })
+	return goldens, nil
+}
+
+// Write replaces the golden messages in dir with goldens, so event types
+// that are no longer published don't linger.
+func Write(dir string, goldens []Golden) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	for _, golden := range goldens {
+		data, err := json.MarshalIndent(golden, "", "  ")
+		if err != nil {
+			return fmt.Errorf("%s: %w", golden.Name(), err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, golden.FileName()), append(data, '\n'), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decoder decodes msg the way the consumer's handler does, returning an
+// error if it can't.
+type Decoder func(msg *pubsub.Message) error
+
+type options struct {
+	types []string
+}
+
+type Option func(*options)
+
+// WithTypes checks only the event types the consumer handles, and fails if
+// any of them has no golden messages, e.g. because it's no longer
+// published.
+func WithTypes(types ...string) Option {
+	return func(o *options) {
+		o.types = append(o.types, types...)
+	}
+}
+
+// Run decodes each golden message in dir with decode, as a subtest named
+// after the message.
+func Run(t *testing.T, dir string, decode Decoder, opts ...Option) {
+	t.Helper()
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	goldens, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Loading golden messages: %v", err)
+	}
+	if len(o.types) > 0 {
+		wanted := make(map[string]bool, len(o.types))
+		for _, eventType := range o.types {
+			wanted[eventType] = true
+		}
+		found := make(map[string]bool, len(o.types))
+		filtered := goldens[:0]
+		for _, golden := range goldens {
+			if wanted[golden.Type] {
+				filtered = append(filtered, golden)
+				found[golden.Type] = true
+			}
+		}
+		goldens = filtered
+		for _, eventType := range o.types {
+			if !found[eventType] {
+				t.Errorf("No golden messages for event type %s in %s", eventType, dir)
+			}
+		}
+	}
+	if len(goldens) == 0 {
+		t.Fatalf("No golden messages in %s", dir)
+	}
+	for _, golden := range goldens {
+		golden := golden
+		t.Run(golden.Name(), func(t *testing.T) {
+			if err := decode(golden.Message()); err != nil {
+				t.Errorf("Decoding %s: %v", golden.Name(), err)
+			}
+		})
+	}
+}
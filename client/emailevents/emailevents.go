@@ -0,0 +1,130 @@
+// Package emailevents is the typed client for the email events published
+// through gcp-pubsub-test. It owns the topic name, attributes and payload
+// encoding so callers only deal with SendEmailRequest values.
+package emailevents
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	// DefaultTopic is the topic email events are published to unless
+	// overridden with WithTopic.
+	DefaultTopic = "email-events"
+
+	EventTypeSendEmail = "email.send"
+	SchemaVersion      = "1"
+
+	AttributeEventType     = "event_type"
+	AttributeSchemaVersion = "schema_version"
+	AttributeContentType   = "content_type"
+
+	contentTypeJSON = "application/json"
+)
+
+var ErrInvalidRequest = errors.New("invalid email request")
+
+type SendEmailRequest struct {
+	From       string            `json:"from,omitempty"`
+	To         []string          `json:"to"`
+	Cc         []string          `json:"cc,omitempty"`
+	Bcc        []string          `json:"bcc,omitempty"`
+	ReplyTo    string            `json:"reply_to,omitempty"`
+	Subject    string            `json:"subject"`
+	TemplateId string            `json:"template_id,omitempty"`
+	Variables  map[string]string `json:"variables,omitempty"`
+	TextBody   string            `json:"text_body,omitempty"`
+	HtmlBody   string            `json:"html_body,omitempty"`
+}
+
+func (r SendEmailRequest) Validate() error {
+	if len(r.To)+len(r.Cc)+len(r.Bcc) == 0 {
+		return fmt.Errorf("%w: at least one recipient is required", ErrInvalidRequest)
+	}
+	if r.Subject == "" && r.TemplateId == "" {
+		return fmt.Errorf("%w: subject or template_id is required", ErrInvalidRequest)
+	}
+	if r.TemplateId == "" && r.TextBody == "" && r.HtmlBody == "" {
+		return fmt.Errorf("%w: a body or template_id is required", ErrInvalidRequest)
+	}
+	return nil
+}
+
+type Option func(*Client)
+
+// WithTopic overrides the topic events are published to, for environments
+// that don't use DefaultTopic.
+func WithTopic(topicId string) Option {
+	return func(c *Client) {
+		c.topicId = topicId
+	}
+}
+
+type Client struct {
+	topicId string
+	topic   *pubsub.Topic
+}
+
+func NewClient(client *pubsub.Client, opts ...Option) *Client {
+	c := &Client{topicId: DefaultTopic}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.topic = client.Topic(c.topicId)
+	return c
+}
+
+// Topic exposes the underlying topic handle so callers can tune its
+// PublishSettings.
+func (c *Client) Topic() *pubsub.Topic {
+	return c.topic
+}
+
+// SendEmail publishes req and blocks until the server assigns it a message ID.
+func (c *Client) SendEmail(ctx context.Context, req SendEmailRequest) (string, error) {
+	msg, err := Encode(req)
+	if err != nil {
+		return "", err
+	}
+	return c.topic.Publish(ctx, msg).Get(ctx)
+}
+
+// Stop flushes outstanding messages and releases the topic's goroutines.
+func (c *Client) Stop() {
+	c.topic.Stop()
+}
+
+func Encode(req SendEmailRequest) (*pubsub.Message, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return &pubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			AttributeEventType:     EventTypeSendEmail,
+			AttributeSchemaVersion: SchemaVersion,
+			AttributeContentType:   contentTypeJSON,
+		},
+	}, nil
+}
+
+// Decode is the consumer-side counterpart of Encode.
+func Decode(msg *pubsub.Message) (SendEmailRequest, error) {
+	var req SendEmailRequest
+	if eventType := msg.Attributes[AttributeEventType]; eventType != EventTypeSendEmail {
+		return req, fmt.Errorf("unexpected event type %q", eventType)
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return req, err
+	}
+	return req, nil
+}
@@ -0,0 +1,163 @@
+// Package inbox implements the inbox pattern for consumers of
+// gcp-pubsub-test's topics that keep their state in a SQL database: the
+// message ID is inserted into an inbox table in the same transaction as the
+// handler's writes, so a redelivered message finds its ID already present
+// and is acked without running the handler again. A crash before commit
+// rolls back both the inbox row and the side effects, and the redelivery is
+// processed normally.
+//
+//	box, err := inbox.New(db, inbox.Postgres, "inbox")
+//	...
+//	handle := box.Handler("orders", func(ctx context.Context, tx *sql.Tx, msg *pubsub.Message) error {
+//		_, err := tx.ExecContext(ctx, "INSERT INTO orders ...")
+//		return err
+//	})
+//	err = subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+//		if err := handle(ctx, msg); err != nil {
+//			msg.Nack()
+//			return
+//		}
+//		msg.Ack()
+//	})
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Handler processes a message, returning an error to have it redelivered.
+type Handler func(ctx context.Context, msg *pubsub.Message) error
+
+// TxHandler processes a message inside the transaction that records it in
+// the inbox. Its side effects must go through tx to be covered by the
+// effectively-once guarantee.
+type TxHandler func(ctx context.Context, tx *sql.Tx, msg *pubsub.Message) error
+
+// Dialect is the SQL dialect of the inbox's database, which the caller
+// opens with its own driver.
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	MySQL    Dialect = "mysql"
+	SQLite   Dialect = "sqlite"
+)
+
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type Option func(*Inbox)
+
+// WithDuplicateHook calls hook for each redelivered message skipped because
+// the inbox already recorded it, e.g. to count them in a metric.
+func WithDuplicateHook(hook func(subscription string, msg *pubsub.Message)) Option {
+	return func(i *Inbox) {
+		i.duplicate = hook
+	}
+}
+
+// Inbox records the messages handled for each subscription in a table.
+type Inbox struct {
+	db        *sql.DB
+	dialect   Dialect
+	table     string
+	duplicate func(subscription string, msg *pubsub.Message)
+}
+
+func New(db *sql.DB, dialect Dialect, table string, opts ...Option) (*Inbox, error) {
+	if !tableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid inbox table name %q", table)
+	}
+	switch dialect {
+	case Postgres, MySQL, SQLite:
+	default:
+		return nil, fmt.Errorf("unsupported inbox dialect %q", dialect)
+	}
+	i := &Inbox{db: db, dialect: dialect, table: table, duplicate: func(string, *pubsub.Message) {}}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i, nil
+}
+
+// EnsureSchema creates the inbox table if it doesn't exist.
+func (i *Inbox) EnsureSchema(ctx context.Context) error {
+	_, err := i.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	subscription VARCHAR(255) NOT NULL,
+	message_id VARCHAR(255) NOT NULL,
+	processed_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (subscription, message_id)
+)`, i.table))
+	return err
+}
+
+func (i *Inbox) claimQuery() string {
+	switch i.dialect {
+	case Postgres:
+		return fmt.Sprintf("INSERT INTO %s (subscription, message_id, processed_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", i.table)
+	case MySQL:
+		return fmt.Sprintf("INSERT IGNORE INTO %s (subscription, message_id, processed_at) VALUES (?, ?, ?)", i.table)
+	default:
+		return fmt.Sprintf("INSERT INTO %s (subscription, message_id, processed_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", i.table)
+	}
+}
+
+// Handler wraps handle so that it runs at most once per message ID for
+// subscription, as far as its transactional side effects are concerned.
+func (i *Inbox) Handler(subscription string, handle TxHandler) Handler {
+	query := i.claimQuery()
+	return func(ctx context.Context, msg *pubsub.Message) error {
+		tx, err := i.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("inbox: begin: %w", err)
+		}
+		defer tx.Rollback()
+
+		result, err := tx.ExecContext(ctx, query, subscription, msg.ID, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("inbox: claim %s: %w", msg.ID, err)
+		}
+		claimed, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("inbox: claim %s: %w", msg.ID, err)
+		}
+		if claimed == 0 {
+			i.duplicate(subscription, msg)
+			return nil
+		}
+
+		if err := handle(ctx, tx, msg); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("inbox: commit %s: %w", msg.ID, err)
+		}
+		return nil
+	}
+}
+
+// Prune deletes inbox rows older than retention. Rows only need to outlive
+// the window in which Pub/Sub may redeliver, i.e. the subscription's message
+// retention.
+func (i *Inbox) Prune(ctx context.Context, retention time.Duration) (int64, error) {
+	placeholder := "?"
+	if i.dialect == Postgres {
+		placeholder = "$1"
+	}
+	result, err := i.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE processed_at < %s", i.table, placeholder), time.Now().UTC().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Check pings the inbox database, for consumers to include in their health
+// checks.
+func (i *Inbox) Check(ctx context.Context) error {
+	return i.db.PingContext(ctx)
+}
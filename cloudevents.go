@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// CloudEvents 1.0 over the Pub/Sub protocol binding. In binary mode the
+// context attributes travel as "ce-" prefixed message attributes and the
+// message data is the event data; in structured mode the whole event is a
+// JSON document in the message data.
+const (
+	cloudEventsSpecVersion       = "1.0"
+	cloudEventsAttributePrefix   = "ce-"
+	cloudEventsContentType       = "application/cloudevents+json"
+	cloudEventsModeBinary        = "binary"
+	cloudEventsModeStructured    = "structured"
+	contentTypeAttribute         = "content-type"
+	defaultCloudEventContentType = "application/json"
+)
+
+var errNotCloudEvent = errors.New("message is not a CloudEvent")
+
+type CloudEventsConfig struct {
+	// Mode is binary (the default) or structured.
+	Mode string `yaml:"mode"`
+	// Source and Type are used for events whose publish request doesn't set
+	// ce-source or ce-type attributes.
+	Source string `yaml:"source"`
+	Type   string `yaml:"type"`
+}
+
+type CloudEvent struct {
+	Id              string
+	Source          string
+	Type            string
+	Subject         string
+	Time            time.Time
+	DataContentType string
+	DataSchema      string
+	// Extensions holds extension context attributes as strings.
+	Extensions map[string]string
+	Data       []byte
+}
+
+func newCloudEventId() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// set assigns a context attribute by name, treating unknown names as
+// extensions.
+func (e *CloudEvent) set(name string, value string) error {
+	switch name {
+	case "specversion":
+		if value != cloudEventsSpecVersion {
+			return fmt.Errorf("unsupported CloudEvents specversion %q", value)
+		}
+	case "id":
+		e.Id = value
+	case "source":
+		e.Source = value
+	case "type":
+		e.Type = value
+	case "subject":
+		e.Subject = value
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return fmt.Errorf("invalid CloudEvent time: %w", err)
+		}
+		e.Time = t
+	case "datacontenttype":
+		e.DataContentType = value
+	case "dataschema":
+		e.DataSchema = value
+	default:
+		if e.Extensions == nil {
+			e.Extensions = make(map[string]string)
+		}
+		e.Extensions[name] = value
+	}
+	return nil
+}
+
+// contextAttributes returns the event's context attributes by CloudEvents
+// name, omitting unset optional ones.
+func (e *CloudEvent) contextAttributes() map[string]string {
+	attributes := make(map[string]string, len(e.Extensions)+8)
+	for name, value := range e.Extensions {
+		attributes[name] = value
+	}
+	attributes["specversion"] = cloudEventsSpecVersion
+	attributes["id"] = e.Id
+	attributes["source"] = e.Source
+	attributes["type"] = e.Type
+	for name, value := range map[string]string{
+		"subject":         e.Subject,
+		"datacontenttype": e.DataContentType,
+		"dataschema":      e.DataSchema,
+	} {
+		if value != "" {
+			attributes[name] = value
+		}
+	}
+	if !e.Time.IsZero() {
+		attributes["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	}
+	return attributes
+}
+
+func (e *CloudEvent) validate() error {
+	if e.Id == "" || e.Source == "" || e.Type == "" {
+		return errors.New("CloudEvent needs id, source and type")
+	}
+	return nil
+}
+
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// MarshalJSON encodes the event in the structured content mode's JSON
+// format, inlining JSON data and base64-encoding anything else.
+func (e *CloudEvent) MarshalJSON() ([]byte, error) {
+	document := make(map[string]interface{}, len(e.Extensions)+9)
+	for name, value := range e.contextAttributes() {
+		document[name] = value
+	}
+	if len(e.Data) > 0 {
+		if isJSONContentType(e.DataContentType) && json.Valid(e.Data) {
+			document["data"] = json.RawMessage(e.Data)
+		} else {
+			document["data_base64"] = e.Data
+		}
+	}
+	return json.Marshal(document)
+}
+
+func (e *CloudEvent) UnmarshalJSON(data []byte) error {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	for name, raw := range document {
+		switch name {
+		case "data", "data_base64":
+			// Decoded below, once datacontenttype is known.
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		if err := e.set(name, fmt.Sprint(value)); err != nil {
+			return err
+		}
+	}
+	if raw, ok := document["data_base64"]; ok {
+		if err := json.Unmarshal(raw, &e.Data); err != nil {
+			return fmt.Errorf("invalid CloudEvent data_base64: %w", err)
+		}
+	} else if raw, ok := document["data"]; ok {
+		var text string
+		if !isJSONContentType(e.DataContentType) && json.Unmarshal(raw, &text) == nil {
+			e.Data = []byte(text)
+		} else {
+			e.Data = raw
+		}
+	}
+	return nil
+}
+
+// Message encodes the event as a Pub/Sub message in mode. attributes are
+// copied onto the message alongside the event.
+func (e *CloudEvent) Message(mode string, attributes map[string]string) (*pubsub.Message, error) {
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	msg := &pubsub.Message{Attributes: make(map[string]string, len(attributes)+9)}
+	for key, value := range attributes {
+		msg.Attributes[key] = value
+	}
+	if mode == cloudEventsModeStructured {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = data
+		msg.Attributes[contentTypeAttribute] = cloudEventsContentType
+		return msg, nil
+	}
+	for name, value := range e.contextAttributes() {
+		if name == "datacontenttype" {
+			msg.Attributes[contentTypeAttribute] = value
+			continue
+		}
+		msg.Attributes[cloudEventsAttributePrefix+name] = value
+	}
+	msg.Data = e.Data
+	return msg, nil
+}
+
+// ParseCloudEvent decodes msg as a CloudEvent in either content mode. It
+// returns errNotCloudEvent if msg is in neither, and also returns the
+// attributes that aren't part of the event.
+func ParseCloudEvent(msg *pubsub.Message) (*CloudEvent, map[string]string, error) {
+	other := make(map[string]string, len(msg.Attributes))
+	event := new(CloudEvent)
+	if mediaType, _, _ := mime.ParseMediaType(msg.Attributes[contentTypeAttribute]); mediaType == cloudEventsContentType {
+		if err := json.Unmarshal(msg.Data, event); err != nil {
+			return nil, nil, fmt.Errorf("invalid structured CloudEvent: %w", err)
+		}
+		for key, value := range msg.Attributes {
+			if key != contentTypeAttribute {
+				other[key] = value
+			}
+		}
+		return event, other, event.validate()
+	}
+
+	if _, ok := msg.Attributes[cloudEventsAttributePrefix+"specversion"]; !ok {
+		return nil, nil, errNotCloudEvent
+	}
+	for key, value := range msg.Attributes {
+		if name, ok := strings.CutPrefix(key, cloudEventsAttributePrefix); ok {
+			if err := event.set(name, value); err != nil {
+				return nil, nil, err
+			}
+		} else if key == contentTypeAttribute {
+			event.DataContentType = value
+		} else {
+			other[key] = value
+		}
+	}
+	event.Data = msg.Data
+	return event, other, event.validate()
+}
+
+// toCloudEvent re-encodes msg as a CloudEvent in the topic's mode. Messages
+// that are already CloudEvents keep their context; others become the data
+// of a new event, with ce- prefixed attributes setting its context.
+func toCloudEvent(config CloudEventsConfig, msg *pubsub.Message) (*pubsub.Message, error) {
+	event, attributes, err := ParseCloudEvent(msg)
+	if errors.Is(err, errNotCloudEvent) {
+		event = &CloudEvent{
+			Id:              newCloudEventId(),
+			Source:          config.Source,
+			Type:            config.Type,
+			Time:            time.Now().UTC(),
+			DataContentType: defaultCloudEventContentType,
+			Data:            msg.Data,
+		}
+		attributes = make(map[string]string, len(msg.Attributes))
+		for key, value := range msg.Attributes {
+			if name, ok := strings.CutPrefix(key, cloudEventsAttributePrefix); ok {
+				if err := event.set(name, value); err != nil {
+					return nil, err
+				}
+			} else {
+				attributes[key] = value
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	encoded, err := event.Message(config.Mode, attributes)
+	if err != nil {
+		return nil, err
+	}
+	encoded.OrderingKey = msg.OrderingKey
+	return encoded, nil
+}
+
+type cloudEventContextKey struct{}
+
+// CloudEventFrom returns the CloudEvent decoded from the message being
+// handled, for subscriptions with cloudevents enabled.
+func CloudEventFrom(ctx context.Context) (*CloudEvent, bool) {
+	event, ok := ctx.Value(cloudEventContextKey{}).(*CloudEvent)
+	return event, ok
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"gopkg.in/yaml.v3"
+)
+
+type TopicConfig struct {
+	// Name is the name callers use on the HTTP API.
+	Name string `yaml:"name"`
+	// Id is the Pub/Sub topic ID. Defaults to Name.
+	Id string `yaml:"id"`
+	// OrderingKey is a top-level field name (e.g. "user_id") or a JSONPath
+	// (e.g. "$.user.id") evaluated against JSON payloads to derive the
+	// message ordering key.
+	OrderingKey string `yaml:"ordering_key"`
+	// Profile names a publish profile, built in (low-latency,
+	// high-throughput or bulk) or from publish_profiles, that fills in the
+	// publish, flow_control and isolation settings the topic doesn't set.
+	Profile string `yaml:"profile"`
+	// Publish tunes the publisher's batching, compression and timeout.
+	Publish PublishSettingsConfig `yaml:"publish"`
+
+	AdaptiveBatching *AdaptiveBatchingConfig `yaml:"adaptive_batching"`
+	// Transforms rewrite messages published through the HTTP API, in order,
+	// before the ordering key is derived.
+	Transforms []TransformStep `yaml:"transforms"`
+	// MessageTransforms are server-side JavaScript UDFs that Pub/Sub runs
+	// on every message published to the topic. They're applied with the
+	// sync-transforms command.
+	MessageTransforms []MessageTransformConfig `yaml:"message_transforms"`
+	// Failover publishes to a secondary topic while the primary is failing.
+	Failover *FailoverConfig `yaml:"failover"`
+	// CloudEvents publishes every message to the topic as a CloudEvent.
+	CloudEvents *CloudEventsConfig `yaml:"cloudevents"`
+	// AttributePolicy applies on top of the top-level attribute_policy.
+	AttributePolicy *AttributePolicy `yaml:"attribute_policy"`
+	// SensitiveAttributes maps the names of attributes holding PII to
+	// encrypt, which our subscribers decrypt before their handlers see
+	// them, or hash, which can't be reversed but can still be matched on.
+	// Either needs attribute_encryption's key.
+	SensitiveAttributes map[string]string `yaml:"sensitive_attributes"`
+	// FlowControl and CircuitBreaker reject publishes with 503 and
+	// Retry-After while the topic can't keep up or keeps failing.
+	FlowControl    *FlowControlConfig    `yaml:"flow_control"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// Hedge sends a publish a second time once it's slower than usual.
+	Hedge *HedgeConfig `yaml:"hedge"`
+	// Isolation bounds the publishes and goroutines the topic can use, so
+	// it can't starve the others.
+	Isolation IsolationConfig `yaml:"isolation"`
+	// DebugSample mirrors a sample of the messages published to a debug
+	// topic.
+	DebugSample *DebugSampleConfig `yaml:"debug_sample"`
+	// Priority publishes messages in high, normal and bulk lanes, so
+	// transactional traffic isn't stuck behind bulk traffic.
+	Priority *PriorityConfig `yaml:"priority"`
+	// AutoCreate recreates the topic, with default settings, if it's
+	// deleted while the service runs. Subscriptions of the deleted topic
+	// stay detached from the new one.
+	AutoCreate bool `yaml:"auto_create"`
+}
+
+type AdaptiveBatchingConfig struct {
+	MinDelay time.Duration `yaml:"min_delay"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+	MinCount int           `yaml:"min_count"`
+	MaxCount int           `yaml:"max_count"`
+	// BurstRate is the publish rate, in messages per second, at which the
+	// maximum delay applies.
+	BurstRate float64 `yaml:"burst_rate"`
+	// LatencyTarget halves the delay whenever the mean publish latency of an
+	// interval exceeds it.
+	LatencyTarget time.Duration `yaml:"latency_target"`
+	Interval      time.Duration `yaml:"interval"`
+}
+
+type QuarantineConfig struct {
+	// Topic is the Pub/Sub topic ID quarantined messages are published to.
+	Topic string `yaml:"topic"`
+	// Subscription is a subscription on Topic used by the admin API to list
+	// and requeue quarantined messages.
+	Subscription string `yaml:"subscription"`
+	MaxAttempts  int    `yaml:"max_attempts"`
+}
+
+type SubscriptionConfig struct {
+	Name string `yaml:"name"`
+	// Id is the Pub/Sub subscription ID. Defaults to Name.
+	Id string `yaml:"id"`
+	// Topic is the Pub/Sub topic ID the subscription is attached to.
+	Topic   string `yaml:"topic"`
+	Handler string `yaml:"handler"`
+	// Ordered must match the subscription's message ordering setting. It
+	// routes messages through a KeyedDispatcher so busy ordering keys don't
+	// starve the others.
+	Ordered bool `yaml:"ordered"`
+	// CloudEvents decodes each message as a CloudEvent before handling,
+	// failing messages that aren't. Handlers get it from CloudEventFrom.
+	CloudEvents            bool `yaml:"cloudevents"`
+	MaxOutstandingMessages int  `yaml:"max_outstanding_messages"`
+	MaxConcurrentKeys      int  `yaml:"max_concurrent_keys"`
+	MaxQueuedPerKey        int  `yaml:"max_queued_per_key"`
+
+	// Timeout bounds how long the handler may run for a single message.
+	// Zero means no limit beyond the subscription's max extension.
+	Timeout time.Duration `yaml:"timeout"`
+	// TimeoutPolicy is nack (the default), which cancels the handler's
+	// context and nacks as soon as Timeout elapses, or extend, which keeps
+	// the lease for a further TimeoutExtension before doing the same.
+	TimeoutPolicy    string        `yaml:"timeout_policy"`
+	TimeoutExtension time.Duration `yaml:"timeout_extension"`
+
+	// MaxBacklog and MaxBacklogAge gate /readyz on the subscription's
+	// undelivered message count and oldest unacked message age.
+	MaxBacklog    int64         `yaml:"max_backlog"`
+	MaxBacklogAge time.Duration `yaml:"max_backlog_age"`
+
+	// Priority is the lane the subscription consumes, high, normal or bulk,
+	// of a topic whose lanes share it. It's created with a filter on the
+	// lane, so each lane is consumed with its own concurrency.
+	Priority string `yaml:"priority"`
+
+	// MessageTransforms run server side on messages before delivery.
+	MessageTransforms []MessageTransformConfig `yaml:"message_transforms"`
+
+	// DeadLetter is the subscription's own Pub/Sub dead letter policy,
+	// which the drift reconciler reattaches if it's removed.
+	DeadLetter *DeadLetter `yaml:"dead_letter"`
+	// RetryPolicy is how long Pub/Sub waits before redelivering a nacked
+	// message. It's set when the subscription is provisioned and checked
+	// for drift at startup and by the reconciler.
+	RetryPolicy *RetryPolicy `yaml:"retry_policy"`
+
+	Quarantine *QuarantineConfig `yaml:"quarantine"`
+	Retry      *RetryConfig      `yaml:"retry"`
+	// Backoff stops receiving while the handler's error rate is too high.
+	Backoff *BackoffConfig `yaml:"backoff"`
+	Batch   *BatchConfig   `yaml:"batch"`
+	// Stall restarts the receive stream if it stops delivering while the
+	// subscription has a backlog.
+	Stall *StallConfig `yaml:"stall"`
+	// Webhook delivers each message to an HTTP endpoint, in place of a
+	// handler.
+	Webhook *WebhookConfig `yaml:"webhook"`
+	// ExpiredTopic is the topic ID messages past their expires_at are
+	// published to instead of being dropped, e.g. to audit OTP emails that
+	// were never sent. Expired messages are never handled either way.
+	ExpiredTopic string `yaml:"expired_topic"`
+}
+
+type HTTPConfig struct {
+	// SwaggerUI serves an interactive API explorer at /docs.
+	SwaggerUI bool `yaml:"swagger_ui"`
+	// Debug serves expvar, pprof, the loaded config and connectivity
+	// checks under /debug. With API keys configured, they need the
+	// admin:debug scope.
+	Debug bool `yaml:"debug"`
+	// AdminPort serves the admin API, /debug and /metrics on, instead of
+	// alongside the public API on 8080, e.g. for a sidecar or an internal
+	// load balancer to reach while Cloud Run only exposes 8080. Health
+	// checks are served on both. Zero, the default, serves everything on
+	// 8080.
+	AdminPort int `yaml:"admin_port"`
+}
+
+type StoreConfig struct {
+	// Backend is memory (the default), redis or firestore.
+	Backend string `yaml:"backend"`
+	// Prefix is prepended to every key.
+	Prefix string `yaml:"prefix"`
+	Redis  struct {
+		Address string `yaml:"address"`
+		// Password defaults to the REDIS_PASSWORD environment variable.
+		Password string `yaml:"password"`
+		DB       int    `yaml:"db"`
+		TLS      bool   `yaml:"tls"`
+	} `yaml:"redis"`
+	Firestore struct {
+		// Project defaults to PROJECT_ID.
+		Project    string `yaml:"project"`
+		Database   string `yaml:"database"`
+		Collection string `yaml:"collection"`
+	} `yaml:"firestore"`
+}
+
+type Config struct {
+	Environment EnvironmentConfig `yaml:"environment"`
+	HTTP        HTTPConfig        `yaml:"http"`
+	GRPC        GRPCConfig        `yaml:"grpc"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Firewall    FirewallConfig    `yaml:"firewall"`
+	Logging     LoggingConfig     `yaml:"logging"`
+	Health      HealthConfig      `yaml:"health"`
+	Readiness   ReadinessConfig   `yaml:"readiness"`
+	Drift       DriftConfig       `yaml:"drift"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	Runtime     RuntimeConfig     `yaml:"runtime"`
+	Store       StoreConfig       `yaml:"store"`
+	Templates   TemplatesConfig   `yaml:"templates"`
+	Suppression SuppressionConfig `yaml:"suppression"`
+	Campaigns   CampaignsConfig   `yaml:"campaigns"`
+	Failures    FailuresConfig    `yaml:"failures"`
+	Shutdown    ShutdownConfig    `yaml:"shutdown"`
+	Recent      RecentConfig      `yaml:"recent"`
+	Identity    IdentityConfig    `yaml:"identity"`
+	// AttributeEncryption holds the key for topics' sensitive attributes.
+	AttributeEncryption AttributeEncryptionConfig `yaml:"attribute_encryption"`
+	Dedup               DedupConfig               `yaml:"dedup"`
+	Lineage             LineageConfig             `yaml:"lineage"`
+	Quotas              QuotaConfig               `yaml:"quotas"`
+	Canary              CanaryConfig              `yaml:"canary"`
+	RetryBudget         RetryBudgetConfig         `yaml:"retry_budget"`
+	Audit               AuditConfig               `yaml:"audit"`
+	Reports             ReportsConfig             `yaml:"reports"`
+	Routing             RoutingConfig             `yaml:"routing"`
+	Callbacks           CallbacksConfig           `yaml:"callbacks"`
+	// TLS serves HTTP and gRPC over TLS, or mutual TLS.
+	TLS TLSConfig `yaml:"tls"`
+	// PublishGroups tunes publishing groups of messages all or none.
+	PublishGroups PublishGroupConfig `yaml:"publish_groups"`
+	Eventarc      EventarcConfig     `yaml:"eventarc"`
+	Events        []EventConfig      `yaml:"events"`
+	// PublishProfiles are named bundles of publish settings topics can
+	// use by profile, adding to or replacing the built-in ones.
+	PublishProfiles map[string]PublishProfileConfig `yaml:"publish_profiles"`
+	// ReadOnly starts the service in read-only mode, which the admin
+	// toggle can't turn off.
+	ReadOnly bool `yaml:"read_only"`
+	// AttributePolicy restricts the attributes callers can publish to
+	// every topic.
+	AttributePolicy *AttributePolicy     `yaml:"attribute_policy"`
+	Topics          []TopicConfig        `yaml:"topics"`
+	Subscriptions   []SubscriptionConfig `yaml:"subscriptions"`
+	// PushSubscriptions are subscriptions that push to other services,
+	// which provisioning creates but this service doesn't receive from.
+	PushSubscriptions []PushSubscriptionConfig `yaml:"push_subscriptions"`
+}
+
+func newConfig(logger *log.Logger) func() (Config, error) {
+	return func() (Config, error) {
+		var config Config
+		path := envOrDefault("CONFIG_PATH", "config.yaml")
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Carry on with no config, so it still gets its defaults.
+			logger.Printf("No config file at %s, using defaults", path)
+			data = nil
+		} else if err != nil {
+			return config, err
+		}
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		switch config.Readiness.Mode {
+		case "":
+			config.Readiness.Mode = readinessModeUnready
+		case readinessModeUnready, readinessModeDegraded:
+		default:
+			return config, fmt.Errorf("readiness: unknown mode %q", config.Readiness.Mode)
+		}
+		if config.Readiness.Interval == 0 {
+			config.Readiness.Interval = time.Minute
+		}
+		if mode := config.Identity.Mode; mode != "" {
+			if _, ok := identityPropagators[mode]; !ok {
+				return config, fmt.Errorf("identity: unknown mode %q", mode)
+			}
+		}
+		if config.Identity.TokenTTL == 0 {
+			config.Identity.TokenTTL = defaultIdentityTokenTTL
+		}
+		config.Lineage.validate()
+		if err := config.Dedup.validate(); err != nil {
+			return config, fmt.Errorf("dedup: %w", err)
+		}
+		if err := config.PublishGroups.validate(); err != nil {
+			return config, fmt.Errorf("publish_groups: %w", err)
+		}
+		if err := config.Metrics.validate(); err != nil {
+			return config, fmt.Errorf("metrics: %w", err)
+		}
+		if err := config.Canary.validate(); err != nil {
+			return config, fmt.Errorf("canary: %w", err)
+		}
+		if err := config.Callbacks.validate(); err != nil {
+			return config, fmt.Errorf("callbacks: %w", err)
+		}
+		if err := config.RetryBudget.validate(); err != nil {
+			return config, fmt.Errorf("retry_budget: %w", err)
+		}
+		if err := config.Audit.validate(); err != nil {
+			return config, fmt.Errorf("audit: %w", err)
+		}
+		if err := config.TLS.validate(); err != nil {
+			return config, fmt.Errorf("tls: %w", err)
+		}
+		if config.Suppression.Refresh == 0 {
+			config.Suppression.Refresh = defaultSuppressionRefresh
+		} else if config.Suppression.Refresh < 0 {
+			return config, fmt.Errorf("suppression: refresh can't be negative")
+		}
+		if config.GRPC.Port < 0 || config.GRPC.Port > 65535 || config.GRPC.Port == 8080 {
+			return config, fmt.Errorf("grpc: port must be a TCP port other than HTTP's 8080")
+		}
+		if config.HTTP.AdminPort < 0 || config.HTTP.AdminPort > 65535 || config.HTTP.AdminPort == 8080 {
+			return config, fmt.Errorf("http: admin_port must be a TCP port other than 8080")
+		}
+		if config.HTTP.AdminPort != 0 && config.HTTP.AdminPort == config.GRPC.Port {
+			return config, fmt.Errorf("http: admin_port can't be gRPC's port")
+		}
+		if config.Recent.Size == 0 {
+			config.Recent.Size = defaultRecentSize
+		}
+		if config.Shutdown.Timeout == 0 {
+			config.Shutdown.Timeout = defaultShutdownTimeout
+		}
+		if config.Failures.Retention == 0 {
+			config.Failures.Retention = 30 * 24 * time.Hour
+		}
+		if config.Campaigns.Interval == 0 {
+			config.Campaigns.Interval = 10 * time.Second
+		}
+		if config.Campaigns.MaxRate == 0 {
+			config.Campaigns.MaxRate = 100
+		} else if config.Campaigns.MaxRate < 0 || config.Campaigns.Interval < 0 {
+			return config, fmt.Errorf("campaigns: interval and max_rate can't be negative")
+		}
+		if err := config.Drift.validate(); err != nil {
+			return config, fmt.Errorf("drift: %w", err)
+		}
+		for _, key := range config.Auth.Keys {
+			if err := key.validate(); err != nil {
+				return config, fmt.Errorf("auth: %w", err)
+			}
+		}
+		if err := config.Quotas.Default.validate(); err != nil {
+			return config, fmt.Errorf("quotas: default: %w", err)
+		}
+		if err := config.Firewall.validate(); err != nil {
+			return config, fmt.Errorf("firewall: %w", err)
+		}
+		if config.Runtime.MaxProcs < 0 || config.Runtime.MemoryLimit < 0 {
+			return config, fmt.Errorf("runtime: max_procs and memory_limit can't be negative")
+		}
+		if config.Runtime.MemoryLimitRatio < 0 || config.Runtime.MemoryLimitRatio > 1 {
+			return config, fmt.Errorf("runtime: memory_limit_ratio must be between 0 and 1")
+		}
+		if config.Logging.SampleRate == 0 {
+			config.Logging.SampleRate = defaultMessageLogSampleRate
+		} else if config.Logging.SampleRate > 1 {
+			return config, fmt.Errorf("logging: sample_rate must be at most 1")
+		}
+		if config.Logging.Level == "" {
+			config.Logging.Level = logLevelInfo
+		}
+		if err := validLogLevel(config.Logging.Level); err != nil {
+			return config, fmt.Errorf("logging: %w", err)
+		}
+		for component, level := range config.Logging.Levels {
+			if err := validLogLevel(level); err != nil {
+				return config, fmt.Errorf("logging: %s: %w", component, err)
+			}
+		}
+		profiles := publishProfiles(config)
+		for i := range config.Topics {
+			topic := &config.Topics[i]
+			if topic.Name == "" {
+				return config, fmt.Errorf("topic %d in %s has no name", i, path)
+			}
+			if topic.Id == "" {
+				topic.Id = topic.Name
+			}
+			if topic.AdaptiveBatching != nil && (topic.Publish.DelayThreshold > 0 || topic.Publish.CountThreshold > 0) {
+				return config, fmt.Errorf("topic %s: adaptive_batching tunes the delay and count thresholds itself", topic.Name)
+			}
+			if topic.Profile != "" {
+				if err := topic.applyProfile(profiles); err != nil {
+					return config, fmt.Errorf("topic %s: %w", topic.Name, err)
+				}
+			}
+			if err := topic.Publish.validate(); err != nil {
+				return config, fmt.Errorf("topic %s: publish: %w", topic.Name, err)
+			}
+			if topic.OrderingKey != "" {
+				if _, err := parseJSONPath(topic.OrderingKey); err != nil {
+					return config, fmt.Errorf("topic %s: ordering_key: %w", topic.Name, err)
+				}
+			}
+			if topic.Isolation.MaxConcurrentPublishes == 0 {
+				topic.Isolation.MaxConcurrentPublishes = defaultMaxConcurrentPublishes
+			} else if topic.Isolation.MaxConcurrentPublishes < 0 || topic.Isolation.Goroutines < 0 {
+				return config, fmt.Errorf("topic %s: isolation limits can't be negative", topic.Name)
+			}
+			if adaptive := topic.AdaptiveBatching; adaptive != nil {
+				if topic.OrderingKey != "" {
+					// Swapping handles could reorder messages still buffered
+					// in the previous handle.
+					return config, fmt.Errorf("topic %s: adaptive_batching can't be combined with ordering_key", topic.Name)
+				}
+				if adaptive.MaxDelay == 0 {
+					adaptive.MaxDelay = 50 * time.Millisecond
+				}
+				if adaptive.MinCount == 0 {
+					adaptive.MinCount = 1
+				}
+				if adaptive.MaxCount == 0 {
+					adaptive.MaxCount = pubsub.DefaultPublishSettings.CountThreshold
+				}
+				if adaptive.BurstRate == 0 {
+					adaptive.BurstRate = 1000
+				}
+				if adaptive.Interval == 0 {
+					adaptive.Interval = 10 * time.Second
+				}
+				if adaptive.MinDelay > adaptive.MaxDelay || adaptive.MinCount > adaptive.MaxCount {
+					return config, fmt.Errorf("topic %s: adaptive_batching minimums exceed maximums", topic.Name)
+				}
+			}
+			if _, err := compileTransforms(topic.Transforms); err != nil {
+				return config, fmt.Errorf("topic %s: %w", topic.Name, err)
+			}
+			if _, err := messageTransforms(topic.MessageTransforms); err != nil {
+				return config, fmt.Errorf("topic %s: %w", topic.Name, err)
+			}
+			if _, err := compileAttributePolicies(config.AttributePolicy, topic.AttributePolicy); err != nil {
+				return config, fmt.Errorf("topic %s: %w", topic.Name, err)
+			}
+			if err := validSensitiveAttributes(topic.SensitiveAttributes); err != nil {
+				return config, fmt.Errorf("topic %s: %w", topic.Name, err)
+			}
+			if failover := topic.Failover; failover != nil {
+				if failover.Topic == "" {
+					failover.Topic = topic.Id
+				}
+				if failover.Project == "" {
+					failover.Project = os.Getenv("PROJECT_ID")
+				}
+				if failover.ErrorThreshold == 0 {
+					failover.ErrorThreshold = 5
+				}
+				if failover.ProbeInterval == 0 {
+					failover.ProbeInterval = 30 * time.Second
+				}
+				if failover.HealthyProbes == 0 {
+					failover.HealthyProbes = 3
+				}
+				if failover.Topic == topic.Id && failover.Project == os.Getenv("PROJECT_ID") && failover.Endpoint == "" {
+					return config, fmt.Errorf("topic %s: failover must name a different topic, project or endpoint", topic.Name)
+				}
+			}
+			if sample := topic.DebugSample; sample != nil {
+				if sample.Topic == "" || sample.Topic == topic.Id || sample.Rate <= 0 || sample.Rate > 1 {
+					return config, fmt.Errorf("topic %s: debug_sample needs a topic of its own and a rate above 0 and up to 1", topic.Name)
+				}
+			}
+			if priority := topic.Priority; priority != nil {
+				if err := priority.validate(); err != nil {
+					return config, fmt.Errorf("topic %s: priority: %w", topic.Name, err)
+				}
+			}
+			if flowControl := topic.FlowControl; flowControl != nil {
+				if flowControl.MaxOutstandingMessages <= 0 && flowControl.MaxOutstandingBytes <= 0 {
+					return config, fmt.Errorf("topic %s: flow_control needs max_outstanding_messages or max_outstanding_bytes", topic.Name)
+				}
+				if flowControl.RetryAfter == 0 {
+					flowControl.RetryAfter = time.Second
+				}
+				switch flowControl.Shedding {
+				case "":
+					flowControl.Shedding = sheddingReject
+				case sheddingReject, sheddingBlock:
+				case sheddingSpill:
+					if topic.OrderingKey != "" {
+						return config, fmt.Errorf("topic %s: flow_control can't spill messages with ordering keys", topic.Name)
+					}
+				default:
+					return config, fmt.Errorf("topic %s: flow_control: unknown shedding %q", topic.Name, flowControl.Shedding)
+				}
+				if flowControl.OutboxTTL == 0 {
+					flowControl.OutboxTTL = defaultOutboxTTL
+				}
+			}
+			if breaker := topic.CircuitBreaker; breaker != nil {
+				if breaker.FailureThreshold == 0 {
+					breaker.FailureThreshold = 5
+				}
+				if breaker.Cooldown == 0 {
+					breaker.Cooldown = 30 * time.Second
+				}
+			}
+			if hedge := topic.Hedge; hedge != nil {
+				if err := hedge.validate(); err != nil {
+					return config, fmt.Errorf("topic %s: hedge: %w", topic.Name, err)
+				}
+			}
+			if cloudEvents := topic.CloudEvents; cloudEvents != nil {
+				switch cloudEvents.Mode {
+				case "":
+					cloudEvents.Mode = cloudEventsModeBinary
+				case cloudEventsModeBinary, cloudEventsModeStructured:
+				default:
+					return config, fmt.Errorf("topic %s: unknown cloudevents mode %q", topic.Name, cloudEvents.Mode)
+				}
+			}
+		}
+		for i := range config.Subscriptions {
+			subscription := &config.Subscriptions[i]
+			if subscription.Name == "" {
+				return config, fmt.Errorf("subscription %d in %s has no name", i, path)
+			}
+			if subscription.Id == "" {
+				subscription.Id = subscription.Name
+			}
+			if subscription.MaxConcurrentKeys < 0 || subscription.MaxQueuedPerKey < 0 {
+				return config, fmt.Errorf("subscription %s: max_concurrent_keys and max_queued_per_key can't be negative", subscription.Name)
+			}
+			if subscription.MaxConcurrentKeys == 0 {
+				subscription.MaxConcurrentKeys = 10
+			}
+			if subscription.MaxQueuedPerKey == 0 {
+				subscription.MaxQueuedPerKey = 100
+			}
+			if _, err := messageTransforms(subscription.MessageTransforms); err != nil {
+				return config, fmt.Errorf("subscription %s: %w", subscription.Name, err)
+			}
+			switch subscription.TimeoutPolicy {
+			case "":
+				subscription.TimeoutPolicy = timeoutPolicyNack
+			case timeoutPolicyNack, timeoutPolicyExtend:
+			default:
+				return config, fmt.Errorf("subscription %s: unknown timeout_policy %q", subscription.Name, subscription.TimeoutPolicy)
+			}
+			if subscription.TimeoutPolicy == timeoutPolicyExtend {
+				if subscription.Timeout == 0 {
+					return config, fmt.Errorf("subscription %s: timeout_policy extend needs a timeout", subscription.Name)
+				}
+				if subscription.TimeoutExtension == 0 {
+					subscription.TimeoutExtension = subscription.Timeout
+				}
+			}
+			if quarantine := subscription.Quarantine; quarantine != nil {
+				if quarantine.Topic == "" || quarantine.Subscription == "" || subscription.Topic == "" {
+					return config, fmt.Errorf("subscription %s: quarantine needs topic, subscription and the subscription's topic", subscription.Name)
+				}
+				if quarantine.MaxAttempts == 0 {
+					quarantine.MaxAttempts = defaultQuarantineMaxAttempt
+				}
+			}
+			if deadLetter := subscription.DeadLetter; deadLetter != nil {
+				if deadLetter.Topic == "" || deadLetter.MaxDeliveryAttempts < 5 || deadLetter.MaxDeliveryAttempts > 100 {
+					return config, fmt.Errorf("subscription %s: dead_letter needs a topic and max_delivery_attempts between 5 and 100", subscription.Name)
+				}
+			}
+			if subscription.Priority != "" {
+				if err := validateSubscriptionPriority(config, *subscription); err != nil {
+					return config, fmt.Errorf("subscription %s: %w", subscription.Name, err)
+				}
+			}
+			if policy := subscription.RetryPolicy; policy != nil {
+				if err := policy.validate(); err != nil {
+					return config, fmt.Errorf("subscription %s: %w", subscription.Name, err)
+				}
+			}
+			if backoff := subscription.Backoff; backoff != nil {
+				if backoff.ErrorRate == 0 {
+					backoff.ErrorRate = 0.5
+				}
+				if backoff.Window == 0 {
+					backoff.Window = time.Minute
+				}
+				if backoff.MinMessages == 0 {
+					backoff.MinMessages = 10
+				}
+				if backoff.InitialPause == 0 {
+					backoff.InitialPause = 10 * time.Second
+				}
+				if backoff.MaxPause == 0 {
+					backoff.MaxPause = 10 * time.Minute
+				}
+				if backoff.ErrorRate > 1 || backoff.InitialPause > backoff.MaxPause {
+					return config, fmt.Errorf("subscription %s: backoff error_rate must be at most 1 and initial_pause at most max_pause", subscription.Name)
+				}
+			}
+			if stall := subscription.Stall; stall != nil {
+				if stall.After == 0 {
+					stall.After = 5 * time.Minute
+				}
+				if stall.After < 0 {
+					return config, fmt.Errorf("subscription %s: stall after can't be negative", subscription.Name)
+				}
+			}
+			if webhook := subscription.Webhook; webhook != nil {
+				if subscription.Batch != nil || (subscription.Handler != "" && subscription.Handler != webhookHandler) {
+					return config, fmt.Errorf("subscription %s: webhook can't be combined with batch or another handler", subscription.Name)
+				}
+				subscription.Handler = webhookHandler
+				if err := webhook.validate(); err != nil {
+					return config, fmt.Errorf("subscription %s: %w", subscription.Name, err)
+				}
+			}
+			if batch := subscription.Batch; batch != nil {
+				if subscription.Ordered || subscription.CloudEvents {
+					return config, fmt.Errorf("subscription %s: batch can't be combined with ordering or cloudevents", subscription.Name)
+				}
+				if batch.MaxMessages == 0 {
+					batch.MaxMessages = 100
+				}
+				if batch.MaxDelay == 0 {
+					batch.MaxDelay = time.Second
+				}
+				maxOutstanding := subscription.MaxOutstandingMessages
+				if maxOutstanding == 0 {
+					maxOutstanding = pubsub.DefaultReceiveSettings.MaxOutstandingMessages
+				}
+				if batch.MaxMessages < 0 || batch.MaxDelay < 0 || (maxOutstanding > 0 && batch.MaxMessages > maxOutstanding) {
+					return config, fmt.Errorf("subscription %s: batch max_messages must be positive and at most max_outstanding_messages", subscription.Name)
+				}
+			}
+			if retry := subscription.Retry; retry != nil {
+				if subscription.Topic == "" || subscription.Quarantine != nil || subscription.Ordered {
+					return config, fmt.Errorf("subscription %s: retry needs the subscription's topic and can't be combined with quarantine or ordering", subscription.Name)
+				}
+				if len(retry.Delays) == 0 {
+					retry.Delays = defaultRetryDelays
+				}
+				for _, delay := range retry.Delays {
+					if delay <= 0 {
+						return config, fmt.Errorf("subscription %s: retry delays must be positive", subscription.Name)
+					}
+				}
+				if retry.DeadLetterTopic == "" {
+					retry.DeadLetterTopic = subscription.Topic + ".dlq"
+				}
+				if retry.DeadLetterSubscription == "" {
+					retry.DeadLetterSubscription = subscription.Id + ".dlq"
+				}
+			}
+		}
+		subscriptionIds := make(map[string]bool, len(config.Subscriptions))
+		for _, subscription := range config.Subscriptions {
+			subscriptionIds[subscription.Id] = true
+		}
+		for i, push := range config.PushSubscriptions {
+			if err := push.validate(); err != nil {
+				return config, fmt.Errorf("push subscription %d in %s: %w", i, path, err)
+			}
+			if subscriptionIds[push.Id] {
+				return config, fmt.Errorf("push subscription %s is declared twice", push.Id)
+			}
+			subscriptionIds[push.Id] = true
+			if deadLetter := push.DeadLetter; deadLetter != nil {
+				if deadLetter.Topic == "" || deadLetter.MaxDeliveryAttempts < 5 || deadLetter.MaxDeliveryAttempts > 100 {
+					return config, fmt.Errorf("push subscription %s: dead_letter needs a topic and max_delivery_attempts between 5 and 100", push.Id)
+				}
+			}
+			if policy := push.RetryPolicy; policy != nil {
+				if err := policy.validate(); err != nil {
+					return config, fmt.Errorf("push subscription %s: %w", push.Id, err)
+				}
+			}
+		}
+		topics := make(map[string]bool, len(config.Topics))
+		for _, topic := range config.Topics {
+			topics[topic.Name] = true
+		}
+		for i, route := range config.Eventarc.Routes {
+			if route.Type == "" || !topics[route.Topic] {
+				return config, fmt.Errorf("eventarc route %d needs a type and a configured topic", i)
+			}
+			if err := route.validatePatterns(); err != nil {
+				return config, fmt.Errorf("eventarc route %d: %w", i, err)
+			}
+		}
+		for i, event := range config.Events {
+			if event.Type == "" {
+				return config, fmt.Errorf("event %d in %s has no type", i, path)
+			}
+			for _, topic := range event.Topics {
+				if !topics[topic] {
+					return config, fmt.Errorf("event %s: topic %s isn't configured", event.Type, topic)
+				}
+			}
+		}
+		if err := (&RoutingTable{Aliases: config.Routing.Aliases, Splits: config.Routing.Splits}).validate(topics); err != nil {
+			return config, fmt.Errorf("routing: %w", err)
+		}
+		if err := config.Reports.validate(topics); err != nil {
+			return config, fmt.Errorf("reports: %w", err)
+		}
+		if deep := config.Health.Deep; deep != nil {
+			if err := deep.validate(topics); err != nil {
+				return config, fmt.Errorf("health: deep: %w", err)
+			}
+		}
+		if err := applyEnvironment(&config); err != nil {
+			return config, err
+		}
+		return config, nil
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/boxes-ltd/gcp-pubsub-test/client/contracttest"
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+	"go.uber.org/fx"
+)
+
+// goldenMessages generates the golden messages consumers' contract tests
+// decode for each event in the catalog: its registered sample, and payloads
+// with only the required and with every field of its schema. Events with
+// neither a sample nor a schema get none.
+func goldenMessages(events []catalogEvent) ([]contracttest.Golden, error) {
+	var goldens []contracttest.Golden
+	for _, event := range events {
+		attributes := map[string]string{
+			emailevents.AttributeEventType:   event.Type,
+			emailevents.AttributeContentType: mediaTypeJSON,
+		}
+		if event.Version != "" {
+			attributes[emailevents.AttributeSchemaVersion] = event.Version
+		}
+		add := func(variant string, data json.RawMessage) {
+			goldens = append(goldens, contracttest.Golden{Type: event.Type, Version: event.Version, Variant: variant, Attributes: attributes, Data: data})
+		}
+		if event.Sample != nil {
+			add(contracttest.VariantSample, event.Sample)
+		}
+		if event.Schema == nil {
+			continue
+		}
+		var schema map[string]interface{}
+		if err := json.Unmarshal(event.Schema, &schema); err != nil {
+			return nil, fmt.Errorf("event %s: schema: %w", event.Type, err)
+		}
+		minimal, err := json.Marshal(sampleFromSchema(schema, false))
+		if err != nil {
+			return nil, fmt.Errorf("event %s: %w", event.Type, err)
+		}
+		add(contracttest.VariantMinimal, minimal)
+		full, err := json.Marshal(sampleFromSchema(schema, true))
+		if err != nil {
+			return nil, fmt.Errorf("event %s: %w", event.Type, err)
+		}
+		// A schema without optional fields would give the same message twice.
+		if !bytes.Equal(full, minimal) {
+			add(contracttest.VariantFull, full)
+		}
+	}
+	return goldens, nil
+}
+
+// sampleFromSchema generates a value that's valid against a JSON Schema,
+// with every property of objects if full, or only the required ones. It
+// prefers the schema's own examples, default, const or enum, and takes the
+// first alternative of anyOf and oneOf; $ref isn't resolved.
+func sampleFromSchema(schema map[string]interface{}, full bool) interface{} {
+	if examples, ok := schema["examples"].([]interface{}); ok && len(examples) > 0 {
+		return examples[0]
+	}
+	for _, keyword := range []string{"default", "const"} {
+		if value, ok := schema[keyword]; ok {
+			return value
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+		return enum[0]
+	}
+	for _, keyword := range []string{"anyOf", "oneOf", "allOf"} {
+		if alternatives, ok := schema[keyword].([]interface{}); ok && len(alternatives) > 0 {
+			if alternative, ok := alternatives[0].(map[string]interface{}); ok {
+				return sampleFromSchema(alternative, full)
+			}
+		}
+	}
+
+	schemaType, _ := schema["type"].(string)
+	if types, ok := schema["type"].([]interface{}); ok {
+		for _, t := range types {
+			if t, _ := t.(string); t != "null" {
+				schemaType = t
+				break
+			}
+		}
+	}
+	if schemaType == "" {
+		if _, ok := schema["properties"]; ok {
+			schemaType = "object"
+		}
+	}
+	switch schemaType {
+	case "object":
+		object := make(map[string]interface{})
+		properties, _ := schema["properties"].(map[string]interface{})
+		required := make(map[string]bool)
+		if names, ok := schema["required"].([]interface{}); ok {
+			for _, name := range names {
+				if name, ok := name.(string); ok {
+					required[name] = true
+				}
+			}
+		}
+		for name, property := range properties {
+			property, ok := property.(map[string]interface{})
+			if ok && (full || required[name]) {
+				object[name] = sampleFromSchema(property, full)
+			}
+		}
+		if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok && full && len(properties) == 0 {
+			object["key"] = sampleFromSchema(additional, full)
+		}
+		return object
+	case "array":
+		array := []interface{}{}
+		minItems, _ := schema["minItems"].(float64)
+		if items, ok := schema["items"].(map[string]interface{}); ok && (full || minItems > 0) {
+			array = append(array, sampleFromSchema(items, full))
+		}
+		return array
+	case "string":
+		switch schema["format"] {
+		case "date-time":
+			return "2024-01-01T00:00:00Z"
+		case "date":
+			return "2024-01-01"
+		case "email":
+			return "user@example.com"
+		case "uri":
+			return "https://example.com"
+		case "uuid":
+			return "00000000-0000-0000-0000-000000000000"
+		case "byte":
+			return "c2FtcGxl"
+		}
+		return "sample"
+	case "integer", "number":
+		if minimum, ok := schema["minimum"].(float64); ok {
+			return minimum
+		}
+		return 0
+	case "boolean":
+		return false
+	}
+	return nil
+}
+
+func exportContracts(logger *log.Logger) fx.Option {
+	flags := flag.NewFlagSet("export-contracts", flag.ExitOnError)
+	output := flags.String("o", "contracts", "directory to write the golden messages to, replacing any already there")
+	flags.Parse(commandArgs)
+
+	return fx.Options(
+		fx.Provide(newConfig(logger), newCatalog),
+		fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, catalog *Catalog) {
+			runOnce(lifecycle, shutdowner, logger, func(context.Context) error {
+				goldens, err := goldenMessages(catalog.events)
+				if err != nil {
+					return err
+				}
+				if err := contracttest.Write(*output, goldens); err != nil {
+					return err
+				}
+				logger.Printf("Wrote %d golden messages for %d event types to %s", len(goldens), len(catalog.events), *output)
+				return nil
+			})
+		}),
+	)
+}
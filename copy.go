@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+)
+
+// copiedFromAttribute records the source message ID on each copy, so a
+// copy run that's interrupted and restarted can be reconciled.
+const copiedFromAttribute = "copied_from_message_id"
+
+// attributeFilters matches messages whose attributes satisfy every filter:
+// key=value requires the value, and a bare key only requires presence.
+type attributeFilters []string
+
+func (f *attributeFilters) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *attributeFilters) Set(value string) error {
+	if value == "" || strings.HasPrefix(value, "=") {
+		return fmt.Errorf("invalid attribute filter %q", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+func (f attributeFilters) match(attributes map[string]string) bool {
+	for _, filter := range f {
+		key, want, hasValue := strings.Cut(filter, "=")
+		value, ok := attributes[key]
+		if !ok || (hasValue && value != want) {
+			return false
+		}
+	}
+	return true
+}
+
+type copyResult struct {
+	Copied  int `json:"copied"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+type copyOptions struct {
+	from    string
+	to      string
+	filters attributeFilters
+	max     int
+	idle    time.Duration
+	dryRun  bool
+	lineage LineageConfig
+}
+
+// copyMessages pulls from the source subscription and publishes each
+// matching message to the destination topic, acking the source only once
+// the copy is published. Messages that don't match are nacked and left
+// where they are. It stops after max copies, or once no new message has
+// arrived for the idle period.
+func copyMessages(ctx context.Context, source *pubsub.Subscription, destination *pubsub.Topic, options copyOptions, logger *log.Logger) (copyResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		result   copyResult
+		seen     = make(map[string]bool)
+		lastSeen = time.Now()
+	)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				mu.Lock()
+				idle := time.Since(lastSeen) >= options.idle
+				mu.Unlock()
+				if idle {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	if options.max > 0 && options.max < source.ReceiveSettings.MaxOutstandingMessages {
+		source.ReceiveSettings.MaxOutstandingMessages = options.max
+	}
+	err := source.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		// Messages left on the source come back after being nacked; they're
+		// only counted once and don't count as activity.
+		if seen[msg.ID] {
+			mu.Unlock()
+			msg.Nack()
+			return
+		}
+		lastSeen = time.Now()
+		if !options.filters.match(msg.Attributes) {
+			seen[msg.ID] = true
+			result.Skipped++
+			mu.Unlock()
+			msg.Nack()
+			return
+		}
+		if options.max > 0 && result.Copied >= options.max {
+			mu.Unlock()
+			msg.Nack()
+			cancel()
+			return
+		}
+		// Reserve the slot so concurrent callbacks can't exceed max.
+		result.Copied++
+		if options.dryRun {
+			seen[msg.ID] = true
+			mu.Unlock()
+			msg.Nack()
+			return
+		}
+		mu.Unlock()
+
+		attributes := make(map[string]string, len(msg.Attributes)+4)
+		for key, value := range msg.Attributes {
+			attributes[key] = value
+		}
+		attributes[copiedFromAttribute] = msg.ID
+		if err := stampLineage(options.lineage, attributes, msg.ID); err != nil {
+			logger.Printf("Not copying message %s: %v", msg.ID, err)
+			mu.Lock()
+			defer mu.Unlock()
+			seen[msg.ID] = true
+			result.Copied--
+			result.Failed++
+			msg.Nack()
+			return
+		}
+		// Publishing isn't cancelled with the receive once max is reached,
+		// so a copy that was sent is always acked.
+		publishCtx := context.WithoutCancel(ctx)
+		_, err := destination.Publish(publishCtx, &pubsub.Message{Data: msg.Data, Attributes: attributes, OrderingKey: msg.OrderingKey}).Get(publishCtx)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			logger.Printf("Failed to copy message %s: %v", msg.ID, err)
+			seen[msg.ID] = true
+			result.Copied--
+			result.Failed++
+			if msg.OrderingKey != "" {
+				destination.ResumePublish(msg.OrderingKey)
+			}
+			msg.Nack()
+			return
+		}
+		msg.Ack()
+		if options.max > 0 && result.Copied >= options.max {
+			cancel()
+		}
+	})
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	return result, err
+}
+
+func copyCommand(logger *log.Logger) fx.Option {
+	flags := flag.NewFlagSet("copy", flag.ExitOnError)
+	var options copyOptions
+	flags.StringVar(&options.from, "from", "", "source subscription ID")
+	flags.StringVar(&options.to, "to", "", "destination topic ID")
+	toProject := flags.String("to-project", "", "project of the destination topic, defaulting to PROJECT_ID")
+	flags.Var(&options.filters, "attr", "only copy messages with this attribute, as key or key=value; repeatable")
+	flags.IntVar(&options.max, "max", 0, "stop after copying this many messages; 0 is no limit")
+	flags.DurationVar(&options.idle, "idle", 30*time.Second, "stop once no new message has arrived for this long")
+	flags.BoolVar(&options.dryRun, "dry-run", false, "count matching messages without publishing or acking them")
+	flags.Parse(commandArgs)
+	if options.from == "" || options.to == "" {
+		logger.Fatal("copy needs -from and -to")
+	}
+
+	return fx.Options(
+		fx.Provide(newPubSubParams(logger), newPubSubClient, newConfig(logger)),
+		fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, params PubSubParams, config Config, client *pubsub.Client) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				options.lineage = config.Lineage
+				destinationClient := client
+				if *toProject != "" && *toProject != params.Config.ProjectId {
+					var err error
+					destinationClient, err = pubsub.NewClient(ctx, *toProject, params.clientOptions()...)
+					if err != nil {
+						return fmt.Errorf("connecting to project %s: %w", *toProject, err)
+					}
+					defer destinationClient.Close()
+				}
+				destination := destinationClient.Topic(options.to)
+				destination.EnableMessageOrdering = true
+				defer destination.Stop()
+				exists, err := destination.Exists(ctx)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					return fmt.Errorf("topic %s does not exist", options.to)
+				}
+
+				logger.Printf("Copying from subscription %s to topic %s", options.from, destination)
+				result, err := copyMessages(ctx, client.Subscription(options.from), destination, options, logger)
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				encoder.Encode(result)
+				if err != nil {
+					return err
+				}
+				if result.Failed > 0 {
+					return fmt.Errorf("%d messages failed to copy and were left on %s", result.Failed, options.from)
+				}
+				return nil
+			})
+		}),
+	)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"gcp-pubsub-test/healthcheck"
+)
+
+const (
+	unavailableAuth = "auth_unhealthy"
+
+	// credentialsScope covers every Google API the service calls.
+	credentialsScope = "https://www.googleapis.com/auth/cloud-platform"
+	// credentialsStatInterval is how often the key file is checked for a
+	// rotation.
+	credentialsStatInterval = 10 * time.Second
+	// credentialsProbeInterval is how often a publish is let through to
+	// probe credentials that failed, and how soon callers are asked to
+	// retry meanwhile.
+	credentialsProbeInterval = 10 * time.Second
+)
+
+// Credentials authenticates every Google client the service creates, and
+// tracks whether authentication works. With GOOGLE_APPLICATION_CREDENTIALS
+// set, it supplies their tokens from the key file, reloading it when it's
+// rotated or when fetching a token fails, so a replaced key is picked up
+// without a restart. Otherwise the clients use application default
+// credentials as usual, and it only tracks their health.
+//
+// While authentication fails, publishes are rejected with 503 and reason
+// auth_unhealthy rather than each failing with Unauthenticated, with one
+// let through every 10s to probe, and the credentials health check reports
+// status auth_unhealthy.
+type Credentials struct {
+	logger *log.Logger
+
+	mu   sync.Mutex
+	path string
+	// source is nil until the key file has been loaded, from the file
+	// modified at modTime.
+	source  oauth2.TokenSource
+	modTime time.Time
+	statAt  time.Time
+	// failure is the last authentication error, nil while healthy.
+	failure error
+	probeAt time.Time
+}
+
+var googleCredentials = &Credentials{logger: newLogger("credentials")}
+
+// TokenSource returns the source of tokens from the key file at path, or
+// nil without one.
+func (c *Credentials) TokenSource(path string) oauth2.TokenSource {
+	if path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.path = path
+	return c
+}
+
+// Use switches the clients authenticating with the key file to the one at
+// path, from their next token, reporting whether there were any. Without a
+// key file, clients use application default credentials, which it can't
+// switch.
+func (c *Credentials) Use(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" {
+		return false
+	}
+	c.path, c.source = path, nil
+	return true
+}
+
+// Token returns a token from the key file, reloading it if it has changed,
+// or when fetching a token fails, in case it was rotated meanwhile.
+func (c *Credentials) Token() (*oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reloaded := false
+	if now := time.Now(); c.source == nil || now.Sub(c.statAt) >= credentialsStatInterval {
+		c.statAt = now
+		if info, err := os.Stat(c.path); c.source == nil || (err == nil && !info.ModTime().Equal(c.modTime)) {
+			if err := c.load(); err != nil {
+				c.fail(err)
+				return nil, err
+			}
+			reloaded = true
+		}
+	}
+	token, err := c.source.Token()
+	if err != nil && !reloaded {
+		if loadErr := c.load(); loadErr == nil {
+			token, err = c.source.Token()
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("fetching a token with %s: %w", c.path, err)
+		c.fail(err)
+		return nil, err
+	}
+	c.succeed()
+	return token, nil
+}
+
+// load reads the key file. Called with mu held.
+func (c *Credentials) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return fmt.Errorf("reading credentials: %w", err)
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("reading credentials: %w", err)
+	}
+	parsed, err := google.CredentialsFromJSON(context.Background(), data, credentialsScope)
+	if err != nil {
+		return fmt.Errorf("parsing credentials %s: %w", c.path, err)
+	}
+	if c.source != nil {
+		credentialReloads.Inc()
+		c.logger.Printf("Reloaded credentials from %s", c.path)
+	}
+	c.source, c.modTime = parsed.TokenSource, info.ModTime()
+	return nil
+}
+
+// isAuthError reports whether err is Google rejecting the credentials.
+func isAuthError(err error) bool {
+	var retrieve *oauth2.RetrieveError
+	return status.Code(err) == codes.Unauthenticated || errors.As(err, &retrieve)
+}
+
+// record updates the health of the credentials with the outcome of a call
+// made with them.
+func (c *Credentials) record(err error) {
+	if err != nil && !isAuthError(err) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.fail(err)
+	} else {
+		c.succeed()
+	}
+}
+
+// fail and succeed are called with mu held.
+func (c *Credentials) fail(err error) {
+	if c.failure == nil {
+		authUnhealthy.Set(1)
+		c.probeAt = time.Now()
+		c.logger.Printf("Authentication is failing, rejecting publishes until it works again: %v", err)
+		auditLog.Emit(auditEvent{
+			Id:       auditAuthUnhealthy,
+			Resource: c.path,
+			Message:  "Authentication with Google Cloud is failing",
+			Details:  map[string]string{"error": err.Error()},
+			Severity: logging.Error,
+		})
+	}
+	c.failure = err
+}
+
+func (c *Credentials) succeed() {
+	if c.failure == nil {
+		return
+	}
+	c.failure = nil
+	authUnhealthy.Set(0)
+	c.logger.Println("Authentication works again")
+	auditLog.Emit(auditEvent{
+		Id:       auditAuthRestored,
+		Resource: c.path,
+		Message:  "Authentication with Google Cloud works again",
+	})
+}
+
+// allow reports whether a publish may be attempted, and if not, how long
+// until it's worth retrying, and why.
+func (c *Credentials) allow() (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failure == nil {
+		return 0, nil
+	}
+	if remaining := credentialsProbeInterval - time.Since(c.probeAt); remaining > 0 {
+		return remaining, c.failure
+	}
+	c.probeAt = time.Now()
+	return 0, nil
+}
+
+// Check is the credentials health check. With a key file, failing
+// credentials are reloaded and retried, so it recovers without waiting for
+// a publish to probe.
+func (c *Credentials) Check(ctx context.Context) error {
+	c.mu.Lock()
+	failure, keyFile := c.failure, c.path != ""
+	c.mu.Unlock()
+	if failure != nil && keyFile {
+		_, failure = c.Token()
+	}
+	if failure != nil {
+		return &healthcheck.StatusError{Status: unavailableAuth, Err: failure}
+	}
+	return nil
+}
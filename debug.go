@@ -0,0 +1,134 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+var startedAt = time.Now()
+
+func publishDebugVars() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("uptime_seconds", expvar.Func(func() interface{} { return time.Since(startedAt).Seconds() }))
+	expvar.Publish("gc", expvar.Func(func() interface{} {
+		var stats debug.GCStats
+		debug.ReadGCStats(&stats)
+		return map[string]interface{}{
+			"num_gc":      stats.NumGC,
+			"pause_total": stats.PauseTotal.String(),
+			"last_gc":     stats.LastGC,
+		}
+	}))
+	expvar.Publish("build", expvar.Func(func() interface{} {
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return nil
+		}
+		settings := make(map[string]string, len(info.Settings))
+		for _, setting := range info.Settings {
+			settings[setting.Key] = setting.Value
+		}
+		return map[string]interface{}{"go": info.GoVersion, "module": info.Main.Path, "version": info.Main.Version, "settings": settings}
+	}))
+}
+
+// redactedConfig returns config with credentials replaced, for serving.
+func redactedConfig(config Config) Config {
+	if config.Store.Redis.Password != "" {
+		config.Store.Redis.Password = redacted
+	}
+	if config.Identity.Secret != "" {
+		config.Identity.Secret = redacted
+	}
+	if config.AttributeEncryption.Key != "" {
+		config.AttributeEncryption.Key = redacted
+	}
+	if config.Callbacks.Secret != "" {
+		config.Callbacks.Secret = redacted
+	}
+	keys := make([]APIKeyConfig, len(config.Auth.Keys))
+	for i, key := range config.Auth.Keys {
+		key.Hash = redacted
+		keys[i] = key
+	}
+	config.Auth.Keys = keys
+	// Copied, as the subscriptions and their webhooks are shared with the
+	// config the service runs with.
+	subscriptions := make([]SubscriptionConfig, len(config.Subscriptions))
+	for i, subscription := range config.Subscriptions {
+		if subscription.Webhook != nil && subscription.Webhook.Secret != "" {
+			webhook := *subscription.Webhook
+			webhook.Secret = redacted
+			subscription.Webhook = &webhook
+		}
+		subscriptions[i] = subscription
+	}
+	config.Subscriptions = subscriptions
+	return config
+}
+
+// debugRoutes serve live runtime state of the instance, like goroutine
+// stacks, GC stats and the loaded config, for inspecting a running Cloud
+// Run instance during an incident.
+func debugRoutes(config Config, diagnostics *Diagnostics) []Route {
+	publishDebugVars()
+	body, err := yaml.Marshal(redactedConfig(config))
+	if err != nil {
+		panic(err)
+	}
+	const scope = "admin:debug"
+	return []Route{
+		{
+			Method: http.MethodGet,
+			Path:   "/debug/config",
+			Scope:  scope,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/yaml")
+				w.Write(body)
+			}),
+			Doc: RouteDoc{Summary: "The loaded config, after defaults and environment scoping, with credentials redacted", Tag: "debug", Responses: []ResponseDoc{{Status: http.StatusOK, Description: "Config as YAML."}}},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/debug/vars",
+			Scope:   scope,
+			Handler: expvar.Handler(),
+			Doc:     RouteDoc{Summary: "expvar variables: memstats, GC stats, goroutine count, uptime and build info", Tag: "debug", Responses: []ResponseDoc{{Status: http.StatusOK, Description: "Variables by name.", Body: map[string]interface{}{}}}},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/debug/connectivity",
+			Scope:   scope,
+			Handler: diagnostics,
+			Doc:     RouteDoc{Summary: "Check DNS, TCP and TLS reachability of Pub/Sub, the metadata server and fetching a token", Tag: "debug", Responses: []ResponseDoc{{Status: http.StatusOK, Description: "The result of each check.", Body: connectivityReport{}}}},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/debug/pprof/{profile}",
+			Scope:   scope,
+			Handler: http.HandlerFunc(pprof.Index),
+			Doc: RouteDoc{
+				Summary: "A runtime profile, e.g. goroutine with debug=2 for every goroutine's stack, or heap",
+				Tag:     "debug",
+				Query:   []QueryParameterDoc{{Name: "debug", Description: "1 or 2 for text output instead of the binary pprof format.", Type: "integer"}},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The profile."},
+					{Status: http.StatusNotFound, Description: "There's no such profile."},
+				},
+			},
+		},
+		{Method: http.MethodGet, Path: "/debug/pprof/", Scope: scope, Handler: http.HandlerFunc(pprof.Index), Doc: RouteDoc{Undocumented: true}},
+		{Method: http.MethodGet, Path: "/debug/pprof/cmdline", Scope: scope, Handler: http.HandlerFunc(pprof.Cmdline), Doc: RouteDoc{Undocumented: true}},
+		{Method: http.MethodGet, Path: "/debug/pprof/profile", Scope: scope, Handler: http.HandlerFunc(pprof.Profile), Doc: RouteDoc{Undocumented: true}},
+		{Method: http.MethodGet, Path: "/debug/pprof/symbol", Scope: scope, Handler: http.HandlerFunc(pprof.Symbol), Doc: RouteDoc{Undocumented: true}},
+		{Method: http.MethodGet, Path: "/debug/pprof/trace", Scope: scope, Handler: http.HandlerFunc(pprof.Trace), Doc: RouteDoc{Undocumented: true}},
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	dedupKeyPrefix     = "dedup/"
+	defaultDedupHeader = "Idempotency-Key"
+	defaultDedupTTL    = 24 * time.Hour
+	// dedupClaimTTL is how long a key stays claimed by a publish that's in
+	// flight, so one whose instance died is retried after it.
+	dedupClaimTTL = time.Minute
+	maxDedupKey   = 256
+
+	// idempotencyKeyAttribute carries the key of a message published with
+	// PUT /publish/{topic}/{key}.
+	idempotencyKeyAttribute = "idempotency_key"
+
+	dedupHashSHA256 = "sha256"
+	dedupHashNone   = "none"
+)
+
+type DedupConfig struct {
+	// Enabled deduplicates publish requests that carry Header: a repeat of
+	// a key that was published within TTL gets the first publish's message
+	// ID back instead of publishing again. Keys are kept in the store, so
+	// with the redis or firestore backend dedup works across instances and
+	// survives restarts; with memory it's per instance.
+	Enabled bool `yaml:"enabled"`
+	// Header defaults to Idempotency-Key.
+	Header string `yaml:"header"`
+	// TTL defaults to 24h.
+	TTL time.Duration `yaml:"ttl"`
+	// Hash is how keys are stored: sha256, the default, so they can be
+	// long or sensitive, or none to store them as sent for debugging.
+	Hash string `yaml:"hash"`
+}
+
+func (c *DedupConfig) validate() error {
+	if c.Header == "" {
+		c.Header = defaultDedupHeader
+	}
+	if c.TTL == 0 {
+		c.TTL = defaultDedupTTL
+	} else if c.TTL < 0 {
+		return fmt.Errorf("ttl can't be negative")
+	}
+	switch c.Hash {
+	case "":
+		c.Hash = dedupHashSHA256
+	case dedupHashSHA256, dedupHashNone:
+	default:
+		return fmt.Errorf("unknown hash %q, use sha256 or none", c.Hash)
+	}
+	return nil
+}
+
+// dedupEntry is what's stored for a key: nothing but the digest while its
+// publish is in flight, then the message ID.
+type dedupEntry struct {
+	// Digest is the SHA-256 of the request's data and attributes, so a key
+	// reused for a different message is caught.
+	Digest    string `json:"digest"`
+	MessageId string `json:"message_id,omitempty"`
+}
+
+var (
+	errDedupInProgress = errors.New("a publish with this idempotency key is in progress")
+	errDedupMismatch   = errors.New("the idempotency key was used for a different message")
+)
+
+// PublishDedup makes publishing idempotent per key. It fails open: if the
+// store can't be reached, requests are published as if they had no key.
+type PublishDedup struct {
+	logger *log.Logger
+	config DedupConfig
+	store  Store
+}
+
+func newPublishDedup(config Config, store Store) *PublishDedup {
+	return &PublishDedup{logger: newLogger("dedup"), config: config.Dedup, store: store}
+}
+
+// storeKey namespaces key by topic and hashes it as configured.
+func (d *PublishDedup) storeKey(topic string, key string) string {
+	if d.config.Hash == dedupHashSHA256 {
+		sum := sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+	return dedupKeyPrefix + topic + "/" + key
+}
+
+// requestDigest is the digest of a publish request's message as the caller
+// sent it, before prepare adds anything that differs between retries, such
+// as a CloudEvent's id and time or an identity token.
+func requestDigest(msg *pubsub.Message) string {
+	names := make([]string, 0, len(msg.Attributes))
+	for name := range msg.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	hash.Write(msg.Data)
+	for _, name := range names {
+		// Lengths first, so different attributes can't hash the same.
+		fmt.Fprintf(hash, "%d:%s%d:%s", len(name), name, len(msg.Attributes[name]), msg.Attributes[name])
+	}
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// Claim reserves key for publishing a message with digest, from
+// requestDigest, to topic, the name the caller published to. It returns
+// the message ID of an earlier publish with the key, errDedupInProgress or
+// errDedupMismatch if the request shouldn't be published, or a release
+// function to call with the outcome once it has been. Without a key, or
+// with dedup disabled, release is a no-op.
+func (d *PublishDedup) Claim(ctx context.Context, topic string, key string, digest string) (string, func(messageId string, err error), error) {
+	if !d.config.Enabled {
+		return "", func(string, error) {}, nil
+	}
+	return d.ClaimKey(ctx, topic, key, digest)
+}
+
+// ClaimKey is Claim for a key the caller asked to publish under, as with
+// PUT /publish/{topic}/{key}, which is deduplicated even with dedup
+// disabled.
+func (d *PublishDedup) ClaimKey(ctx context.Context, topic string, key string, digest string) (string, func(messageId string, err error), error) {
+	release := func(string, error) {}
+	if key == "" {
+		return "", release, nil
+	}
+	if len(key) > maxDedupKey {
+		return "", release, fmt.Errorf("idempotency key is longer than %d bytes", maxDedupKey)
+	}
+	storeKey := d.storeKey(topic, key)
+	claim, err := json.Marshal(dedupEntry{Digest: digest})
+	if err != nil {
+		return "", release, err
+	}
+	// A key released or expired between failing to claim it and reading it
+	// is claimed again, once.
+	for attempt := 0; attempt < 2; attempt++ {
+		claimed, err := d.store.SetIfAbsent(ctx, storeKey, claim, dedupClaimTTL)
+		if err != nil {
+			d.failOpen(topic, err)
+			return "", release, nil
+		}
+		if claimed {
+			publishDedup.WithLabelValues(topic, "new").Inc()
+			return "", d.release(ctx, topic, storeKey, digest), nil
+		}
+		data, err := d.store.Get(ctx, storeKey)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			d.failOpen(topic, err)
+			return "", release, nil
+		}
+		var entry dedupEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			d.failOpen(topic, err)
+			return "", release, nil
+		}
+		if entry.Digest != digest {
+			publishDedup.WithLabelValues(topic, "mismatch").Inc()
+			return "", release, errDedupMismatch
+		}
+		if entry.MessageId == "" {
+			break
+		}
+		publishDedup.WithLabelValues(topic, "duplicate").Inc()
+		return entry.MessageId, release, nil
+	}
+	publishDedup.WithLabelValues(topic, "in_progress").Inc()
+	return "", release, errDedupInProgress
+}
+
+// release returns the function that records the outcome of the publish
+// holding storeKey's claim.
+func (d *PublishDedup) release(ctx context.Context, topic string, storeKey string, digest string) func(string, error) {
+	// The request's context may be done by the time it's called.
+	ctx = context.WithoutCancel(ctx)
+	return func(messageId string, err error) {
+		if err != nil {
+			// Let the publisher retry with the same key.
+			if err := d.store.Delete(ctx, storeKey); err != nil {
+				d.logger.Printf("Failed to release idempotency key on %s: %v", topic, err)
+			}
+			return
+		}
+		entry, err := json.Marshal(dedupEntry{Digest: digest, MessageId: messageId})
+		if err == nil {
+			err = d.store.Set(ctx, storeKey, entry, d.config.TTL)
+		}
+		if err != nil {
+			d.logger.Printf("Failed to remember idempotency key on %s, a retry will publish again: %v", topic, err)
+		}
+	}
+}
+
+func (d *PublishDedup) failOpen(topic string, err error) {
+	publishDedup.WithLabelValues(topic, "error").Inc()
+	d.logger.Printf("Publishing to %s without deduplication: %v", topic, err)
+}
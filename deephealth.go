@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+
+	"gcp-pubsub-test/healthcheck"
+)
+
+const (
+	// healthProbeAttribute carries a deep health probe's ID, which the
+	// designated consumer's echo must carry back.
+	healthProbeAttribute     = "health_probe"
+	healthProbeSentAttribute = "health_probe_sent_at"
+	healthProbeKeyPrefix     = "health-probe/"
+
+	defaultDeepHealthTimeout  = 10 * time.Second
+	defaultDeepHealthCacheTTL = 30 * time.Second
+	// healthProbePollInterval is how often the store is checked for the
+	// echo of a probe that's in flight.
+	healthProbePollInterval = 200 * time.Millisecond
+)
+
+// DeepHealthConfig proves the full path works, on GET /health/deep: each
+// run publishes a probe message to Topic and waits for the designated
+// consumer to echo it back on EchoSubscription. It's reported apart from
+// /health, whose checks only reach the dependencies, so a slow or broken
+// consumer doesn't fail the shallow probes Cloud Run restarts on.
+//
+// The probe carries the attribute health_probe, with a unique ID. The
+// consumer should publish a message with the same health_probe attribute
+// to the echo subscription's topic once it has handled the probe, and
+// every other consumer of Topic should ack and ignore it.
+type DeepHealthConfig struct {
+	// Topic is the configured topic, by name, the probe is published to.
+	Topic string `yaml:"topic"`
+	// EchoSubscription is the ID of the subscription echoes arrive on.
+	// Every instance shares it: which receives an echo doesn't matter, as
+	// receipts are recorded in the store.
+	EchoSubscription string `yaml:"echo_subscription"`
+	// Timeout is how long the echo has to come back. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+	// CacheTTL is how long a report is served before another probe is
+	// sent. Defaults to 30s.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+func (c *DeepHealthConfig) validate(topics map[string]bool) error {
+	if c.Topic == "" || c.EchoSubscription == "" {
+		return errors.New("needs a topic and an echo_subscription")
+	}
+	if !topics[c.Topic] {
+		return fmt.Errorf("topic %s isn't configured", c.Topic)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultDeepHealthTimeout
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = defaultDeepHealthCacheTTL
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout can't be negative")
+	}
+	return nil
+}
+
+// DeepHealth runs the deep health check, which is nil unless it's
+// configured.
+type DeepHealth struct {
+	logger   *log.Logger
+	config   *DeepHealthConfig
+	registry *TopicRegistry
+	store    Store
+	checks   *healthcheck.Registry
+
+	mu sync.Mutex
+	// err is why receiving echoes last failed, until one is received.
+	err error
+}
+
+func newDeepHealth(lifecycle fx.Lifecycle, config Config, client *pubsub.Client, registry *TopicRegistry, store Store) *DeepHealth {
+	deep := &DeepHealth{logger: newLogger("deep-health"), config: config.Health.Deep, registry: registry, store: store}
+	if deep.config == nil {
+		return deep
+	}
+	deep.checks = healthcheck.New(deep.config.CacheTTL)
+	// The check's own timeout leaves the probe time to be published too.
+	deep.checks.Register("echo/"+deep.config.Topic, deep.config.Timeout+healthcheck.DefaultTimeout, deep.Check)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(context.Context) error {
+				go deep.receive(ctx, client.Subscription(deep.config.EchoSubscription), done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				return nil
+			},
+		},
+	)
+	return deep
+}
+
+// receive records each echo that arrives until ctx is done.
+func (d *DeepHealth) receive(ctx context.Context, subscription *pubsub.Subscription, done chan<- struct{}) {
+	defer close(done)
+	for ctx.Err() == nil {
+		err := subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+			d.fail(nil)
+			id := msg.Attributes[healthProbeAttribute]
+			if id == "" {
+				d.logger.Printf("Dropping message %s, which isn't an echo of a probe", msg.ID)
+				msg.Ack()
+				return
+			}
+			if err := d.store.Set(ctx, healthProbeKeyPrefix+id, []byte(time.Now().UTC().Format(time.RFC3339Nano)), 2*d.config.Timeout); err != nil {
+				d.logger.Printf("Failed to record the echo of probe %s: %v", id, err)
+				msg.Nack()
+				return
+			}
+			msg.Ack()
+		})
+		if err != nil && ctx.Err() == nil {
+			d.logger.Printf("Receiving echoes from %s failed, retrying: %v", subscription.ID(), err)
+			d.fail(fmt.Errorf("receiving echoes from %s: %w", subscription.ID(), err))
+			select {
+			case <-ctx.Done():
+			case <-time.After(d.config.Timeout):
+			}
+		}
+	}
+}
+
+func (d *DeepHealth) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+}
+
+// Check publishes a probe and waits for its echo.
+func (d *DeepHealth) Check(ctx context.Context) error {
+	d.mu.Lock()
+	receiveErr := d.err
+	d.mu.Unlock()
+	if receiveErr != nil {
+		return receiveErr
+	}
+	topic, ok := d.registry.Lookup(d.config.Topic)
+	if !ok {
+		return fmt.Errorf("topic %s isn't registered yet", d.config.Topic)
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	probe := hex.EncodeToString(id[:])
+	sentAt := time.Now()
+	_, err := topic.Publish(ctx, &pubsub.Message{
+		Data: []byte("{}"),
+		Attributes: map[string]string{
+			healthProbeAttribute:     probe,
+			healthProbeSentAttribute: sentAt.UTC().Format(time.RFC3339Nano),
+		},
+	})
+	if err != nil {
+		healthProbes.WithLabelValues("publish_failed").Inc()
+		return fmt.Errorf("publishing a probe to %s: %w", d.config.Topic, err)
+	}
+
+	deadline := time.NewTimer(d.config.Timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(healthProbePollInterval)
+	defer ticker.Stop()
+	for {
+		_, err := d.store.Get(ctx, healthProbeKeyPrefix+probe)
+		if err == nil {
+			healthProbes.WithLabelValues("echoed").Inc()
+			healthProbeLatency.Observe(time.Since(sentAt).Seconds())
+			return nil
+		}
+		if !errors.Is(err, ErrNotFound) && ctx.Err() == nil {
+			d.logger.Printf("Failed to look up the echo of probe %s: %v", probe, err)
+		}
+		select {
+		case <-ctx.Done():
+			healthProbes.WithLabelValues("timeout").Inc()
+			return ctx.Err()
+		case <-deadline.C:
+			healthProbes.WithLabelValues("timeout").Inc()
+			return fmt.Errorf("probe %s published to %s wasn't echoed on %s within %s", probe, d.config.Topic, d.config.EchoSubscription, d.config.Timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// ServeHTTP reports the deep health check, or 404 if it isn't configured.
+func (d *DeepHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.checks == nil {
+		http.Error(w, "Deep health isn't configured", http.StatusNotFound)
+		return
+	}
+	healthHandler(d.checks)(w, r)
+}
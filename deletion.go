@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	unavailableTopicDeleted = "topic_deleted"
+	// topicRecreateRetryAfter is how soon callers are asked to retry while
+	// a deleted topic is being recreated, and topicDeletedRetryAfter how
+	// soon otherwise, which is about when a manual recreation is noticed.
+	topicRecreateRetryAfter = 5 * time.Second
+	topicDeletedRetryAfter  = time.Minute
+)
+
+// topicDeletion tracks a registered topic that was deleted while the
+// service runs. Publishes to it are rejected without being attempted until
+// it exists again, whether recreated by hand or, with auto_create, by the
+// first publish to find it missing.
+type topicDeletion struct {
+	deleted atomic.Bool
+	// checking is held by the one publish checking on the topic, which
+	// the others don't wait for.
+	checking sync.Mutex
+}
+
+// markDeleted records that publishing to the topic failed with NotFound.
+func (t *RegisteredTopic) markDeleted() {
+	if t.deletion.deleted.CompareAndSwap(false, true) {
+		topicDeleted.WithLabelValues(t.Config.Name).Set(1)
+		newLogger("registry").Printf("Topic %s (%s) was deleted, rejecting publishes until it exists again", t.Config.Name, t.Config.Id)
+	}
+}
+
+// Deleted reports whether the topic is missing since a publish to it
+// failed with NotFound.
+func (t *RegisteredTopic) Deleted() bool {
+	return t.deletion.deleted.Load()
+}
+
+// checkDeleted returns an UnavailableError while the topic is deleted. It
+// checks whether the topic exists again, recreating it with auto_create.
+func (t *RegisteredTopic) checkDeleted(ctx context.Context) error {
+	if !t.deletion.deleted.Load() {
+		return nil
+	}
+	unavailable := t.deletedError(errors.New("publishing is paused until it exists again"))
+	if !t.deletion.checking.TryLock() {
+		return unavailable
+	}
+	defer t.deletion.checking.Unlock()
+	if !t.deletion.deleted.Load() {
+		return nil
+	}
+
+	handle := t.Handle()
+	exists, err := t.exists.Exists(ctx, handle)
+	if err == nil && !exists && t.Config.AutoCreate {
+		_, err = t.currentClient().CreateTopic(ctx, t.Config.Id)
+		if status.Code(err) == codes.AlreadyExists {
+			err = nil
+		}
+		logger := newLogger("registry")
+		if err != nil {
+			topicRecreations.WithLabelValues(t.Config.Name, "error").Inc()
+			logger.Printf("Failed to recreate topic %s (%s): %v", t.Config.Name, t.Config.Id, err)
+		} else {
+			topicRecreations.WithLabelValues(t.Config.Name, "ok").Inc()
+			logger.Printf("Recreated topic %s (%s); its subscriptions have to be recreated to receive from it", t.Config.Name, t.Config.Id)
+			t.exists.Invalidate(handle)
+			exists = true
+		}
+	}
+	if err != nil || !exists {
+		return unavailable
+	}
+	t.deletion.deleted.Store(false)
+	topicDeleted.WithLabelValues(t.Config.Name).Set(0)
+	newLogger("registry").Printf("Topic %s (%s) exists again, publishing to it", t.Config.Name, t.Config.Id)
+	return nil
+}
+
+// deletedError is the error publishes to the deleted topic fail with.
+func (t *RegisteredTopic) deletedError(err error) *UnavailableError {
+	retryAfter := topicDeletedRetryAfter
+	if t.Config.AutoCreate {
+		retryAfter = topicRecreateRetryAfter
+	}
+	return &UnavailableError{
+		Reason:     unavailableTopicDeleted,
+		RetryAfter: retryAfter,
+		Err:        fmt.Errorf("topic %s was deleted: %w", t.Config.Name, err),
+	}
+}
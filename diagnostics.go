@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"go.uber.org/fx"
+)
+
+const (
+	pubsubEndpoint = "pubsub.googleapis.com:443"
+	// connectivityCheckTimeout bounds each check, so one that hangs, like
+	// the metadata server off GCP, doesn't hold up the rest.
+	connectivityCheckTimeout = 5 * time.Second
+)
+
+type connectivityCheck struct {
+	Check    string        `json:"check"`
+	OK       bool          `json:"ok"`
+	Skipped  bool          `json:"skipped,omitempty"`
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+type connectivityReport struct {
+	CheckedAt time.Time           `json:"checked_at"`
+	Checks    []connectivityCheck `json:"checks"`
+}
+
+// Diagnostics checks the network path to Pub/Sub on startup, logging the
+// result of each check, so a cold start that can't reach Pub/Sub says why:
+// DNS resolution and TCP and TLS reachability of the endpoint, or of the
+// emulator, access to the metadata server, and fetching a token. The
+// checks run again on each request to /debug/connectivity.
+type Diagnostics struct {
+	logger *log.Logger
+	params PubSubParams
+}
+
+func newDiagnostics(lifecycle fx.Lifecycle, params PubSubParams) *Diagnostics {
+	diagnostics := &Diagnostics{logger: newLogger("diagnostics"), params: params}
+	ctx, cancel := context.WithCancel(context.Background())
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(context.Context) error {
+				// In the background, as a failing check shouldn't hold up
+				// startup: the clients report their own errors.
+				go diagnostics.Run(ctx)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				return nil
+			},
+		},
+	)
+	return diagnostics
+}
+
+// Run runs every check, logging each result.
+func (d *Diagnostics) Run(ctx context.Context) connectivityReport {
+	report := connectivityReport{CheckedAt: time.Now().UTC()}
+	check := func(name string, run func(ctx context.Context) (string, error)) {
+		ctx, cancel := context.WithTimeout(ctx, connectivityCheckTimeout)
+		defer cancel()
+		started := time.Now()
+		detail, err := run(ctx)
+		result := connectivityCheck{Check: name, OK: err == nil, Detail: detail, Duration: time.Since(started)}
+		if err != nil {
+			result.Detail = err.Error()
+		} else if strings.HasPrefix(detail, "skipped") {
+			result.Skipped = true
+		}
+		report.Checks = append(report.Checks, result)
+		d.logger.Printf("event=connectivity_check check=%s ok=%t skipped=%t duration=%s detail=%q", name, result.OK, result.Skipped, result.Duration.Round(time.Microsecond), result.Detail)
+	}
+
+	endpoint, tlsEnabled := pubsubEndpoint, true
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		endpoint, tlsEnabled = host, false
+	}
+	local := d.params.Config.ProjectId == localProjectId
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+
+	check("dns", func(ctx context.Context) (string, error) {
+		if local {
+			return "skipped, using the in-process Pub/Sub", nil
+		}
+		addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		return strings.Join(addresses, ", "), nil
+	})
+	check("tcp", func(ctx context.Context) (string, error) {
+		if local {
+			return "skipped, using the in-process Pub/Sub", nil
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", endpoint)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return "connected to " + conn.RemoteAddr().String(), nil
+	})
+	check("tls", func(ctx context.Context) (string, error) {
+		if local {
+			return "skipped, using the in-process Pub/Sub", nil
+		}
+		if !tlsEnabled {
+			return "skipped, the emulator doesn't use TLS", nil
+		}
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: host}}
+		conn, err := dialer.DialContext(ctx, "tcp", endpoint)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		state := conn.(*tls.Conn).ConnectionState()
+		certificate := state.PeerCertificates[0]
+		return fmt.Sprintf("%s, certificate for %s issued by %s, expires %s", tls.VersionName(state.Version), certificate.Subject.CommonName, certificate.Issuer.CommonName, certificate.NotAfter.Format(time.DateOnly)), nil
+	})
+	check("metadata", func(ctx context.Context) (string, error) {
+		if path := d.params.Config.CredentialsPath; path != "" {
+			return "skipped, credentials come from " + path, nil
+		}
+		if local || !tlsEnabled {
+			return "skipped, not using Google credentials", nil
+		}
+		project, err := metadata.ProjectIDWithContext(ctx)
+		if err != nil {
+			return "", err
+		}
+		return "project " + project, nil
+	})
+	check("token", func(ctx context.Context) (string, error) {
+		if local {
+			return "skipped, using the in-process Pub/Sub", nil
+		}
+		return checkCredentials(ctx, d.params)
+	})
+	return report
+}
+
+// ServeHTTP runs the checks and responds with the report.
+func (d *Diagnostics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := d.Run(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
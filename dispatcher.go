@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+type keyQueue struct {
+	messages []*pubsub.Message
+}
+
+// KeyedDispatcher runs messages with different ordering keys concurrently
+// while serializing messages that share a key. Each key gets its own bounded
+// queue, and workers give their slot back after every message, so a single
+// hot key can neither exhaust the subscription's flow control nor starve the
+// keys behind it.
+type KeyedDispatcher struct {
+	subscription string
+	process      func(ctx context.Context, msg *pubsub.Message) error
+	maxQueued    int
+	slots        chan struct{}
+
+	mu     sync.Mutex
+	queues map[string]*keyQueue
+	wg     sync.WaitGroup
+}
+
+func NewKeyedDispatcher(subscription string, maxConcurrentKeys int, maxQueuedPerKey int, process func(ctx context.Context, msg *pubsub.Message) error) *KeyedDispatcher {
+	return &KeyedDispatcher{
+		subscription: subscription,
+		process:      process,
+		maxQueued:    maxQueuedPerKey,
+		slots:        make(chan struct{}, maxConcurrentKeys),
+		queues:       make(map[string]*keyQueue),
+	}
+}
+
+// Dispatch is used as the Receive callback. It returns as soon as msg is
+// queued; the Pub/Sub client only hands over the next message for a key once
+// the callback for the previous one returns, so queue order is delivery order.
+func (d *KeyedDispatcher) Dispatch(ctx context.Context, msg *pubsub.Message) {
+	if msg.OrderingKey == "" {
+		d.slots <- struct{}{}
+		d.process(ctx, msg)
+		<-d.slots
+		return
+	}
+
+	d.mu.Lock()
+	queue, running := d.queues[msg.OrderingKey]
+	if !running {
+		queue = &keyQueue{}
+		d.queues[msg.OrderingKey] = queue
+	}
+	if d.maxQueued > 0 && len(queue.messages) >= d.maxQueued {
+		d.mu.Unlock()
+		dispatcherRejected.WithLabelValues(d.subscription).Inc()
+		msg.Nack()
+		return
+	}
+	queue.messages = append(queue.messages, msg)
+	d.mu.Unlock()
+
+	if !running {
+		dispatcherActiveKeys.WithLabelValues(d.subscription).Inc()
+		d.wg.Add(1)
+		go d.drain(ctx, msg.OrderingKey, queue)
+	}
+}
+
+func (d *KeyedDispatcher) drain(ctx context.Context, key string, queue *keyQueue) {
+	defer d.wg.Done()
+	defer dispatcherActiveKeys.WithLabelValues(d.subscription).Dec()
+	for {
+		d.mu.Lock()
+		if len(queue.messages) == 0 || ctx.Err() != nil {
+			// Anything still queued is redelivered once the stream restarts.
+			for _, msg := range queue.messages {
+				msg.Nack()
+			}
+			delete(d.queues, key)
+			d.mu.Unlock()
+			return
+		}
+		msg := queue.messages[0]
+		queue.messages = queue.messages[1:]
+		d.mu.Unlock()
+
+		d.slots <- struct{}{}
+		err := d.process(ctx, msg)
+		<-d.slots
+
+		if err != nil {
+			// The server redelivers the failed message and everything after
+			// it for this key, so processing what's queued would break order.
+			d.mu.Lock()
+			for _, msg := range queue.messages {
+				msg.Nack()
+			}
+			queue.messages = nil
+			d.mu.Unlock()
+		}
+	}
+}
+
+// Wait blocks until every key worker has exited.
+func (d *KeyedDispatcher) Wait() {
+	d.wg.Wait()
+}
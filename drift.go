@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type DriftConfig struct {
+	// Interval is how often the declared topology is compared with GCP.
+	// Zero disables the reconciler.
+	Interval time.Duration `yaml:"interval"`
+	// Topics, Subscriptions, DeadLetters, RetryPolicies and PushConfigs
+	// are what to do about each kind of drift: alert (the default), which
+	// logs it and reports it in topology_drift, or heal, which also fixes
+	// it where it can.
+	Topics        string `yaml:"topics"`
+	Subscriptions string `yaml:"subscriptions"`
+	DeadLetters   string `yaml:"dead_letters"`
+	RetryPolicies string `yaml:"retry_policies"`
+	PushConfigs   string `yaml:"push_configs"`
+}
+
+const (
+	driftActionAlert = "alert"
+	driftActionHeal  = "heal"
+)
+
+const (
+	driftKindTopic        = "topic"
+	driftKindSubscription = "subscription"
+	driftKindDeadLetter   = "dead_letter"
+	driftKindRetryPolicy  = "retry_policy"
+	driftKindPushConfig   = "push_config"
+)
+
+func (c *DriftConfig) validate() error {
+	for name, action := range map[string]*string{"topics": &c.Topics, "subscriptions": &c.Subscriptions, "dead_letters": &c.DeadLetters, "retry_policies": &c.RetryPolicies, "push_configs": &c.PushConfigs} {
+		switch *action {
+		case "":
+			*action = driftActionAlert
+		case driftActionAlert, driftActionHeal:
+		default:
+			return fmt.Errorf("%s: unknown action %q", name, *action)
+		}
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("interval can't be negative")
+	}
+	return nil
+}
+
+func (c DriftConfig) action(kind string) string {
+	switch kind {
+	case driftKindTopic:
+		return c.Topics
+	case driftKindSubscription:
+		return c.Subscriptions
+	case driftKindRetryPolicy:
+		return c.RetryPolicies
+	case driftKindPushConfig:
+		return c.PushConfigs
+	default:
+		return c.DeadLetters
+	}
+}
+
+// Drift is a difference between a declared resource and its live state.
+type Drift struct {
+	Kind     string `json:"kind"`
+	Resource string `json:"resource"`
+	// Problem is missing, wrong_topic, detached or mismatched.
+	Problem string `json:"problem"`
+	Detail  string `json:"detail"`
+	// Healable is false for drift that can only be fixed by deleting a
+	// resource, like a subscription attached to the wrong topic, which is
+	// left to an operator.
+	Healable bool `json:"healable"`
+
+	topic        *TopicTopology
+	subscription *SubscriptionTopology
+}
+
+// planDrift is the first phase of reconciling: it reads the live state of
+// each declared resource, without changing anything.
+func planDrift(ctx context.Context, client *pubsub.Client, declared Topology) ([]Drift, error) {
+	var drifts []Drift
+	for i := range declared.Topics {
+		topic := &declared.Topics[i]
+		exists, err := client.Topic(topic.Name).Exists(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("topic %s: %w", topic.Name, err)
+		}
+		if !exists {
+			drifts = append(drifts, Drift{Kind: driftKindTopic, Resource: topic.Name, Problem: "missing", Detail: "topic doesn't exist", Healable: true, topic: topic})
+		}
+	}
+	for i := range declared.Subscriptions {
+		subscription := &declared.Subscriptions[i]
+		live, err := client.Subscription(subscription.Name).Config(ctx)
+		if status.Code(err) == codes.NotFound {
+			drifts = append(drifts, Drift{Kind: driftKindSubscription, Resource: subscription.Name, Problem: "missing", Detail: "subscription doesn't exist", Healable: true, subscription: subscription})
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("subscription %s: %w", subscription.Name, err)
+		}
+		// A subscription whose topic was deleted is attached to
+		// _deleted-topic_.
+		if live.Topic == nil || live.Topic.ID() != subscription.Topic {
+			attached := "_deleted-topic_"
+			if live.Topic != nil {
+				attached = live.Topic.ID()
+			}
+			drifts = append(drifts, Drift{Kind: driftKindSubscription, Resource: subscription.Name, Problem: "wrong_topic", Detail: fmt.Sprintf("attached to %s instead of %s", attached, subscription.Topic), subscription: subscription})
+		}
+		if deadLetter := subscription.DeadLetter; deadLetter != nil {
+			policy := live.DeadLetterPolicy
+			if policy == nil || resourceId(policy.DeadLetterTopic) != deadLetter.Topic || policy.MaxDeliveryAttempts != deadLetter.MaxDeliveryAttempts {
+				drifts = append(drifts, Drift{Kind: driftKindDeadLetter, Resource: subscription.Name, Problem: "detached", Detail: fmt.Sprintf("dead letter policy doesn't forward to %s after %d attempts", deadLetter.Topic, deadLetter.MaxDeliveryAttempts), Healable: true, subscription: subscription})
+			}
+		}
+		if policy := liveRetryPolicy(live.RetryPolicy); retryPolicyDrifted(subscription.RetryPolicy, policy) {
+			drifts = append(drifts, Drift{Kind: driftKindRetryPolicy, Resource: subscription.Name, Problem: "mismatched", Detail: retryPolicyDetail(subscription.RetryPolicy, policy), Healable: true, subscription: subscription})
+		}
+		if subscription.PushEndpoint != "" {
+			if detail, drifted := pushConfigDrifted(*subscription, live.PushConfig); drifted {
+				drifts = append(drifts, Drift{Kind: driftKindPushConfig, Resource: subscription.Name, Problem: "mismatched", Detail: detail, Healable: true, subscription: subscription})
+			}
+		}
+	}
+	return drifts, nil
+}
+
+// heal is the second phase: it fixes drift. Topics come first in a plan,
+// so subscriptions are recreated after the topics they attach to.
+func heal(ctx context.Context, client *pubsub.Client, project string, drift Drift) error {
+	switch {
+	case drift.topic != nil:
+		_, err := client.CreateTopic(ctx, drift.topic.Name)
+		return err
+	case drift.Kind == driftKindSubscription:
+		config := pubsub.SubscriptionConfig{
+			Topic:                 client.Topic(drift.subscription.Topic),
+			AckDeadline:           drift.subscription.AckDeadline,
+			EnableMessageOrdering: drift.subscription.Ordering,
+			Filter:                drift.subscription.Filter,
+			DeadLetterPolicy:      deadLetterPolicy(project, drift.subscription.DeadLetter),
+			RetryPolicy:           pubsubRetryPolicy(drift.subscription.RetryPolicy),
+		}
+		if drift.subscription.PushEndpoint != "" {
+			config.PushConfig = pubsubPushConfig(*drift.subscription)
+		}
+		_, err := client.CreateSubscription(ctx, drift.subscription.Name, config)
+		return err
+	case drift.Kind == driftKindRetryPolicy:
+		_, err := client.Subscription(drift.subscription.Name).Update(ctx, pubsub.SubscriptionConfigToUpdate{
+			RetryPolicy: pubsubRetryPolicy(drift.subscription.RetryPolicy),
+		})
+		return err
+	case drift.Kind == driftKindPushConfig:
+		config := pubsubPushConfig(*drift.subscription)
+		_, err := client.Subscription(drift.subscription.Name).Update(ctx, pubsub.SubscriptionConfigToUpdate{
+			PushConfig: &config,
+		})
+		return err
+	default:
+		_, err := client.Subscription(drift.subscription.Name).Update(ctx, pubsub.SubscriptionConfigToUpdate{
+			DeadLetterPolicy: deadLetterPolicy(project, drift.subscription.DeadLetter),
+		})
+		return err
+	}
+}
+
+// verifyHealedPush checks that the endpoint of a push subscription that
+// healing created or repointed accepts pushes. It returns false, and no
+// error, for drift that doesn't need checking.
+func verifyHealedPush(ctx context.Context, project string, options []option.ClientOption, drift Drift) (bool, error) {
+	if drift.subscription == nil || !drift.subscription.pushVerification || (drift.Kind != driftKindSubscription && drift.Kind != driftKindPushConfig) {
+		return false, nil
+	}
+	err := verifyPush(ctx, project, *drift.subscription, options)
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	pushVerifications.WithLabelValues(drift.Resource, result).Inc()
+	return true, err
+}
+
+func deadLetterPolicy(project string, deadLetter *DeadLetter) *pubsub.DeadLetterPolicy {
+	if deadLetter == nil {
+		return nil
+	}
+	return &pubsub.DeadLetterPolicy{
+		DeadLetterTopic:     "projects/" + project + "/topics/" + deadLetter.Topic,
+		MaxDeliveryAttempts: deadLetter.MaxDeliveryAttempts,
+	}
+}
+
+// Reconciler periodically compares the topology declared by the config
+// with GCP, alerting on or healing whatever has drifted, like a
+// subscription deleted by hand or a DLQ detached in the console.
+type Reconciler struct {
+	logger     *log.Logger
+	config     DriftConfig
+	project    string
+	client     *pubsub.Client
+	options    []option.ClientOption
+	loadConfig func() (Config, error)
+
+	// mu runs one reconcile at a time and guards declared, which
+	// provisioning replaces.
+	mu       sync.Mutex
+	declared Topology
+}
+
+func newReconciler(lifecycle fx.Lifecycle, config Config, params PubSubParams, client *pubsub.Client) *Reconciler {
+	reconciler := &Reconciler{
+		logger:   newLogger("drift"),
+		config:   config.Drift,
+		project:  params.Config.ProjectId,
+		declared: configTopology(params.Config.ProjectId, config),
+		client:   client,
+		options:  params.clientOptions(),
+	}
+	reconciler.loadConfig = newConfig(reconciler.logger)
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(ctx context.Context) error {
+				verifyRetryPolicies(ctx, reconciler.logger, client, reconciler.declared)
+				return nil
+			},
+		},
+	)
+	if config.Drift.Interval == 0 {
+		return reconciler
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(context.Context) error {
+				go reconciler.run(ctx, done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				return nil
+			},
+		},
+	)
+	return reconciler
+}
+
+func (r *Reconciler) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.reconcile(ctx)
+	}
+}
+
+func (r *Reconciler) reconcile(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	drifts, err := planDrift(ctx, r.client, r.declared)
+	if err != nil {
+		if ctx.Err() == nil {
+			// The last known drift stays reported until a plan succeeds.
+			topologyReconciles.WithLabelValues("error").Inc()
+			r.logger.Printf("Failed to read live topology: %v", err)
+		}
+		return
+	}
+	topologyReconciles.WithLabelValues("ok").Inc()
+	topologyDrift.Reset()
+	for _, drift := range drifts {
+		if !drift.Healable || r.config.action(drift.Kind) != driftActionHeal {
+			topologyDrift.WithLabelValues(drift.Kind, drift.Resource, drift.Problem).Set(1)
+			r.logger.Printf("Drift in %s %s: %s", drift.Kind, drift.Resource, drift.Detail)
+			continue
+		}
+		if err := heal(ctx, r.client, r.project, drift); err != nil {
+			topologyDrift.WithLabelValues(drift.Kind, drift.Resource, drift.Problem).Set(1)
+			topologyHealed.WithLabelValues(drift.Kind, "error").Inc()
+			r.logger.Printf("Failed to heal %s %s (%s): %v", drift.Kind, drift.Resource, drift.Detail, err)
+			continue
+		}
+		topologyHealed.WithLabelValues(drift.Kind, "ok").Inc()
+		r.logger.Printf("Healed %s %s: %s", drift.Kind, drift.Resource, drift.Detail)
+		auditHealed(drift, "reconciler")
+		if verified, err := verifyHealedPush(ctx, r.project, r.options, drift); err != nil {
+			r.logger.Printf("Push subscription %s doesn't deliver: %v", drift.Resource, err)
+		} else if verified {
+			r.logger.Printf("Verified pushes from %s to %s", drift.Resource, drift.subscription.PushEndpoint)
+		}
+	}
+}
+
+// auditHealed records that via, the reconciler or a provision request,
+// changed the live topology to heal drift.
+func auditHealed(drift Drift, via string) {
+	auditLog.Emit(auditEvent{
+		Id:       auditTopologyChanged,
+		Resource: drift.Resource,
+		Message:  fmt.Sprintf("Provisioned %s %s: %s", drift.Kind, drift.Resource, drift.Detail),
+		Details:  map[string]string{"kind": drift.Kind, "problem": drift.Problem, "via": via},
+	})
+}
+
+type provisionChange struct {
+	Drift
+	// Result is planned in a dry run, and otherwise healed, failed, or
+	// skipped for drift that can't be healed.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	// Verification is passed or failed for a healed push subscription
+	// whose endpoint was checked, with VerificationError saying why.
+	Verification      string `json:"verification,omitempty"`
+	VerificationError string `json:"verification_error,omitempty"`
+}
+
+type provisionResponse struct {
+	DryRun  bool              `json:"dry_run"`
+	Changes []provisionChange `json:"changes"`
+}
+
+// Provision reloads the config file and heals every kind of drift it can
+// from the topology it declares, like reconcile -apply, so infra changes
+// merged to the config are applied without a restart. With dry_run it only
+// returns the plan. The applied topology becomes the one the reconciler
+// checks; the rest of the service keeps the config it started with until
+// it restarts.
+func (r *Reconciler) Provision(w http.ResponseWriter, req *http.Request) {
+	dryRun := false
+	if value := req.URL.Query().Get("dry_run"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Invalid dry_run", http.StatusBadRequest)
+			return
+		}
+		dryRun = parsed
+	}
+	logger := requestLogger(r.logger, req)
+	config, err := r.loadConfig()
+	if err != nil {
+		http.Error(w, "Failed to load the config: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	declared := configTopology(r.project, config)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	drifts, err := planDrift(req.Context(), r.client, declared)
+	if err != nil {
+		http.Error(w, "Failed to read live topology: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := provisionResponse{DryRun: dryRun, Changes: make([]provisionChange, 0, len(drifts))}
+	healed := 0
+	for _, drift := range drifts {
+		change := provisionChange{Drift: drift, Result: "planned"}
+		switch {
+		case dryRun:
+		case !drift.Healable:
+			change.Result = "skipped"
+		default:
+			if err := heal(req.Context(), r.client, r.project, drift); err != nil {
+				topologyHealed.WithLabelValues(drift.Kind, "error").Inc()
+				change.Result, change.Error = "failed", err.Error()
+				logger.Printf("Failed to provision %s %s (%s): %v", drift.Kind, drift.Resource, drift.Detail, err)
+			} else {
+				topologyHealed.WithLabelValues(drift.Kind, "ok").Inc()
+				change.Result = "healed"
+				healed++
+				logger.Printf("Provisioned %s %s: %s", drift.Kind, drift.Resource, drift.Detail)
+				auditHealed(drift, "provision")
+				if verified, err := verifyHealedPush(req.Context(), r.project, r.options, drift); err != nil {
+					change.Verification, change.VerificationError = "failed", err.Error()
+					logger.Printf("Push subscription %s doesn't deliver: %v", drift.Resource, err)
+				} else if verified {
+					change.Verification = "passed"
+				}
+			}
+		}
+		response.Changes = append(response.Changes, change)
+	}
+	if dryRun {
+		logger.Printf("Planned %d changes", len(drifts))
+	} else {
+		r.declared = declared
+		logger.Printf("Healed %d of %d changes", healed, len(drifts))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// reconcileCommand plans, and with -apply heals, drift once, for
+// provisioning a new environment or checking one by hand. Unlike the
+// reconciler, it heals every kind of drift it can when applying.
+func reconcileCommand(logger *log.Logger) fx.Option {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "heal the planned drift instead of only printing it")
+	flags.Parse(commandArgs)
+
+	return fx.Options(
+		fx.Provide(newPubSubParams(logger), newPubSubClient, newConfig(logger)),
+		fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, params PubSubParams, config Config, client *pubsub.Client) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				project := params.Config.ProjectId
+				drifts, err := planDrift(ctx, client, configTopology(project, config))
+				if err != nil {
+					return err
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				for _, drift := range drifts {
+					if err := encoder.Encode(drift); err != nil {
+						return err
+					}
+				}
+				if !*apply {
+					logger.Printf("Planned %d changes; run with -apply to heal them", len(drifts))
+					return nil
+				}
+				healed, unverified := 0, 0
+				for _, drift := range drifts {
+					if !drift.Healable {
+						continue
+					}
+					if err := heal(ctx, client, project, drift); err != nil {
+						return fmt.Errorf("healing %s %s: %w", drift.Kind, drift.Resource, err)
+					}
+					healed++
+					if verified, err := verifyHealedPush(ctx, project, params.clientOptions(), drift); err != nil {
+						unverified++
+						logger.Printf("Push subscription %s doesn't deliver: %v", drift.Resource, err)
+					} else if verified {
+						logger.Printf("Verified pushes from %s to %s", drift.Resource, drift.subscription.PushEndpoint)
+					}
+				}
+				logger.Printf("Healed %d of %d changes", healed, len(drifts))
+				if unverified > 0 {
+					return fmt.Errorf("%d push subscriptions failed verification", unverified)
+				}
+				return nil
+			})
+		}),
+	)
+}
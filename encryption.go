@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	sensitiveEncrypt = "encrypt"
+	sensitiveHash    = "hash"
+
+	// Encrypted values are prefixed with their format version, and hashed
+	// ones with the algorithm, so consumers can tell them from plaintext.
+	encryptedAttributePrefix = "enc:v1:"
+	hashedAttributePrefix    = "hmac-sha256:"
+
+	kmsUnwrapTimeout = 30 * time.Second
+)
+
+// AttributeEncryptionConfig holds the key that protects the attributes
+// topics mark as sensitive, keeping PII out of the plaintext attributes
+// visible in the console.
+type AttributeEncryptionConfig struct {
+	// Key is a base64-encoded 32-byte key, from which an AES-256-GCM key
+	// for encrypted attributes and an HMAC-SHA256 key for hashed ones are
+	// derived. Defaults to the ATTRIBUTE_ENCRYPTION_KEY environment
+	// variable.
+	Key string `yaml:"key"`
+	// KMSKey, e.g. projects/p/locations/l/keyRings/r/cryptoKeys/k, makes
+	// Key a key wrapped with that Cloud KMS key, which is unwrapped on
+	// startup, so the key itself is never in config or the environment.
+	KMSKey string `yaml:"kms_key"`
+}
+
+// validSensitiveAttributes checks the modes of a topic's sensitive
+// attributes.
+func validSensitiveAttributes(attributes map[string]string) error {
+	for name, mode := range attributes {
+		if mode != sensitiveEncrypt && mode != sensitiveHash {
+			return fmt.Errorf("sensitive attribute %s: mode must be %s or %s", name, sensitiveEncrypt, sensitiveHash)
+		}
+	}
+	return nil
+}
+
+// AttributeCipher encrypts or hashes sensitive attributes before publish
+// and decrypts encrypted ones for handlers. Without a key it protects
+// nothing, and config validation makes sure no topic needs it to.
+type AttributeCipher struct {
+	aead    cipher.AEAD
+	hashKey []byte
+}
+
+func newAttributeCipher(config Config) (*AttributeCipher, error) {
+	encryption := config.AttributeEncryption
+	if encryption.Key == "" {
+		encryption.Key = os.Getenv("ATTRIBUTE_ENCRYPTION_KEY")
+	}
+	if encryption.Key == "" {
+		for _, topic := range config.Topics {
+			if len(topic.SensitiveAttributes) > 0 {
+				return nil, fmt.Errorf("topic %s has sensitive attributes but attribute_encryption has no key", topic.Name)
+			}
+		}
+		return &AttributeCipher{}, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encryption.Key)
+	if err != nil {
+		return nil, fmt.Errorf("attribute_encryption: key isn't base64: %w", err)
+	}
+	if encryption.KMSKey != "" {
+		if key, err = unwrapKey(encryption.KMSKey, key); err != nil {
+			return nil, fmt.Errorf("attribute_encryption: unwrapping key with %s: %w", encryption.KMSKey, err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("attribute_encryption: key is %d bytes, not 32", len(key))
+	}
+	block, err := aes.NewCipher(deriveKey(key, "attribute encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AttributeCipher{aead: aead, hashKey: deriveKey(key, "attribute hashing")}, nil
+}
+
+// unwrapKey decrypts wrapped with the Cloud KMS key name.
+func unwrapKey(name string, wrapped []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsUnwrapTimeout)
+	defer cancel()
+	client, err := kms.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	response, err := client.Decrypt(ctx, &kmspb.DecryptRequest{Name: name, Ciphertext: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return response.Plaintext, nil
+}
+
+// deriveKey derives a key for purpose from key, so encryption and hashing
+// never share one.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Seal replaces the values of the attributes topic marks as sensitive:
+// encrypted ones by their ciphertext, bound to the attribute's name so it
+// can't be moved to another, and hashed ones by a keyed hash, which stays
+// the same for the same value so consumers can still match on it.
+func (c *AttributeCipher) Seal(topic TopicConfig, attributes map[string]string) error {
+	for name, mode := range topic.SensitiveAttributes {
+		value, ok := attributes[name]
+		if !ok {
+			continue
+		}
+		if c.aead == nil {
+			return fmt.Errorf("attribute %s is sensitive but there's no attribute encryption key", name)
+		}
+		switch mode {
+		case sensitiveEncrypt:
+			nonce := make([]byte, c.aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return err
+			}
+			sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+			attributes[name] = encryptedAttributePrefix + base64.RawURLEncoding.EncodeToString(sealed)
+		case sensitiveHash:
+			mac := hmac.New(sha256.New, c.hashKey)
+			mac.Write([]byte(value))
+			attributes[name] = hashedAttributePrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		}
+	}
+	return nil
+}
+
+// Open returns msg as its handler sees it, with its encrypted attributes
+// decrypted. msg itself is left as is, so what's retried, quarantined or
+// recorded as a failure stays encrypted. A value that fails to decrypt
+// can't be handled, ever, so the error is permanent.
+func (c *AttributeCipher) Open(msg *pubsub.Message) (*pubsub.Message, error) {
+	var attributes map[string]string
+	for name, value := range msg.Attributes {
+		if !strings.HasPrefix(value, encryptedAttributePrefix) {
+			continue
+		}
+		if c.aead == nil {
+			return nil, Permanent(fmt.Errorf("attribute %s is encrypted but there's no attribute encryption key", name))
+		}
+		plaintext, err := c.open(name, strings.TrimPrefix(value, encryptedAttributePrefix))
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("decrypting attribute %s: %w", name, err))
+		}
+		if attributes == nil {
+			attributes = make(map[string]string, len(msg.Attributes))
+			for key, value := range msg.Attributes {
+				attributes[key] = value
+			}
+		}
+		attributes[name] = plaintext
+	}
+	if attributes == nil {
+		return msg, nil
+	}
+	opened := *msg
+	opened.Attributes = attributes
+	return &opened, nil
+}
+
+func (c *AttributeCipher) open(name string, value string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
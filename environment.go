@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type EnvironmentConfig struct {
+	// Name is the environment, e.g. staging. Defaults to the ENVIRONMENT
+	// environment variable; with neither set, IDs are used as configured.
+	Name string `yaml:"name"`
+	// Prefix and Suffix are added to every Pub/Sub topic and subscription
+	// ID in the config, with {env} replaced by Name. Without either, IDs
+	// are prefixed with "{env}.", e.g. staging.email-events.
+	Prefix string `yaml:"prefix"`
+	Suffix string `yaml:"suffix"`
+}
+
+var environmentName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// scope resolves the environment into the prefix and suffix it adds.
+func (e EnvironmentConfig) scope() (string, string, error) {
+	if e.Name == "" {
+		if strings.Contains(e.Prefix+e.Suffix, "{env}") {
+			return "", "", fmt.Errorf("environment: prefix or suffix uses {env} but no name is set")
+		}
+		return e.Prefix, e.Suffix, nil
+	}
+	if !environmentName.MatchString(e.Name) {
+		return "", "", fmt.Errorf("environment: invalid name %q", e.Name)
+	}
+	prefix, suffix := e.Prefix, e.Suffix
+	if prefix == "" && suffix == "" {
+		prefix = "{env}."
+	}
+	return strings.ReplaceAll(prefix, "{env}", e.Name), strings.ReplaceAll(suffix, "{env}", e.Name), nil
+}
+
+// applyEnvironment scopes every Pub/Sub resource ID in config to the
+// environment, so the same file can be deployed to each one. Names used on
+// the HTTP API and admin routes are left alone, and so is everything
+// derived from the IDs later, like retry stages, which picks up the scoped
+// IDs.
+func applyEnvironment(config *Config) error {
+	if config.Environment.Name == "" {
+		config.Environment.Name = os.Getenv("ENVIRONMENT")
+	}
+	prefix, suffix, err := config.Environment.scope()
+	if err != nil || prefix == "" && suffix == "" {
+		return err
+	}
+	scoped := func(id *string) {
+		if *id != "" {
+			*id = prefix + *id + suffix
+		}
+	}
+	for i := range config.Topics {
+		topic := &config.Topics[i]
+		scoped(&topic.Id)
+		if topic.Failover != nil {
+			scoped(&topic.Failover.Topic)
+		}
+		if topic.DebugSample != nil {
+			scoped(&topic.DebugSample.Topic)
+		}
+		if topic.Priority != nil {
+			for lane, id := range topic.Priority.Topics {
+				scoped(&id)
+				topic.Priority.Topics[lane] = id
+			}
+		}
+	}
+	for i := range config.Subscriptions {
+		subscription := &config.Subscriptions[i]
+		scoped(&subscription.Id)
+		scoped(&subscription.Topic)
+		if subscription.DeadLetter != nil {
+			scoped(&subscription.DeadLetter.Topic)
+		}
+		if quarantine := subscription.Quarantine; quarantine != nil {
+			scoped(&quarantine.Topic)
+			scoped(&quarantine.Subscription)
+		}
+		if retry := subscription.Retry; retry != nil {
+			scoped(&retry.DeadLetterTopic)
+			scoped(&retry.DeadLetterSubscription)
+		}
+	}
+	return nil
+}
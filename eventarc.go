@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Eventarc's CloudEvents extension attributes for Cloud Audit Logs and Cloud
+// Storage events, and the attributes they're normalized to on republish.
+var eventarcAttributes = map[string]string{
+	"servicename":  "audit_service_name",
+	"methodname":   "audit_method_name",
+	"resourcename": "audit_resource_name",
+	"bucket":       "storage_bucket",
+}
+
+const eventarcStorageObjectAttribute = "storage_object"
+
+type EventarcRoute struct {
+	// Type and Source are path.Match patterns on the event's type and
+	// source, e.g. "google.cloud.storage.object.v1.*". Source may be empty
+	// to match any source.
+	Type   string `yaml:"type" firestore:"type" json:"type"`
+	Source string `yaml:"source" firestore:"source" json:"source,omitempty"`
+	// Topic is the registered topic name events are republished to.
+	Topic string `yaml:"topic" firestore:"topic" json:"topic"`
+}
+
+type EventarcConfig struct {
+	// Routes are tried in order and the first match wins. Events matching
+	// none are acknowledged and dropped.
+	Routes []EventarcRoute `yaml:"routes"`
+}
+
+func (r EventarcRoute) validatePatterns() error {
+	for _, pattern := range []string{r.Type, r.Source} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (r EventarcRoute) matches(event *CloudEvent) bool {
+	if ok, _ := path.Match(r.Type, event.Type); !ok {
+		return false
+	}
+	if r.Source == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Source, event.Source)
+	return ok
+}
+
+// parseHTTPCloudEvent decodes a CloudEvent delivered over HTTP in either
+// content mode, as Eventarc does.
+func parseHTTPCloudEvent(r *http.Request) (*CloudEvent, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	event := new(CloudEvent)
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == cloudEventsContentType {
+		if err := json.Unmarshal(body, event); err != nil {
+			return nil, fmt.Errorf("invalid structured CloudEvent: %w", err)
+		}
+		return event, event.validate()
+	}
+	if r.Header.Get(cloudEventsAttributePrefix+"specversion") == "" {
+		return nil, errNotCloudEvent
+	}
+	for key, values := range r.Header {
+		name, ok := strings.CutPrefix(strings.ToLower(key), cloudEventsAttributePrefix)
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if err := event.set(name, values[0]); err != nil {
+			return nil, err
+		}
+	}
+	event.DataContentType = contentType
+	event.Data = body
+	return event, event.validate()
+}
+
+// normalizedAttributes lifts the parts of Eventarc events that consumers
+// filter on into plain message attributes.
+func normalizedAttributes(event *CloudEvent) map[string]string {
+	attributes := make(map[string]string)
+	for extension, attribute := range eventarcAttributes {
+		if value, ok := event.Extensions[extension]; ok {
+			attributes[attribute] = value
+		}
+	}
+	if object, ok := strings.CutPrefix(event.Subject, "objects/"); ok && strings.HasPrefix(event.Type, "google.cloud.storage.") {
+		attributes[eventarcStorageObjectAttribute] = object
+	}
+	return attributes
+}
+
+// EventarcHandler receives events from Eventarc triggers and republishes
+// them as CloudEvents to registered topics, so the service can act as the
+// ingestion point for Google Cloud sources.
+type EventarcHandler struct {
+	logger   *log.Logger
+	registry *TopicRegistry
+	messages *MessageLogger
+	// router has the routes in effect, config.Eventarc.Routes unless
+	// routing comes from Firestore.
+	router *Router
+}
+
+func newEventarcHandler(registry *TopicRegistry, messages *MessageLogger, router *Router) *EventarcHandler {
+	return &EventarcHandler{
+		logger:   newLogger("eventarc"),
+		registry: registry,
+		messages: messages,
+		router:   router,
+	}
+}
+
+func (h *EventarcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	event, err := parseHTTPCloudEvent(&http.Request{Header: r.Header, Body: http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)})
+	if err != nil {
+		eventarcEvents.WithLabelValues("", "invalid").Inc()
+		http.Error(w, "Invalid event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var route *EventarcRoute
+	routes := h.router.EventarcRoutes()
+	for i := range routes {
+		if routes[i].matches(event) {
+			route = &routes[i]
+			break
+		}
+	}
+	if route == nil {
+		// Eventarc retries non-2xx responses, which wouldn't help.
+		requestLogger(h.logger, r).Printf("Dropping event %s of type %s from %s: no matching route", event.Id, event.Type, event.Source)
+		eventarcEvents.WithLabelValues("", "unrouted").Inc()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	registered, ok := h.registry.Lookup(route.Topic)
+	if !ok {
+		eventarcEvents.WithLabelValues(route.Topic, "error").Inc()
+		http.Error(w, "Unknown topic", http.StatusInternalServerError)
+		return
+	}
+
+	mode := cloudEventsModeBinary
+	if registered.Config.CloudEvents != nil {
+		mode = registered.Config.CloudEvents.Mode
+	}
+	msg, err := event.Message(mode, normalizedAttributes(event))
+	if err == nil {
+		err = validatePubSubLimits(msg)
+	}
+	if err != nil {
+		eventarcEvents.WithLabelValues(route.Topic, "invalid").Inc()
+		http.Error(w, "Invalid event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg.OrderingKey = registered.OrderingKeyFor(event.Data)
+	started := time.Now()
+	messageId, err := registered.Publish(r.Context(), msg)
+	observePublishRequest(r.Context(), registered.Config.Name, received, err)
+	h.messages.Log(msg, messageOutcome{Event: "eventarc_republish", Resource: route.Topic, MessageId: messageId, Duration: time.Since(started), Err: err, Request: r})
+	if err != nil {
+		eventarcEvents.WithLabelValues(route.Topic, "error").Inc()
+		// Eventarc retries 429s and 5xxs, honouring Retry-After.
+		writePublishError(w, route.Topic, "Failed to publish", err)
+		return
+	}
+	eventarcEvents.WithLabelValues(route.Topic, "ok").Inc()
+	w.WriteHeader(http.StatusNoContent)
+}
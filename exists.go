@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultExistsTTL = 5 * time.Minute
+
+// TopicExistsCache remembers topic.Exists results so callers on hot paths
+// don't hit the admin API. A result older than the TTL is still returned,
+// while a refresh runs in the background; only topics never checked, or
+// whose last check failed, are checked inline.
+type TopicExistsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*existsEntry
+}
+
+type existsEntry struct {
+	exists     bool
+	checkedAt  time.Time
+	refreshing bool
+}
+
+func newTopicExistsCache(config Config) *TopicExistsCache {
+	ttl := config.Health.ExistsTTL
+	if ttl == 0 {
+		ttl = defaultExistsTTL
+	}
+	return &TopicExistsCache{ttl: ttl, entries: make(map[string]*existsEntry)}
+}
+
+func (c *TopicExistsCache) Exists(ctx context.Context, topic *pubsub.Topic) (bool, error) {
+	name := topic.String()
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	if ok {
+		exists := entry.exists
+		if time.Since(entry.checkedAt) >= c.ttl && !entry.refreshing {
+			entry.refreshing = true
+			go c.refresh(topic)
+		}
+		c.mu.Unlock()
+		topicExistsLookups.WithLabelValues("hit").Inc()
+		return exists, nil
+	}
+	c.mu.Unlock()
+
+	topicExistsLookups.WithLabelValues("miss").Inc()
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return false, err
+	}
+	c.store(name, exists)
+	return exists, nil
+}
+
+func (c *TopicExistsCache) refresh(topic *pubsub.Topic) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		// Keep serving the previous result and retry on the next lookup.
+		c.mu.Lock()
+		if entry, ok := c.entries[topic.String()]; ok {
+			entry.refreshing = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.store(topic.String(), exists)
+}
+
+func (c *TopicExistsCache) store(name string, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = &existsEntry{exists: exists, checkedAt: time.Now()}
+}
+
+// Invalidate drops the cached result for topic, so the next lookup checks
+// again.
+func (c *TopicExistsCache) Invalidate(topic *pubsub.Topic) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, topic.String())
+}
+
+// invalidateOnNotFound drops topic from the cache if err says it no longer
+// exists.
+func (c *TopicExistsCache) invalidateOnNotFound(topic *pubsub.Topic, err error) {
+	if status.Code(err) == codes.NotFound {
+		c.Invalidate(topic)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	// expiresAtAttribute is when a message stops being worth delivering,
+	// in RFC 3339, e.g. for an email with a one-time code.
+	expiresAtAttribute = "expires_at"
+
+	expiredSubscriptionAttribute = "expired_subscription"
+	expiredMessageIdAttribute    = "expired_message_id"
+)
+
+// checkExpiresAt rejects an expires_at consumers couldn't parse, which
+// would otherwise be delivered however late.
+func checkExpiresAt(attributes map[string]string) error {
+	value, ok := attributes[expiresAtAttribute]
+	if !ok {
+		return nil
+	}
+	if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+		return fmt.Errorf("%s must be an RFC 3339 time: %w", expiresAtAttribute, err)
+	}
+	return nil
+}
+
+// expired reports whether msg is past its expires_at.
+func expired(msg *pubsub.Message, now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339Nano, msg.Attributes[expiresAtAttribute])
+	return err == nil && now.After(expiresAt)
+}
+
+// expire acks msg without handling it if it has expired, reporting whether
+// it did. With an expired topic, it's published there first, and nacked if
+// that fails so it isn't lost.
+func (s *Subscriber) expire(ctx context.Context, msg *pubsub.Message) bool {
+	if !expired(msg, time.Now()) {
+		return false
+	}
+	result := "dropped"
+	if s.expiredTopic != nil {
+		attributes := make(map[string]string, len(msg.Attributes)+2)
+		for key, value := range msg.Attributes {
+			attributes[key] = value
+		}
+		attributes[expiredSubscriptionAttribute] = s.Config.Id
+		attributes[expiredMessageIdAttribute] = msg.ID
+		_, err := s.expiredTopic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attributes}).Get(ctx)
+		if err != nil {
+			s.logger.Printf("Failed to publish expired message %s to %s: %v", msg.ID, s.Config.ExpiredTopic, err)
+			expiredMessages.WithLabelValues(s.Config.Name, "failed").Inc()
+			msg.Nack()
+			return true
+		}
+		result = "forwarded"
+	}
+	s.messages.Log(msg, messageOutcome{Event: "handle", Resource: s.Config.Name, MessageId: msg.ID, Result: "expired", Context: ctx})
+	expiredMessages.WithLabelValues(s.Config.Name, result).Inc()
+	messagesProcessed.WithLabelValues(s.Config.Name, "expired").Inc()
+	msg.Ack()
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	publishTargetPrimary   = "primary"
+	publishTargetSecondary = "secondary"
+	failoverProbeTimeout   = 10 * time.Second
+)
+
+type FailoverConfig struct {
+	// Topic is the secondary topic ID. Defaults to the primary's Id.
+	Topic string `yaml:"topic"`
+	// Project is the secondary topic's project. Defaults to PROJECT_ID.
+	Project string `yaml:"project"`
+	// Endpoint is the Pub/Sub endpoint for the secondary, e.g. a regional
+	// one such as "europe-west1-pubsub.googleapis.com:443".
+	Endpoint string `yaml:"endpoint"`
+	// ErrorThreshold is how many consecutive primary publish failures
+	// trigger failover.
+	ErrorThreshold int `yaml:"error_threshold"`
+	// ProbeInterval is how often the primary is checked while failed over,
+	// and HealthyProbes how many consecutive successful checks fail back.
+	ProbeInterval time.Duration `yaml:"probe_interval"`
+	HealthyProbes int           `yaml:"healthy_probes"`
+}
+
+// Failover tracks whether a topic's publishes go to its primary or its
+// secondary. Switching targets can reorder messages that share an ordering
+// key, since the two topics are independent.
+type Failover struct {
+	config FailoverConfig
+	client *pubsub.Client
+
+	failures atomic.Int64
+	active   atomic.Bool
+}
+
+func (f *Failover) target() string {
+	if f.active.Load() {
+		return publishTargetSecondary
+	}
+	return publishTargetPrimary
+}
+
+// recordFailure counts a failed publish to the primary and reports whether
+// publishes should now go to the secondary.
+func (f *Failover) recordFailure(t *RegisteredTopic, err error) bool {
+	if f.failures.Add(1) >= int64(f.config.ErrorThreshold) && f.active.CompareAndSwap(false, true) {
+		newLogger("failover").Printf("Topic %s failing over to %s/%s after %d consecutive errors, last: %v", t.Config.Name, f.config.Project, f.config.Topic, f.config.ErrorThreshold, err)
+		publishFailoverActive.WithLabelValues(t.Config.Name).Set(1)
+		publishFailovers.WithLabelValues(t.Config.Name, publishTargetSecondary).Inc()
+		auditLog.Emit(auditEvent{
+			Id:       auditFailoverActivated,
+			Resource: t.Config.Name,
+			Message:  fmt.Sprintf("Topic %s failed over to %s/%s", t.Config.Name, f.config.Project, f.config.Topic),
+			Details:  map[string]string{"secondary": "projects/" + f.config.Project + "/topics/" + f.config.Topic, "error": err.Error()},
+			Severity: logging.Warning,
+		})
+	}
+	return f.active.Load()
+}
+
+func (f *Failover) recordSuccess() {
+	f.failures.Store(0)
+}
+
+// probe checks the primary while failed over, failing back once it has
+// answered HealthyProbes times in a row.
+func (f *Failover) probe(ctx context.Context, t *RegisteredTopic) {
+	ticker := time.NewTicker(f.config.ProbeInterval)
+	defer ticker.Stop()
+	healthy := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !f.active.Load() {
+			healthy = 0
+			continue
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, failoverProbeTimeout)
+		exists, err := t.currentClient().Topic(t.Config.Id).Exists(probeCtx)
+		cancel()
+		if err != nil || !exists {
+			healthy = 0
+			continue
+		}
+		if healthy++; healthy < f.config.HealthyProbes {
+			continue
+		}
+		healthy = 0
+		f.failures.Store(0)
+		f.active.Store(false)
+		newLogger("failover").Printf("Topic %s failing back to primary after %d healthy probes", t.Config.Name, f.config.HealthyProbes)
+		publishFailoverActive.WithLabelValues(t.Config.Name).Set(0)
+		publishFailovers.WithLabelValues(t.Config.Name, publishTargetPrimary).Inc()
+		auditLog.Emit(auditEvent{
+			Id:       auditFailoverRestored,
+			Resource: t.Config.Name,
+			Message:  fmt.Sprintf("Topic %s failed back to its primary", t.Config.Name),
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// failureIndexPrefix is outside failureKeyPrefix, so listing failures
+	// doesn't list the index too.
+	failureIndexPrefix = "failure-index/"
+	// maxIndexedErrorBytes keeps index entries small; searches match the
+	// start of long errors.
+	maxIndexedErrorBytes = 1 << 10
+
+	failureIndexAll         = "all"
+	failureIndexMessageId   = "message_id"
+	failureIndexTenant      = "tenant"
+	failureIndexType        = "type"
+	failureIndexDestination = "destination"
+	failureIndexAttribute   = "attribute"
+)
+
+// failureIndexEntry is the metadata of a dead-lettered or quarantined
+// failure, stored under each of its index keys, so searches read these
+// instead of whole failures with their data.
+type failureIndexEntry struct {
+	Id          string            `json:"id"`
+	Resource    string            `json:"resource"`
+	Destination string            `json:"destination"`
+	MessageId   string            `json:"message_id,omitempty"`
+	Type        string            `json:"type,omitempty"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Error       string            `json:"error"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	FailedAt    time.Time         `json:"failed_at"`
+}
+
+func failureIndexKey(field string, value string) string {
+	return failureIndexPrefix + field + "/" + url.PathEscape(value) + "/"
+}
+
+// index adds failure to the index under its ID, tenant, event type,
+// destination and configured attributes, as well as under all. The keys
+// expire with the failure.
+func (s *FailureStore) index(ctx context.Context, failure Failure) error {
+	entry := failureIndexEntry{
+		Id:          failure.Id,
+		Resource:    failure.Resource,
+		Destination: failure.Destination,
+		MessageId:   failure.MessageId,
+		Type:        failure.Attributes[metadataEventType],
+		Tenant:      failure.Attributes[metadataTenant],
+		Error:       truncate(failure.Error, maxIndexedErrorBytes),
+		FailedAt:    failure.FailedAt,
+	}
+	keys := []string{failureIndexPrefix + failureIndexAll + "/", failureIndexKey(failureIndexDestination, entry.Destination)}
+	if entry.MessageId != "" {
+		keys = append(keys, failureIndexKey(failureIndexMessageId, entry.MessageId))
+	}
+	if entry.Type != "" {
+		keys = append(keys, failureIndexKey(failureIndexType, entry.Type))
+	}
+	if entry.Tenant != "" {
+		keys = append(keys, failureIndexKey(failureIndexTenant, entry.Tenant))
+	}
+	for _, attribute := range s.indexAttributes {
+		if value, ok := failure.Attributes[attribute]; ok {
+			if entry.Attributes == nil {
+				entry.Attributes = make(map[string]string, len(s.indexAttributes))
+			}
+			entry.Attributes[attribute] = value
+			keys = append(keys, failureIndexKey(failureIndexAttribute, attribute+"="+value))
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.store.Set(ctx, key+failure.Id, data, s.retention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failureSearch narrows dead-lettered and quarantined failures. Empty
+// fields match everything; Error matches a substring, case-insensitively.
+type failureSearch struct {
+	MessageId   string
+	Tenant      string
+	Type        string
+	Destination string
+	Resource    string
+	// Attribute and Value are one of the configured index attributes and
+	// the value it must have.
+	Attribute string
+	Value     string
+	Error     string
+	Since     time.Time
+	Until     time.Time
+}
+
+// key returns the index key with the fewest entries the search can read,
+// guessing that message IDs are rarer than tenants, and so on.
+func (f failureSearch) key() string {
+	switch {
+	case f.MessageId != "":
+		return failureIndexKey(failureIndexMessageId, f.MessageId)
+	case f.Attribute != "":
+		return failureIndexKey(failureIndexAttribute, f.Attribute+"="+f.Value)
+	case f.Tenant != "":
+		return failureIndexKey(failureIndexTenant, f.Tenant)
+	case f.Type != "":
+		return failureIndexKey(failureIndexType, f.Type)
+	case f.Destination != "":
+		return failureIndexKey(failureIndexDestination, f.Destination)
+	default:
+		return failureIndexPrefix + failureIndexAll + "/"
+	}
+}
+
+func (f failureSearch) matches(entry failureIndexEntry) bool {
+	return (f.MessageId == "" || entry.MessageId == f.MessageId) &&
+		(f.Tenant == "" || entry.Tenant == f.Tenant) &&
+		(f.Type == "" || entry.Type == f.Type) &&
+		(f.Destination == "" || entry.Destination == f.Destination) &&
+		(f.Resource == "" || entry.Resource == f.Resource) &&
+		(f.Attribute == "" || entry.Attributes[f.Attribute] == f.Value) &&
+		(f.Error == "" || strings.Contains(strings.ToLower(entry.Error), strings.ToLower(f.Error))) &&
+		(f.Since.IsZero() || !entry.FailedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.FailedAt.Before(f.Until))
+}
+
+// Search returns up to limit index entries of dead-lettered and
+// quarantined failures matching search, newest first. It reads one index
+// key, so it only scans the failures sharing its most selective field.
+func (s *FailureStore) Search(ctx context.Context, search failureSearch, limit int) ([]failureIndexEntry, error) {
+	entries, err := s.store.List(ctx, search.key(), 0)
+	if err != nil {
+		return nil, err
+	}
+	found := []failureIndexEntry{}
+	for i := len(entries) - 1; i >= 0 && len(found) < limit; i-- {
+		var entry failureIndexEntry
+		if err := json.Unmarshal(entries[i].Value, &entry); err != nil {
+			return nil, fmt.Errorf("%s: %w", entries[i].Key, err)
+		}
+		if search.matches(entry) {
+			found = append(found, entry)
+		}
+	}
+	return found, nil
+}
+
+// Search finds dead-lettered and quarantined failures by their metadata
+// from the index, rather than by listing every failure.
+func (h *FailureHandler) Search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultFailureLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	search := failureSearch{
+		MessageId:   query.Get("message_id"),
+		Tenant:      query.Get("tenant"),
+		Type:        query.Get("type"),
+		Destination: query.Get("destination"),
+		Resource:    query.Get("resource"),
+		Error:       query.Get("error"),
+	}
+	if value := query.Get("attribute"); value != "" {
+		attribute, expected, ok := strings.Cut(value, "=")
+		if !ok || !h.failures.indexed(attribute) {
+			http.Error(w, "Invalid attribute: it must be name=value, for an attribute in failures.index_attributes", http.StatusBadRequest)
+			return
+		}
+		search.Attribute, search.Value = attribute, expected
+	}
+	for name, bound := range map[string]*time.Time{"since": &search.Since, "until": &search.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*bound = parsed
+		}
+	}
+	found, err := h.failures.Search(r.Context(), search, limit)
+	if err != nil {
+		http.Error(w, "Failed to search failures: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(found)
+}
+
+func (s *FailureStore) indexed(attribute string) bool {
+	for _, indexed := range s.indexAttributes {
+		if indexed == attribute {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+type FailuresConfig struct {
+	// Retention is how long a failure is kept after it last changed.
+	// Defaults to 30 days.
+	Retention time.Duration `yaml:"retention"`
+	// IndexAttributes are attributes, besides tenant and event_type,
+	// that dead-lettered and quarantined failures can be searched by.
+	IndexAttributes []string `yaml:"index_attributes"`
+}
+
+const (
+	failureKeyPrefix = "failures/"
+	// maxFailureDataBytes keeps records within the store's value limits,
+	// e.g. Firestore's 1 MiB documents. Failures with more data can be
+	// triaged but not replayed.
+	maxFailureDataBytes = 256 << 10
+	defaultFailureLimit = 100
+
+	failureKindPublish = "publish"
+	failureKindConsume = "consume"
+
+	failureNew      = "new"
+	failureTriaged  = "triaged"
+	failureResolved = "resolved"
+	failureReplayed = "replayed"
+)
+
+// Failure is a message this service gave up on: a publish that failed, or
+// a message a subscriber dead-lettered or quarantined.
+type Failure struct {
+	Id   string `json:"id"`
+	Kind string `json:"kind"`
+	// Resource is the topic name for publishes and the subscription name
+	// for consumes.
+	Resource string `json:"resource"`
+	// Topic is the Pub/Sub topic ID replaying publishes to.
+	Topic     string `json:"topic"`
+	MessageId string `json:"message_id,omitempty"`
+	Error     string `json:"error"`
+	// Destination is where a consumed message was moved to, e.g. the dead
+	// letter topic.
+	Destination string            `json:"destination,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	Data        []byte            `json:"data"`
+	Truncated   bool              `json:"truncated,omitempty"`
+
+	// Status is new, triaged, resolved or replayed.
+	Status    string    `json:"status"`
+	Note      string    `json:"note,omitempty"`
+	FailedAt  time.Time `json:"failed_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newFailure(kind string, resource string, topic string, msg *pubsub.Message, err error) Failure {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	now := time.Now().UTC()
+	failure := Failure{
+		// IDs sort in the order the failures happened.
+		Id:          now.Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix[:]),
+		Kind:        kind,
+		Resource:    resource,
+		Topic:       topic,
+		MessageId:   msg.ID,
+		Error:       err.Error(),
+		Attributes:  msg.Attributes,
+		OrderingKey: msg.OrderingKey,
+		Data:        msg.Data,
+		Status:      failureNew,
+		FailedAt:    now,
+		UpdatedAt:   now,
+	}
+	if len(failure.Data) > maxFailureDataBytes {
+		failure.Data, failure.Truncated = failure.Data[:maxFailureDataBytes], true
+	}
+	return failure
+}
+
+// FailureStore keeps failures in the store for triage, so they don't only
+// live in logs.
+type FailureStore struct {
+	logger          *log.Logger
+	store           Store
+	retention       time.Duration
+	indexAttributes []string
+}
+
+func newFailureStore(config Config, store Store) *FailureStore {
+	return &FailureStore{logger: newLogger("failures"), store: store, retention: config.Failures.Retention, indexAttributes: config.Failures.IndexAttributes}
+}
+
+// Record saves failure, logging rather than returning errors, as its
+// callers have already given up on the message. Failures moved to a dead
+// letter or quarantine topic are indexed for searching too.
+func (s *FailureStore) Record(ctx context.Context, failure Failure) {
+	failuresRecorded.WithLabelValues(failure.Kind, failure.Resource).Inc()
+	if err := s.save(ctx, failure); err != nil {
+		s.logger.Printf("Failed to record %s failure of message %s on %s: %v", failure.Kind, failure.MessageId, failure.Resource, err)
+		return
+	}
+	if failure.Destination == "" {
+		return
+	}
+	if err := s.index(ctx, failure); err != nil {
+		s.logger.Printf("Failed to index failure %s of message %s on %s: %v", failure.Id, failure.MessageId, failure.Resource, err)
+	}
+}
+
+func (s *FailureStore) save(ctx context.Context, failure Failure) error {
+	data, err := json.Marshal(failure)
+	if err != nil {
+		return err
+	}
+	return s.store.Set(ctx, failureKeyPrefix+failure.Id, data, s.retention)
+}
+
+func (s *FailureStore) Get(ctx context.Context, id string) (Failure, error) {
+	var failure Failure
+	data, err := s.store.Get(ctx, failureKeyPrefix+id)
+	if err != nil {
+		return failure, err
+	}
+	err = json.Unmarshal(data, &failure)
+	return failure, err
+}
+
+type failureFilter struct {
+	Kind     string
+	Resource string
+	Status   string
+}
+
+func (f failureFilter) matches(failure Failure) bool {
+	return (f.Kind == "" || failure.Kind == f.Kind) &&
+		(f.Resource == "" || failure.Resource == f.Resource) &&
+		(f.Status == "" || failure.Status == f.Status)
+}
+
+// List returns up to limit failures matching filter, newest first.
+func (s *FailureStore) List(ctx context.Context, filter failureFilter, limit int) ([]Failure, error) {
+	entries, err := s.store.List(ctx, failureKeyPrefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	failures := []Failure{}
+	for i := len(entries) - 1; i >= 0 && len(failures) < limit; i-- {
+		var failure Failure
+		if err := json.Unmarshal(entries[i].Value, &failure); err != nil {
+			return nil, fmt.Errorf("%s: %w", entries[i].Key, err)
+		}
+		if filter.matches(failure) {
+			failures = append(failures, failure)
+		}
+	}
+	return failures, nil
+}
+
+type failureUpdate struct {
+	// Status is new, triaged or resolved; failures are only marked replayed
+	// by replaying them.
+	Status string  `json:"status"`
+	Note   *string `json:"note,omitempty"`
+}
+
+type FailureHandler struct {
+	logger   *log.Logger
+	failures *FailureStore
+	registry *TopicRegistry
+	client   *pubsub.Client
+}
+
+func newFailureHandler(failures *FailureStore, registry *TopicRegistry, client *pubsub.Client) *FailureHandler {
+	return &FailureHandler{logger: newLogger("failures"), failures: failures, registry: registry, client: client}
+}
+
+func (h *FailureHandler) List(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultFailureLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	filter := failureFilter{Kind: query.Get("kind"), Resource: query.Get("resource"), Status: query.Get("status")}
+	failures, err := h.failures.List(r.Context(), filter, limit)
+	if err != nil {
+		http.Error(w, "Failed to list failures: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failures)
+}
+
+func (h *FailureHandler) Get(w http.ResponseWriter, r *http.Request) {
+	failure, ok := h.lookup(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failure)
+}
+
+// Update moves a failure through triage and sets its note.
+func (h *FailureHandler) Update(w http.ResponseWriter, r *http.Request) {
+	var update failureUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&update); err != nil {
+		http.Error(w, "Invalid update: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch update.Status {
+	case "", failureNew, failureTriaged, failureResolved:
+	default:
+		http.Error(w, "Invalid update: status must be new, triaged or resolved", http.StatusBadRequest)
+		return
+	}
+	failure, ok := h.lookup(w, r)
+	if !ok {
+		return
+	}
+	if update.Status != "" {
+		failure.Status = update.Status
+	}
+	if update.Note != nil {
+		failure.Note = *update.Note
+	}
+	h.save(w, r, failure, "Marked failure %s %s", failure.Id, failure.Status)
+}
+
+// Replay publishes a failed message again, to the topic it was published
+// to or the topic of the subscription that gave up on it, without the
+// attributes retries and quarantine added.
+func (h *FailureHandler) Replay(w http.ResponseWriter, r *http.Request) {
+	failure, ok := h.lookup(w, r)
+	if !ok {
+		return
+	}
+	if failure.Truncated {
+		http.Error(w, "The failure's data was truncated when it was recorded, so it can't be replayed", http.StatusConflict)
+		return
+	}
+	attributes := make(map[string]string, len(failure.Attributes))
+	for key, value := range failure.Attributes {
+		if !strings.HasPrefix(key, retryAttributePrefix) && !strings.HasPrefix(key, quarantineAttributePrefix) && !strings.HasPrefix(key, traceAttributePrefix) {
+			attributes[key] = value
+		}
+	}
+	msg := &pubsub.Message{Data: failure.Data, Attributes: attributes, OrderingKey: failure.OrderingKey}
+
+	var messageId string
+	var err error
+	if registered, ok := h.registry.Lookup(failure.Resource); ok && failure.Kind == failureKindPublish {
+		messageId, err = registered.Publish(r.Context(), msg)
+	} else {
+		topic := h.client.Topic(failure.Topic)
+		topic.EnableMessageOrdering = msg.OrderingKey != ""
+		messageId, err = topic.Publish(r.Context(), msg).Get(r.Context())
+		topic.Stop()
+	}
+	if err != nil {
+		writePublishError(w, failure.Resource, "Failed to replay", err)
+		return
+	}
+	failure.Status = failureReplayed
+	failure.Note = strings.TrimSpace(failure.Note + "\nReplayed as message " + messageId)
+	h.save(w, r, failure, "Replayed failure %s to %s as message %s", failure.Id, failure.Topic, messageId)
+}
+
+func (h *FailureHandler) save(w http.ResponseWriter, r *http.Request, failure Failure, format string, args ...interface{}) {
+	failure.UpdatedAt = time.Now().UTC()
+	if err := h.failures.save(r.Context(), failure); err != nil {
+		http.Error(w, "Failed to save failure: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(h.logger, r).Printf(format, args...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failure)
+}
+
+func (h *FailureHandler) lookup(w http.ResponseWriter, r *http.Request) (Failure, bool) {
+	failure, err := h.failures.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Unknown failure", http.StatusNotFound)
+		return failure, false
+	} else if err != nil {
+		http.Error(w, "Failed to get failure: "+err.Error(), http.StatusInternalServerError)
+		return failure, false
+	}
+	return failure, true
+}
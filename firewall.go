@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// armorSrcIPsExpr is the only Cloud Armor match the firewall evaluates:
+// the client address against srcIpRanges.
+const armorSrcIPsExpr = "SRC_IPS_V1"
+
+type FirewallConfig struct {
+	// ForwardedHops is how many proxies in front of the service append to
+	// X-Forwarded-For, so the client is that many addresses from its end.
+	// Zero, the default, takes the client to be the connection's peer, for
+	// deployments without a load balancer in front.
+	ForwardedHops int `yaml:"forwarded_hops"`
+	// Filters apply, in order, to the routes in their groups. A request to
+	// a route in no group isn't filtered.
+	Filters []RequestFilterConfig `yaml:"filters"`
+}
+
+type RequestFilterConfig struct {
+	// Name labels the filter's denials in logs and metrics.
+	Name string `yaml:"name"`
+	// Groups are the endpoint groups filtered, the tags routes are
+	// documented under such as admin or publish; * is every route.
+	Groups []string `yaml:"groups"`
+	// Rules allow or deny clients by address, in the format of Cloud Armor
+	// security policy rules, so they can move to a load balancer's policy
+	// as is. Clients no rule matches are allowed.
+	Rules []ArmorRuleConfig `yaml:"rules"`
+	// Methods are the HTTP methods allowed; empty allows any.
+	Methods []string `yaml:"methods"`
+	// DenyPaths are path.Match patterns of request paths to refuse, e.g.
+	// /admin/debug/*.
+	DenyPaths []string `yaml:"deny_paths"`
+	// MaxBodyBytes limits request bodies; zero doesn't.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// ArmorRuleConfig is a Cloud Armor security policy rule, as gcloud
+// exports it. Only src_ips matches and the allow and deny actions are
+// supported.
+type ArmorRuleConfig struct {
+	Description string `yaml:"description"`
+	// Priority orders the rules, lowest first; the first that matches
+	// decides.
+	Priority int32 `yaml:"priority"`
+	// Action is allow, or deny(403), deny(404) or deny(502) for the status
+	// denied requests get.
+	Action string `yaml:"action"`
+	// Preview logs and counts what the rule would do without enforcing it.
+	Preview bool `yaml:"preview"`
+	Match   struct {
+		VersionedExpr string `yaml:"versionedExpr"`
+		Config        struct {
+			// SrcIpRanges are CIDR ranges or addresses, or * for any.
+			SrcIpRanges []string `yaml:"srcIpRanges"`
+		} `yaml:"config"`
+	} `yaml:"match"`
+}
+
+func (c FirewallConfig) validate() error {
+	if c.ForwardedHops < 0 {
+		return fmt.Errorf("forwarded_hops can't be negative")
+	}
+	for i, filter := range c.Filters {
+		if _, err := compileRequestFilter(filter); err != nil {
+			name := filter.Name
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			return fmt.Errorf("filter %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+type armorRule struct {
+	priority int32
+	allow    bool
+	status   int
+	preview  bool
+	any      bool
+	ranges   []netip.Prefix
+}
+
+func (r armorRule) matches(addr netip.Addr) bool {
+	if r.any {
+		return true
+	}
+	for _, prefix := range r.ranges {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type requestFilter struct {
+	name      string
+	groups    map[string]bool
+	rules     []armorRule
+	methods   map[string]bool
+	denyPaths []string
+	maxBody   int64
+}
+
+func compileRequestFilter(config RequestFilterConfig) (requestFilter, error) {
+	filter := requestFilter{name: config.Name, groups: make(map[string]bool), denyPaths: config.DenyPaths, maxBody: config.MaxBodyBytes}
+	if filter.name == "" {
+		filter.name = strings.Join(config.Groups, ",")
+	}
+	if len(config.Groups) == 0 {
+		return filter, fmt.Errorf("groups are required")
+	}
+	for _, group := range config.Groups {
+		filter.groups[group] = true
+	}
+	if config.MaxBodyBytes < 0 {
+		return filter, fmt.Errorf("max_body_bytes can't be negative")
+	}
+	if len(config.Methods) > 0 {
+		filter.methods = make(map[string]bool, len(config.Methods))
+		for _, method := range config.Methods {
+			filter.methods[strings.ToUpper(method)] = true
+		}
+	}
+	for _, pattern := range config.DenyPaths {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return filter, fmt.Errorf("deny_paths: %q: %w", pattern, err)
+		}
+	}
+	priorities := make(map[int32]bool, len(config.Rules))
+	for _, ruleConfig := range config.Rules {
+		if priorities[ruleConfig.Priority] {
+			return filter, fmt.Errorf("two rules have priority %d", ruleConfig.Priority)
+		}
+		priorities[ruleConfig.Priority] = true
+		rule := armorRule{priority: ruleConfig.Priority, preview: ruleConfig.Preview}
+		switch ruleConfig.Action {
+		case "allow":
+			rule.allow = true
+		case "deny", "deny(403)":
+			rule.status = http.StatusForbidden
+		case "deny(404)":
+			rule.status = http.StatusNotFound
+		case "deny(502)":
+			rule.status = http.StatusBadGateway
+		default:
+			return filter, fmt.Errorf("rule %d: action %q isn't supported, use allow or deny(403|404|502)", rule.priority, ruleConfig.Action)
+		}
+		if expr := ruleConfig.Match.VersionedExpr; expr != "" && expr != armorSrcIPsExpr {
+			return filter, fmt.Errorf("rule %d: only %s matches are supported", rule.priority, armorSrcIPsExpr)
+		}
+		if len(ruleConfig.Match.Config.SrcIpRanges) == 0 {
+			return filter, fmt.Errorf("rule %d: srcIpRanges are required", rule.priority)
+		}
+		for _, value := range ruleConfig.Match.Config.SrcIpRanges {
+			if value == "*" {
+				rule.any = true
+				continue
+			}
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(value)
+				if addrErr != nil {
+					return filter, fmt.Errorf("rule %d: %q isn't a CIDR range or address", rule.priority, value)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			rule.ranges = append(rule.ranges, prefix.Masked())
+		}
+		filter.rules = append(filter.rules, rule)
+	}
+	sort.Slice(filter.rules, func(i, j int) bool { return filter.rules[i].priority < filter.rules[j].priority })
+	return filter, nil
+}
+
+// Firewall filters requests by client address, method, path and body size
+// before they reach authentication, as defense in depth for deployments
+// without a load balancer and Cloud Armor in front.
+type Firewall struct {
+	logger        *log.Logger
+	forwardedHops int
+	filters       []requestFilter
+}
+
+func newFirewall(config Config) (*Firewall, error) {
+	firewall := &Firewall{logger: newLogger("firewall"), forwardedHops: config.Firewall.ForwardedHops}
+	for _, filterConfig := range config.Firewall.Filters {
+		filter, err := compileRequestFilter(filterConfig)
+		if err != nil {
+			return nil, fmt.Errorf("firewall: %w", err)
+		}
+		firewall.filters = append(firewall.filters, filter)
+	}
+	return firewall, nil
+}
+
+// clientAddr is the address of the client that sent r, or an invalid
+// address if it can't be told.
+func (f *Firewall) clientAddr(r *http.Request) netip.Addr {
+	value := r.RemoteAddr
+	if f.forwardedHops > 0 {
+		var forwarded []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				forwarded = append(forwarded, strings.TrimSpace(hop))
+			}
+		}
+		if len(forwarded) < f.forwardedHops {
+			return netip.Addr{}
+		}
+		value = forwarded[len(forwarded)-f.forwardedHops]
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// Wrap returns route's handler behind the filters of the groups it's in.
+func (f *Firewall) Wrap(route Route) http.Handler {
+	var filters []requestFilter
+	for _, filter := range f.filters {
+		if filter.groups["*"] || filter.groups[route.Doc.Tag] {
+			filters = append(filters, filter)
+		}
+	}
+	if len(filters) == 0 {
+		return route.Handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := f.clientAddr(r)
+		for _, filter := range filters {
+			if status, reason := f.check(filter, addr, r); status != 0 {
+				requestLogger(f.logger, r).Printf("Denied %s %s from %s by filter %s: %s", r.Method, r.URL.Path, addr, filter.name, reason)
+				firewallDenials.WithLabelValues(filter.name, reason).Inc()
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			if filter.maxBody > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, filter.maxBody)
+			}
+		}
+		route.Handler.ServeHTTP(w, r)
+	})
+}
+
+// check returns the status to deny r with, and why, or zero to let it
+// through.
+func (f *Firewall) check(filter requestFilter, addr netip.Addr, r *http.Request) (int, string) {
+	if filter.methods != nil && !filter.methods[r.Method] {
+		return http.StatusMethodNotAllowed, "method"
+	}
+	for _, pattern := range filter.denyPaths {
+		if matched, _ := path.Match(pattern, r.URL.Path); matched {
+			return http.StatusForbidden, "path"
+		}
+	}
+	if filter.maxBody > 0 && r.ContentLength > filter.maxBody {
+		return http.StatusRequestEntityTooLarge, "size"
+	}
+	for _, rule := range filter.rules {
+		// A client whose address can't be told only matches rules for any.
+		if !(rule.any || addr.IsValid() && rule.matches(addr)) {
+			continue
+		}
+		if rule.preview {
+			if !rule.allow {
+				requestLogger(f.logger, r).Printf("Preview: filter %s rule %d would deny %s %s from %s", filter.name, rule.priority, r.Method, r.URL.Path, addr)
+				firewallDenials.WithLabelValues(filter.name, "preview").Inc()
+			}
+			continue
+		}
+		if rule.allow {
+			return 0, ""
+		}
+		return rule.status, "ip"
+	}
+	return 0, ""
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+)
+
+const (
+	publishGroupKeyPrefix   = "publish-groups/"
+	publishGroupLeasePrefix = "publish-group-leases/"
+
+	// Every message of a group carries its ID, its position among the
+	// group's messages and their number. Once they're all published, each
+	// topic they went to gets a marker message with publish_group_complete
+	// set and publish_group_count, how many of them went to that topic.
+	publishGroupIdAttribute       = "publish_group_id"
+	publishGroupIndexAttribute    = "publish_group_index"
+	publishGroupSizeAttribute     = "publish_group_size"
+	publishGroupCompleteAttribute = "publish_group_complete"
+	publishGroupCountAttribute    = "publish_group_count"
+
+	defaultPublishGroupMaxMessages   = 100
+	defaultPublishGroupRelayInterval = 30 * time.Second
+)
+
+type PublishGroupConfig struct {
+	// MaxMessages a group can have. Defaults to 100.
+	MaxMessages int `yaml:"max_messages"`
+	// RelayInterval is how often groups left partly published, by a failed
+	// publish or an instance stopping, are looked for and finished.
+	// Defaults to 30s.
+	RelayInterval time.Duration `yaml:"relay_interval"`
+}
+
+func (c *PublishGroupConfig) validate() error {
+	if c.MaxMessages == 0 {
+		c.MaxMessages = defaultPublishGroupMaxMessages
+	}
+	if c.RelayInterval == 0 {
+		c.RelayInterval = defaultPublishGroupRelayInterval
+	}
+	if c.MaxMessages < 0 || c.RelayInterval < 0 {
+		return fmt.Errorf("max_messages and relay_interval can't be negative")
+	}
+	return nil
+}
+
+type publishGroupRequest struct {
+	Messages []publishGroupMessage `json:"messages"`
+}
+
+type publishGroupMessage struct {
+	Topic       string            `json:"topic"`
+	Data        json.RawMessage   `json:"data,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+}
+
+type publishGroupResponse struct {
+	GroupId string `json:"group_id"`
+	// MessageIds are in the order of the request, empty for the messages
+	// still pending.
+	MessageIds []string `json:"message_ids"`
+	Pending    bool     `json:"pending,omitempty"`
+}
+
+// stagedGroup is a group in the store until every message and marker of it
+// has been published.
+type stagedGroup struct {
+	Id       string          `json:"id"`
+	StagedAt time.Time       `json:"staged_at"`
+	Messages []stagedMessage `json:"messages"`
+}
+
+type stagedMessage struct {
+	Topic       string            `json:"topic"`
+	Data        []byte            `json:"data,omitempty"`
+	Attributes  map[string]string `json:"attributes"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	Marker      bool              `json:"marker,omitempty"`
+	// MessageId is set once the message has been published.
+	MessageId string `json:"message_id,omitempty"`
+}
+
+// PublishGroups publishes several related messages, to any topics, all or
+// none: the whole group is validated before anything is published, then
+// staged in the store, which commits it. Once it's staged every message
+// is published, by the request or, if that fails partway, by the relay,
+// followed by the completion markers, so consumers can tell a group is
+// whole. Messages may be published more than once if an instance stops
+// between publishing and recording them, so consumers should dedupe on the
+// group ID and index.
+type PublishGroups struct {
+	logger   *log.Logger
+	config   PublishGroupConfig
+	store    Store
+	registry *TopicRegistry
+	publish  *PublishHandler
+}
+
+func newPublishGroups(lifecycle fx.Lifecycle, config Config, store Store, registry *TopicRegistry, publish *PublishHandler) *PublishGroups {
+	groups := &PublishGroups{
+		logger:   newLogger("publish-groups"),
+		config:   config.PublishGroups,
+		store:    store,
+		registry: registry,
+		publish:  publish,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(context.Context) error {
+				go groups.run(ctx, done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				return nil
+			},
+		},
+	)
+	return groups
+}
+
+func newPublishGroupId() string {
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	// IDs sort in the order the groups were staged.
+	return time.Now().UTC().Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix[:])
+}
+
+func (g *PublishGroups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request publishGroupRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&request); err != nil {
+		http.Error(w, "Invalid publish group: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.Messages) == 0 {
+		http.Error(w, "Invalid publish group: no messages", http.StatusBadRequest)
+		return
+	}
+	if len(request.Messages) > g.config.MaxMessages {
+		http.Error(w, fmt.Sprintf("Invalid publish group: more than %d messages", g.config.MaxMessages), http.StatusBadRequest)
+		return
+	}
+	ctx := requestContext(r)
+	caller, authenticated := CallerFrom(ctx)
+	group := stagedGroup{Id: newPublishGroupId(), StagedAt: time.Now().UTC()}
+	counts := make(map[string]int)
+	var topics []*RegisteredTopic
+	for i, message := range request.Messages {
+		registered, ok := g.registry.Lookup(g.publish.router.Route(message.Topic, message.Attributes))
+		if !ok {
+			http.Error(w, fmt.Sprintf("Message %d: unknown topic %s", i, message.Topic), http.StatusNotFound)
+			return
+		}
+		if authenticated && !caller.Allows("publish:"+message.Topic) {
+			http.Error(w, fmt.Sprintf("Message %d: API key lacks scope publish:%s", i, message.Topic), http.StatusForbidden)
+			return
+		}
+		publishRequest := publishRequest{Data: message.Data, Attributes: message.Attributes, OrderingKey: message.OrderingKey}
+		msg, err := publishRequest.message(registered)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid publish group: message %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if msg.Attributes == nil {
+			msg.Attributes = make(map[string]string, 3)
+		}
+		msg.Attributes[publishGroupIdAttribute] = group.Id
+		msg.Attributes[publishGroupIndexAttribute] = strconv.Itoa(i)
+		msg.Attributes[publishGroupSizeAttribute] = strconv.Itoa(len(request.Messages))
+		if !g.stage(ctx, w, &group, registered, msg, i) {
+			return
+		}
+		// By the topic routed to, as aliases and splits can send messages
+		// named differently to the same one.
+		if counts[registered.Config.Name] == 0 {
+			topics = append(topics, registered)
+		}
+		counts[registered.Config.Name]++
+	}
+	for _, registered := range topics {
+		marker := &pubsub.Message{Attributes: map[string]string{
+			publishGroupIdAttribute:       group.Id,
+			publishGroupCompleteAttribute: "true",
+			publishGroupSizeAttribute:     strconv.Itoa(len(request.Messages)),
+			publishGroupCountAttribute:    strconv.Itoa(counts[registered.Config.Name]),
+		}}
+		if !g.stage(ctx, w, &group, registered, marker, -1) {
+			return
+		}
+	}
+
+	// Counted before staging, as staging commits the group to being
+	// published.
+	var refunds []func(error)
+	for _, staged := range group.Messages {
+		refund, err := g.publish.quotas.Reserve(ctx, &pubsub.Message{Data: staged.Data, Attributes: staged.Attributes})
+		if err != nil {
+			for _, refund := range refunds {
+				refund(err)
+			}
+			writeQuotaExceeded(w, err)
+			return
+		}
+		refunds = append(refunds, refund)
+	}
+	if err := g.save(ctx, group); err != nil {
+		for _, refund := range refunds {
+			refund(err)
+		}
+		http.Error(w, "Failed to stage publish group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Held while this request publishes, so the relay leaves the group be.
+	if _, err := g.lease(ctx, group.Id); err != nil {
+		g.logger.Printf("Failed to lease publish group %s: %v", group.Id, err)
+	}
+
+	deliverCtx, cancel := context.WithTimeout(ctx, g.config.RelayInterval)
+	defer cancel()
+	pending := g.deliver(deliverCtx, &group)
+	response := publishGroupResponse{GroupId: group.Id, Pending: pending}
+	for _, staged := range group.Messages {
+		if !staged.Marker {
+			response.MessageIds = append(response.MessageIds, staged.MessageId)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if pending {
+		publishGroups.WithLabelValues("pending").Inc()
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		publishGroups.WithLabelValues("published").Inc()
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// stage prepares msg for publishing to registered and adds it to group,
+// or responds with why it can't be published and returns false. index is
+// the message's position in the request, or -1 for a marker.
+func (g *PublishGroups) stage(ctx context.Context, w http.ResponseWriter, group *stagedGroup, registered *RegisteredTopic, msg *pubsub.Message, index int) bool {
+	msg, status, err := g.publish.prepare(ctx, registered, msg)
+	if err != nil {
+		what := fmt.Sprintf("message %d", index)
+		if index < 0 {
+			what = "completion marker for " + registered.Config.Name
+		}
+		if status == http.StatusInternalServerError {
+			http.Error(w, fmt.Sprintf("Failed to look up email template for %s: %v", what, err), status)
+		} else {
+			http.Error(w, fmt.Sprintf("Invalid publish group: %s: %v", what, err), status)
+		}
+		return false
+	}
+	group.Messages = append(group.Messages, stagedMessage{
+		Topic:       registered.Config.Name,
+		Data:        msg.Data,
+		Attributes:  msg.Attributes,
+		OrderingKey: msg.OrderingKey,
+		Marker:      index < 0,
+	})
+	return true
+}
+
+func (g *PublishGroups) save(ctx context.Context, group stagedGroup) error {
+	value, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	return g.store.Set(ctx, publishGroupKeyPrefix+group.Id, value, 0)
+}
+
+// deliver publishes the group's unpublished messages, then, once they all
+// are, its markers, and reports whether any are still pending. A group
+// with none pending is removed from the store; otherwise its progress is
+// saved for the relay.
+func (g *PublishGroups) deliver(ctx context.Context, group *stagedGroup) bool {
+	publish := func(markers bool) bool {
+		var (
+			wg     sync.WaitGroup
+			failed atomic.Bool
+		)
+		for i := range group.Messages {
+			staged := &group.Messages[i]
+			if staged.Marker != markers || staged.MessageId != "" {
+				continue
+			}
+			registered, ok := g.registry.Lookup(staged.Topic)
+			if !ok {
+				// Removed from config since the group was staged.
+				g.logger.Printf("Publish group %s: topic %s isn't registered", group.Id, staged.Topic)
+				failed.Store(true)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				msg := &pubsub.Message{Data: staged.Data, Attributes: staged.Attributes, OrderingKey: staged.OrderingKey}
+				messageId, err := registered.Publish(ctx, msg)
+				if err != nil {
+					g.logger.Printf("Publish group %s: failed to publish to %s: %v", group.Id, staged.Topic, err)
+					failed.Store(true)
+					return
+				}
+				staged.MessageId = messageId
+			}()
+		}
+		wg.Wait()
+		return !failed.Load()
+	}
+
+	// Markers only go out once every message has, so consumers that see
+	// one have seen the rest.
+	if publish(false) && publish(true) {
+		// Not the request's context, which may be done by now.
+		if err := g.store.Delete(context.WithoutCancel(ctx), publishGroupKeyPrefix+group.Id); err != nil {
+			g.logger.Printf("Failed to remove published group %s, it may be published again: %v", group.Id, err)
+		}
+		return false
+	}
+	if err := g.save(context.WithoutCancel(ctx), *group); err != nil {
+		g.logger.Printf("Failed to save the progress of publish group %s, its published messages may be published again: %v", group.Id, err)
+	}
+	return true
+}
+
+// lease claims the group for publishing for the relay interval, reporting
+// whether it was free.
+func (g *PublishGroups) lease(ctx context.Context, id string) (bool, error) {
+	return g.store.SetIfAbsent(ctx, publishGroupLeasePrefix+id, []byte(time.Now().UTC().Format(time.RFC3339)), g.config.RelayInterval)
+}
+
+// run relays the groups left pending until ctx is done.
+func (g *PublishGroups) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(g.config.RelayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := g.relay(ctx); err != nil && ctx.Err() == nil {
+			g.logger.Printf("Failed to relay pending publish groups: %v", err)
+		}
+	}
+}
+
+// relay delivers every pending group not leased by a request or another
+// instance's relay.
+func (g *PublishGroups) relay(ctx context.Context) error {
+	entries, err := g.store.List(ctx, publishGroupKeyPrefix, 0)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var group stagedGroup
+		if err := json.Unmarshal(entry.Value, &group); err != nil {
+			g.logger.Printf("Skipping unreadable publish group %s: %v", entry.Key, err)
+			continue
+		}
+		leased, err := g.lease(ctx, group.Id)
+		if err != nil {
+			return err
+		}
+		if !leased {
+			continue
+		}
+		deliverCtx, cancel := context.WithTimeout(ctx, g.config.RelayInterval)
+		pending := g.deliver(deliverCtx, &group)
+		cancel()
+		if !pending {
+			g.logger.Printf("Relayed publish group %s, staged %s ago", group.Id, time.Since(group.StagedAt).Round(time.Second))
+			publishGroups.WithLabelValues("relayed").Inc()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
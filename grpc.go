@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"go.uber.org/fx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"gcp-pubsub-test/healthcheck"
+)
+
+// grpcHealthWatchInterval is how often a Watch call rechecks the status it
+// streams.
+const grpcHealthWatchInterval = 5 * time.Second
+
+// The services the health service reports on, besides the overall status
+// under the empty name.
+const (
+	grpcHealthService    = "health"
+	grpcReadinessService = "readiness"
+)
+
+type GRPCConfig struct {
+	// Port serves gRPC on, alongside HTTP on 8080, for internal load
+	// balancers and service meshes that probe with the standard gRPC health
+	// checking protocol. Zero, the default, doesn't serve gRPC.
+	Port int `yaml:"port"`
+}
+
+// GRPCServer serves gRPC. For now that's only grpc.health.v1.Health, which
+// reports the HTTP health checks as the service health, backlog readiness
+// as readiness, and both as the overall status.
+type GRPCServer struct {
+	logger   *log.Logger
+	server   *grpc.Server
+	stopping chan struct{}
+}
+
+func newGRPCServer(lifecycle fx.Lifecycle, config Config, checks *healthcheck.Registry, readiness *BacklogMonitor, serverTLS *ServerTLS) *GRPCServer {
+	server := &GRPCServer{logger: newLogger("grpc"), stopping: make(chan struct{})}
+	if config.GRPC.Port == 0 {
+		return server
+	}
+	var options []grpc.ServerOption
+	if serverTLS.config != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(serverTLS.config)))
+	}
+	server.server = grpc.NewServer(options...)
+	healthpb.RegisterHealthServer(server.server, &grpcHealth{checks: checks, readiness: readiness, stopping: server.stopping})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(context.Context) error {
+				listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.GRPC.Port))
+				if err != nil {
+					return err
+				}
+				go func() {
+					if err := server.server.Serve(listener); err != nil {
+						server.logger.Fatal(err)
+					}
+				}()
+				return nil
+			},
+		},
+	)
+	return server
+}
+
+// stop reports NOT_SERVING to every watcher, so probes drain traffic away
+// first, then stops once in-flight calls finish, or when ctx is done.
+func (s *GRPCServer) stop(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	close(s.stopping)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.server.GracefulStop()
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return fmt.Errorf("gRPC calls still in flight: %w", ctx.Err())
+	}
+}
+
+type grpcHealth struct {
+	healthpb.UnimplementedHealthServer
+	checks    *healthcheck.Registry
+	readiness *BacklogMonitor
+	stopping  <-chan struct{}
+}
+
+// status returns the serving status of service, false if it's unknown.
+func (h *grpcHealth) status(ctx context.Context, service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	select {
+	case <-h.stopping:
+		return healthpb.HealthCheckResponse_NOT_SERVING, true
+	default:
+	}
+	var serving bool
+	switch service {
+	case "":
+		_, ready := h.readiness.report()
+		serving = ready && h.checks.Run(ctx).Healthy
+	case grpcHealthService:
+		serving = h.checks.Run(ctx).Healthy
+	case grpcReadinessService:
+		_, serving = h.readiness.report()
+	default:
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+	}
+	if !serving {
+		return healthpb.HealthCheckResponse_NOT_SERVING, true
+	}
+	return healthpb.HealthCheckResponse_SERVING, true
+}
+
+func (h *grpcHealth) Check(ctx context.Context, request *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	serving, ok := h.status(ctx, request.Service)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", request.Service)
+	}
+	return &healthpb.HealthCheckResponse{Status: serving}, nil
+}
+
+// Watch sends the status straight away, then again whenever it changes,
+// until the caller goes away or the server stops.
+func (h *grpcHealth) Watch(request *healthpb.HealthCheckRequest, stream grpc.ServerStreamingServer[healthpb.HealthCheckResponse]) error {
+	ticker := time.NewTicker(grpcHealthWatchInterval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		serving, _ := h.status(stream.Context(), request.Service)
+		if serving != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: serving}); err != nil {
+				return err
+			}
+			last = serving
+		}
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-h.stopping:
+			if last != healthpb.HealthCheckResponse_NOT_SERVING {
+				return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING})
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
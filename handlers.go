@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+)
+
+// Handler processes a single message. Returning an error nacks the message.
+type Handler func(ctx context.Context, msg *pubsub.Message) error
+
+// BatchHandler processes a batch of messages together, returning one result
+// per message in the same order. A nil result acks its message and an error
+// fails it as a Handler returning that error would.
+type BatchHandler func(ctx context.Context, msgs []*pubsub.Message) []error
+
+// HandlerRegistration registers a handler with the subscribers. Provide one
+// to the pubsub.handlers group, e.g.
+//
+//	fx.Provide(fx.Annotate(newOrderHandler, fx.ResultTags(`group:"pubsub.handlers"`)))
+//
+// and subscriptions can use it by name, or it can bind them itself, so
+// adding a handler takes only its constructor.
+type HandlerRegistration struct {
+	// Name is how subscriptions' handler refers to it.
+	Name string
+	// Handler handles messages one at a time, and Batch handles them for
+	// subscriptions with batch set. At least one must be set.
+	Handler Handler
+	Batch   BatchHandler
+	// Subscriptions, by name, use this handler without configuring it. Each
+	// must be configured, with no handler or this one.
+	Subscriptions []string
+	// Topics, if set, are the only topics a subscription using this handler
+	// may be attached to, so it's never given messages it doesn't expect.
+	Topics []string
+}
+
+// HandlerRegistrations are the handlers applications registered.
+type HandlerRegistrations struct {
+	fx.In
+	Registrations []HandlerRegistration `group:"pubsub.handlers"`
+}
+
+// builtinHandlers are registered with every HandlerRegistry.
+var builtinHandlers = []HandlerRegistration{
+	{
+		Name: "log",
+		Handler: func(ctx context.Context, msg *pubsub.Message) error {
+			logger := newLogger("handler")
+			if event, ok := CloudEventFrom(ctx); ok {
+				logger.Printf("Received CloudEvent %s (type %s, source %s, %d bytes) in message %s", event.Id, event.Type, event.Source, len(event.Data), msg.ID)
+				return nil
+			}
+			if metadata, err := MetadataFrom(msg); err != nil {
+				logger.Printf("Message %s has invalid metadata: %v", msg.ID, err)
+			} else if metadata.EventType != "" {
+				logger.Printf("Message %s is a %s event, version %d, of tenant %q", msg.ID, metadata.EventType, metadata.Version, metadata.Tenant)
+			}
+			if caller, ok := CallerFrom(ctx); ok {
+				logger.Printf("Received message %s (%d bytes, ordering key %q, attributes %v) published by %s", msg.ID, len(msg.Data), msg.OrderingKey, msg.Attributes, caller.Name)
+				return nil
+			}
+			logger.Printf("Received message %s (%d bytes, ordering key %q, attributes %v)", msg.ID, len(msg.Data), msg.OrderingKey, msg.Attributes)
+			return nil
+		},
+		Batch: func(ctx context.Context, msgs []*pubsub.Message) []error {
+			logger := newLogger("handler")
+			var size int
+			for _, msg := range msgs {
+				size += len(msg.Data)
+			}
+			logger.Printf("Received a batch of %d messages (%d bytes)", len(msgs), size)
+			return make([]error, len(msgs))
+		},
+	},
+}
+
+// HandlerRegistry routes each subscription to its handler: the one its
+// config names, or else the registration that binds it.
+type HandlerRegistry struct {
+	registrations map[string]HandlerRegistration
+	// bindings are the names of the handlers subscriptions use, by
+	// subscription name.
+	bindings map[string]string
+}
+
+func newHandlerRegistry(config Config, registered HandlerRegistrations) (*HandlerRegistry, error) {
+	registry := &HandlerRegistry{
+		registrations: make(map[string]HandlerRegistration),
+		bindings:      make(map[string]string),
+	}
+	subscriptions := make(map[string]SubscriptionConfig, len(config.Subscriptions))
+	for _, subscription := range config.Subscriptions {
+		subscriptions[subscription.Name] = subscription
+		if subscription.Handler != "" {
+			registry.bindings[subscription.Name] = subscription.Handler
+		}
+	}
+	for _, registration := range append(builtinHandlers, registered.Registrations...) {
+		if registration.Name == "" {
+			return nil, fmt.Errorf("handler registration has no name")
+		}
+		if registration.Name == webhookHandler {
+			return nil, fmt.Errorf("handler %s: name is reserved for webhook subscriptions", registration.Name)
+		}
+		if registration.Handler == nil && registration.Batch == nil {
+			return nil, fmt.Errorf("handler %s: registration has neither a handler nor a batch handler", registration.Name)
+		}
+		if _, ok := registry.registrations[registration.Name]; ok {
+			return nil, fmt.Errorf("handler %s is registered more than once", registration.Name)
+		}
+		registry.registrations[registration.Name] = registration
+		for _, name := range registration.Subscriptions {
+			subscription, ok := subscriptions[name]
+			if !ok {
+				return nil, fmt.Errorf("handler %s: binds subscription %s, which isn't configured", registration.Name, name)
+			}
+			if bound, ok := registry.bindings[name]; ok && bound != registration.Name {
+				if subscription.Handler != "" {
+					return nil, fmt.Errorf("handler %s: binds subscription %s, which is configured with handler %s", registration.Name, name, bound)
+				}
+				return nil, fmt.Errorf("handler %s: binds subscription %s, which handler %s binds too", registration.Name, name, bound)
+			}
+			registry.bindings[name] = registration.Name
+		}
+	}
+	for _, subscription := range config.Subscriptions {
+		if subscription.Webhook != nil {
+			continue
+		}
+		name := registry.bindings[subscription.Name]
+		registration, ok := registry.registrations[name]
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("subscription %s: has no handler, and no registered handler binds it", subscription.Name)
+		case !ok:
+			return nil, fmt.Errorf("subscription %s: unknown handler %q", subscription.Name, name)
+		case subscription.Batch != nil && registration.Batch == nil:
+			return nil, fmt.Errorf("subscription %s: handler %s can't handle batches", subscription.Name, name)
+		case subscription.Batch == nil && registration.Handler == nil:
+			return nil, fmt.Errorf("subscription %s: handler %s only handles batches", subscription.Name, name)
+		case len(registration.Topics) > 0 && !slices.Contains(registration.Topics, subscription.Topic):
+			return nil, fmt.Errorf("subscription %s: handler %s only handles topics %s, not %s", subscription.Name, name, strings.Join(registration.Topics, ", "), subscription.Topic)
+		}
+	}
+	return registry, nil
+}
+
+// Resolve returns the name of the handler for subscription, and the handler
+// itself, or its batch handler for subscriptions with batch set.
+func (r *HandlerRegistry) Resolve(subscription SubscriptionConfig) (string, Handler, BatchHandler, bool) {
+	name := r.bindings[subscription.Name]
+	registration, ok := r.registrations[name]
+	if !ok {
+		return name, nil, nil, false
+	}
+	if subscription.Batch != nil {
+		return name, nil, registration.Batch, registration.Batch != nil
+	}
+	return name, registration.Handler, nil, registration.Handler != nil
+}
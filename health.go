@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+
+	"gcp-pubsub-test/healthcheck"
+)
+
+const healthTopic = "support-test"
+
+type HealthConfig struct {
+	// Timeout bounds each check; Timeouts overrides it per check, by name,
+	// e.g. "pubsub", "topic/orders" or "store/redis".
+	Timeout  time.Duration            `yaml:"timeout"`
+	Timeouts map[string]time.Duration `yaml:"timeouts"`
+	// CacheTTL is how long a report is served before checks run again.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// ExistsTTL is how long a topic's existence is trusted before it's
+	// revalidated in the background. Defaults to 5m.
+	ExistsTTL time.Duration `yaml:"exists_ttl"`
+	// Deep, if set, serves GET /health/deep, which publishes a probe and
+	// waits for a consumer to echo it back.
+	Deep *DeepHealthConfig `yaml:"deep"`
+}
+
+// newHealthChecks registers a check for each dependency: the Pub/Sub
+// connection and its credentials, every configured topic and, unless it's in memory, the store,
+// as well as the canary if it's running.
+func newHealthChecks(config Config, client *pubsub.Client, registry *TopicRegistry, store Store, exists *TopicExistsCache, canary *Canary) *healthcheck.Registry {
+	checks := healthcheck.New(config.Health.CacheTTL)
+	timeout := func(name string) time.Duration {
+		if timeout, ok := config.Health.Timeouts[name]; ok {
+			return timeout
+		}
+		return config.Health.Timeout
+	}
+
+	checks.Register("pubsub", timeout("pubsub"), func(ctx context.Context) error {
+		return topicExists(ctx, exists, client.Topic(healthTopic))
+	})
+	checks.Register("credentials", timeout("credentials"), googleCredentials.Check)
+	for _, topic := range config.Topics {
+		name := "topic/" + topic.Name
+		checks.Register(name, timeout(name), func(ctx context.Context) error {
+			registered, ok := registry.Lookup(topic.Name)
+			if !ok {
+				return fmt.Errorf("topic %s isn't registered yet", topic.Name)
+			}
+			if registered.Deleted() {
+				return fmt.Errorf("topic %s was deleted while publishing to it", registered.Config.Id)
+			}
+			return topicExists(ctx, exists, registered.Handle())
+		})
+	}
+	if backend := config.Store.Backend; backend != "" && backend != "memory" {
+		name := "store/" + backend
+		checks.Register(name, timeout(name), func(ctx context.Context) error {
+			_, err := store.Get(ctx, "healthcheck")
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			return err
+		})
+	}
+	if config.Canary.Topic != "" {
+		checks.Register("canary", timeout("canary"), canary.Check)
+	}
+	return checks
+}
+
+func topicExists(ctx context.Context, cache *TopicExistsCache, topic *pubsub.Topic) error {
+	exists, err := cache.Exists(ctx, topic)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("topic %s does not exist", topic.ID())
+	}
+	return nil
+}
+
+func healthHandler(checks *healthcheck.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := checks.Run(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,175 @@
+// Package healthcheck runs dependency checks concurrently, each within its
+// own timeout, and caches the aggregate result so frequent probes don't
+// turn into a load on the dependencies themselves.
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout = 2 * time.Second
+	DefaultTTL     = 5 * time.Second
+)
+
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusTimeout = "timeout"
+)
+
+// Check returns nil if the dependency is healthy. It must return promptly
+// once ctx is done.
+type Check func(ctx context.Context) error
+
+// StatusError is returned by a check to report a status of its own, more
+// specific than StatusFailed. It's unhealthy all the same.
+type StatusError struct {
+	Status string
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+type Result struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type Report struct {
+	Healthy   bool      `json:"healthy"`
+	CheckedAt time.Time `json:"checked_at"`
+	Checks    []Result  `json:"checks"`
+}
+
+type checker struct {
+	name    string
+	timeout time.Duration
+	check   Check
+}
+
+type Registry struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	checkers []checker
+	cached   *Report
+	running  chan struct{}
+}
+
+// New returns a registry whose reports are reused for ttl. A ttl of zero
+// uses DefaultTTL; a negative ttl disables caching.
+func New(ttl time.Duration) *Registry {
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	return &Registry{ttl: ttl}
+}
+
+// Register adds a check. A timeout of zero uses DefaultTimeout.
+func (r *Registry) Register(name string, timeout time.Duration, check Check) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checkers = append(r.checkers, checker{name: name, timeout: timeout, check: check})
+	r.cached = nil
+}
+
+// Run returns the cached report if it's fresh, and otherwise runs every
+// check. Concurrent callers share a single run.
+func (r *Registry) Run(ctx context.Context) Report {
+	r.mu.Lock()
+	if r.cached != nil && time.Since(r.cached.CheckedAt) < r.ttl {
+		report := *r.cached
+		r.mu.Unlock()
+		return report
+	}
+	if running := r.running; running != nil {
+		r.mu.Unlock()
+		select {
+		case <-running:
+			return r.Run(ctx)
+		case <-ctx.Done():
+			return Report{CheckedAt: time.Now(), Checks: []Result{{Name: "healthcheck", Status: StatusTimeout, Error: ctx.Err().Error()}}}
+		}
+	}
+	running := make(chan struct{})
+	r.running = running
+	checkers := append([]checker(nil), r.checkers...)
+	r.mu.Unlock()
+
+	// Checks run detached from the caller so an impatient probe doesn't
+	// cancel a run that other callers are waiting for.
+	report := run(context.WithoutCancel(ctx), checkers)
+
+	r.mu.Lock()
+	r.cached = &report
+	r.running = nil
+	r.mu.Unlock()
+	close(running)
+	return report
+}
+
+func run(ctx context.Context, checkers []checker) Report {
+	report := Report{Healthy: true, CheckedAt: time.Now(), Checks: make([]Result, len(checkers))}
+	var wg sync.WaitGroup
+	for i, checker := range checkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Checks[i] = checker.run(ctx)
+		}()
+	}
+	wg.Wait()
+	for _, result := range report.Checks {
+		if result.Status != StatusOK {
+			report.Healthy = false
+		}
+	}
+	return report
+}
+
+// run waits at most the checker's timeout even if the check ignores its
+// context; the check's goroutine is then left to finish on its own.
+func (c checker) run(ctx context.Context) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.check(ctx)
+	}()
+	result := Result{Name: c.name, Status: StatusOK}
+	select {
+	case err := <-done:
+		if err != nil && ctx.Err() != nil {
+			result.Status = StatusTimeout
+			result.Error = err.Error()
+		} else if err != nil {
+			result.Status = StatusFailed
+			result.Error = err.Error()
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) {
+				result.Status = statusErr.Status
+			}
+		}
+	case <-ctx.Done():
+		result.Status = StatusTimeout
+		result.Error = "no response within " + c.timeout.String()
+	}
+	result.Duration = time.Since(start)
+	return result
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultHedgeQuantile = 0.99
+	defaultHedgeBudget   = 0.05
+
+	// hedgeSamples are the latest publish latencies the quantile is
+	// estimated from, and hedgeMinSamples how many are needed before
+	// publishes are hedged at all.
+	hedgeSamples    = 1000
+	hedgeMinSamples = 100
+	// hedgeEstimateEvery is how many publishes the estimate is kept for
+	// before it's recomputed.
+	hedgeEstimateEvery = 100
+	// hedgeBudgetWindow is the window the budget counts publishes over.
+	hedgeBudgetWindow = 10 * time.Second
+)
+
+// HedgeConfig cuts the tail latency of publishes through the HTTP API: a
+// publish that hasn't resolved by the topic's usual worst case is sent a
+// second time, and whichever succeeds first answers the request. Both
+// copies carry the same idempotency_key attribute, set to a random one if
+// the message has none, so consumers can drop whichever arrives second.
+// Messages with ordering keys aren't hedged, as that would reorder them.
+type HedgeConfig struct {
+	// Quantile of the topic's recent publish latency after which a publish
+	// is hedged. Defaults to 0.99.
+	Quantile float64 `yaml:"quantile"`
+	// After hedges after a fixed delay instead of the quantile.
+	After time.Duration `yaml:"after"`
+	// Budget is the most publishes hedged, as a fraction of publishes over
+	// 10s, so a slow Pub/Sub doesn't get twice the load. Defaults to 0.05.
+	Budget float64 `yaml:"budget"`
+}
+
+func (c *HedgeConfig) validate() error {
+	if c.Quantile == 0 {
+		c.Quantile = defaultHedgeQuantile
+	}
+	if c.Budget == 0 {
+		c.Budget = defaultHedgeBudget
+	}
+	if c.Quantile <= 0 || c.Quantile >= 1 {
+		return errors.New("quantile must be between 0 and 1")
+	}
+	if c.Budget < 0 || c.Budget > 1 {
+		return errors.New("budget must be between 0 and 1")
+	}
+	if c.After < 0 {
+		return errors.New("after can't be negative")
+	}
+	return nil
+}
+
+// Hedger decides when a topic's publishes are hedged and runs the hedges.
+type Hedger struct {
+	topic  string
+	config HedgeConfig
+
+	mu sync.Mutex
+	// samples is a ring of the latest publish latencies.
+	samples []time.Duration
+	next    int
+	// delay is the current estimate, zero until there are enough samples,
+	// and sinceEstimate the publishes observed since it was made.
+	delay         time.Duration
+	sinceEstimate int
+	// windowStart, publishes and hedges count against the budget.
+	windowStart time.Time
+	publishes   int
+	hedges      int
+}
+
+func newHedger(topic string, config HedgeConfig) *Hedger {
+	return &Hedger{topic: topic, config: config, samples: make([]time.Duration, 0, hedgeSamples)}
+}
+
+// stamp sets msg's idempotency key, if it has none, so a hedge of it can
+// be told apart from a second message.
+func (h *Hedger) stamp(msg *pubsub.Message) {
+	if _, ok := msg.Attributes[idempotencyKeyAttribute]; ok {
+		return
+	}
+	if msg.Attributes == nil {
+		msg.Attributes = make(map[string]string, 1)
+	}
+	var key [16]byte
+	rand.Read(key[:])
+	msg.Attributes[idempotencyKeyAttribute] = hex.EncodeToString(key[:])
+}
+
+// observe records the latency of a publish that resolved without a hedge.
+func (h *Hedger) observe(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, latency)
+	} else {
+		h.samples[h.next] = latency
+		h.next = (h.next + 1) % hedgeSamples
+	}
+	if h.sinceEstimate++; h.sinceEstimate < hedgeEstimateEvery || len(h.samples) < hedgeMinSamples {
+		return
+	}
+	h.sinceEstimate = 0
+	sorted := slices.Clone(h.samples)
+	slices.Sort(sorted)
+	h.delay = sorted[int(h.config.Quantile*float64(len(sorted)-1))]
+	publishHedgeDelay.WithLabelValues(h.topic).Set(h.delay.Seconds())
+}
+
+// after returns how long a publish may take before it's hedged, counting
+// it against the budget, or false if it's not to be hedged.
+func (h *Hedger) after() (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now := time.Now(); now.Sub(h.windowStart) >= hedgeBudgetWindow {
+		h.windowStart, h.publishes, h.hedges = now, 0, 0
+	}
+	h.publishes++
+	if h.config.After > 0 {
+		return h.config.After, true
+	}
+	return h.delay, h.delay > 0
+}
+
+// allow reports whether the budget has room for another hedge, taking it
+// if so.
+func (h *Hedger) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if float64(h.hedges+1) > h.config.Budget*float64(h.publishes) {
+		return false
+	}
+	h.hedges++
+	return true
+}
+
+// get waits for result, the first attempt at publishing msg, sending msg
+// again with resend once it has taken longer than the hedge delay, and
+// returns the first attempt to succeed, or the first error if both fail.
+// Only the latencies of publishes that weren't hedged are observed, so the
+// estimate isn't skewed by the hedges.
+func (h *Hedger) get(ctx context.Context, result *pubsub.PublishResult, resend func() *pubsub.PublishResult) (string, error) {
+	started := time.Now()
+	delay, ok := h.after()
+	if !ok {
+		messageId, err := result.Get(ctx)
+		if err == nil {
+			h.observe(time.Since(started))
+		}
+		return messageId, err
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-result.Ready():
+		messageId, err := result.Get(ctx)
+		if err == nil {
+			h.observe(time.Since(started))
+		}
+		return messageId, err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-timer.C:
+	}
+	if !h.allow() {
+		publishHedges.WithLabelValues(h.topic, "denied").Inc()
+		messageId, err := result.Get(ctx)
+		if err == nil {
+			h.observe(time.Since(started))
+		}
+		return messageId, err
+	}
+	hedge := resend()
+	first, second := result, hedge
+	select {
+	case <-result.Ready():
+	case <-hedge.Ready():
+		first, second = hedge, result
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	messageId, err := first.Get(ctx)
+	if err != nil {
+		var secondErr error
+		if messageId, secondErr = second.Get(ctx); secondErr != nil {
+			publishHedges.WithLabelValues(h.topic, "failed").Inc()
+			return "", err
+		}
+		first = second
+	}
+	if first == hedge {
+		publishHedges.WithLabelValues(h.topic, "won").Inc()
+	} else {
+		publishHedges.WithLabelValues(h.topic, "lost").Inc()
+	}
+	return messageId, nil
+}
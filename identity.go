@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	identityModeAttribute = "attribute"
+	identityModeToken     = "token"
+
+	// callerAttribute carries the caller's name in attribute mode, and
+	// callerTokenAttribute the signed token in token mode.
+	callerAttribute      = "caller"
+	callerTokenAttribute = "caller_token"
+
+	defaultIdentityTokenTTL = 5 * time.Minute
+	// identityClockSkew allows for the publish time Pub/Sub records being
+	// a little behind this instance's clock.
+	identityClockSkew = time.Minute
+)
+
+type IdentityConfig struct {
+	// Mode is how the identity of the API key that published a message is
+	// passed on to its consumers: attribute sets the caller attribute to
+	// the key's name, which consumers have to trust the topic for, and
+	// token sets caller_token to a short-lived token signed with Secret,
+	// which consumers sharing the secret verify. Empty passes no identity.
+	Mode string `yaml:"mode"`
+	// Secret signs tokens. Defaults to the IDENTITY_SECRET environment
+	// variable.
+	Secret string `yaml:"secret"`
+	// TokenTTL is how long after publishing a token is valid, judged by the
+	// publish time Pub/Sub records, so a backlog doesn't expire it.
+	// Defaults to 5m.
+	TokenTTL time.Duration `yaml:"token_ttl"`
+}
+
+// Caller is the verified identity of whoever made a request: the API key
+// it presented.
+type Caller struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+type callerContextKey struct{}
+
+func withCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerContextKey{}, caller)
+}
+
+// CallerFrom returns the caller of the HTTP request being served, or, in a
+// handler, the caller that published the message as identity propagation
+// vouches for it. Batch handlers don't get one, as their messages may each
+// have a different caller.
+func CallerFrom(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerContextKey{}).(Caller)
+	return caller, ok
+}
+
+// IdentityPropagator carries a caller's identity from the publish request
+// to the message's consumers in its attributes.
+type IdentityPropagator interface {
+	// Attach adds caller's identity to msg, which is about to be published.
+	Attach(caller Caller, msg *pubsub.Message) error
+	// Extract returns the identity msg carries, false if it has none, and
+	// an error if it has one that can't be trusted.
+	Extract(msg *pubsub.Message) (Caller, bool, error)
+}
+
+// identityPropagators are the propagators by mode.
+var identityPropagators = map[string]func(config IdentityConfig) (IdentityPropagator, error){
+	identityModeAttribute: func(IdentityConfig) (IdentityPropagator, error) {
+		return attributeIdentity{}, nil
+	},
+	identityModeToken: newTokenIdentity,
+}
+
+type attributeIdentity struct{}
+
+func (attributeIdentity) Attach(caller Caller, msg *pubsub.Message) error {
+	msg.Attributes[callerAttribute] = caller.Name
+	return nil
+}
+
+func (attributeIdentity) Extract(msg *pubsub.Message) (Caller, bool, error) {
+	name, ok := msg.Attributes[callerAttribute]
+	return Caller{Name: name}, ok && name != "", nil
+}
+
+// tokenIdentity attaches a JWT signed with HS256 whose claims bind the
+// caller to the message's data and publish time.
+type tokenIdentity struct {
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+type identityClaims struct {
+	Subject  string   `json:"sub"`
+	Scopes   []string `json:"scope,omitempty"`
+	IssuedAt int64    `json:"iat"`
+	Expires  int64    `json:"exp"`
+	// Digest is the SHA-256 of the message data, so the token can't be
+	// copied onto another message.
+	Digest string `json:"dig"`
+}
+
+var errIdentityToken = errors.New("invalid caller token")
+
+// identityTokenHeader is the JWT header of every token, pre-encoded.
+var identityTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func newTokenIdentity(config IdentityConfig) (IdentityPropagator, error) {
+	if config.Secret == "" {
+		return nil, errors.New("identity: token mode needs a secret or IDENTITY_SECRET")
+	}
+	return tokenIdentity{secret: []byte(config.Secret), ttl: config.TokenTTL, now: time.Now}, nil
+}
+
+func (t tokenIdentity) Attach(caller Caller, msg *pubsub.Message) error {
+	now := t.now()
+	claims, err := json.Marshal(identityClaims{
+		Subject:  caller.Name,
+		Scopes:   caller.Scopes,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(t.ttl).Unix(),
+		Digest:   dataDigest(msg.Data),
+	})
+	if err != nil {
+		return err
+	}
+	signed := identityTokenHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	msg.Attributes[callerTokenAttribute] = signed + "." + t.sign(signed)
+	return nil
+}
+
+func (t tokenIdentity) Extract(msg *pubsub.Message) (Caller, bool, error) {
+	token, ok := msg.Attributes[callerTokenAttribute]
+	if !ok {
+		return Caller{}, false, nil
+	}
+	header, rest, _ := strings.Cut(token, ".")
+	payload, signature, _ := strings.Cut(rest, ".")
+	if header != identityTokenHeader || !hmac.Equal([]byte(signature), []byte(t.sign(header+"."+payload))) {
+		return Caller{}, false, fmt.Errorf("%w: bad signature", errIdentityToken)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Caller{}, false, fmt.Errorf("%w: %v", errIdentityToken, err)
+	}
+	var claims identityClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return Caller{}, false, fmt.Errorf("%w: %v", errIdentityToken, err)
+	}
+	if claims.Digest != dataDigest(msg.Data) {
+		return Caller{}, false, fmt.Errorf("%w: issued for other data", errIdentityToken)
+	}
+	published := msg.PublishTime
+	if published.IsZero() {
+		published = t.now()
+	}
+	if published.Before(time.Unix(claims.IssuedAt, 0).Add(-identityClockSkew)) || published.After(time.Unix(claims.Expires, 0)) {
+		return Caller{}, false, fmt.Errorf("%w: expired before the message was published", errIdentityToken)
+	}
+	return Caller{Name: claims.Subject, Scopes: claims.Scopes}, true, nil
+}
+
+func (t tokenIdentity) sign(signed string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func dataDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Identity propagates callers' identities with the configured propagator,
+// or not at all without one.
+type Identity struct {
+	logger     *log.Logger
+	propagator IdentityPropagator
+}
+
+func newIdentity(config Config) (*Identity, error) {
+	identity := &Identity{logger: newLogger("identity")}
+	identityConfig := config.Identity
+	if identityConfig.Mode == "" {
+		return identity, nil
+	}
+	if identityConfig.Secret == "" {
+		identityConfig.Secret = os.Getenv("IDENTITY_SECRET")
+	}
+	propagator, err := identityPropagators[identityConfig.Mode](identityConfig)
+	if err != nil {
+		return nil, err
+	}
+	identity.propagator = propagator
+	return identity, nil
+}
+
+// Attach replaces whatever identity attributes msg came with by the
+// identity of the caller in ctx, if any, so publishers can't claim to be
+// someone else.
+func (i *Identity) Attach(ctx context.Context, msg *pubsub.Message) error {
+	if i.propagator == nil {
+		return nil
+	}
+	delete(msg.Attributes, callerAttribute)
+	delete(msg.Attributes, callerTokenAttribute)
+	caller, ok := CallerFrom(ctx)
+	if !ok {
+		return nil
+	}
+	if msg.Attributes == nil {
+		msg.Attributes = make(map[string]string)
+	}
+	return i.propagator.Attach(caller, msg)
+}
+
+// Extract returns ctx with the caller msg carries, leaving it out if it
+// can't be trusted.
+func (i *Identity) Extract(ctx context.Context, msg *pubsub.Message) context.Context {
+	if i.propagator == nil {
+		return ctx
+	}
+	caller, ok, err := i.propagator.Extract(msg)
+	if err != nil {
+		i.logger.Printf("Ignoring the identity on message %s: %v", msg.ID, err)
+		identityRejections.Inc()
+		return ctx
+	}
+	if !ok {
+		return ctx
+	}
+	return withCaller(ctx, caller)
+}
@@ -0,0 +1,205 @@
+// Command metadatagen writes metadata_gen.go: the well-known message
+// attributes listed below, and the Metadata struct giving typed access to
+// them, with its Unmarshal, Marshal and Validate methods. Add an attribute
+// to the list and run go generate to give handlers a field for it.
+package main
+
+import (
+	"bytes"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// The kinds of attribute value, which decide a field's type and how it's
+// parsed, formatted and validated.
+const (
+	// kindString is a string field, validated against Pattern if it has
+	// one.
+	kindString = "string"
+	// kindInt is a non-negative int field, where zero means it isn't set.
+	kindInt = "int"
+	// kindTrace is a trace.SpanContext field, in W3C trace context
+	// attributes.
+	kindTrace = "trace"
+)
+
+type attribute struct {
+	// Field is the Metadata field, and Const the constant naming the
+	// attribute, set to Name, a Go expression.
+	Field string
+	Const string
+	Name  string
+	Kind  string
+	// Doc is the field's doc comment, without the leading //.
+	Doc []string
+	// Pattern is the regexp string values must match, and Rule how
+	// they're described when they don't.
+	Pattern string
+	Rule    string
+}
+
+var attributes = []attribute{
+	{
+		Field:   "Tenant",
+		Const:   "metadataTenant",
+		Name:    `"tenant"`,
+		Kind:    kindString,
+		Doc:     []string{"Tenant is the tenant the message belongs to: lowercase letters,", "digits, - and _, up to 63 characters."},
+		Pattern: `^[a-z0-9][a-z0-9_-]{0,62}$`,
+		Rule:    "must be lowercase letters, digits, - and _, up to 63 characters",
+	},
+	{
+		Field:   "EventType",
+		Const:   "metadataEventType",
+		Name:    "emailevents.AttributeEventType",
+		Kind:    kindString,
+		Doc:     []string{"EventType is the catalog event type, e.g. email.send."},
+		Pattern: `^[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)+$`,
+		Rule:    "must be dot-separated lowercase names, e.g. email.send",
+	},
+	{
+		Field: "Version",
+		Const: "metadataSchemaVersion",
+		Name:  "emailevents.AttributeSchemaVersion",
+		Kind:  kindInt,
+		Doc:   []string{"Version is the payload's schema version. Zero means it isn't set."},
+	},
+	{
+		Field: "Trace",
+		Const: "metadataTraceparent",
+		Name:  `"traceparent"`,
+		Kind:  kindTrace,
+		Doc:   []string{"Trace is the span the message was published in, from the W3C trace", "context attribute the Pub/Sub client library and this service inject."},
+	},
+}
+
+var source = template.Must(template.New("metadata").Funcs(template.FuncMap{
+	"pattern": func(a attribute) string { return strings.ToLower(a.Field[:1]) + a.Field[1:] + "Pattern" },
+	"quote":   func(s string) string { return "`" + s + "`" },
+}).Parse(`// Code generated by metadatagen. DO NOT EDIT.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Well-known attributes, which Metadata gives typed access to.
+const (
+{{- range .}}
+	{{.Const}} = {{.Name}}
+{{- end}}
+)
+
+var (
+{{- range .}}{{if .Pattern}}
+	{{pattern .}} = regexp.MustCompile({{quote .Pattern}})
+{{- end}}{{end}}
+)
+
+// Metadata is a message's well-known attributes, typed, so handlers read
+// them as fields instead of looking up keys in its attribute map and
+// parsing the values themselves.
+type Metadata struct {
+{{- range .}}
+{{- range .Doc}}
+	// {{.}}
+{{- end}}
+	{{.Field}} {{if eq .Kind "string"}}string{{else if eq .Kind "int"}}int{{else}}trace.SpanContext{{end}}
+{{- end}}
+}
+
+// Unmarshal sets m from attributes, leaving the fields whose attributes
+// aren't set zero, and validates it.
+func (m *Metadata) Unmarshal(attributes map[string]string) error {
+	*m = Metadata{
+{{- range .}}{{if eq .Kind "string"}}
+		{{.Field}}: attributes[{{.Const}}],
+{{- end}}{{end}}
+	}
+{{- range .}}
+{{- if eq .Kind "int"}}
+	if value, ok := attributes[{{.Const}}]; ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%w: %s %q isn't an integer", errInvalidMetadata, {{.Const}}, value)
+		}
+		m.{{.Field}} = parsed
+	}
+{{- else if eq .Kind "trace"}}
+	if carrier := attributeCarrier(attributes); carrier.Get({{.Const}}) != "" {
+		m.{{.Field}} = trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+		if !m.{{.Field}}.IsValid() {
+			return fmt.Errorf("%w: %s %q isn't a valid W3C trace context", errInvalidMetadata, {{.Const}}, carrier.Get({{.Const}}))
+		}
+	}
+{{- end}}
+{{- end}}
+	return m.Validate()
+}
+
+// Marshal validates m and sets its non-zero fields in attributes, replacing
+// any values already there.
+func (m Metadata) Marshal(attributes map[string]string) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+{{- range .}}
+{{- if eq .Kind "string"}}
+	if m.{{.Field}} != "" {
+		attributes[{{.Const}}] = m.{{.Field}}
+	}
+{{- else if eq .Kind "int"}}
+	if m.{{.Field}} != 0 {
+		attributes[{{.Const}}] = strconv.Itoa(m.{{.Field}})
+	}
+{{- else if eq .Kind "trace"}}
+	if m.{{.Field}}.IsValid() {
+		ctx := trace.ContextWithRemoteSpanContext(context.Background(), m.{{.Field}})
+		propagation.TraceContext{}.Inject(ctx, attributeCarrier(attributes))
+	}
+{{- end}}
+{{- end}}
+	return nil
+}
+
+// Validate checks the fields that are set.
+func (m Metadata) Validate() error {
+{{- range .}}
+{{- if and (eq .Kind "string") .Pattern}}
+	if m.{{.Field}} != "" && !{{pattern .}}.MatchString(m.{{.Field}}) {
+		return fmt.Errorf("%w: %s %q {{.Rule}}", errInvalidMetadata, {{.Const}}, m.{{.Field}})
+	}
+{{- else if eq .Kind "int"}}
+	if m.{{.Field}} < 0 {
+		return fmt.Errorf("%w: %s %d can't be negative", errInvalidMetadata, {{.Const}}, m.{{.Field}})
+	}
+{{- end}}
+{{- end}}
+	return nil
+}
+`))
+
+func main() {
+	var generated bytes.Buffer
+	if err := source.Execute(&generated, attributes); err != nil {
+		log.Fatal(err)
+	}
+	formatted, err := format.Source(generated.Bytes())
+	if err != nil {
+		log.Fatalf("formatting the generated code: %v\n%s", err, generated.Bytes())
+	}
+	if err := os.WriteFile("metadata_gen.go", formatted, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
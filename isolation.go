@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const defaultMaxConcurrentPublishes = 1000
+
+type IsolationConfig struct {
+	// MaxConcurrentPublishes bounds the requests waiting on a publish to
+	// the topic at once. A topic that's slow, e.g. with exhausted quota,
+	// rejects publishes over it with 503 rather than tying up goroutines
+	// and memory every other topic needs. Defaults to 1000.
+	MaxConcurrentPublishes int `yaml:"max_concurrent_publishes"`
+	// Goroutines is the size of the topic's own pool of publisher
+	// goroutines. Defaults to the client's, 25 per GOMAXPROCS.
+	Goroutines int `yaml:"goroutines"`
+}
+
+const unavailableConcurrency = "concurrency"
+
+var errConcurrencyLimit = errors.New("too many concurrent publishes to the topic")
+
+// apply sets the topic's goroutine pool size on settings.
+func (c IsolationConfig) apply(settings *pubsub.PublishSettings) {
+	if c.Goroutines > 0 {
+		settings.NumGoroutines = c.Goroutines
+	}
+}
+
+// Bulkhead limits the publishes in flight to one topic.
+type Bulkhead struct {
+	topic string
+	slots chan struct{}
+}
+
+func newBulkhead(topic string, config IsolationConfig) *Bulkhead {
+	return &Bulkhead{topic: topic, slots: make(chan struct{}, config.MaxConcurrentPublishes)}
+}
+
+// acquire takes a slot without waiting, failing with an UnavailableError
+// when they're all taken.
+func (b *Bulkhead) acquire() error {
+	select {
+	case b.slots <- struct{}{}:
+		publishInFlight.WithLabelValues(b.topic).Inc()
+		return nil
+	default:
+		return &UnavailableError{Reason: unavailableConcurrency, RetryAfter: time.Second, Err: errConcurrencyLimit}
+	}
+}
+
+func (b *Bulkhead) release() {
+	<-b.slots
+	publishInFlight.WithLabelValues(b.topic).Dec()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	pb "cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"go.uber.org/fx/fxtest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const isolationTestConfig = `
+topics:
+  - name: bad
+    isolation:
+      max_concurrent_publishes: 2
+  - name: good
+`
+
+// topicFault makes publish RPCs to one topic misbehave: they block until
+// release is closed, then fail with err, or fail straight away without a
+// release channel. Each message they carry is sent on arrived, if set, as
+// it arrives. It's a client interceptor, as the in-process Pub/Sub handles
+// one publish at a time, so stalling one there stalls every topic.
+type topicFault struct {
+	topic   string
+	arrived chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func (f *topicFault) intercept(ctx context.Context, method string, request, reply interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, options ...grpc.CallOption) error {
+	publish, ok := request.(*pb.PublishRequest)
+	if !ok || !strings.HasSuffix(publish.Topic, "/topics/"+f.topic) {
+		return invoker(ctx, method, request, reply, conn, options...)
+	}
+	if f.arrived != nil {
+		// The client may bundle several publishes into one RPC.
+		for range publish.Messages {
+			f.arrived <- struct{}{}
+		}
+	}
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return f.err
+}
+
+// newIsolationTestRegistry starts a registry of isolationTestConfig's topics
+// against an in-process Pub/Sub, with fault on one of them.
+func newIsolationTestRegistry(t *testing.T, fault *topicFault) *TopicRegistry {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(isolationTestConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_PATH", path)
+	config, err := newConfig(newLogger("test"))()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	server := pstest.NewServer()
+	t.Cleanup(func() { server.Close() })
+	conn, err := grpc.NewClient(server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithChainUnaryInterceptor(fault.intercept))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client, err := pubsub.NewClient(ctx, localProjectId, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	for _, topic := range config.Topics {
+		if _, err := client.CreateTopic(ctx, topic.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lifecycle := fxtest.NewLifecycle(t)
+	registry := newTopicRegistry(lifecycle, config, client, PubSubParams{Logger: newLogger("test")}, newTopicExistsCache(config), newRecentMessages(config), nil, nil, newMemoryStore())
+	lifecycle.RequireStart()
+	t.Cleanup(lifecycle.RequireStop)
+	return registry
+}
+
+func lookupTopic(t *testing.T, registry *TopicRegistry, name string) *RegisteredTopic {
+	t.Helper()
+	topic, ok := registry.Lookup(name)
+	if !ok {
+		t.Fatalf("topic %s isn't registered", name)
+	}
+	return topic
+}
+
+func publishTestMessage(t *testing.T, topic *RegisteredTopic) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte(`{}`)}); err != nil {
+		t.Fatalf("publish to %s: %v", topic.Config.Name, err)
+	}
+}
+
+func TestSaturatedTopicDoesNotBlockOthers(t *testing.T) {
+	fault := &topicFault{topic: "bad", release: make(chan struct{}), err: status.Error(codes.InvalidArgument, "stalled")}
+	registry := newIsolationTestRegistry(t, fault)
+	bad, good := lookupTopic(t, registry, "bad"), lookupTopic(t, registry, "good")
+	slots := bad.Config.Isolation.MaxConcurrentPublishes
+	fault.arrived = make(chan struct{}, slots)
+
+	// Take every one of the bad topic's slots with a publish that hangs.
+	var stalled sync.WaitGroup
+	for i := 0; i < slots; i++ {
+		stalled.Add(1)
+		go func() {
+			defer stalled.Done()
+			bad.Publish(context.Background(), &pubsub.Message{Data: []byte(`{}`)})
+		}()
+	}
+	t.Cleanup(func() {
+		close(fault.release)
+		stalled.Wait()
+	})
+	// A publish holds its slot by the time it reaches Pub/Sub.
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < slots; i++ {
+		select {
+		case <-fault.arrived:
+		case <-timeout:
+			t.Fatal("the stalled publishes didn't take the bad topic's slots")
+		}
+	}
+
+	_, err := bad.Publish(context.Background(), &pubsub.Message{Data: []byte(`{}`)})
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.Reason != unavailableConcurrency {
+		t.Fatalf("publish to the saturated topic: got %v, want the concurrency limit", err)
+	}
+	for i := 0; i < 10; i++ {
+		publishTestMessage(t, good)
+	}
+}
+
+func TestFailingTopicDoesNotFailOthers(t *testing.T) {
+	// Not retryable, nor an auth error, which would rightly stop
+	// publishing to every topic.
+	fault := &topicFault{topic: "bad", err: status.Error(codes.InvalidArgument, "failing")}
+	registry := newIsolationTestRegistry(t, fault)
+	bad, good := lookupTopic(t, registry, "bad"), lookupTopic(t, registry, "good")
+
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := bad.Publish(ctx, &pubsub.Message{Data: []byte(`{}`)})
+		cancel()
+		if err == nil {
+			t.Fatal("publish to the failing topic succeeded")
+		}
+		publishTestMessage(t, good)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type jsonPathSegment struct {
+	field string
+	index int
+}
+
+// parseJSONPath accepts the subset of JSONPath needed to address a single
+// scalar: a bare field name ("user_id"), or "$" followed by ".field" and
+// "[index]" selectors ("$.user.ids[0]").
+func parseJSONPath(expression string) ([]jsonPathSegment, error) {
+	if !strings.HasPrefix(expression, "$") {
+		if expression == "" || strings.ContainsAny(expression, ".[]") {
+			return nil, fmt.Errorf("invalid field name %q", expression)
+		}
+		return []jsonPathSegment{{field: expression, index: -1}}, nil
+	}
+	var segments []jsonPathSegment
+	rest := expression[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			field := rest[1 : end+1]
+			if field == "" {
+				return nil, fmt.Errorf("empty field in %q", expression)
+			}
+			segments = append(segments, jsonPathSegment{field: field, index: -1})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated index in %q", expression)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index in %q", expression)
+			}
+			segments = append(segments, jsonPathSegment{index: index})
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", rest[0], expression)
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%q selects the whole document", expression)
+	}
+	return segments, nil
+}
+
+// extractJSONPath returns the scalar at path in data as a string, and false
+// when the document isn't JSON or the path is missing or points at an object
+// or array.
+func extractJSONPath(data []byte, path []jsonPathSegment) (string, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", false
+	}
+	for _, segment := range path {
+		if segment.index >= 0 {
+			array, ok := value.([]interface{})
+			if !ok || segment.index >= len(array) {
+				return "", false
+			}
+			value = array[segment.index]
+		} else {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if value, ok = object[segment.field]; !ok {
+				return "", false
+			}
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const publishRPCMethod = "/google.pubsub.v1.Publisher/Publish"
+
+// publishRPCOption times every Publish RPC the client sends. A call carries
+// a whole batch, so comparing publish_rpc_latency_seconds with
+// publish_request_latency_seconds shows how long messages queue for a batch.
+var publishRPCOption = option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(observePublishRPC))
+
+func observePublishRPC(ctx context.Context, method string, req, reply interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if method != publishRPCMethod {
+		return invoker(ctx, method, req, reply, conn, opts...)
+	}
+	started := time.Now()
+	err := invoker(ctx, method, req, reply, conn, opts...)
+	topic := ""
+	if request, ok := req.(*pubsubpb.PublishRequest); ok {
+		topic = path.Base(request.GetTopic())
+	}
+	publishRPCLatency.WithLabelValues(topic, status.Code(err).String()).Observe(time.Since(started).Seconds())
+	return err
+}
+
+// observePublishRequest records the time from an HTTP request being
+// received to its publish result resolving. Sampled requests attach their
+// trace ID as an exemplar so a slow bucket links to an example trace.
+func observePublishRequest(ctx context.Context, topic string, received time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	observer := publishRequestLatency.WithLabelValues(topic, result)
+	seconds := time.Since(received).Seconds()
+	if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
+		observer.ObserveWithExemplar(seconds, map[string]string{"trace_id": span.TraceID().String()})
+		return
+	}
+	observer.Observe(seconds)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/fx/fxevent"
+)
+
+const lifecycleHistorySize = 256
+
+type LifecycleEvent struct {
+	Hook      string        `json:"hook"`
+	Caller    string        `json:"caller"`
+	Phase     string        `json:"phase"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration_ns"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// LifecycleRecorder is installed as the fx event logger. It keeps the default
+// console output for everything fx reports and additionally records each
+// OnStart/OnStop hook so slow cold starts can be traced to a dependency.
+type LifecycleRecorder struct {
+	logger  *log.Logger
+	console fxevent.Logger
+
+	mu      sync.Mutex
+	history []LifecycleEvent
+}
+
+func NewLifecycleRecorder() *LifecycleRecorder {
+	return &LifecycleRecorder{
+		logger:  newLogger("lifecycle"),
+		console: &fxevent.ConsoleLogger{W: fxLogOutput()},
+	}
+}
+
+func (r *LifecycleRecorder) LogEvent(event fxevent.Event) {
+	switch e := event.(type) {
+	case *fxevent.OnStartExecuted:
+		r.record(e.FunctionName, e.CallerName, "start", e.Runtime, e.Err)
+	case *fxevent.OnStopExecuted:
+		r.record(e.FunctionName, e.CallerName, "stop", e.Runtime, e.Err)
+	default:
+		r.console.LogEvent(event)
+	}
+}
+
+func (r *LifecycleRecorder) record(hook string, caller string, phase string, runtime time.Duration, err error) {
+	event := LifecycleEvent{
+		Hook:      hook,
+		Caller:    caller,
+		Phase:     phase,
+		StartedAt: time.Now().Add(-runtime),
+		Duration:  runtime,
+	}
+	result := "ok"
+	if err != nil {
+		event.Error = err.Error()
+		result = "error"
+		r.logger.Printf("event=hook_failed hook=%q caller=%q phase=%s duration=%s error=%q", hook, caller, phase, runtime, event.Error)
+	} else {
+		r.logger.Printf("event=hook_executed hook=%q caller=%q phase=%s duration=%s", hook, caller, phase, runtime)
+	}
+	lifecycleHookDuration.WithLabelValues(caller, phase, result).Observe(runtime.Seconds())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.history) == lifecycleHistorySize {
+		r.history = r.history[1:]
+	}
+	r.history = append(r.history, event)
+}
+
+func (r *LifecycleRecorder) History() []LifecycleEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]LifecycleEvent(nil), r.history...)
+}
+
+func (r *LifecycleRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.History())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Lineage attributes are stamped on every message this service forwards
+// from another topic, as a bridge of push envelopes or by copy. Retries,
+// quarantine requeues and replays resend a message into the same flow, so
+// they carry its lineage as is rather than counting a hop.
+const (
+	// originServiceAttribute is the service that first forwarded the
+	// message, kept as it's forwarded further.
+	originServiceAttribute = "origin_service"
+	// hopCountAttribute is how many times the message has been forwarded.
+	hopCountAttribute = "hop_count"
+	// parentMessageIdAttribute is the ID of the message it was forwarded
+	// from.
+	parentMessageIdAttribute = "parent_message_id"
+
+	defaultLineageService = "gcp-pubsub-test"
+	defaultMaxHops        = 10
+)
+
+type LineageConfig struct {
+	// Service is stamped as origin_service. Defaults to K_SERVICE, the Cloud
+	// Run service name, then gcp-pubsub-test.
+	Service string `yaml:"service"`
+	// MaxHops is how many times a message can be forwarded before it's
+	// taken to be in a loop between topics and isn't forwarded again.
+	// Defaults to 10; set a negative value for no limit.
+	MaxHops int `yaml:"max_hops"`
+}
+
+func (c *LineageConfig) validate() {
+	if c.Service == "" {
+		c.Service = os.Getenv("K_SERVICE")
+	}
+	if c.Service == "" {
+		c.Service = defaultLineageService
+	}
+	if c.MaxHops == 0 {
+		c.MaxHops = defaultMaxHops
+	}
+}
+
+var errHopLimit = errors.New("hop limit reached")
+
+// stampLineage sets the lineage attributes of a message being forwarded
+// from the message parentId, whose attributes it starts with. It returns
+// errHopLimit instead if that would take the message past MaxHops.
+func stampLineage(config LineageConfig, attributes map[string]string, parentId string) error {
+	// A hop count that isn't a number can't be trusted to stop a loop, so
+	// it's counted from scratch.
+	hops, err := strconv.Atoi(attributes[hopCountAttribute])
+	if err != nil || hops < 0 {
+		hops = 0
+	}
+	hops++
+	if config.MaxHops > 0 && hops > config.MaxHops {
+		lineageHopLimited.WithLabelValues(attributes[originServiceAttribute]).Inc()
+		return fmt.Errorf("%w: message %s has been forwarded %d times, up to max_hops %d", errHopLimit, parentId, hops-1, config.MaxHops)
+	}
+	if attributes[originServiceAttribute] == "" {
+		attributes[originServiceAttribute] = config.Service
+	}
+	attributes[hopCountAttribute] = strconv.Itoa(hops)
+	attributes[parentMessageIdAttribute] = parentId
+	return nil
+}
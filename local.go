@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"go.uber.org/fx"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const localProjectId = "local"
+
+// newLocalPubSubClient backs the client with an in-process fake Pub/Sub
+// server instead of GCP or an emulator, for running the service on a
+// laptop. Every topic and subscription the config refers to is created on
+// start, since the fake starts out empty and loses everything on exit.
+func newLocalPubSubClient(lifecycle fx.Lifecycle, params PubSubParams, config Config) *pubsub.Client {
+	client := new(pubsub.Client)
+	var (
+		server *pstest.Server
+		conn   *grpc.ClientConn
+	)
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(ctx context.Context) error {
+				params.Logger.Println("Starting in-process Pub/Sub...")
+				server = pstest.NewServer()
+				var err error
+				conn, err = grpc.NewClient(server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithChainUnaryInterceptor(observePublishRPC))
+				if err != nil {
+					return err
+				}
+				newClient, err := pubsub.NewClient(ctx, localProjectId, option.WithGRPCConn(conn))
+				if err != nil {
+					return err
+				}
+				*client = *newClient
+				if err := provisionLocal(ctx, client, config); err != nil {
+					return fmt.Errorf("provisioning local Pub/Sub: %w", err)
+				}
+				params.Logger.Printf("In-process Pub/Sub ready with %d topics and %d subscriptions", len(config.Topics), len(config.Subscriptions))
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				params.Logger.Println("Stopping in-process Pub/Sub...")
+				client.Close()
+				conn.Close()
+				return server.Close()
+			},
+		},
+	)
+	return client
+}
+
+func provisionLocal(ctx context.Context, client *pubsub.Client, config Config) error {
+	// The health check looks for this topic.
+	topics := map[string]bool{"support-test": true}
+	for _, topic := range config.Topics {
+		topics[topic.Id] = true
+		if topic.DebugSample != nil {
+			topics[topic.DebugSample.Topic] = true
+		}
+		if topic.Priority != nil {
+			for _, id := range topic.Priority.Topics {
+				topics[id] = true
+			}
+		}
+	}
+	for _, subscription := range config.Subscriptions {
+		topics[subscription.Topic] = true
+		if subscription.DeadLetter != nil {
+			topics[subscription.DeadLetter.Topic] = true
+		}
+		if subscription.Quarantine != nil {
+			topics[subscription.Quarantine.Topic] = true
+		}
+		topics[subscription.ExpiredTopic] = true
+	}
+	delete(topics, "")
+	for id := range topics {
+		if _, err := client.CreateTopic(ctx, id); err != nil {
+			return fmt.Errorf("topic %s: %w", id, err)
+		}
+	}
+
+	create := func(id string, topic string, ordered bool, filter string, deadLetter *DeadLetter, retryPolicy *RetryPolicy) error {
+		if topic == "" {
+			return fmt.Errorf("subscription %s: no topic configured", id)
+		}
+		_, err := client.CreateSubscription(ctx, id, pubsub.SubscriptionConfig{
+			Topic:                 client.Topic(topic),
+			EnableMessageOrdering: ordered,
+			Filter:                filter,
+			DeadLetterPolicy:      deadLetterPolicy(localProjectId, deadLetter),
+			RetryPolicy:           pubsubRetryPolicy(retryPolicy),
+		})
+		if err != nil {
+			return fmt.Errorf("subscription %s: %w", id, err)
+		}
+		return nil
+	}
+	for _, subscription := range config.Subscriptions {
+		if err := create(subscription.Id, subscription.Topic, subscription.Ordered, subscriptionFilter(config, subscription), subscription.DeadLetter, subscription.RetryPolicy); err != nil {
+			return err
+		}
+		if quarantine := subscription.Quarantine; quarantine != nil {
+			if err := create(quarantine.Subscription, quarantine.Topic, false, "", nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// localConfig adjusts config for the in-process server: failover targets
+// are real endpoints, so they're dropped.
+func localConfig(config Config) Config {
+	topics := make([]TopicConfig, len(config.Topics))
+	for i, topic := range config.Topics {
+		topic.Failover = nil
+		topics[i] = topic
+	}
+	config.Topics = topics
+	return config
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+)
+
+// logFormat is json on Cloud Run, where stdout is parsed into structured
+// log entries, and console elsewhere. LOG_FORMAT overrides the detection.
+var logFormat = detectLogFormat()
+
+func detectLogFormat() string {
+	if format := os.Getenv("LOG_FORMAT"); format != "" {
+		return format
+	}
+	if os.Getenv("K_SERVICE") != "" {
+		return logFormatJSON
+	}
+	return logFormatConsole
+}
+
+const (
+	severityDebug   = "DEBUG"
+	severityInfo    = "INFO"
+	severityWarning = "WARNING"
+	severityError   = "ERROR"
+)
+
+// logSeverity infers a severity from the message, since the standard
+// logger has no levels. Messages reporting a failure, or carrying an error
+// field as message logs do, are errors.
+func logSeverity(message string) string {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.HasPrefix(lower, "failed"), strings.HasPrefix(lower, "error"), strings.Contains(lower, " failed"), strings.Contains(message, ` error="`):
+		return severityError
+	case strings.HasPrefix(lower, "warning"):
+		return severityWarning
+	case strings.HasPrefix(lower, "debug"):
+		return severityDebug
+	default:
+		return severityInfo
+	}
+}
+
+// logWriter serializes each line written by a *log.Logger, which writes
+// every message in a single call, in the current logFormat.
+type logWriter struct {
+	out       io.Writer
+	component string
+	color     bool
+	// trace and span tie the entry to a request in Cloud Trace.
+	trace string
+	span  string
+	// labels are baggage members, e.g. a campaign_id.
+	labels map[string]string
+}
+
+type logEntry struct {
+	Severity  string            `json:"severity"`
+	Message   string            `json:"message"`
+	Time      time.Time         `json:"time"`
+	Component string            `json:"component"`
+	Trace     string            `json:"logging.googleapis.com/trace,omitempty"`
+	SpanId    string            `json:"logging.googleapis.com/spanId,omitempty"`
+	Labels    map[string]string `json:"logging.googleapis.com/labels,omitempty"`
+}
+
+func newLogWriter(out io.Writer, component string) *logWriter {
+	color := false
+	if file, ok := out.(*os.File); ok && os.Getenv("NO_COLOR") == "" {
+		if info, err := file.Stat(); err == nil {
+			color = info.Mode()&os.ModeCharDevice != 0
+		}
+	}
+	return &logWriter{out: out, component: component, color: color}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	// The fx console logger tags its own lines.
+	message = strings.TrimPrefix(message, "[Fx] ")
+	severity := logSeverity(message)
+	if !logLevels.enabled(w.component, severity) {
+		return len(p), nil
+	}
+	now := time.Now()
+
+	var err error
+	if logFormat == logFormatJSON {
+		encoder := json.NewEncoder(w.out)
+		encoder.SetEscapeHTML(false)
+		err = encoder.Encode(logEntry{
+			Severity:  severity,
+			Message:   message,
+			Time:      now,
+			Component: w.component,
+			Trace:     w.trace,
+			SpanId:    w.span,
+			Labels:    w.labels,
+		})
+	} else {
+		line := "[" + w.component + "] " + now.Format("2006/01/02 15:04:05.000000") + " " + message
+		if w.color {
+			switch severity {
+			case severityError:
+				line = "\x1b[31m" + line + "\x1b[0m"
+			case severityWarning:
+				line = "\x1b[33m" + line + "\x1b[0m"
+			}
+		}
+		_, err = io.WriteString(w.out, line+"\n")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// requestLogger returns logger with the request's trace and baggage
+// attached to every entry, when logging JSON and the request carries a
+// Cloud Trace context or configured baggage.
+func requestLogger(logger *log.Logger, r *http.Request) *log.Logger {
+	writer, ok := logger.Writer().(*logWriter)
+	if !ok || logFormat != logFormatJSON {
+		return logger
+	}
+	traceId, spanId := requestTrace(r)
+	labels := baggageLabels(requestContext(r))
+	if traceId == "" && labels == nil {
+		return logger
+	}
+	traced := *writer
+	if traceId != "" {
+		traced.trace = "projects/" + os.Getenv("PROJECT_ID") + "/traces/" + traceId
+		traced.span = spanId
+	}
+	traced.labels = labels
+	return log.New(&traced, logger.Prefix(), logger.Flags())
+}
+
+// requestTrace returns the trace and span IDs of the span in the request's
+// context, or reads them from the W3C traceparent header or, failing that,
+// the X-Cloud-Trace-Context header set by Cloud Run.
+func requestTrace(r *http.Request) (string, string) {
+	if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+		return spanContext.TraceID().String(), spanContext.SpanID().String()
+	}
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return parts[1], parts[2]
+	}
+	value := r.Header.Get("X-Cloud-Trace-Context")
+	if value == "" {
+		return "", ""
+	}
+	value, _, _ = strings.Cut(value, ";")
+	trace, span, _ := strings.Cut(value, "/")
+	return trace, span
+}
+
+// fxLogOutput keeps fx's own console format locally and serializes its
+// events like every other log line otherwise.
+func fxLogOutput() io.Writer {
+	if logFormat == logFormatJSON {
+		return newLogWriter(os.Stderr, "fx")
+	}
+	return os.Stderr
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+	logLevelError = "error"
+)
+
+var logLevelRanks = map[string]int{logLevelDebug: 0, logLevelInfo: 1, logLevelWarn: 2, logLevelError: 3}
+
+var severityLevels = map[string]string{
+	severityDebug:   logLevelDebug,
+	severityInfo:    logLevelInfo,
+	severityWarning: logLevelWarn,
+	severityError:   logLevelError,
+}
+
+// LogLevels are the least severe level logged, per logger name. A
+// subscriber:orders logger falls back to the level for subscriber, and
+// then to the default.
+type LogLevels struct {
+	mu       sync.RWMutex
+	fallback string
+	levels   map[string]string
+}
+
+var logLevels = &LogLevels{fallback: logLevelInfo, levels: make(map[string]string)}
+
+func validLogLevel(level string) error {
+	if _, ok := logLevelRanks[level]; !ok {
+		return fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+	}
+	return nil
+}
+
+// enabled reports whether component logs entries of severity.
+func (l *LogLevels) enabled(component string, severity string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	level, ok := l.levels[component]
+	if !ok {
+		if kind, _, found := strings.Cut(component, ":"); found {
+			level, ok = l.levels[kind]
+		}
+	}
+	if !ok {
+		level = l.fallback
+	}
+	return logLevelRanks[severityLevels[severity]] >= logLevelRanks[level]
+}
+
+// Set sets component's level, or the default with no component. An empty
+// level goes back to the default.
+func (l *LogLevels) Set(component string, level string) error {
+	if component == "" && level == "" {
+		level = logLevelInfo
+	}
+	if level != "" {
+		if err := validLogLevel(level); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case component == "":
+		l.fallback = level
+	case level == "":
+		delete(l.levels, component)
+	default:
+		l.levels[component] = level
+	}
+	return nil
+}
+
+type logLevelsStatus struct {
+	// Default is the level of loggers without their own.
+	Default string            `json:"default"`
+	Levels  map[string]string `json:"levels"`
+}
+
+func (l *LogLevels) status() logLevelsStatus {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	levels := make(map[string]string, len(l.levels))
+	for component, level := range l.levels {
+		levels[component] = level
+	}
+	return logLevelsStatus{Default: l.fallback, Levels: levels}
+}
+
+// applyLogLevels sets the configured levels, which the admin API can then
+// change on a running instance.
+func applyLogLevels(config Config) error {
+	if err := logLevels.Set("", config.Logging.Level); err != nil {
+		return err
+	}
+	for component, level := range config.Logging.Levels {
+		if err := logLevels.Set(component, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type logLevelUpdate struct {
+	// Component is a logger name such as registry or subscriber:orders, a
+	// kind of logger such as subscriber, or empty for the default.
+	Component string `json:"component"`
+	// Level is debug, info, warn or error, or empty to go back to the
+	// default.
+	Level string `json:"level"`
+}
+
+type LogLevelHandler struct {
+	logger *log.Logger
+}
+
+func newLogLevelHandler() *LogLevelHandler {
+	return &LogLevelHandler{logger: newLogger("logging")}
+}
+
+func (h *LogLevelHandler) Get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevels.status())
+}
+
+// Put changes a level on the instance serving the request. Levels go back
+// to the configured ones when the instance restarts.
+func (h *LogLevelHandler) Put(w http.ResponseWriter, r *http.Request) {
+	var update logLevelUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&update); err != nil {
+		http.Error(w, "Invalid update: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := logLevels.Set(update.Component, update.Level); err != nil {
+		http.Error(w, "Invalid update: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	component := update.Component
+	if component == "" {
+		component = "the default"
+	}
+	requestLogger(h.logger, r).Printf("Set the log level of %s to %q", component, update.Level)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevels.status())
+}
@@ -3,13 +3,21 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/fx"
+	"go.uber.org/fx/fxevent"
 	"google.golang.org/api/option"
 )
 
@@ -20,24 +28,78 @@ type Publisher struct {
 
 type Email struct {
 	Publisher Publisher
+	Client    *emailevents.Client
 }
 
 type PubSubParams struct {
 	Config struct {
 		ProjectId       string
 		CredentialsPath string
+		// UserAgentSuffix and Labels are added to the user agent of every
+		// Google API client, so this service's traffic can be told apart
+		// from other clients in the same project.
+		UserAgentSuffix string
+		Labels          map[string]string
 	}
 	Logger *log.Logger
 }
 
+const userAgent = "gcp-pubsub-test"
+
+// clientOptions returns the options every Google API client is created
+// with.
+func (p PubSubParams) clientOptions() []option.ClientOption {
+	credentialsOption := option.WithCredentialsFile(p.Config.CredentialsPath)
+	if source := googleCredentials.TokenSource(p.Config.CredentialsPath); source != nil {
+		credentialsOption = option.WithTokenSource(source)
+	}
+	return []option.ClientOption{
+		credentialsOption,
+		option.WithUserAgent(p.userAgent()),
+	}
+}
+
+// userAgent renders labels as product tokens after the suffix, e.g.
+// "gcp-pubsub-test canary env/prod team/mail".
+func (p PubSubParams) userAgent() string {
+	tokens := []string{userAgent}
+	if p.Config.UserAgentSuffix != "" {
+		tokens = append(tokens, p.Config.UserAgentSuffix)
+	}
+	keys := make([]string, 0, len(p.Config.Labels))
+	for key := range p.Config.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tokens = append(tokens, key+"/"+p.Config.Labels[key])
+	}
+	return strings.Join(tokens, " ")
+}
+
+// parseLabels parses a comma-separated list of key=value pairs.
+func parseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" || strings.ContainsAny(key+value, " /") {
+			return nil, fmt.Errorf("invalid label %q", pair)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
 func newPubSubClient(lifecycle fx.Lifecycle, params PubSubParams) *pubsub.Client {
 	client := new(pubsub.Client)
 	lifecycle.Append(
 		fx.Hook{
 			OnStart: func(ctx context.Context) error {
 				params.Logger.Println("Connecting to PubSub...")
-				clientOption := option.WithCredentialsFile(params.Config.CredentialsPath)
-				newClient, err := pubsub.NewClient(ctx, params.Config.ProjectId, clientOption)
+				newClient, err := pubsub.NewClientWithConfig(ctx, params.Config.ProjectId, &pubsub.ClientConfig{PublisherCallOptions: publisherCallOptions()}, append(params.clientOptions(), publishRPCOption)...)
 				if err == nil {
 					*client = *newClient
 					params.Logger.Println("Successfully connected to PubSub.")
@@ -55,9 +117,10 @@ func newPubSubClient(lifecycle fx.Lifecycle, params PubSubParams) *pubsub.Client
 	return client
 }
 
-func NewEmailTopic(ctx context.Context, client *pubsub.Client, topicId string) (*Email, error) {
-	topic := client.Topic(topicId)
-	exists, err := topic.Exists(ctx)
+func NewEmailTopic(ctx context.Context, client *pubsub.Client, cache *TopicExistsCache, topicId string) (*Email, error) {
+	events := emailevents.NewClient(client, emailevents.WithTopic(topicId))
+	topic := events.Topic()
+	exists, err := cache.Exists(ctx, topic)
 	if err != nil {
 		return nil, err
 	} else if !exists {
@@ -65,65 +128,250 @@ func NewEmailTopic(ctx context.Context, client *pubsub.Client, topicId string) (
 	}
 	return &Email{
 		Publisher: Publisher{
-			logger: log.New(os.Stdout, "[email] ", log.LstdFlags|log.Lmicroseconds),
+			logger: newLogger("email"),
 			topic:  topic,
 		},
+		Client: events,
 	}, nil
 }
 
-func main() {
-	logger := log.New(os.Stdout, "[app] ", log.LstdFlags|log.Lmicroseconds)
+var logOutput io.Writer = os.Stdout
 
-	app := fx.New(
+func newLogger(component string) *log.Logger {
+	return log.New(newLogWriter(logOutput, component), "", 0)
+}
+
+func envOrDefault(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func newPubSubParams(logger *log.Logger) func() (PubSubParams, error) {
+	return func() (PubSubParams, error) {
+		params := PubSubParams{Logger: logger}
+		params.Config.ProjectId = os.Getenv("PROJECT_ID")
+		params.Config.CredentialsPath = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		params.Config.UserAgentSuffix = os.Getenv("CLIENT_USER_AGENT_SUFFIX")
+		labels, err := parseLabels(os.Getenv("CLIENT_LABELS"))
+		if err != nil {
+			return params, fmt.Errorf("CLIENT_LABELS: %w", err)
+		}
+		params.Config.Labels = labels
+		return params, nil
+	}
+}
+
+// localPubSubOptions provide the config and a client backed by an
+// in-process Pub/Sub, in place of GCP or an emulator.
+func localPubSubOptions(logger *log.Logger) fx.Option {
+	return fx.Provide(
+		func() (PubSubParams, error) {
+			params, err := newPubSubParams(logger)()
+			params.Config.ProjectId = localProjectId
+			return params, err
+		},
+		newLocalPubSubClient,
+		func() (Config, error) {
+			config, err := newConfig(logger)()
+			return localConfig(config), err
+		},
+	)
+}
+
+func serve(logger *log.Logger) fx.Option {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	local := flags.Bool("local", false, "use an in-process Pub/Sub instead of GCP or an emulator")
+	flags.Parse(commandArgs)
+
+	pubsubOptions := fx.Provide(newPubSubParams(logger), newPubSubClient, newConfig(logger))
+	if *local {
+		pubsubOptions = localPubSubOptions(logger)
+	}
+	return fx.Options(
+		pubsubOptions,
 		fx.Provide(
-			func() PubSubParams {
-				return PubSubParams{
-					Logger: logger,
-					Config: struct {
-						ProjectId       string
-						CredentialsPath string
-					}{
-						ProjectId:       os.Getenv("PROJECT_ID"),
-						CredentialsPath: os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"),
-					},
-				}
-			},
-			newPubSubClient,
+			newTracerProvider,
+			newStore,
+			newTopicExistsCache,
+			newTemplateRepository,
+			newEmailTemplateHandler,
+			newSuppressionList,
+			newSuppressionHandler,
+			newCampaignScheduler,
+			newCampaignHandler,
+			newMessageLogger,
+			newFailureStore,
+			newFailureHandler,
+			newRecentMessages,
+			newRecentHandler,
+			newIdentity,
+			newAttributeCipher,
+			newPublishDedup,
+			newPublishQuotas,
+			newUsageHandler,
+			newReadOnly,
+			newReadOnlyHandler,
+			newLogLevelHandler,
+			newUsageLedger,
+			newTopicRegistry,
+			newRouter,
+			newUsageReporter,
+			newCallbacks,
+			newPublishHandler,
+			newPublishGroups,
+			newEventarcHandler,
+			newHandlerRegistry,
+			newSubscriberSet,
+			newSubscriberAdminHandler,
+			newBacklogMonitor,
+			newStallDetector,
+			newQuarantineHandler,
+			newTransformAdminHandler,
+			newCanary,
+			newHealthChecks,
+			newDeepHealth,
+			newReconciler,
+			newClientRotator,
+			newAuthorizer,
+			newFirewall,
+			newServerTLS,
+			newCatalog,
+			newDiagnostics,
+			newRoutes,
 		),
-		fx.Invoke(func(lifecycle fx.Lifecycle) {
-			go func() {
-				names, err := net.LookupHost("pubsub.googleapis.com")
-				if err != nil {
-					return
-				}
-				logger.Printf("%#v\n", names)
-			}()
+		fx.Invoke(applyMetrics, applyRuntimeConfig, applyLogLevels, applyRetryBudget, applyAuditLog),
+		fx.Invoke(func(trace.TracerProvider, *SubscriberSet, *Reconciler, *StallDetector, *Diagnostics, *UsageReporter) {
 		}),
-		fx.Invoke(func(lifecycle fx.Lifecycle, client *pubsub.Client) {
-			http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-				w.Write([]byte("Hello, Cloud Run!"))
-			})
-
-			http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-				topic := client.Topic("support-test")
-				exists, err := topic.Exists(r.Context())
-				if err != nil {
-					http.Error(w, "Failed to check topic existence: "+err.Error(), http.StatusInternalServerError)
-					return
-				}
-				if !exists {
-					http.Error(w, "Topic does not exist", http.StatusNotFound)
-					return
-				}
-				w.Write([]byte("PubSub connection is healthy. Topic exists."))
-			})
+		fx.Provide(newGRPCServer, newHTTPServers, newShutdownSequence),
+		fx.Invoke(func(*ShutdownSequence) {}),
+	)
+}
 
-			go func() {
-				if err := http.ListenAndServe(":8080", nil); err != nil {
-					logger.Fatal(err)
-				}
-			}()
-		}),
+// newMux serves routes, each behind the firewall, the authorizer and then
+// read-only mode.
+func newMux(routes []Route, firewall *Firewall, authorizer *Authorizer, readOnly *ReadOnly) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		route.Handler = readOnly.Wrap(route)
+		route.Handler = authorizer.Wrap(route)
+		mux.Handle(route.Pattern(), firewall.Wrap(route))
+	}
+	return mux
+}
+
+func archive(logger *log.Logger) fx.Option {
+	return fx.Options(
+		fx.Provide(
+			newPubSubParams(logger),
+			newPubSubClient,
+			newStorageClient,
+			func() ArchiverParams {
+				return newArchiverParams(newLogger("archive"))
+			},
+			newArchiver,
+		),
+		fx.Invoke(func(*Archiver) {}),
 	)
-	app.Run()
+}
+
+// runOnce runs task once the app has started, then shuts the app down,
+// exiting non-zero if task failed. It's used by commands that do a single
+// job rather than serve.
+func runOnce(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, logger *log.Logger, task func(ctx context.Context) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(context.Context) error {
+				go func() {
+					if err := task(ctx); err != nil {
+						logger.Printf("Command failed: %v", err)
+						shutdowner.Shutdown(fx.ExitCode(1))
+						return
+					}
+					shutdowner.Shutdown()
+				}()
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				return nil
+			},
+		},
+	)
+}
+
+type command struct {
+	options func(logger *log.Logger) fx.Option
+	// tool commands write their result to stdout, so their logs go to
+	// stderr instead.
+	tool bool
+}
+
+// commandArgs are the arguments after the command name.
+var commandArgs []string
+
+var commands = map[string]command{
+	"serve":            {options: serve},
+	"archive":          {options: archive},
+	"export-topology":  {options: exportTopology, tool: true},
+	"export-contracts": {options: exportContracts, tool: true},
+	"validate-config":  {options: validateConfig, tool: true},
+	"sync-transforms":  {options: syncTransforms, tool: true},
+	"copy":             {options: copyCommand, tool: true},
+	"replay":           {options: replayCommand, tool: true},
+	"promote":          {options: promoteCommand, tool: true},
+	"schema":           {options: schemaCommand, tool: true},
+	"reconcile":        {options: reconcileCommand, tool: true},
+	"api-key":          {options: apiKeyCommand, tool: true},
+}
+
+func main() {
+	name := "serve"
+	commandArgs = os.Args[1:]
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		name = os.Args[1]
+		commandArgs = os.Args[2:]
+	}
+	command, ok := commands[name]
+	if command.tool {
+		logOutput = os.Stderr
+	}
+	logger := newLogger("app")
+	if !ok {
+		logger.Fatalf("Unknown command %q", name)
+	}
+	if logFormat != logFormatConsole && logFormat != logFormatJSON {
+		logger.Fatalf("Unknown LOG_FORMAT %q", logFormat)
+	}
+
+	recorder := NewLifecycleRecorder()
+	app := fx.New(
+		fx.WithLogger(func() fxevent.Logger { return recorder }),
+		fx.Supply(recorder),
+		command.options(logger),
+	)
+	run(app, logger)
+}
+
+// run is app.Run, but with the stop bounded by stopTimeout, which serve
+// sets from config once the app is built.
+func run(app *fx.App, logger *log.Logger) {
+	startCtx, cancel := context.WithTimeout(context.Background(), app.StartTimeout())
+	defer cancel()
+	if err := app.Start(startCtx); err != nil {
+		logger.Fatalf("Failed to start: %v", err)
+	}
+	signal := <-app.Wait()
+	stopping := time.Now()
+	stopCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if err := app.Stop(stopCtx); err != nil {
+		logger.Fatalf("Failed to stop cleanly after %s: %v", time.Since(stopping), err)
+	}
+	logger.Printf("Stopped in %s", time.Since(stopping))
+	if signal.ExitCode != 0 {
+		os.Exit(signal.ExitCode)
+	}
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultMessageLogSampleRate = 0.01
+	maxLoggedAttributeBytes     = 256
+)
+
+type LoggingConfig struct {
+	// SampleRate is the fraction of successful publishes and deliveries that
+	// are logged, between 0 and 1. Failures are always logged. Defaults to
+	// 0.01; set a negative value to log no successes.
+	SampleRate float64 `yaml:"sample_rate"`
+	// Level is the least severe level logged, debug, info (the default),
+	// warn or error. Levels sets it per logger name, e.g. messages or
+	// subscriber:orders, or kind of logger, e.g. subscriber.
+	Level  string            `yaml:"level"`
+	Levels map[string]string `yaml:"levels"`
+}
+
+// MessageLogger writes one key=value line per published or handled message:
+// a digest of the payload rather than the payload itself, its size,
+// attributes and outcome. Successes are sampled so busy topics don't flood
+// the logs.
+type MessageLogger struct {
+	logger *log.Logger
+	rate   float64
+}
+
+func newMessageLogger(config Config) *MessageLogger {
+	return &MessageLogger{logger: newLogger("messages"), rate: config.Logging.SampleRate}
+}
+
+type messageOutcome struct {
+	// Event is what happened to the message, e.g. publish or handle.
+	Event string
+	// Resource is the topic or subscription name.
+	Resource  string
+	MessageId string
+	Result    string
+	Duration  time.Duration
+	Err       error
+	// Request, if set, is the HTTP request the message arrived in, whose
+	// trace the log entry is tied to.
+	Request *http.Request
+	// Context, if set, is the context the message was handled in, whose
+	// baggage labels the log entry.
+	Context context.Context
+}
+
+func (l *MessageLogger) Log(msg *pubsub.Message, outcome messageOutcome) {
+	if outcome.Err == nil && (l.rate <= 0 || rand.Float64() >= l.rate) {
+		return
+	}
+	if outcome.Result == "" {
+		outcome.Result = "ok"
+		if outcome.Err != nil {
+			outcome.Result = "error"
+		}
+	}
+	digest := sha256.Sum256(msg.Data)
+	var b strings.Builder
+	fmt.Fprintf(&b, "event=%s resource=%q result=%s message_id=%q bytes=%d sha256=%s",
+		outcome.Event, outcome.Resource, outcome.Result, outcome.MessageId, len(msg.Data), hex.EncodeToString(digest[:8]))
+	if msg.OrderingKey != "" {
+		fmt.Fprintf(&b, " ordering_key=%q", msg.OrderingKey)
+	}
+	if len(msg.Attributes) > 0 {
+		fmt.Fprintf(&b, " attributes=%q", formatAttributes(msg.Attributes))
+	}
+	fmt.Fprintf(&b, " duration=%s", outcome.Duration)
+	if outcome.Err != nil {
+		fmt.Fprintf(&b, " error=%q", outcome.Err.Error())
+	}
+	if outcome.Err == nil {
+		fmt.Fprintf(&b, " sampled=%g", l.rate)
+	}
+	logger := l.logger
+	if outcome.Request != nil {
+		logger = requestLogger(logger, outcome.Request)
+	} else if outcome.Context != nil {
+		logger = contextLogger(logger, outcome.Context)
+	}
+	logger.Print(b.String())
+}
+
+func formatAttributes(attributes map[string]string) string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + truncate(attributes[key], maxLoggedAttributeBytes)
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// The well-known attributes and the Metadata struct are generated into
+// metadata_gen.go from the list in internal/metadatagen.
+
+//go:generate go run ./internal/metadatagen
+
+var errInvalidMetadata = errors.New("invalid metadata")
+
+// MetadataFrom reads and validates the well-known attributes of msg.
+func MetadataFrom(msg *pubsub.Message) (Metadata, error) {
+	var metadata Metadata
+	err := metadata.Unmarshal(msg.Attributes)
+	return metadata, err
+}
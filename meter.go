@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	mexporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/metric"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.uber.org/fx"
+
+	"gcp-pubsub-test/metrics"
+	"gcp-pubsub-test/metrics/otelmetrics"
+	"gcp-pubsub-test/metrics/prommetrics"
+)
+
+const (
+	metricsBackendPrometheus    = "prometheus"
+	metricsBackendOpenTelemetry = "opentelemetry"
+	metricsBackendNone          = "none"
+
+	defaultMetricsExportInterval = time.Minute
+)
+
+// MetricsConfig chooses what records the service's metrics.
+type MetricsConfig struct {
+	// Backend is prometheus, the default, served on /metrics;
+	// opentelemetry, exported to Cloud Monitoring; or none.
+	Backend string `yaml:"backend"`
+	// ExportInterval is how often OpenTelemetry metrics are exported.
+	// Defaults to 1m.
+	ExportInterval time.Duration `yaml:"export_interval"`
+}
+
+func (c *MetricsConfig) validate() error {
+	switch c.Backend {
+	case "":
+		c.Backend = metricsBackendPrometheus
+	case metricsBackendPrometheus, metricsBackendOpenTelemetry, metricsBackendNone:
+	default:
+		return fmt.Errorf("unknown backend %q", c.Backend)
+	}
+	if c.ExportInterval == 0 {
+		c.ExportInterval = defaultMetricsExportInterval
+	} else if c.ExportInterval < 0 {
+		return fmt.Errorf("export_interval can't be negative")
+	}
+	return nil
+}
+
+// Every command records with Prometheus unless applyMetrics says otherwise.
+func init() {
+	metrics.Use(prommetrics.New(prometheus.DefaultRegisterer))
+}
+
+// applyMetrics switches the metrics to the configured backend. It's
+// invoked before anything that records them is constructed.
+func applyMetrics(lifecycle fx.Lifecycle, config Config, params PubSubParams) error {
+	switch config.Metrics.Backend {
+	case metricsBackendNone:
+		metrics.Use(metrics.NoOp())
+	case metricsBackendOpenTelemetry:
+		if params.Config.ProjectId == localProjectId || os.Getenv("PUBSUB_EMULATOR_HOST") != "" {
+			// The global meter provider records nothing until one is set.
+			newLogger("metrics").Println("Not exporting OpenTelemetry metrics without Google Cloud")
+			metrics.Use(otelmetrics.New(otel.Meter(tracerName)))
+			return nil
+		}
+		exporter, err := mexporter.New(
+			mexporter.WithProjectID(params.Config.ProjectId),
+			mexporter.WithMonitoringClientOptions(params.clientOptions()...),
+		)
+		if err != nil {
+			return fmt.Errorf("metrics: %w", err)
+		}
+		provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(config.Metrics.ExportInterval))))
+		otel.SetMeterProvider(provider)
+		lifecycle.Append(fx.Hook{OnStop: provider.Shutdown})
+		metrics.Use(otelmetrics.New(provider.Meter(tracerName)))
+	}
+	return nil
+}
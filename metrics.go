@@ -0,0 +1,598 @@
+package main
+
+import (
+	"gcp-pubsub-test/metrics"
+)
+
+var (
+	lifecycleHookDuration = metrics.NewHistogramVec(
+		metrics.HistogramOpts{
+			Name:    "lifecycle_hook_duration_seconds",
+			Help:    "Time taken by fx lifecycle hooks.",
+			Buckets: []float64{.001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"hook", "phase", "result"},
+	)
+)
+
+var (
+	messagesProcessed = metrics.NewCounterVec(
+		metrics.Opts{
+			Name: "subscriber_messages_processed_total",
+			Help: "Messages handled by subscribers, by outcome.",
+		},
+		[]string{"subscription", "result"},
+	)
+	retriedMessages = metrics.NewCounterVec(
+		metrics.Opts{
+			Name: "subscriber_retried_messages_total",
+			Help: "Failed messages sent on through a retry chain, by the stage delay or dead_letter.",
+		},
+		[]string{"subscription", "target"},
+	)
+	handlerTimeouts = metrics.NewCounterVec(
+		metrics.Opts{
+			Name: "subscriber_handler_timeouts_total",
+			Help: "Handlers that exceeded their timeout, by the action taken.",
+		},
+		[]string{"subscription", "action"},
+	)
+	subscriberBackoffState = metrics.NewGaugeVec(
+		metrics.Opts{
+			Name: "subscriber_backoff_state",
+			Help: "Consumption backoff state: 0 closed, 1 open (not receiving), 2 probing.",
+		},
+		[]string{"subscription"},
+	)
+	subscriberBackoffTrips = metrics.NewCounterVec(
+		metrics.Opts{
+			Name: "subscriber_backoff_trips_total",
+			Help: "Times a subscriber stopped receiving because its handler kept failing.",
+		},
+		[]string{"subscription"},
+	)
+	subscriberPaused = metrics.NewGaugeVec(
+		metrics.Opts{
+			Name: "subscriber_paused",
+			Help: "1 while a subscriber is paused through the admin API.",
+		},
+		[]string{"subscription"},
+	)
+	subscriberBacklogExceeded = metrics.NewGaugeVec(
+		metrics.Opts{
+			Name: "subscriber_backlog_exceeded",
+			Help: "1 while a subscription's backlog is over its readiness limits.",
+		},
+		[]string{"subscription"},
+	)
+	dispatcherActiveKeys = metrics.NewGaugeVec(
+		metrics.Opts{
+			Name: "dispatcher_active_ordering_keys",
+			Help: "Ordering keys with queued or in-flight messages.",
+		},
+		[]string{"subscription"},
+	)
+	dispatcherRejected = metrics.NewCounterVec(
+		metrics.Opts{
+			Name: "dispatcher_rejected_messages_total",
+			Help: "Messages nacked because their ordering key's queue was full.",
+		},
+		[]string{"subscription"},
+	)
+)
+
+var (
+	publishLatency = metrics.NewHistogramVec(
+		metrics.HistogramOpts{
+			Name:    "publish_latency_seconds",
+			Help:    "Time from Publish to the result resolving, including batching delay.",
+			Buckets: metrics.ExponentialBuckets(.001, 2, 14),
+		},
+		[]string{"topic", "result"},
+	)
+	publishUnavailable = metrics.NewCounterVec(
+		metrics.Opts{
+			Name: "publish_unavailable_total",
+			Help: "Publish requests rejected with 503, by reason.",
+		},
+		[]string{"topic", "reason"},
+	)
+	publishInFlight = metrics.NewGaugeVec(
+		metrics.Opts{
+			Name: "publish_in_flight",
+			Help: "Publish requests waiting on a result, against the topic's max_concurrent_publishes.",
+		},
+		[]string{"topic"},
+	)
+	publisherCircuitOpen = metrics.NewGaugeVec(
+		metrics.Opts{
+			Name: "publisher_circuit_open",
+			Help: "1 while a topic's circuit breaker is open.",
+		},
+		[]string{"topic"},
+	)
+	publishRequestLatency = metrics.NewHistogramVec(
+		metrics.HistogramOpts{
+			Name:    "publish_request_latency_seconds",
+			Help:    "Time from receiving a publish HTTP request to its publish result resolving.",
+			Buckets: metrics.ExponentialBuckets(.001, 2, 14),
+		},
+		[]string{"topic", "result"},
+	)
+	publishRPCLatency = metrics.NewHistogramVec(
+		metrics.HistogramOpts{
+			Name:    "publish_rpc_latency_seconds",
+			Help:    "Duration of Publish RPCs, each carrying a batch, by Pub/Sub topic ID and gRPC code.",
+			Buckets: metrics.ExponentialBuckets(.001, 2, 14),
+		},
+		[]string{"topic", "code"},
+	)
+	publishTargetMessages = metrics.NewCounterVec(
+		metrics.Opts{
+			Name: "publish_target_messages_total",
+			Help: "Messages published, by whether the primary or failover topic served them.",
+		},
+		[]string{"topic", "target"},
+	)
+	publishFailoverActive = metrics.NewGaugeVec(
+		metrics.Opts{
+			Name: "publish_failover_active",
+			Help: "1 while a topic publishes to its failover topic.",
+		},
+		[]string{"topic"},
+	)
+	publishFailovers = metrics.NewCounterVec(
+		metrics.Opts{
+			Name: "publish_failovers_total",
+			Help: "Switches between primary and failover topic, by the target switched to.",
+		},
+		[]string{"topic", "target"},
+	)
+	topicExistsLookups = metrics.NewCounterVec(
+		metrics.Opts{
+			Name: "publisher_topic_exists_lookups_total",
+			Help: "Topic existence lookups, by whether the cache answered them.",
+		},
+		[]string{"result"},
+	)
+	batchDelayThreshold = metrics.NewGaugeVec(
+		metrics.Opts{
+			Name: "publisher_batch_delay_threshold_seconds",
+			Help: "Current DelayThreshold of adaptively batched topics.",
+		},
+		[]string{"topic"},
+	)
+	batchCountThreshold = metrics.NewGaugeVec(
+		metrics.Opts{
+			Name: "publisher_batch_count_threshold",
+			Help: "Current CountThreshold of adaptively batched topics.",
+		},
+		[]string{"topic"},
+	)
+)
+
+var authDenials = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "http_auth_denials_total",
+		Help: "Requests to scoped routes rejected for a missing, unknown or insufficient API key.",
+	},
+	[]string{"route", "reason"},
+)
+
+var eventarcEvents = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "eventarc_events_total",
+		Help: "Events received from Eventarc, by destination topic and outcome.",
+	},
+	[]string{"topic", "result"},
+)
+
+var containerCPULimitCores = metrics.NewGauge(
+	metrics.Opts{
+		Name: "runtime_container_cpu_limit_cores",
+		Help: "CPU limit of the container, in cores, that GOMAXPROCS is derived from.",
+	},
+)
+
+var topologyDrift = metrics.NewGaugeVec(
+	metrics.Opts{
+		Name: "topology_drift",
+		Help: "Declared resources found drifted from the config by the last reconcile, and not healed.",
+	},
+	[]string{"kind", "resource", "problem"},
+)
+
+var topologyReconciles = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "topology_reconciles_total",
+		Help: "Comparisons of the declared topology with GCP, by whether the live state could be read.",
+	},
+	[]string{"result"},
+)
+
+var topologyHealed = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "topology_healed_total",
+		Help: "Drifted resources the reconciler tried to heal, by kind and outcome.",
+	},
+	[]string{"kind", "result"},
+)
+
+var campaignMessages = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "campaign_messages_total",
+		Help: "Email events published for campaigns, by whether publishing them failed.",
+	},
+	[]string{"result"},
+)
+
+var failuresRecorded = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "failures_recorded_total",
+		Help: "Publishes and consumed messages given up on and recorded for triage.",
+	},
+	[]string{"kind", "resource"},
+)
+
+var batchSize = metrics.NewHistogramVec(
+	metrics.HistogramOpts{
+		Name:    "subscriber_batch_size",
+		Help:    "Messages in each batch handed to a batch handler.",
+		Buckets: metrics.ExponentialBuckets(1, 2, 11),
+	},
+	[]string{"subscription"},
+)
+
+var recentTails = metrics.NewGauge(
+	metrics.Opts{
+		Name: "recent_tails",
+		Help: "Clients streaming published messages from /admin/tail.",
+	},
+)
+
+var identityRejections = metrics.NewCounter(
+	metrics.Opts{
+		Name: "identity_rejections_total",
+		Help: "Received messages whose caller identity couldn't be trusted and was ignored.",
+	},
+)
+
+var publishDedup = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "publish_dedup_total",
+		Help: "Publish requests with an idempotency key, by whether they were new, a duplicate, in_progress, a mismatch or published without dedup after an error.",
+	},
+	[]string{"topic", "result"},
+)
+
+var readOnlyMode = metrics.NewGauge(
+	metrics.Opts{
+		Name: "read_only",
+		Help: "1 while publishes and admin mutations are rejected by read-only mode.",
+	},
+)
+
+var readOnlyRejections = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "read_only_rejections_total",
+		Help: "Requests rejected by read-only mode, by route.",
+	},
+	[]string{"route"},
+)
+
+var lineageHopLimited = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "lineage_hop_limited_total",
+		Help: "Messages not forwarded because they reached max_hops, by origin service.",
+	},
+	[]string{"origin"},
+)
+
+var debugSampledMessages = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "debug_sampled_messages_total",
+		Help: "Published messages mirrored to their topic's debug topic, by whether mirroring failed.",
+	},
+	[]string{"topic", "result"},
+)
+
+var firewallDenials = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "http_firewall_denials_total",
+		Help: "Requests denied by the firewall, by filter and whether for the client address, method, path or size, or that a preview rule would have denied.",
+	},
+	[]string{"filter", "reason"},
+)
+
+var priorityMessages = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "priority_lane_messages_total",
+		Help: "Messages published to topics with priority lanes, by lane.",
+	},
+	[]string{"topic", "lane"},
+)
+
+var publishQuota = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "publish_quota_total",
+		Help: "Publishes counted against API key budgets, by key and whether they fit, exceeded it or couldn't be counted.",
+	},
+	[]string{"caller", "result"},
+)
+
+var subscriberStallRestarts = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "subscriber_stall_restarts_total",
+		Help: "Times a subscriber's receive stream was restarted for delivering nothing while its subscription had a backlog.",
+	},
+	[]string{"subscription"},
+)
+
+var topicDeleted = metrics.NewGaugeVec(
+	metrics.Opts{
+		Name: "topic_deleted",
+		Help: "1 while a registered topic is missing after publishing to it failed with NotFound, else 0.",
+	},
+	[]string{"topic"},
+)
+
+var topicRecreations = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "topic_recreations_total",
+		Help: "Attempts to recreate a deleted topic with auto_create, by result.",
+	},
+	[]string{"topic", "result"},
+)
+
+var webhookDeliveries = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "webhook_deliveries_total",
+		Help: "Webhook delivery attempts by subscription and result: ok, retry, failed once attempts ran out, or permanent.",
+	},
+	[]string{"subscription", "result"},
+)
+
+var emailSuppressions = metrics.NewGauge(
+	metrics.Opts{
+		Name: "email_suppressions",
+		Help: "Addresses on this instance's copy of the email suppression list.",
+	},
+)
+
+var emailSuppressed = metrics.NewCounter(
+	metrics.Opts{
+		Name: "email_suppressed_recipients_total",
+		Help: "Recipients dropped from email events for being on the suppression list.",
+	},
+)
+
+var expiredMessages = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "subscriber_expired_messages_total",
+		Help: "Messages acked unhandled for being past their expires_at, by result: dropped, forwarded to the expired topic, or failed to forward and nacked.",
+	},
+	[]string{"subscription", "result"},
+)
+
+var publishGroups = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "publish_groups_total",
+		Help: "Publish groups staged, by result: published by the request, left pending for the relay, or relayed.",
+	},
+	[]string{"result"},
+)
+
+var canaryHeartbeats = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "canary_heartbeats_total",
+		Help: "Canary heartbeats sent by this instance, by result: received, lost, or publish_failed.",
+	},
+	[]string{"result"},
+)
+
+var canaryLatency = metrics.NewHistogram(
+	metrics.HistogramOpts{
+		Name:    "canary_latency_seconds",
+		Help:    "Time from a canary heartbeat being sent to it being received, by whichever instance received it.",
+		Buckets: metrics.ExponentialBuckets(.001, 2, 16),
+	},
+)
+
+var retryBudgetRequests = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "retry_budget_requests_total",
+		Help: "First attempts counted by the retry budget, by kind: publish RPCs or webhook deliveries.",
+	},
+	[]string{"kind"},
+)
+
+var retryBudgetRetries = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "retry_budget_retries_total",
+		Help: "Retries asked of the retry budget, by kind and result: allowed, or denied for the budget being spent.",
+	},
+	[]string{"kind", "result"},
+)
+
+var retryBudgetAvailable = metrics.NewGauge(
+	metrics.Opts{
+		Name: "retry_budget_available",
+		Help: "Retries the retry budget allowed over the window as of its last use. Only set when retry_budget.ratio is.",
+	},
+)
+
+var auditEvents = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "audit_events_total",
+		Help: "Events written to the audit log, by event_id.",
+	},
+	[]string{"event_id"},
+)
+
+var mtlsDenials = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "mtls_denials_total",
+		Help: "Requests and connections denied by mutual TLS, by reason: no_certificate or san_not_allowed.",
+	},
+	[]string{"reason"},
+)
+
+var publishHedges = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "publish_hedges_total",
+		Help: "Publishes that were slow enough to hedge, by result: won when the hedge succeeded first, lost when the first attempt did, failed when both failed, or denied by the hedge budget.",
+	},
+	[]string{"topic", "result"},
+)
+
+var publishHedgeDelay = metrics.NewGaugeVec(
+	metrics.Opts{
+		Name: "publish_hedge_delay_seconds",
+		Help: "The estimated publish latency quantile after which publishes to the topic are hedged.",
+	},
+	[]string{"topic"},
+)
+
+var priorityLaneWait = metrics.NewHistogramVec(
+	metrics.HistogramOpts{
+		Name:    "priority_lane_wait_seconds",
+		Help:    "How long messages of a priority lane waited for a handler slot shared with the topic's other lanes.",
+		Buckets: metrics.ExponentialBuckets(0.01, 4, 10),
+	},
+	[]string{"topic", "lane"},
+)
+
+var priorityLaneWaiting = metrics.NewGaugeVec(
+	metrics.Opts{
+		Name: "priority_lane_waiting",
+		Help: "Messages of a priority lane waiting for a handler slot.",
+	},
+	[]string{"topic", "lane"},
+)
+
+var priorityAgedMessages = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "priority_aged_messages_total",
+		Help: "Messages given a handler slot while boosted above their lane by priority aging, by the lane they were boosted to.",
+	},
+	[]string{"topic", "lane", "boosted_to"},
+)
+
+var usageReports = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "usage_reports_total",
+		Help: "Usage reports generated and delivered, by period and result: ok or error.",
+	},
+	[]string{"period", "result"},
+)
+
+var usageReportEstimatedCost = metrics.NewGaugeVec(
+	metrics.Opts{
+		Name: "usage_report_estimated_cost_dollars",
+		Help: "The estimated Pub/Sub cost of the topic in the latest usage report of the period, in USD.",
+	},
+	[]string{"period", "topic"},
+)
+
+var authUnhealthy = metrics.NewGauge(
+	metrics.Opts{
+		Name: "auth_unhealthy",
+		Help: "1 while authenticating with Google Cloud fails, and publishes are rejected.",
+	},
+)
+
+var credentialReloads = metrics.NewCounter(
+	metrics.Opts{
+		Name: "credential_reloads_total",
+		Help: "Times the credentials key file was reloaded, after it changed or a token couldn't be fetched with it.",
+	},
+)
+
+var routingUpdates = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "routing_updates_total",
+		Help: "Versions of the Firestore routing document seen, by result: applied, invalid, missing, or error when watching it failed.",
+	},
+	[]string{"result"},
+)
+
+var routedMessages = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "routed_messages_total",
+		Help: "Messages published to an alias or split, by the name published to and the topic it was routed to.",
+	},
+	[]string{"from", "to"},
+)
+
+var healthProbes = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "health_probes_total",
+		Help: "Deep health probes sent by this instance, by result: echoed, timeout, or publish_failed.",
+	},
+	[]string{"result"},
+)
+
+var healthProbeLatency = metrics.NewHistogram(
+	metrics.HistogramOpts{
+		Name:    "health_probe_latency_seconds",
+		Help:    "Time from a deep health probe being published to its echo being seen.",
+		Buckets: metrics.ExponentialBuckets(.01, 2, 12),
+	},
+)
+
+var publishErrors = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "publish_errors_total",
+		Help: "Publishes through the API that Pub/Sub failed, by topic and gRPC status code.",
+	},
+	[]string{"topic", "code"},
+)
+
+var callbackDeliveries = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "callback_deliveries_total",
+		Help: "Publish callback delivery attempts by topic and result: ok, retry, or failed once attempts ran out or the endpoint rejected it.",
+	},
+	[]string{"topic", "result"},
+)
+
+var pushVerifications = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "push_verifications_total",
+		Help: "Checks that a provisioned push subscription's endpoint accepts pushes, by subscription and result.",
+	},
+	[]string{"subscription", "result"},
+)
+
+var publishShed = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "publish_shed_total",
+		Help: "Publishes over a topic's flow control limits, by topic and what was done with them: reject or spill.",
+	},
+	[]string{"topic", "policy"},
+)
+
+var outboxPublished = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "outbox_published_total",
+		Help: "Attempts to publish messages spilled to a topic's outbox, by topic and result.",
+	},
+	[]string{"topic", "result"},
+)
+
+var outboxDelay = metrics.NewHistogramVec(
+	metrics.HistogramOpts{
+		Name:    "outbox_delay_seconds",
+		Help:    "Time from a message being spilled to a topic's outbox to its publish.",
+		Buckets: metrics.ExponentialBuckets(.1, 2, 14),
+	},
+	[]string{"topic"},
+)
+
+var clientRotations = metrics.NewCounterVec(
+	metrics.Opts{
+		Name: "client_rotations_total",
+		Help: "Requests to rotate the Pub/Sub client, by result: ok, or failed when the standby client couldn't be created or reach Pub/Sub.",
+	},
+	[]string{"result"},
+)
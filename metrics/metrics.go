@@ -0,0 +1,261 @@
+// Package metrics declares metrics independently of the stack that records
+// them. Metrics are declared as package variables, as with promauto, and
+// are bound to the backend in use when first recorded, so code embedding
+// the service's packages chooses Prometheus, OpenTelemetry or nothing with
+// Use, without being tied to any of them.
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Desc describes a metric to a backend.
+type Desc struct {
+	Name   string
+	Help   string
+	Labels []string
+	// Buckets are a histogram's upper bounds.
+	Buckets []float64
+}
+
+type Counter interface {
+	Inc()
+	Add(delta float64)
+}
+
+type Gauge interface {
+	Set(value float64)
+	Inc()
+	Dec()
+	Add(delta float64)
+}
+
+type Histogram interface {
+	Observe(value float64)
+	// ObserveWithExemplar attaches labels, such as a trace ID, to the
+	// observation, where the backend supports exemplars, and otherwise
+	// just observes value.
+	ObserveWithExemplar(value float64, exemplar map[string]string)
+}
+
+// Backend records metrics. Each family it returns gives the metric with a
+// value for each of its labels, in order.
+type Backend interface {
+	Counter(desc Desc) CounterFamily
+	Gauge(desc Desc) GaugeFamily
+	Histogram(desc Desc) HistogramFamily
+}
+
+type CounterFamily interface {
+	With(values ...string) Counter
+	// Reset drops every label combination, where the backend can.
+	Reset()
+}
+
+type GaugeFamily interface {
+	With(values ...string) Gauge
+	Reset()
+}
+
+type HistogramFamily interface {
+	With(values ...string) Histogram
+	Reset()
+}
+
+var (
+	mu       sync.Mutex
+	backend  Backend = NoOp()
+	declared []interface{ unbind() }
+)
+
+// Use records every metric with b from now on. It's meant to be called
+// once, on startup, before metrics are recorded: what was recorded with
+// the previous backend stays there.
+func Use(b Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	backend = b
+	for _, metric := range declared {
+		metric.unbind()
+	}
+}
+
+func declare(metric interface{ unbind() }) {
+	mu.Lock()
+	defer mu.Unlock()
+	declared = append(declared, metric)
+}
+
+// lazy is a family bound to the backend in use when it's first needed.
+type lazy[F any] struct {
+	desc  Desc
+	new   func(Backend, Desc) F
+	bound atomic.Pointer[F]
+}
+
+func (l *lazy[F]) family() F {
+	if family := l.bound.Load(); family != nil {
+		return *family
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if family := l.bound.Load(); family != nil {
+		return *family
+	}
+	family := l.new(backend, l.desc)
+	l.bound.Store(&family)
+	return family
+}
+
+func (l *lazy[F]) unbind() {
+	l.bound.Store(nil)
+}
+
+type Opts struct {
+	Name string
+	Help string
+}
+
+type HistogramOpts struct {
+	Name    string
+	Help    string
+	Buckets []float64
+}
+
+type CounterVec struct {
+	lazy[CounterFamily]
+}
+
+func NewCounterVec(opts Opts, labels []string) *CounterVec {
+	vec := &CounterVec{lazy[CounterFamily]{desc: Desc{Name: opts.Name, Help: opts.Help, Labels: labels}, new: Backend.Counter}}
+	declare(vec)
+	return vec
+}
+
+func (v *CounterVec) WithLabelValues(values ...string) Counter {
+	return v.family().With(values...)
+}
+
+func (v *CounterVec) Reset() {
+	v.family().Reset()
+}
+
+// NewCounter declares a counter without labels.
+func NewCounter(opts Opts) Counter {
+	return counter{NewCounterVec(opts, nil)}
+}
+
+type counter struct {
+	vec *CounterVec
+}
+
+func (c counter) Inc()              { c.vec.WithLabelValues().Inc() }
+func (c counter) Add(delta float64) { c.vec.WithLabelValues().Add(delta) }
+
+type GaugeVec struct {
+	lazy[GaugeFamily]
+}
+
+func NewGaugeVec(opts Opts, labels []string) *GaugeVec {
+	vec := &GaugeVec{lazy[GaugeFamily]{desc: Desc{Name: opts.Name, Help: opts.Help, Labels: labels}, new: Backend.Gauge}}
+	declare(vec)
+	return vec
+}
+
+func (v *GaugeVec) WithLabelValues(values ...string) Gauge {
+	return v.family().With(values...)
+}
+
+func (v *GaugeVec) Reset() {
+	v.family().Reset()
+}
+
+// NewGauge declares a gauge without labels.
+func NewGauge(opts Opts) Gauge {
+	return gauge{NewGaugeVec(opts, nil)}
+}
+
+type gauge struct {
+	vec *GaugeVec
+}
+
+func (g gauge) Set(value float64) { g.vec.WithLabelValues().Set(value) }
+func (g gauge) Inc()              { g.vec.WithLabelValues().Inc() }
+func (g gauge) Dec()              { g.vec.WithLabelValues().Dec() }
+func (g gauge) Add(delta float64) { g.vec.WithLabelValues().Add(delta) }
+
+type HistogramVec struct {
+	lazy[HistogramFamily]
+}
+
+func NewHistogramVec(opts HistogramOpts, labels []string) *HistogramVec {
+	vec := &HistogramVec{lazy[HistogramFamily]{desc: Desc{Name: opts.Name, Help: opts.Help, Labels: labels, Buckets: opts.Buckets}, new: Backend.Histogram}}
+	declare(vec)
+	return vec
+}
+
+func (v *HistogramVec) WithLabelValues(values ...string) Histogram {
+	return v.family().With(values...)
+}
+
+func (v *HistogramVec) Reset() {
+	v.family().Reset()
+}
+
+// NewHistogram declares a histogram without labels.
+func NewHistogram(opts HistogramOpts) Histogram {
+	return histogram{NewHistogramVec(opts, nil)}
+}
+
+type histogram struct {
+	vec *HistogramVec
+}
+
+func (h histogram) Observe(value float64) { h.vec.WithLabelValues().Observe(value) }
+func (h histogram) ObserveWithExemplar(value float64, exemplar map[string]string) {
+	h.vec.WithLabelValues().ObserveWithExemplar(value, exemplar)
+}
+
+// ExponentialBuckets returns count buckets, the first with the upper bound
+// start and each after factor times the one before.
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// NoOp returns a backend that records nothing.
+func NoOp() Backend {
+	return noOp{}
+}
+
+type noOp struct{}
+
+func (noOp) Counter(Desc) CounterFamily     { return noOp{} }
+func (noOp) Gauge(Desc) GaugeFamily         { return noOpGauges{} }
+func (noOp) Histogram(Desc) HistogramFamily { return noOpHistograms{} }
+func (noOp) With(...string) Counter         { return noOpMetric{} }
+func (noOp) Reset()                         {}
+
+type noOpGauges struct{}
+
+func (noOpGauges) With(...string) Gauge { return noOpMetric{} }
+func (noOpGauges) Reset()               {}
+
+type noOpHistograms struct{}
+
+func (noOpHistograms) With(...string) Histogram { return noOpMetric{} }
+func (noOpHistograms) Reset()                   {}
+
+type noOpMetric struct{}
+
+func (noOpMetric) Inc()                                           {}
+func (noOpMetric) Dec()                                           {}
+func (noOpMetric) Add(float64)                                    {}
+func (noOpMetric) Set(float64)                                    {}
+func (noOpMetric) Observe(float64)                                {}
+func (noOpMetric) ObserveWithExemplar(float64, map[string]string) {}
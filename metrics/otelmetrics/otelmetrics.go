@@ -0,0 +1,176 @@
+// Package otelmetrics records metrics with OpenTelemetry.
+package otelmetrics
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"gcp-pubsub-test/metrics"
+)
+
+// New returns a backend that creates each metric as an instrument of
+// meter: counters as counters, histograms as histograms with the metric's
+// buckets, and gauges as observable gauges reporting the last value set.
+// Instruments that fail to be created, say for an invalid name, record
+// nothing.
+func New(meter metric.Meter) metrics.Backend {
+	return backend{meter: meter}
+}
+
+type backend struct {
+	meter metric.Meter
+}
+
+func (b backend) Counter(desc metrics.Desc) metrics.CounterFamily {
+	counter, err := b.meter.Float64Counter(desc.Name, metric.WithDescription(desc.Help))
+	if err != nil {
+		return metrics.NoOp().Counter(desc)
+	}
+	return counters{labels: desc.Labels, counter: counter}
+}
+
+func (b backend) Gauge(desc metrics.Desc) metrics.GaugeFamily {
+	family := &gauges{labels: desc.Labels}
+	_, err := b.meter.Float64ObservableGauge(desc.Name, metric.WithDescription(desc.Help), metric.WithFloat64Callback(family.observe))
+	if err != nil {
+		return metrics.NoOp().Gauge(desc)
+	}
+	return family
+}
+
+func (b backend) Histogram(desc metrics.Desc) metrics.HistogramFamily {
+	options := []metric.Float64HistogramOption{metric.WithDescription(desc.Help)}
+	if len(desc.Buckets) > 0 {
+		options = append(options, metric.WithExplicitBucketBoundaries(desc.Buckets...))
+	}
+	histogram, err := b.meter.Float64Histogram(desc.Name, options...)
+	if err != nil {
+		return metrics.NoOp().Histogram(desc)
+	}
+	return histograms{labels: desc.Labels, histogram: histogram}
+}
+
+// attributes pairs a metric's labels with their values.
+func attributes(labels []string, values []string) attribute.Set {
+	kvs := make([]attribute.KeyValue, min(len(labels), len(values)))
+	for i := range kvs {
+		kvs[i] = attribute.String(labels[i], values[i])
+	}
+	return attribute.NewSet(kvs...)
+}
+
+type counters struct {
+	labels  []string
+	counter metric.Float64Counter
+}
+
+func (c counters) With(values ...string) metrics.Counter {
+	return counter{counter: c.counter, options: metric.WithAttributeSet(attributes(c.labels, values))}
+}
+
+// Reset does nothing: OpenTelemetry counters can't be reset.
+func (counters) Reset() {}
+
+type counter struct {
+	counter metric.Float64Counter
+	options metric.AddOption
+}
+
+func (c counter) Inc() {
+	c.Add(1)
+}
+
+func (c counter) Add(delta float64) {
+	c.counter.Add(context.Background(), delta, c.options)
+}
+
+// gauges holds the last value of each gauge, by its label values, for the
+// instrument's callback to report.
+type gauges struct {
+	labels []string
+	values sync.Map
+}
+
+func (g *gauges) With(values ...string) metrics.Gauge {
+	key := strings.Join(values, "\x00")
+	if existing, ok := g.values.Load(key); ok {
+		return existing.(*gauge)
+	}
+	existing, _ := g.values.LoadOrStore(key, &gauge{attributes: attributes(g.labels, values)})
+	return existing.(*gauge)
+}
+
+func (g *gauges) Reset() {
+	g.values.Range(func(key, _ any) bool {
+		g.values.Delete(key)
+		return true
+	})
+}
+
+func (g *gauges) observe(_ context.Context, observer metric.Float64Observer) error {
+	g.values.Range(func(_, value any) bool {
+		gauge := value.(*gauge)
+		observer.Observe(math.Float64frombits(gauge.bits.Load()), metric.WithAttributeSet(gauge.attributes))
+		return true
+	})
+	return nil
+}
+
+type gauge struct {
+	attributes attribute.Set
+	bits       atomic.Uint64
+}
+
+func (g *gauge) Set(value float64) {
+	g.bits.Store(math.Float64bits(value))
+}
+
+func (g *gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *gauge) Add(delta float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+type histograms struct {
+	labels    []string
+	histogram metric.Float64Histogram
+}
+
+func (h histograms) With(values ...string) metrics.Histogram {
+	return histogram{histogram: h.histogram, options: metric.WithAttributeSet(attributes(h.labels, values))}
+}
+
+// Reset does nothing: OpenTelemetry histograms can't be reset.
+func (histograms) Reset() {}
+
+type histogram struct {
+	histogram metric.Float64Histogram
+	options   metric.RecordOption
+}
+
+func (h histogram) Observe(value float64) {
+	h.histogram.Record(context.Background(), value, h.options)
+}
+
+// ObserveWithExemplar observes value without the exemplar: OpenTelemetry
+// samples exemplars itself, from the span in the context.
+func (h histogram) ObserveWithExemplar(value float64, _ map[string]string) {
+	h.Observe(value)
+}
@@ -0,0 +1,85 @@
+// Package prommetrics records metrics with Prometheus.
+package prommetrics
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gcp-pubsub-test/metrics"
+)
+
+// New returns a backend that registers each metric with registerer. A
+// metric already registered, say by an earlier backend, is reused.
+func New(registerer prometheus.Registerer) metrics.Backend {
+	return backend{registerer: registerer}
+}
+
+type backend struct {
+	registerer prometheus.Registerer
+}
+
+// register registers collector, or returns the one already registered in
+// its place.
+func register[C prometheus.Collector](registerer prometheus.Registerer, collector C) C {
+	err := registerer.Register(collector)
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		if existing, ok := registered.ExistingCollector.(C); ok {
+			return existing
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	return collector
+}
+
+func (b backend) Counter(desc metrics.Desc) metrics.CounterFamily {
+	return counters{register(b.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{Name: desc.Name, Help: desc.Help}, desc.Labels))}
+}
+
+func (b backend) Gauge(desc metrics.Desc) metrics.GaugeFamily {
+	return gauges{register(b.registerer, prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: desc.Name, Help: desc.Help}, desc.Labels))}
+}
+
+func (b backend) Histogram(desc metrics.Desc) metrics.HistogramFamily {
+	opts := prometheus.HistogramOpts{Name: desc.Name, Help: desc.Help, Buckets: desc.Buckets}
+	return histograms{register(b.registerer, prometheus.NewHistogramVec(opts, desc.Labels))}
+}
+
+type counters struct {
+	*prometheus.CounterVec
+}
+
+func (c counters) With(values ...string) metrics.Counter {
+	return c.WithLabelValues(values...)
+}
+
+type gauges struct {
+	*prometheus.GaugeVec
+}
+
+func (g gauges) With(values ...string) metrics.Gauge {
+	return g.WithLabelValues(values...)
+}
+
+type histograms struct {
+	*prometheus.HistogramVec
+}
+
+func (h histograms) With(values ...string) metrics.Histogram {
+	return histogram{h.WithLabelValues(values...)}
+}
+
+type histogram struct {
+	prometheus.Observer
+}
+
+func (h histogram) ObserveWithExemplar(value float64, exemplar map[string]string) {
+	if observer, ok := h.Observer.(prometheus.ExemplarObserver); ok {
+		observer.ObserveWithExemplar(value, exemplar)
+		return
+	}
+	h.Observe(value)
+}
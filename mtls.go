@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TLSConfig serves the HTTP and gRPC APIs over TLS, and with ClientCAFile,
+// mutual TLS, for deployments on GKE or VMs that have no IAM-controlled
+// ingress in front of them, as Cloud Run does. The files are read on
+// startup, so rotating them takes a restart.
+type TLSConfig struct {
+	// CertFile and KeyFile are the server's PEM certificate chain and key.
+	// Setting them serves every port over TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile is a PEM bundle of the CAs client certificates must be
+	// issued by. Setting it requires a client certificate for every route
+	// but the health checks, which stay open for probes that can't present
+	// one, like the kubelet's.
+	ClientCAFile string `yaml:"client_ca_file"`
+	// AllowedSANs, if set, are the client certificate subject alternative
+	// names accepted: DNS names, where *.example.com matches one label, IP
+	// addresses, email addresses, or URIs such as SPIFFE IDs. A certificate
+	// needs only one of its SANs listed.
+	AllowedSANs []string `yaml:"allowed_sans"`
+}
+
+func (c TLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	if c.ClientCAFile != "" && c.CertFile == "" {
+		return errors.New("client_ca_file needs cert_file and key_file")
+	}
+	if len(c.AllowedSANs) > 0 && c.ClientCAFile == "" {
+		return errors.New("allowed_sans needs client_ca_file")
+	}
+	return nil
+}
+
+// ServerTLS is the TLS config the HTTP and gRPC servers share.
+type ServerTLS struct {
+	logger *log.Logger
+	// config is nil when serving plaintext.
+	config *tls.Config
+	// mutual is whether routes require a client certificate.
+	mutual bool
+}
+
+func newServerTLS(config Config) (*ServerTLS, error) {
+	s := &ServerTLS{logger: newLogger("tls")}
+	settings := config.TLS
+	if settings.CertFile == "" {
+		return s, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	s.config = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if settings.ClientCAFile == "" {
+		return s, nil
+	}
+	bundle, err := os.ReadFile(settings.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("tls: client_ca_file %s has no PEM certificates", settings.ClientCAFile)
+	}
+	s.mutual = true
+	s.config.ClientCAs = pool
+	// Verified if given rather than required, so health checks can be
+	// served without one; Wrap requires it for everything else.
+	s.config.ClientAuth = tls.VerifyClientCertIfGiven
+	if len(settings.AllowedSANs) > 0 {
+		allowed := settings.AllowedSANs
+		s.config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return nil
+			}
+			leaf := state.PeerCertificates[0]
+			if !sanAllowed(leaf, allowed) {
+				mtlsDenials.WithLabelValues("san_not_allowed").Inc()
+				s.logger.Printf("Denied client certificate %q: none of its SANs are allowed", leaf.Subject.String())
+				return fmt.Errorf("client certificate %q has no allowed SAN", leaf.Subject.String())
+			}
+			return nil
+		}
+	}
+	return s, nil
+}
+
+// sanAllowed reports whether any of certificate's SANs is in allowed.
+func sanAllowed(certificate *x509.Certificate, allowed []string) bool {
+	for _, pattern := range allowed {
+		for _, name := range certificate.DNSNames {
+			if matchDNSName(pattern, name) {
+				return true
+			}
+		}
+		for _, address := range certificate.IPAddresses {
+			if pattern == address.String() {
+				return true
+			}
+		}
+		for _, email := range certificate.EmailAddresses {
+			if pattern == email {
+				return true
+			}
+		}
+		for _, uri := range certificate.URIs {
+			if pattern == uri.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDNSName matches name against pattern, where a leading *. matches
+// exactly one label.
+func matchDNSName(pattern string, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(name, ".")
+		return found && label != "" && rest == suffix
+	}
+	return pattern == name
+}
+
+// Wrap returns route's handler requiring a verified client certificate,
+// with mutual TLS on, unless the route is a health check.
+func (s *ServerTLS) Wrap(route Route) http.Handler {
+	if !s.mutual || route.Doc.Tag == "health" {
+		return route.Handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			mtlsDenials.WithLabelValues("no_certificate").Inc()
+			requestLogger(s.logger, r).Printf("Denied %s %s from %s: no client certificate", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Client certificate required", http.StatusUnauthorized)
+			return
+		}
+		route.Handler.ServeHTTP(w, r)
+	})
+}
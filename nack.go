@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// maxNackDelay is the longest ack deadline Pub/Sub accepts, and so the
+// longest a nack can be put off.
+const maxNackDelay = 10 * time.Minute
+
+// NackDelayError is an error a handler returns to have its message
+// redelivered no sooner than Delay, for backing off a downstream that's
+// failing transiently without relying on the subscription's retry policy.
+// Create it with NackAfter.
+type NackDelayError struct {
+	Delay time.Duration
+	Err   error
+}
+
+// NackAfter wraps err to nack the message only once delay has passed, up to
+// 10 minutes.
+func NackAfter(delay time.Duration, err error) error {
+	return &NackDelayError{Delay: delay, Err: err}
+}
+
+func (e *NackDelayError) Error() string {
+	return fmt.Sprintf("%v (nack delayed %s)", e.Err, e.Delay)
+}
+
+func (e *NackDelayError) Unwrap() error {
+	return e.Err
+}
+
+// nackDelay returns the delay err asks for, capped at maxNackDelay.
+func nackDelay(err error) time.Duration {
+	var delayed *NackDelayError
+	if !errors.As(err, &delayed) || delayed.Delay <= 0 {
+		return 0
+	}
+	return min(delayed.Delay, maxNackDelay)
+}
+
+// nackAfter nacks msg once delay has passed, or straight away if ctx ends
+// first, as the subscriber is stopping. The Go client doesn't expose a
+// message's ack ID to modify its deadline with, so until then the message
+// stays outstanding and the client's lease management keeps extending its
+// ack deadline. It counts towards max_outstanding_messages while it waits.
+func nackAfter(ctx context.Context, msg *pubsub.Message, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		msg.Nack()
+	}()
+}
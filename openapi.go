@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type openAPIDocument struct {
+	OpenAPI string                                 `json:"openapi"`
+	Info    openAPIInfo                            `json:"info"`
+	Paths   map[string]map[string]openAPIOperation `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary,omitempty"`
+	OperationId string                     `json:"operationId"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string        `json:"name"`
+	In          string        `json:"in"`
+	Description string        `json:"description,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+	Schema      openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema openAPISchema `json:"schema"`
+}
+
+type openAPISchema map[string]interface{}
+
+var pathParameterPattern = regexp.MustCompile(`\{([^}$.]+)(\.\.\.)?\}`)
+
+// openAPIPath converts a ServeMux path pattern to an OpenAPI path template.
+func openAPIPath(path string) string {
+	path = strings.TrimSuffix(path, "{$}")
+	return pathParameterPattern.ReplaceAllString(path, "{$1}")
+}
+
+func operationId(method string, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '{' || r == '}' || r == '-' || r == '.' || r == '_' }) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+func newOpenAPIDocument(routes []Route) http.Handler {
+	document := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "gcp-pubsub-test", Version: "1.0.0"},
+		Paths:   make(map[string]map[string]openAPIOperation),
+	}
+	for _, route := range routes {
+		if route.Doc.Undocumented {
+			continue
+		}
+		path := openAPIPath(route.Path)
+		method := strings.ToLower(route.Method)
+		if method == "" {
+			method = "get"
+		}
+		operation := openAPIOperation{
+			Summary:     route.Doc.Summary,
+			OperationId: operationId(method, path),
+			Responses:   make(map[string]openAPIResponse, len(route.Doc.Responses)),
+		}
+		if route.Doc.Tag != "" {
+			operation.Tags = []string{route.Doc.Tag}
+		}
+		for _, match := range pathParameterPattern.FindAllStringSubmatch(route.Path, -1) {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:     match[1],
+				In:       "path",
+				Required: true,
+				Schema:   openAPISchema{"type": "string"},
+			})
+		}
+		for _, query := range route.Doc.Query {
+			schema := openAPISchema{"type": query.Type}
+			if query.Repeated {
+				schema = openAPISchema{"type": "array", "items": schema}
+			}
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:        query.Name,
+				In:          "query",
+				Description: query.Description,
+				Schema:      schema,
+			})
+		}
+		if route.Doc.RequestBody != nil {
+			operation.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content: map[string]openAPIMediaType{
+					"application/json": {Schema: schemaFor(reflect.TypeOf(route.Doc.RequestBody))},
+				},
+			}
+			for mediaType, schema := range route.Doc.RequestMediaTypes {
+				operation.RequestBody.Content[mediaType] = openAPIMediaType{Schema: schema}
+			}
+		}
+		for _, response := range route.Doc.Responses {
+			documented := openAPIResponse{Description: response.Description}
+			if response.Body != nil {
+				documented.Content = map[string]openAPIMediaType{
+					"application/json": {Schema: schemaFor(reflect.TypeOf(response.Body))},
+				}
+			} else {
+				documented.Content = map[string]openAPIMediaType{
+					"text/plain": {Schema: openAPISchema{"type": "string"}},
+				}
+			}
+			operation.Responses[strconv.Itoa(response.Status)] = documented
+		}
+		if route.Scope != "" {
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:        apiKeyHeader,
+				In:          "header",
+				Description: "API key with scope " + route.Scope + ", when keys are configured.",
+				Schema:      openAPISchema{"type": "string"},
+			})
+			operation.Responses["401"] = openAPIResponse{Description: "The API key is missing or unknown.", Content: map[string]openAPIMediaType{"text/plain": {Schema: openAPISchema{"type": "string"}}}}
+			operation.Responses["403"] = openAPIResponse{Description: "The API key lacks the route's scope.", Content: map[string]openAPIMediaType{"text/plain": {Schema: openAPISchema{"type": "string"}}}}
+		}
+		if document.Paths[path] == nil {
+			document.Paths[path] = make(map[string]openAPIOperation)
+		}
+		document.Paths[path][method] = operation
+	}
+
+	body, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// schemaFor derives a JSON schema from a Go type using its json struct tags.
+func schemaFor(t reflect.Type) openAPISchema {
+	switch t {
+	case timeType:
+		return openAPISchema{"type": "string", "format": "date-time"}
+	case durationType:
+		return openAPISchema{"type": "integer", "description": "Duration in nanoseconds."}
+	case rawMessageType:
+		return openAPISchema{"description": "Any JSON value."}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.String:
+		return openAPISchema{"type": "string"}
+	case reflect.Bool:
+		return openAPISchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return openAPISchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return openAPISchema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return openAPISchema{"type": "string", "format": "byte"}
+		}
+		return openAPISchema{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return openAPISchema{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaFor(field.Type)
+			if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+		schema := openAPISchema{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return openAPISchema{}
+	}
+}
+
+var swaggerUIHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(`<!DOCTYPE html>
+<html>
+<head>
+  <title>gcp-pubsub-test API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`))
+})
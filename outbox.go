@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	sheddingReject = "reject"
+	sheddingBlock  = "block"
+	sheddingSpill  = "spill"
+
+	outboxKeyPrefix      = "outbox/"
+	outboxClaimKeyPrefix = "outbox-claims/"
+	outboxDrainInterval  = time.Second
+	outboxDrainBatch     = 100
+	// outboxClaimTTL is how long an instance has to publish a spilled
+	// message before another may try.
+	outboxClaimTTL   = time.Minute
+	defaultOutboxTTL = 24 * time.Hour
+)
+
+// SpilledError is returned for a publish flow control shed to the topic's
+// outbox. It isn't a failure: the outbox publishes the message once the
+// topic has room.
+type SpilledError struct {
+	OutboxId string
+	Err      error
+}
+
+func (e *SpilledError) Error() string {
+	return fmt.Sprintf("spilled to the outbox as %s: %v", e.OutboxId, e.Err)
+}
+
+func (e *SpilledError) Unwrap() error {
+	return e.Err
+}
+
+type outboxEntry struct {
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	SpilledAt  time.Time         `json:"spilled_at"`
+}
+
+// Outbox holds the messages a topic with the spill shedding policy had no
+// room for, in the store, so they survive a restart and any instance can
+// publish them.
+type Outbox struct {
+	logger *log.Logger
+	topic  *RegisteredTopic
+	store  Store
+	ttl    time.Duration
+}
+
+func newOutbox(topic *RegisteredTopic, store Store) *Outbox {
+	return &Outbox{logger: newLogger("outbox"), topic: topic, store: store, ttl: topic.Config.FlowControl.OutboxTTL}
+}
+
+// spill saves msg, which flow control rejected with err, returning a
+// SpilledError, or, if it can't be saved, an UnavailableError as if it
+// had been rejected.
+func (o *Outbox) spill(ctx context.Context, msg *pubsub.Message, err error) (string, error) {
+	now := time.Now().UTC()
+	data, marshalErr := json.Marshal(outboxEntry{Data: msg.Data, Attributes: msg.Attributes, SpilledAt: now})
+	if marshalErr != nil {
+		return "", o.rejected(err)
+	}
+	// IDs sort in the order messages were spilled, so they're published
+	// in roughly that order.
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	id := now.Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix[:])
+	if storeErr := o.store.Set(ctx, o.prefix()+id, data, o.ttl); storeErr != nil {
+		o.logger.Printf("Failed to spill a message for topic %s: %v", o.topic.Config.Name, storeErr)
+		return "", o.rejected(err)
+	}
+	publishShed.WithLabelValues(o.topic.Config.Name, sheddingSpill).Inc()
+	return "", &SpilledError{OutboxId: id, Err: err}
+}
+
+func (o *Outbox) rejected(err error) error {
+	publishShed.WithLabelValues(o.topic.Config.Name, sheddingReject).Inc()
+	return &UnavailableError{Reason: unavailableFlowControl, RetryAfter: o.topic.Config.FlowControl.RetryAfter, Err: err}
+}
+
+func (o *Outbox) prefix() string {
+	return outboxKeyPrefix + o.topic.Config.Name + "/"
+}
+
+func (o *Outbox) run(ctx context.Context) {
+	ticker := time.NewTicker(outboxDrainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		o.drain(ctx)
+	}
+}
+
+// drain publishes a batch of spilled messages, oldest first, stopping if
+// the topic runs out of room again. Messages that fail to publish are
+// retried once their claim expires.
+func (o *Outbox) drain(ctx context.Context) {
+	entries, err := o.store.List(ctx, o.prefix(), outboxDrainBatch)
+	if err != nil {
+		if ctx.Err() == nil {
+			o.logger.Printf("Failed to list the outbox of topic %s: %v", o.topic.Config.Name, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		claimed, err := o.store.SetIfAbsent(ctx, outboxClaimKeyPrefix+entry.Key, []byte(entry.Key), outboxClaimTTL)
+		if err != nil || !claimed {
+			continue
+		}
+		var spilled outboxEntry
+		if err := json.Unmarshal(entry.Value, &spilled); err != nil {
+			o.logger.Printf("Dropping unreadable outbox entry %s: %v", entry.Key, err)
+			o.store.Delete(ctx, entry.Key)
+			continue
+		}
+		messageId, err := o.topic.send(ctx, &pubsub.Message{Data: spilled.Data, Attributes: spilled.Attributes})
+		var unavailable *UnavailableError
+		if errors.As(err, &unavailable) {
+			o.store.Delete(ctx, outboxClaimKeyPrefix+entry.Key)
+			return
+		} else if err != nil {
+			outboxPublished.WithLabelValues(o.topic.Config.Name, "error").Inc()
+			o.logger.Printf("Failed to publish outbox entry %s: %v", entry.Key, err)
+			continue
+		}
+		outboxPublished.WithLabelValues(o.topic.Config.Name, "ok").Inc()
+		outboxDelay.WithLabelValues(o.topic.Config.Name).Observe(time.Since(spilled.SpilledAt).Seconds())
+		if err := o.store.Delete(ctx, entry.Key); err != nil {
+			o.logger.Printf("Published outbox entry %s as message %s but failed to remove it: %v", entry.Key, messageId, err)
+		}
+		o.store.Delete(ctx, outboxClaimKeyPrefix+entry.Key)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+)
+
+const (
+	mediaTypeJSON      = "application/json"
+	mediaTypeText      = "text/plain"
+	mediaTypeMultipart = "multipart/form-data"
+
+	// schemaHeader names the message type of a Protobuf payload, e.g.
+	// boxes.email.v1.SendEmail, which is published as the schema attribute.
+	schemaHeader    = "X-Schema"
+	schemaAttribute = "schema"
+)
+
+var protobufMediaTypes = map[string]bool{
+	"application/x-protobuf":          true,
+	"application/protobuf":            true,
+	"application/vnd.google.protobuf": true,
+}
+
+// errUnsupportedMediaType is answered with 415.
+var errUnsupportedMediaType = errors.New("unsupported Content-Type")
+
+// publishMediaTypes are documented, with the JSON envelope, on the publish
+// route.
+var publishMediaTypes = map[string]openAPISchema{
+	"application/x-protobuf": {"type": "string", "format": "binary", "description": "A serialized Protobuf message, named by the X-Schema header."},
+	mediaTypeText:            {"type": "string", "description": "UTF-8 text."},
+	mediaTypeMultipart: {
+		"type": "object",
+		"properties": map[string]interface{}{
+			"data":         openAPISchema{"type": "string", "format": "binary", "description": "The payload, in any of the other media types."},
+			"attributes":   openAPISchema{"type": "object", "additionalProperties": openAPISchema{"type": "string"}},
+			"ordering_key": openAPISchema{"type": "string"},
+		},
+		"required": []string{"data"},
+	},
+}
+
+// decodePublishRequest reads the body of a publish request into the JSON
+// envelope the rest of publishing works with, according to its
+// Content-Type. A body without one is taken to be the JSON envelope if it
+// parses as JSON, and text otherwise. Payloads that aren't JSON carry
+// their media type in the content_type attribute.
+func decodePublishRequest(w http.ResponseWriter, r *http.Request) (publishRequest, error) {
+	var request publishRequest
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes))
+	if err != nil {
+		return request, err
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = mediaTypeText
+		if json.Valid(data) {
+			contentType = mediaTypeJSON
+		}
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return request, fmt.Errorf("%w %q: %v", errUnsupportedMediaType, contentType, err)
+	}
+	switch {
+	case mediaType == mediaTypeJSON:
+		err = json.Unmarshal(data, &request)
+		return request, err
+	case mediaType == mediaTypeMultipart:
+		return decodeMultipartPublish(r, bytes.NewReader(data), params["boundary"])
+	}
+	request.Data = data
+	request.Attributes, err = payloadAttributes(mediaType, params, r.Header.Get(schemaHeader), request.Data)
+	if len(request.Data) == 0 && err == nil {
+		err = errors.New("publish request has no data")
+	}
+	return request, err
+}
+
+// payloadAttributes checks a payload that isn't a JSON envelope against
+// its media type and returns the attributes describing it.
+func payloadAttributes(mediaType string, params map[string]string, schema string, data []byte) (map[string]string, error) {
+	attributes := map[string]string{emailevents.AttributeContentType: mediaType}
+	switch {
+	case mediaType == mediaTypeText:
+		if charset := strings.ToLower(params["charset"]); charset != "" && charset != "utf-8" && charset != "us-ascii" {
+			return nil, fmt.Errorf("%w: text/plain is only accepted as UTF-8, not %s", errUnsupportedMediaType, charset)
+		}
+		if !utf8.Valid(data) {
+			return nil, errors.New("text/plain payload isn't valid UTF-8")
+		}
+	case protobufMediaTypes[mediaType]:
+		if schema == "" {
+			return nil, fmt.Errorf("a Protobuf payload needs the message type in the %s header", schemaHeader)
+		}
+		attributes[schemaAttribute] = schema
+	default:
+		return nil, fmt.Errorf("%w %q: use application/json, application/x-protobuf, text/plain or multipart/form-data", errUnsupportedMediaType, mediaType)
+	}
+	return attributes, nil
+}
+
+// decodeMultipartPublish reads a form with the payload in its data part,
+// in any media type publishing accepts except multipart, and optionally
+// attributes, as a JSON object, and ordering_key parts. A data part
+// without a Content-Type is text, and one with Protobuf can name its
+// message type in its own X-Schema header.
+func decodeMultipartPublish(r *http.Request, body io.Reader, boundary string) (publishRequest, error) {
+	var request publishRequest
+	if boundary == "" {
+		return request, errors.New("multipart/form-data needs a boundary")
+	}
+	reader := multipart.NewReader(body, boundary)
+	var (
+		data        []byte
+		dataType    string
+		dataParams  map[string]string
+		dataSchema  string
+		hasData     bool
+		attributes  map[string]string
+		orderingKey string
+	)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return request, err
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return request, err
+		}
+		switch part.FormName() {
+		case "data":
+			data, hasData = value, true
+			dataType, dataParams = mediaTypeText, nil
+			if dataSchema = part.Header.Get(schemaHeader); dataSchema == "" {
+				dataSchema = r.Header.Get(schemaHeader)
+			}
+			if contentType := part.Header.Get("Content-Type"); contentType != "" {
+				if dataType, dataParams, err = mime.ParseMediaType(contentType); err != nil {
+					return request, fmt.Errorf("%w %q in the data part: %v", errUnsupportedMediaType, contentType, err)
+				}
+			}
+		case "attributes":
+			if err := json.Unmarshal(value, &attributes); err != nil {
+				return request, fmt.Errorf("attributes part: %w", err)
+			}
+		case "ordering_key":
+			orderingKey = string(value)
+		default:
+			return request, fmt.Errorf("unexpected form part %q", part.FormName())
+		}
+	}
+	if !hasData || len(data) == 0 {
+		return request, errors.New("publish request has no data")
+	}
+
+	request.Data, request.OrderingKey = data, orderingKey
+	request.Attributes = attributes
+	if dataType == mediaTypeJSON {
+		if !json.Valid(data) {
+			return request, errors.New("data part isn't valid JSON")
+		}
+		return request, nil
+	}
+	if dataType == mediaTypeMultipart {
+		return request, fmt.Errorf("%w: the data part can't be multipart", errUnsupportedMediaType)
+	}
+	described, err := payloadAttributes(dataType, dataParams, dataSchema, data)
+	if err != nil {
+		return request, err
+	}
+	if request.Attributes == nil {
+		request.Attributes = make(map[string]string, len(described))
+	}
+	// Attributes the caller set explicitly win.
+	for key, value := range described {
+		if _, ok := request.Attributes[key]; !ok {
+			request.Attributes[key] = value
+		}
+	}
+	return request, nil
+}
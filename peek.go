@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultPeekLimit = 10
+	maxPeekLimit     = 100
+	peekPreviewBytes = 1024
+	peekPullWait     = 5 * time.Second
+)
+
+type peekedMessage struct {
+	Id              string            `json:"id"`
+	PublishTime     time.Time         `json:"publish_time"`
+	OrderingKey     string            `json:"ordering_key,omitempty"`
+	Attributes      map[string]string `json:"attributes"`
+	DeliveryAttempt *int              `json:"delivery_attempt,omitempty"`
+	Size            int               `json:"size"`
+	// Preview is the start of the payload, as text if it's UTF-8 and
+	// base64 otherwise, as Encoding says.
+	Preview   string `json:"preview"`
+	Encoding  string `json:"encoding"`
+	Truncated bool   `json:"truncated"`
+}
+
+func newPeekedMessage(msg *pubsub.Message) peekedMessage {
+	peeked := peekedMessage{
+		Id:              msg.ID,
+		PublishTime:     msg.PublishTime,
+		OrderingKey:     msg.OrderingKey,
+		Attributes:      msg.Attributes,
+		DeliveryAttempt: msg.DeliveryAttempt,
+		Size:            len(msg.Data),
+	}
+	peeked.Preview, peeked.Encoding, peeked.Truncated = previewData(msg.Data)
+	return peeked
+}
+
+// previewData returns the start of data, as text if it's UTF-8 and base64
+// otherwise, with the encoding and whether it was cut short.
+func previewData(data []byte) (preview string, encoding string, truncated bool) {
+	truncated = len(data) > peekPreviewBytes
+	start := data
+	if truncated {
+		start = start[:peekPreviewBytes]
+	}
+	if !utf8.Valid(data) {
+		return base64.StdEncoding.EncodeToString(start), "base64", truncated
+	}
+	// Don't cut a character in half.
+	for !utf8.Valid(start) {
+		start = start[:len(start)-1]
+	}
+	return string(start), "utf-8", truncated
+}
+
+// Peek pulls up to limit messages from a subscriber's subscription and
+// nacks them straight away, for seeing what's stuck in a backlog. Peeked
+// messages are redelivered, but the pull still counts as a delivery
+// attempt towards a dead letter policy.
+func (h *SubscriberAdminHandler) Peek(w http.ResponseWriter, r *http.Request) {
+	subscriber, ok := h.subscribers.Lookup(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Unknown subscriber", http.StatusNotFound)
+		return
+	}
+	limit := defaultPeekLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxPeekLimit {
+			http.Error(w, "Invalid limit, it must be between 1 and "+strconv.Itoa(maxPeekLimit), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	// pullMessages changes the receive settings, so it gets its own handle
+	// rather than the subscriber's.
+	subscription := h.client.Subscription(subscriber.Config.Id)
+	peeked := []peekedMessage{}
+	err := pullMessages(r.Context(), subscription, limit, peekPullWait, func(messages []*pubsub.Message) {
+		for _, msg := range messages {
+			peeked = append(peeked, newPeekedMessage(msg))
+			msg.Nack()
+		}
+	})
+	if err != nil {
+		http.Error(w, "Failed to pull messages: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peeked)
+}
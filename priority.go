@@ -0,0 +1,291 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The priority lanes a topic's messages are published in.
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityBulk   = "bulk"
+
+	defaultPriorityAttribute = "priority"
+
+	defaultPriorityAgingAfter = 30 * time.Second
+)
+
+var priorityLanes = map[string]bool{priorityHigh: true, priorityNormal: true, priorityBulk: true}
+
+// laneOrder lists the lanes from highest priority to lowest.
+var laneOrder = []string{priorityHigh, priorityNormal, priorityBulk}
+
+func laneRank(lane string) int {
+	for rank, name := range laneOrder {
+		if name == lane {
+			return rank
+		}
+	}
+	return len(laneOrder) - 1
+}
+
+type PriorityConfig struct {
+	// Attribute carries each message's priority: high, normal or bulk.
+	// Defaults to priority. It's set on every message published, to its
+	// lane, so subscriptions can filter on it.
+	Attribute string `yaml:"attribute"`
+	// Field is a top-level field name or JSONPath evaluated against JSON
+	// payloads for the priority of messages without the attribute.
+	Field string `yaml:"field"`
+	// Default is the lane of messages without a priority, or with one
+	// that isn't a lane. Defaults to normal.
+	Default string `yaml:"default"`
+	// Topics are the Pub/Sub topic IDs lanes are published to instead of
+	// the topic itself, e.g. bulk: email-events-bulk, so each lane has its
+	// own backlog. Lanes without one share the topic, and are told apart
+	// by subscriptions with a priority.
+	Topics map[string]string `yaml:"topics"`
+	// Aging has the subscriptions consuming the topic's lanes share their
+	// handlers, so a burst of high priority messages takes capacity from
+	// bulk ones, while waiting long enough moves a message up a lane, so
+	// bulk messages are never starved.
+	Aging *PriorityAgingConfig `yaml:"aging"`
+}
+
+type PriorityAgingConfig struct {
+	// Concurrency is how many messages the lane subscriptions of this
+	// instance handle at once, together. Messages waiting for a slot get
+	// one highest lane first, then oldest first.
+	Concurrency int `yaml:"concurrency"`
+	// After is how long since it was published a message waits before it
+	// competes for a slot a lane higher, and again after each further
+	// After, e.g. with 30s a bulk message published 45s ago competes as
+	// normal, and 60s ago as high. Defaults to 30s.
+	After time.Duration `yaml:"after"`
+}
+
+func (c *PriorityConfig) validate() error {
+	if c.Attribute == "" {
+		c.Attribute = defaultPriorityAttribute
+	}
+	if c.Default == "" {
+		c.Default = priorityNormal
+	} else if !priorityLanes[c.Default] {
+		return fmt.Errorf("default %q isn't high, normal or bulk", c.Default)
+	}
+	for lane, topic := range c.Topics {
+		if !priorityLanes[lane] {
+			return fmt.Errorf("topics: %q isn't high, normal or bulk", lane)
+		}
+		if topic == "" {
+			return fmt.Errorf("topics: %s has no topic", lane)
+		}
+	}
+	if c.Field != "" {
+		if _, err := parseJSONPath(c.Field); err != nil {
+			return fmt.Errorf("field: %w", err)
+		}
+	}
+	if aging := c.Aging; aging != nil {
+		if aging.After == 0 {
+			aging.After = defaultPriorityAgingAfter
+		}
+		if aging.Concurrency <= 0 {
+			return fmt.Errorf("aging: concurrency must be positive")
+		}
+		if aging.After < 0 {
+			return fmt.Errorf("aging: after can't be negative")
+		}
+	}
+	return nil
+}
+
+// validateSubscriptionPriority checks that the lane subscription consumes
+// shares its topic, rather than being published to a topic of its own.
+func validateSubscriptionPriority(config Config, subscription SubscriptionConfig) error {
+	if !priorityLanes[subscription.Priority] {
+		return fmt.Errorf("priority %q isn't high, normal or bulk", subscription.Priority)
+	}
+	for _, topic := range config.Topics {
+		if topic.Id != subscription.Topic || topic.Priority == nil {
+			continue
+		}
+		if laneTopic := topic.Priority.Topics[subscription.Priority]; laneTopic != "" {
+			return fmt.Errorf("the %s lane of topic %s is published to %s, subscribe to that instead", subscription.Priority, topic.Name, laneTopic)
+		}
+	}
+	return nil
+}
+
+// subscriptionFilter is the filter subscription is created with, if any.
+func subscriptionFilter(config Config, subscription SubscriptionConfig) string {
+	if subscription.Priority == "" {
+		return ""
+	}
+	attribute := defaultPriorityAttribute
+	for _, topic := range config.Topics {
+		if topic.Id == subscription.Topic && topic.Priority != nil {
+			attribute = topic.Priority.Attribute
+		}
+	}
+	return priorityFilter(attribute, subscription.Priority)
+}
+
+// priorityFilter is the subscription filter that delivers only the
+// messages of lane, for lanes sharing a topic. Messages published around
+// the service may not have the attribute, so they're taken as normal.
+func priorityFilter(attribute string, lane string) string {
+	if lane == priorityNormal {
+		return fmt.Sprintf("NOT attributes:%s OR attributes.%s = %q", attribute, attribute, lane)
+	}
+	return fmt.Sprintf("attributes.%s = %q", attribute, lane)
+}
+
+// subscriptionLane returns the topic whose lane subscription consumes, and
+// the lane, whether it's filtered to a lane of the topic or subscribes to
+// the topic the lane is published to.
+func subscriptionLane(config Config, subscription SubscriptionConfig) (TopicConfig, string, bool) {
+	for _, topic := range config.Topics {
+		if topic.Priority == nil {
+			continue
+		}
+		if subscription.Priority != "" && topic.Id == subscription.Topic {
+			return topic, subscription.Priority, true
+		}
+		for lane, id := range topic.Priority.Topics {
+			if id == subscription.Topic {
+				return topic, lane, true
+			}
+		}
+	}
+	return TopicConfig{}, "", false
+}
+
+// LaneScheduler shares a number of handler slots between the lane
+// subscriptions of a topic, giving free slots to the waiting message with
+// the highest lane once aged.
+type LaneScheduler struct {
+	topic  string
+	config PriorityAgingConfig
+
+	mu      sync.Mutex
+	running int
+	waiting laneWaiters
+}
+
+func newLaneScheduler(topic string, config PriorityAgingConfig) *LaneScheduler {
+	return &LaneScheduler{topic: topic, config: config}
+}
+
+type laneWaiter struct {
+	lane      string
+	published time.Time
+	queued    time.Time
+	// ready is closed once the waiter is given a slot.
+	ready chan struct{}
+	index int
+}
+
+// rank is the lane the waiter competes in now, boosted a lane for each
+// After it has waited since it was published.
+func (w *laneWaiter) rank(now time.Time, after time.Duration) int {
+	boost := int(now.Sub(w.published) / after)
+	return max(laneRank(w.lane)-boost, 0)
+}
+
+// laneWaiters is a queue of waiters in the order they're given slots. The
+// ranks they're ordered by change as time passes, so it's reordered before
+// each slot is given.
+type laneWaiters struct {
+	waiters []*laneWaiter
+	now     time.Time
+	after   time.Duration
+}
+
+func (q *laneWaiters) Len() int { return len(q.waiters) }
+
+func (q *laneWaiters) Less(i, j int) bool {
+	a, b := q.waiters[i], q.waiters[j]
+	if rankA, rankB := a.rank(q.now, q.after), b.rank(q.now, q.after); rankA != rankB {
+		return rankA < rankB
+	}
+	return a.published.Before(b.published)
+}
+
+func (q *laneWaiters) Swap(i, j int) {
+	q.waiters[i], q.waiters[j] = q.waiters[j], q.waiters[i]
+	q.waiters[i].index, q.waiters[j].index = i, j
+}
+
+func (q *laneWaiters) Push(x any) {
+	waiter := x.(*laneWaiter)
+	waiter.index = len(q.waiters)
+	q.waiters = append(q.waiters, waiter)
+}
+
+func (q *laneWaiters) Pop() any {
+	last := q.waiters[len(q.waiters)-1]
+	q.waiters = q.waiters[:len(q.waiters)-1]
+	last.index = -1
+	return last
+}
+
+// acquire waits for a slot to handle a message of lane, published at
+// published, returning the function that frees it.
+func (l *LaneScheduler) acquire(ctx context.Context, lane string, published time.Time) (func(), error) {
+	waiter := &laneWaiter{lane: lane, published: published, queued: time.Now(), ready: make(chan struct{}), index: -1}
+	l.mu.Lock()
+	heap.Push(&l.waiting, waiter)
+	priorityLaneWaiting.WithLabelValues(l.topic, lane).Inc()
+	l.schedule()
+	l.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return l.release, nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-waiter.ready:
+		// Given a slot meanwhile, which goes to the next waiter.
+		l.running--
+		l.schedule()
+	default:
+		heap.Remove(&l.waiting, waiter.index)
+		priorityLaneWaiting.WithLabelValues(l.topic, lane).Dec()
+	}
+	return nil, ctx.Err()
+}
+
+func (l *LaneScheduler) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.schedule()
+}
+
+// schedule gives free slots to waiters, highest ranked first.
+func (l *LaneScheduler) schedule() {
+	if l.running >= l.config.Concurrency || l.waiting.Len() == 0 {
+		return
+	}
+	now := time.Now()
+	l.waiting.now, l.waiting.after = now, l.config.After
+	heap.Init(&l.waiting)
+	for l.running < l.config.Concurrency && l.waiting.Len() > 0 {
+		waiter := heap.Pop(&l.waiting).(*laneWaiter)
+		l.running++
+		priorityLaneWaiting.WithLabelValues(l.topic, waiter.lane).Dec()
+		priorityLaneWait.WithLabelValues(l.topic, waiter.lane).Observe(now.Sub(waiter.queued).Seconds())
+		if rank := waiter.rank(now, l.config.After); rank < laneRank(waiter.lane) {
+			priorityAgedMessages.WithLabelValues(l.topic, waiter.lane, laneOrder[rank]).Inc()
+		}
+		close(waiter.ready)
+	}
+}
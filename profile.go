@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// PublishSettingsConfig are the publisher's batching, compression and
+// timeout settings for a topic. Zero values keep the client's defaults.
+type PublishSettingsConfig struct {
+	// DelayThreshold, CountThreshold and ByteThreshold send a batch once
+	// its oldest message has waited that long, or it holds that many
+	// messages or bytes.
+	DelayThreshold time.Duration `yaml:"delay_threshold"`
+	CountThreshold int           `yaml:"count_threshold"`
+	ByteThreshold  int           `yaml:"byte_threshold"`
+	// Timeout is how long a publish is retried before it fails.
+	Timeout time.Duration `yaml:"timeout"`
+	// Compression gzips batches of at least CompressionBytesThreshold
+	// bytes, which defaults to 240.
+	Compression               bool `yaml:"compression"`
+	CompressionBytesThreshold int  `yaml:"compression_bytes_threshold"`
+}
+
+func (c PublishSettingsConfig) validate() error {
+	if c.DelayThreshold < 0 || c.CountThreshold < 0 || c.ByteThreshold < 0 || c.Timeout < 0 || c.CompressionBytesThreshold < 0 {
+		return fmt.Errorf("publish settings can't be negative")
+	}
+	if c.CountThreshold > pubsub.MaxPublishRequestCount || c.ByteThreshold > pubsub.MaxPublishRequestBytes {
+		return fmt.Errorf("count_threshold and byte_threshold can be at most %d and %d, Pub/Sub's request limits", pubsub.MaxPublishRequestCount, int(pubsub.MaxPublishRequestBytes))
+	}
+	return nil
+}
+
+// apply sets the configured settings on settings.
+func (c PublishSettingsConfig) apply(settings *pubsub.PublishSettings) {
+	if c.DelayThreshold > 0 {
+		settings.DelayThreshold = c.DelayThreshold
+	}
+	if c.CountThreshold > 0 {
+		settings.CountThreshold = c.CountThreshold
+	}
+	if c.ByteThreshold > 0 {
+		settings.ByteThreshold = c.ByteThreshold
+	}
+	if c.Timeout > 0 {
+		settings.Timeout = c.Timeout
+	}
+	settings.EnableCompression = c.Compression
+	if c.CompressionBytesThreshold > 0 {
+		settings.CompressionBytesThreshold = c.CompressionBytesThreshold
+	}
+}
+
+// PublishProfileConfig bundles the settings a kind of traffic needs, so
+// topics name a profile instead of repeating them.
+type PublishProfileConfig struct {
+	PublishSettingsConfig `yaml:",inline"`
+	FlowControl           *FlowControlConfig `yaml:"flow_control"`
+	Isolation             IsolationConfig    `yaml:"isolation"`
+}
+
+// builtinPublishProfiles can be used without being configured, and are
+// replaced by configured profiles of the same name.
+var builtinPublishProfiles = map[string]PublishProfileConfig{
+	// low-latency sends each message almost as soon as it's published,
+	// for requests a user is waiting on.
+	"low-latency": {PublishSettingsConfig: PublishSettingsConfig{
+		DelayThreshold: time.Millisecond,
+		CountThreshold: 10,
+		Timeout:        10 * time.Second,
+	}},
+	// high-throughput fills larger batches, compressed, for steady heavy
+	// traffic.
+	"high-throughput": {PublishSettingsConfig: PublishSettingsConfig{
+		DelayThreshold: 50 * time.Millisecond,
+		CountThreshold: 500,
+		ByteThreshold:  5e6,
+		Compression:    true,
+	}},
+	// bulk fills the largest batches Pub/Sub takes and waits out outages,
+	// for backfills and campaigns nobody waits on.
+	"bulk": {PublishSettingsConfig: PublishSettingsConfig{
+		DelayThreshold: 200 * time.Millisecond,
+		CountThreshold: pubsub.MaxPublishRequestCount,
+		ByteThreshold:  9e6,
+		Timeout:        10 * time.Minute,
+		Compression:    true,
+	}},
+}
+
+// publishProfiles returns the built-in profiles with the configured ones
+// added.
+func publishProfiles(config Config) map[string]PublishProfileConfig {
+	profiles := make(map[string]PublishProfileConfig, len(builtinPublishProfiles)+len(config.PublishProfiles))
+	for name, profile := range builtinPublishProfiles {
+		profiles[name] = profile
+	}
+	for name, profile := range config.PublishProfiles {
+		profiles[name] = profile
+	}
+	return profiles
+}
+
+// applyProfile fills in the settings the topic doesn't set itself from its
+// profile. Adaptive batching tunes the delay and count itself, so a topic
+// using it doesn't take them from the profile.
+func (t *TopicConfig) applyProfile(profiles map[string]PublishProfileConfig) error {
+	profile, ok := profiles[t.Profile]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown profile %q, use one of %s", t.Profile, strings.Join(names, ", "))
+	}
+	if err := profile.validate(); err != nil {
+		return fmt.Errorf("profile %s: %w", t.Profile, err)
+	}
+	publish := &t.Publish
+	if publish.DelayThreshold == 0 && t.AdaptiveBatching == nil {
+		publish.DelayThreshold = profile.DelayThreshold
+	}
+	if publish.CountThreshold == 0 && t.AdaptiveBatching == nil {
+		publish.CountThreshold = profile.CountThreshold
+	}
+	if publish.ByteThreshold == 0 {
+		publish.ByteThreshold = profile.ByteThreshold
+	}
+	if publish.Timeout == 0 {
+		publish.Timeout = profile.Timeout
+	}
+	if !publish.Compression {
+		publish.Compression = profile.Compression
+	}
+	if publish.CompressionBytesThreshold == 0 {
+		publish.CompressionBytesThreshold = profile.CompressionBytesThreshold
+	}
+	if t.FlowControl == nil && profile.FlowControl != nil {
+		flowControl := *profile.FlowControl
+		t.FlowControl = &flowControl
+	}
+	if t.Isolation.MaxConcurrentPublishes == 0 {
+		t.Isolation.MaxConcurrentPublishes = profile.Isolation.MaxConcurrentPublishes
+	}
+	if t.Isolation.Goroutines == 0 {
+		t.Isolation.Goroutines = profile.Isolation.Goroutines
+	}
+	return nil
+}
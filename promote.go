@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+)
+
+// promotedFromAttribute records the staging message ID on each promoted
+// message, so a promotion can be traced back to what it was promoted from.
+const promotedFromAttribute = "promoted_from_message_id"
+
+type promoteResult struct {
+	Promoted int `json:"promoted"`
+	Skipped  int `json:"skipped"`
+	Invalid  int `json:"invalid"`
+	Failed   int `json:"failed"`
+	// Declined is true when promotion wasn't confirmed, and nothing was
+	// published.
+	Declined bool `json:"declined,omitempty"`
+}
+
+type promoteOptions struct {
+	from    string
+	to      string
+	filters attributeFilters
+	max     int
+	idle    time.Duration
+	yes     bool
+	lineage LineageConfig
+}
+
+// promoteSchema validates messages against the destination topic's schema.
+type promoteSchema struct {
+	schemas  *pubsub.SchemaClient
+	id       string
+	encoding pubsub.SchemaEncoding
+}
+
+func (s *promoteSchema) validate(ctx context.Context, msg *pubsub.Message) error {
+	if s == nil {
+		return nil
+	}
+	_, err := s.schemas.ValidateMessageWithID(ctx, msg.Data, s.encoding, s.id)
+	return err
+}
+
+// promoteMessages pulls the messages matching the filters from the staging
+// subscription, holding them unacked, validates them against the
+// destination's schema, and once confirm agrees, publishes the valid ones
+// to destination, acking each once it's published. Everything else is
+// nacked and stays on the staging subscription. It selects at most max
+// messages, and stops selecting once no new message has arrived for the
+// idle period.
+func promoteMessages(ctx context.Context, source *pubsub.Subscription, destination *pubsub.Topic, schema *promoteSchema, options promoteOptions, confirm func(selected []*pubsub.Message) (bool, error), logger *log.Logger) (promoteResult, error) {
+	receiveCtx, stopReceiving := context.WithCancel(ctx)
+	defer stopReceiving()
+
+	var (
+		mu       sync.Mutex
+		result   promoteResult
+		selected []*pubsub.Message
+		seen     = make(map[string]bool)
+		lastSeen = time.Now()
+		// closed stops selecting, once max is reached or after idle.
+		closed bool
+		full   = make(chan struct{})
+	)
+	if options.max > 0 && options.max < source.ReceiveSettings.MaxOutstandingMessages {
+		source.ReceiveSettings.MaxOutstandingMessages = options.max
+	}
+	received := make(chan error, 1)
+	go func() {
+		received <- source.Receive(receiveCtx, func(ctx context.Context, msg *pubsub.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			// Skipped messages come back after being nacked; they're only
+			// counted once and don't count as activity.
+			if closed || seen[msg.ID] {
+				msg.Nack()
+				return
+			}
+			seen[msg.ID] = true
+			lastSeen = time.Now()
+			if !options.filters.match(msg.Attributes) {
+				result.Skipped++
+				msg.Nack()
+				return
+			}
+			// Left unacked: the client keeps extending its lease until
+			// it's acked or nacked below.
+			selected = append(selected, msg)
+			if options.max > 0 && len(selected) >= options.max {
+				closed = true
+				close(full)
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-full:
+			waiting = false
+		case err := <-received:
+			if errors.Is(err, context.Canceled) {
+				err = nil
+			}
+			if err == nil {
+				err = errors.New("receiving stopped early")
+			}
+			return result, err
+		case <-ticker.C:
+			mu.Lock()
+			if time.Since(lastSeen) >= options.idle {
+				closed, waiting = true, false
+			}
+			mu.Unlock()
+		}
+	}
+	mu.Lock()
+	held := selected
+	mu.Unlock()
+	defer func() {
+		stopReceiving()
+		<-received
+	}()
+
+	var valid []*pubsub.Message
+	for _, msg := range held {
+		if err := schema.validate(ctx, msg); err != nil {
+			logger.Printf("Not promoting message %s, which fails the schema of topic %s: %v", msg.ID, destination.ID(), err)
+			result.Invalid++
+			msg.Nack()
+			continue
+		}
+		valid = append(valid, msg)
+	}
+	if len(valid) == 0 {
+		return result, nil
+	}
+	ok, err := confirm(valid)
+	if err != nil || !ok {
+		for _, msg := range valid {
+			msg.Nack()
+		}
+		result.Declined = err == nil
+		return result, err
+	}
+
+	for _, msg := range valid {
+		attributes := make(map[string]string, len(msg.Attributes)+4)
+		for key, value := range msg.Attributes {
+			attributes[key] = value
+		}
+		attributes[promotedFromAttribute] = msg.ID
+		err := stampLineage(options.lineage, attributes, msg.ID)
+		if err == nil {
+			_, err = destination.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attributes, OrderingKey: msg.OrderingKey}).Get(ctx)
+		}
+		if err != nil {
+			logger.Printf("Failed to promote message %s: %v", msg.ID, err)
+			result.Failed++
+			if msg.OrderingKey != "" {
+				destination.ResumePublish(msg.OrderingKey)
+			}
+			msg.Nack()
+			continue
+		}
+		result.Promoted++
+		msg.Ack()
+	}
+	return result, nil
+}
+
+// confirmPromotion lists the messages about to be promoted on out and asks
+// for a yes on in.
+func confirmPromotion(in io.Reader, out io.Writer, destination string, selected []*pubsub.Message) (bool, error) {
+	fmt.Fprintf(out, "About to publish %d messages to %s:\n", len(selected), destination)
+	for _, msg := range selected {
+		fmt.Fprintf(out, "  %s  published %s  %d bytes", msg.ID, msg.PublishTime.UTC().Format(time.RFC3339), len(msg.Data))
+		if len(msg.Attributes) > 0 {
+			fmt.Fprintf(out, "  %s", formatAttributes(msg.Attributes))
+		}
+		fmt.Fprintln(out)
+	}
+	fmt.Fprint(out, "Promote them? [y/N] ")
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// isTerminal reports whether file is a terminal someone can answer on.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func promoteCommand(logger *log.Logger) fx.Option {
+	flags := flag.NewFlagSet("promote", flag.ExitOnError)
+	var options promoteOptions
+	flags.StringVar(&options.from, "from", "", "staging subscription ID")
+	flags.StringVar(&options.to, "to", "", "production topic ID")
+	toProject := flags.String("to-project", "", "project of the production topic, defaulting to PROJECT_ID")
+	flags.Var(&options.filters, "attr", "only promote messages with this attribute, as key or key=value; repeatable")
+	flags.IntVar(&options.max, "max", 100, "promote at most this many messages; 0 is no limit")
+	flags.DurationVar(&options.idle, "idle", 30*time.Second, "stop selecting once no new message has arrived for this long")
+	flags.BoolVar(&options.yes, "yes", false, "promote without asking for confirmation")
+	flags.Parse(commandArgs)
+	if options.from == "" || options.to == "" {
+		logger.Fatal("promote needs -from and -to")
+	}
+	if !options.yes && !isTerminal(os.Stdin) {
+		logger.Fatal("promote asks for confirmation on a terminal; pass -yes to promote without asking")
+	}
+
+	return fx.Options(
+		fx.Provide(newPubSubParams(logger), newPubSubClient, newConfig(logger)),
+		fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, params PubSubParams, config Config, client *pubsub.Client) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				options.lineage = config.Lineage
+				project := params.Config.ProjectId
+				destinationClient := client
+				if *toProject != "" && *toProject != project {
+					project = *toProject
+					var err error
+					destinationClient, err = pubsub.NewClient(ctx, project, params.clientOptions()...)
+					if err != nil {
+						return fmt.Errorf("connecting to project %s: %w", project, err)
+					}
+					defer destinationClient.Close()
+				}
+				destination := destinationClient.Topic(options.to)
+				destination.EnableMessageOrdering = true
+				defer destination.Stop()
+				exists, err := destination.Exists(ctx)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					return fmt.Errorf("topic %s does not exist", options.to)
+				}
+				topicConfig, err := destination.Config(ctx)
+				if err != nil {
+					return err
+				}
+				var schema *promoteSchema
+				if settings := topicConfig.SchemaSettings; settings != nil {
+					schemas, err := pubsub.NewSchemaClient(ctx, project, params.clientOptions()...)
+					if err != nil {
+						return err
+					}
+					defer schemas.Close()
+					schema = &promoteSchema{schemas: schemas, id: path.Base(settings.Schema), encoding: settings.Encoding}
+					logger.Printf("Validating messages against schema %s", settings.Schema)
+				} else {
+					logger.Printf("Topic %s has no schema, so messages aren't validated", options.to)
+				}
+
+				confirm := func(selected []*pubsub.Message) (bool, error) {
+					if options.yes {
+						return true, nil
+					}
+					return confirmPromotion(os.Stdin, os.Stderr, destination.String(), selected)
+				}
+				logger.Printf("Selecting messages to promote from subscription %s", options.from)
+				result, err := promoteMessages(ctx, client.Subscription(options.from), destination, schema, options, confirm, logger)
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				encoder.Encode(result)
+				if err != nil {
+					return err
+				}
+				if result.Failed > 0 {
+					return fmt.Errorf("%d messages failed to promote and were left on %s", result.Failed, options.from)
+				}
+				return nil
+			})
+		}),
+	)
+}
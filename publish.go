@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const maxPublishBodyBytes = 10 << 20
+
+// publishRequest is either a message given as a JSON data value with
+// attributes, or a Pub/Sub push envelope (Message and Subscription) being
+// forwarded from another environment. Bodies in other media types are
+// decoded into one by decodePublishRequest, with Data holding the payload
+// as is.
+type publishRequest struct {
+	Data        json.RawMessage   `json:"data,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+
+	Message      *pushMessage `json:"message,omitempty"`
+	Subscription string       `json:"subscription,omitempty"`
+}
+
+// pushMessage is the message in the JSON envelope Pub/Sub push subscriptions
+// deliver.
+type pushMessage struct {
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	MessageId   string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+const (
+	forwardedMessageIdAttribute    = "forwarded_message_id"
+	forwardedPublishTimeAttribute  = "forwarded_publish_time"
+	forwardedSubscriptionAttribute = "forwarded_subscription"
+)
+
+// message converts the request into the message to publish to topic.
+func (r publishRequest) message(topic *RegisteredTopic) (*pubsub.Message, error) {
+	if r.Message != nil {
+		if len(r.Message.Data) == 0 && len(r.Message.Attributes) == 0 {
+			return nil, errors.New("push message has neither data nor attributes")
+		}
+		attributes := make(map[string]string, len(r.Message.Attributes)+3)
+		for key, value := range r.Message.Attributes {
+			attributes[key] = value
+		}
+		attributes[forwardedMessageIdAttribute] = r.Message.MessageId
+		if !r.Message.PublishTime.IsZero() {
+			attributes[forwardedPublishTimeAttribute] = r.Message.PublishTime.UTC().Format(time.RFC3339Nano)
+		}
+		if r.Subscription != "" {
+			attributes[forwardedSubscriptionAttribute] = r.Subscription
+		}
+		msg := &pubsub.Message{Data: r.Message.Data, Attributes: attributes}
+		if err := topic.Transform(msg); err != nil {
+			return nil, err
+		}
+		if topic.Ordered() {
+			msg.OrderingKey = r.Message.OrderingKey
+			if msg.OrderingKey == "" {
+				msg.OrderingKey = topic.OrderingKeyFor(msg.Data)
+			}
+		}
+		return msg, nil
+	}
+
+	if len(r.Data) == 0 {
+		return nil, errors.New("publish request has no data")
+	}
+	msg := &pubsub.Message{Data: r.Data, Attributes: r.Attributes}
+	if err := topic.Transform(msg); err != nil {
+		return nil, err
+	}
+	if !topic.Ordered() {
+		// The topic's publisher doesn't enable ordering, so Pub/Sub would
+		// reject the message.
+		if r.OrderingKey != "" {
+			return nil, errors.New("ordering_key is set, but the topic isn't ordered")
+		}
+		return msg, nil
+	}
+	msg.OrderingKey = r.OrderingKey
+	if msg.OrderingKey == "" {
+		msg.OrderingKey = topic.OrderingKeyFor(msg.Data)
+	}
+	return msg, nil
+}
+
+type publishResponse struct {
+	MessageId   string `json:"message_id"`
+	OrderingKey string `json:"ordering_key,omitempty"`
+}
+
+type PublishHandler struct {
+	lineage   LineageConfig
+	registry  *TopicRegistry
+	messages  *MessageLogger
+	templates TemplateRepository
+	failures  *FailureStore
+	identity  *Identity
+	dedup     *PublishDedup
+	quotas    *PublishQuotas
+	cipher    *AttributeCipher
+	router    *Router
+	callbacks *Callbacks
+}
+
+func newPublishHandler(config Config, registry *TopicRegistry, messages *MessageLogger, templates TemplateRepository, failures *FailureStore, identity *Identity, dedup *PublishDedup, quotas *PublishQuotas, cipher *AttributeCipher, router *Router, callbacks *Callbacks) *PublishHandler {
+	return &PublishHandler{
+		lineage:   config.Lineage,
+		registry:  registry,
+		messages:  messages,
+		templates: templates,
+		failures:  failures,
+		identity:  identity,
+		dedup:     dedup,
+		quotas:    quotas,
+		cipher:    cipher,
+		router:    router,
+		callbacks: callbacks,
+	}
+}
+
+func (h *PublishHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	name := r.PathValue("topic")
+	if !h.router.Known(name) {
+		http.Error(w, "Unknown topic", http.StatusNotFound)
+		return
+	}
+	callbackURL := r.Header.Get(callbackUrlHeader)
+	if callbackURL != "" {
+		if err := h.callbacks.Check(callbackURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	request, err := decodePublishRequest(w, r)
+	if errors.Is(err, errUnsupportedMediaType) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		http.Error(w, "Invalid publish request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	attributes := request.Attributes
+	if request.Message != nil {
+		attributes = request.Message.Attributes
+	}
+	registered, ok := h.registry.Lookup(h.router.Route(name, attributes))
+	if !ok {
+		http.Error(w, "Unknown topic", http.StatusNotFound)
+		return
+	}
+	ctx := requestContext(r)
+	if request.Message != nil {
+		var span trace.Span
+		ctx, span = startReceiveSpan(ctx, request.Subscription, request.Message.MessageId, request.Message.Attributes)
+		defer span.End()
+	}
+	r = r.WithContext(ctx)
+
+	msg, err := request.message(registered)
+	if err == nil && request.Message != nil {
+		// After transforms, so they can't drop the lineage.
+		if msg.Attributes == nil {
+			msg.Attributes = make(map[string]string)
+		}
+		if err := stampLineage(h.lineage, msg.Attributes, request.Message.MessageId); errors.Is(err, errHopLimit) {
+			h.messages.Log(msg, messageOutcome{Event: "publish", Resource: registered.Config.Name, Err: err, Request: r})
+			h.failures.Record(ctx, newFailure(failureKindPublish, registered.Config.Name, registered.Config.Id, msg, err))
+			// 2xx, so a push subscription acks the message and the loop
+			// ends here instead of being redelivered.
+			http.Error(w, err.Error(), http.StatusAccepted)
+			return
+		}
+	}
+	key := r.PathValue("key")
+	if err == nil && key != "" {
+		if msg.Attributes == nil {
+			msg.Attributes = make(map[string]string, 1)
+		}
+		msg.Attributes[idempotencyKeyAttribute] = key
+	}
+	status := http.StatusBadRequest
+	var digest string
+	if err == nil {
+		// Before prepare, so a retry of the request has the same digest.
+		digest = requestDigest(msg)
+		msg, status, err = h.prepare(ctx, registered, msg)
+	}
+	if status == http.StatusInternalServerError {
+		http.Error(w, "Failed to look up email template: "+err.Error(), status)
+		return
+	} else if err != nil {
+		http.Error(w, "Invalid publish request: "+err.Error(), status)
+		return
+	}
+	claim := h.dedup.Claim
+	if key == "" {
+		key = r.Header.Get(h.dedup.config.Header)
+	} else {
+		claim = h.dedup.ClaimKey
+	}
+	// Under the topic asked for rather than the one routed to, which can
+	// be a different variant of a split for a retry.
+	duplicateId, release, err := claim(ctx, name, key, digest)
+	switch {
+	case errors.Is(err, errDedupInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errDedupMismatch):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, "Invalid publish request: "+err.Error(), http.StatusBadRequest)
+		return
+	case duplicateId != "":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		json.NewEncoder(w).Encode(publishResponse{MessageId: duplicateId, OrderingKey: msg.OrderingKey})
+		return
+	}
+
+	refund, err := h.quotas.Reserve(ctx, msg)
+	if writeQuotaExceeded(w, err) {
+		release("", err)
+		return
+	}
+
+	publish := func(ctx context.Context) (string, error) {
+		ctx, span := startPublishSpan(ctx, registered.Config.Name, msg)
+		started := time.Now()
+		messageId, err := registered.Publish(ctx, msg)
+		var spilled *SpilledError
+		if !errors.As(err, &spilled) {
+			// A spilled message is still to be published, so it keeps its
+			// quota, and its idempotency key stays claimed until the
+			// claim expires.
+			release(messageId, err)
+			refund(err)
+		}
+		endSpan(span, err)
+		observePublishRequest(ctx, registered.Config.Name, received, err)
+		h.messages.Log(msg, messageOutcome{Event: "publish", Resource: registered.Config.Name, MessageId: messageId, Duration: time.Since(started), Err: err, Request: r})
+		var unavailable *UnavailableError
+		if err != nil && !errors.As(err, &unavailable) && spilled == nil {
+			h.failures.Record(ctx, newFailure(failureKindPublish, registered.Config.Name, registered.Config.Id, msg, err))
+		}
+		return messageId, err
+	}
+	if callbackURL != "" {
+		id := h.callbacks.Go(ctx, callbackURL, registered.Config.Name, msg.OrderingKey, publish)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(callbackAccepted{RequestId: id})
+		return
+	}
+	messageId, err := publish(ctx)
+	if err != nil {
+		writePublishError(w, registered.Config.Name, "Failed to publish", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(publishResponse{MessageId: messageId, OrderingKey: msg.OrderingKey})
+}
+
+// prepare runs msg, built from a request to publish to registered, through
+// the checks and conversions every message published through the API goes
+// through, returning the message to publish. On failure it returns the
+// status to respond with: 422 for an email event referencing an unknown
+// template, 500 if the template couldn't be looked up, and otherwise 400.
+func (h *PublishHandler) prepare(ctx context.Context, registered *RegisteredTopic, msg *pubsub.Message) (*pubsub.Message, int, error) {
+	injectBaggage(ctx, msg)
+	if err := registered.CheckAttributes(msg.Attributes); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := checkExpiresAt(msg.Attributes); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := checkEmailTemplate(ctx, h.templates, msg); errors.Is(err, errUnknownTemplate) {
+		return nil, http.StatusUnprocessableEntity, err
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	// After every check that reads attributes, as they see plaintext.
+	if err := h.cipher.Seal(registered.Config, msg.Attributes); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if registered.Config.CloudEvents != nil {
+		var err error
+		if msg, err = toCloudEvent(*registered.Config.CloudEvents, msg); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	// Last, as a token covers the data as published.
+	if err := h.identity.Attach(ctx, msg); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := validatePubSubLimits(msg); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return msg, 0, nil
+}
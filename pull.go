@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// pullMessages receives up to limit messages from subscription, waiting at
+// most wait for them to arrive, and passes them to handle as one batch.
+// subscription must be a handle of the caller's own, as its receive
+// settings are changed and a handle can only receive once at a time. The
+// Receive callbacks stay blocked until handle returns so that every ack or
+// nack it issues is delivered while the stream is still open. Messages that
+// arrive after the batch is closed are nacked.
+func pullMessages(ctx context.Context, subscription *pubsub.Subscription, limit int, wait time.Duration, handle func([]*pubsub.Message)) error {
+	subscription.ReceiveSettings.MaxOutstandingMessages = limit
+	subscription.ReceiveSettings.NumGoroutines = 1
+
+	receiveCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		batch   []*pubsub.Message
+		closed  bool
+		full    = make(chan struct{})
+		release = make(chan struct{})
+		errs    = make(chan error, 1)
+	)
+	go func() {
+		errs <- subscription.Receive(receiveCtx, func(_ context.Context, msg *pubsub.Message) {
+			mu.Lock()
+			if closed || len(batch) >= limit {
+				mu.Unlock()
+				msg.Nack()
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) == limit {
+				close(full)
+			}
+			mu.Unlock()
+			<-release
+		})
+	}()
+
+	var err error
+	select {
+	case <-full:
+	case <-receiveCtx.Done():
+	case err = <-errs:
+	}
+
+	mu.Lock()
+	closed = true
+	messages := batch
+	mu.Unlock()
+
+	handle(messages)
+	close(release)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if err := <-errs; err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
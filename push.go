@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const (
+	// pushVerificationAttribute marks the synthetic push sent to check a
+	// push subscription's endpoint, which it should ack without handling.
+	pushVerificationAttribute = "push_verification"
+
+	pushVerificationTimeout = 30 * time.Second
+)
+
+// PushSubscriptionConfig declares a push subscription, which delivers a
+// topic's messages to an HTTP endpoint, such as a Cloud Run service, rather
+// than to this service. It's part of the declared topology, so
+// provisioning creates it, and fixes its push config if it drifts.
+type PushSubscriptionConfig struct {
+	// Id is the Pub/Sub subscription ID, and Topic the ID of the topic it's
+	// attached to.
+	Id    string `yaml:"id"`
+	Topic string `yaml:"topic"`
+	// Endpoint is the HTTPS URL messages are pushed to.
+	Endpoint string `yaml:"endpoint"`
+	// ServiceAccount is the email of the service account Pub/Sub signs an
+	// OIDC token as for each push, for the endpoint to check; for Cloud
+	// Run, grant it roles/run.invoker on the service. Without one, pushes
+	// aren't authenticated.
+	ServiceAccount string `yaml:"service_account"`
+	// Audience is the token's audience. Defaults to Endpoint.
+	Audience    string        `yaml:"audience"`
+	AckDeadline time.Duration `yaml:"ack_deadline"`
+	Filter      string        `yaml:"filter"`
+	DeadLetter  *DeadLetter   `yaml:"dead_letter"`
+	RetryPolicy *RetryPolicy  `yaml:"retry_policy"`
+	// SkipVerification stops provisioning from checking that the endpoint
+	// accepts pushes once the subscription is created or changed. The
+	// check sends it a push envelope with the attribute push_verification
+	// and data {}, authenticated as ServiceAccount, which needs this
+	// service's identity to have roles/iam.serviceAccountTokenCreator on
+	// it, and expects a 2xx response, as Pub/Sub does to ack.
+	SkipVerification bool `yaml:"skip_verification"`
+}
+
+func (c PushSubscriptionConfig) validate() error {
+	if c.Id == "" || c.Topic == "" || c.Endpoint == "" {
+		return errors.New("needs an id, a topic and an endpoint")
+	}
+	if endpoint, err := url.Parse(c.Endpoint); err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return errors.New("endpoint must be an https URL")
+	}
+	if c.Audience != "" && c.ServiceAccount == "" {
+		return errors.New("audience needs a service_account")
+	}
+	if c.AckDeadline < 0 {
+		return errors.New("ack_deadline can't be negative")
+	}
+	return nil
+}
+
+// pubsubPushConfig is the push config of a declared subscription.
+func pubsubPushConfig(subscription SubscriptionTopology) pubsub.PushConfig {
+	config := pubsub.PushConfig{Endpoint: subscription.PushEndpoint}
+	if subscription.PushServiceAccount != "" {
+		config.AuthenticationMethod = &pubsub.OIDCToken{
+			ServiceAccountEmail: subscription.PushServiceAccount,
+			Audience:            subscription.PushAudience,
+		}
+	}
+	return config
+}
+
+// livePushAuth returns the service account and audience of a live push
+// config's OIDC token, if it has one.
+func livePushAuth(config pubsub.PushConfig) (string, string) {
+	token, ok := config.AuthenticationMethod.(*pubsub.OIDCToken)
+	if !ok || token == nil {
+		return "", ""
+	}
+	return token.ServiceAccountEmail, token.Audience
+}
+
+// pushConfigDrifted reports how the live push config differs from the
+// declared one, if it does.
+func pushConfigDrifted(declared SubscriptionTopology, live pubsub.PushConfig) (string, bool) {
+	account, audience := livePushAuth(live)
+	switch {
+	case live.Endpoint != declared.PushEndpoint:
+		return fmt.Sprintf("pushes to %q instead of %s", live.Endpoint, declared.PushEndpoint), true
+	case account != declared.PushServiceAccount:
+		return fmt.Sprintf("pushes authenticated as %q instead of %q", account, declared.PushServiceAccount), true
+	case audience != declared.PushAudience:
+		return fmt.Sprintf("push token audience is %q instead of %q", audience, declared.PushAudience), true
+	}
+	return "", false
+}
+
+// verifyPush checks that subscription's endpoint accepts a push, sent as
+// Pub/Sub would, with an OIDC token for its service account.
+func verifyPush(ctx context.Context, project string, subscription SubscriptionTopology, options []option.ClientOption) error {
+	ctx, cancel := context.WithTimeout(ctx, pushVerificationTimeout)
+	defer cancel()
+	client := &http.Client{}
+	if subscription.PushServiceAccount != "" {
+		audience := subscription.PushAudience
+		if audience == "" {
+			audience = subscription.PushEndpoint
+		}
+		source, err := impersonate.IDTokenSource(ctx, impersonate.IDTokenConfig{
+			Audience:        audience,
+			TargetPrincipal: subscription.PushServiceAccount,
+			IncludeEmail:    true,
+		}, options...)
+		if err != nil {
+			return fmt.Errorf("getting a token as %s: %w", subscription.PushServiceAccount, err)
+		}
+		client = oauth2.NewClient(ctx, source)
+	}
+
+	var id [8]byte
+	rand.Read(id[:])
+	envelope := struct {
+		Message      pushMessage `json:"message"`
+		Subscription string      `json:"subscription"`
+	}{
+		Message: pushMessage{
+			Data:        []byte("{}"),
+			Attributes:  map[string]string{pushVerificationAttribute: "true"},
+			MessageId:   "verification-" + hex.EncodeToString(id[:]),
+			PublishTime: time.Now().UTC(),
+		},
+		Subscription: "projects/" + project + "/subscriptions/" + subscription.Name,
+	}
+	body, _ := json.Marshal(envelope)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.PushEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("pushing to %s: %w", subscription.PushEndpoint, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 300 {
+		io.Copy(io.Discard, response.Body)
+		return nil
+	}
+	excerpt, _ := io.ReadAll(io.LimitReader(response.Body, maxWebhookResponseBytes))
+	return fmt.Errorf("%s responded %s to a push: %s", subscription.PushEndpoint, response.Status, strings.TrimSpace(string(excerpt)))
+}
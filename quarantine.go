@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	quarantineAttributePrefix   = "quarantine_"
+	defaultQuarantineListLimit  = 10
+	quarantinePullWait          = 5 * time.Second
+	defaultQuarantineMaxAttempt = 5
+	// quarantineFailureTTL matches Pub/Sub's default message retention, after
+	// which a failing message can't be redelivered anyway.
+	quarantineFailureTTL = 7 * 24 * time.Hour
+)
+
+// PermanentError is an error a handler returns for a message that will
+// never succeed, which is quarantined, or sent to the retry chain's dead
+// letter topic, without waiting for further attempts. Create it with
+// Permanent.
+type PermanentError struct {
+	Err error
+}
+
+// Permanent wraps err to give up on the message straight away.
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func isPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// Quarantine moves messages that keep failing out of a subscription and onto
+// a separate topic, annotated with why they failed, so they stop consuming
+// redeliveries and can be inspected and requeued by hand.
+type Quarantine struct {
+	config QuarantineConfig
+	topic  *pubsub.Topic
+	client *pubsub.Client
+	source *pubsub.Topic
+	store  Store
+}
+
+func newQuarantine(client *pubsub.Client, store Store, config SubscriptionConfig) *Quarantine {
+	topic := client.Topic(config.Quarantine.Topic)
+	// Messages from an ordered subscription keep their ordering key.
+	topic.EnableMessageOrdering = config.Ordered
+	return &Quarantine{
+		config: *config.Quarantine,
+		topic:  topic,
+		client: client,
+		source: client.Topic(config.Topic),
+		store:  store,
+	}
+}
+
+// subscription returns a new handle on the quarantine subscription for
+// pullMessages, which changes its receive settings.
+func (q *Quarantine) subscription() *pubsub.Subscription {
+	return q.client.Subscription(q.config.Subscription)
+}
+
+func (q *Quarantine) failureKey(subscriber *Subscriber, msg *pubsub.Message) string {
+	return "quarantine/failures/" + subscriber.Config.Id + "/" + msg.ID
+}
+
+// attempts returns how many times msg has failed, including this delivery.
+// The server-side delivery attempt is used when the subscription has a dead
+// letter policy; otherwise failures are counted per message ID in the store.
+func (q *Quarantine) attempts(ctx context.Context, subscriber *Subscriber, msg *pubsub.Message) (int, error) {
+	if msg.DeliveryAttempt != nil {
+		return *msg.DeliveryAttempt, nil
+	}
+	count, err := q.store.Increment(ctx, q.failureKey(subscriber, msg), 1, quarantineFailureTTL)
+	return int(count), err
+}
+
+func (q *Quarantine) forget(ctx context.Context, subscriber *Subscriber, msg *pubsub.Message) {
+	if msg.DeliveryAttempt != nil {
+		return
+	}
+	if err := q.store.Delete(ctx, q.failureKey(subscriber, msg)); err != nil {
+		subscriber.logger.Printf("Failed to clear failure count for message %s: %v", msg.ID, err)
+	}
+}
+
+// Fail records a handler failure for msg and, once it has failed MaxAttempts
+// times, publishes it to the quarantine topic. It reports whether msg was
+// quarantined and may be acked.
+func (q *Quarantine) Fail(ctx context.Context, subscriber *Subscriber, msg *pubsub.Message, handlerErr error, stack string) bool {
+	attempt, err := q.attempts(ctx, subscriber, msg)
+	if err != nil {
+		subscriber.logger.Printf("Failed to count failures for message %s: %v", msg.ID, err)
+		return false
+	}
+	if attempt < q.config.MaxAttempts && !isPermanent(handlerErr) {
+		return false
+	}
+
+	attributes := make(map[string]string, len(msg.Attributes)+7)
+	for key, value := range msg.Attributes {
+		attributes[key] = value
+	}
+	attributes[quarantineAttributePrefix+"error"] = truncate(handlerErr.Error(), maxAttributeValueBytes)
+	attributes[quarantineAttributePrefix+"handler"] = subscriber.Config.Handler
+	attributes[quarantineAttributePrefix+"subscription"] = subscriber.Config.Id
+	attributes[quarantineAttributePrefix+"message_id"] = msg.ID
+	attributes[quarantineAttributePrefix+"attempts"] = strconv.Itoa(attempt)
+	attributes[quarantineAttributePrefix+"at"] = time.Now().UTC().Format(time.RFC3339Nano)
+	if stack != "" {
+		attributes[quarantineAttributePrefix+"stack"] = truncate(stack, maxAttributeValueBytes)
+	}
+
+	_, err = q.topic.Publish(ctx, &pubsub.Message{
+		Data:        msg.Data,
+		Attributes:  attributes,
+		OrderingKey: msg.OrderingKey,
+	}).Get(ctx)
+	if err != nil {
+		if msg.OrderingKey != "" {
+			// Publishing with the key is paused after a failure.
+			q.topic.ResumePublish(msg.OrderingKey)
+		}
+		subscriber.logger.Printf("Failed to quarantine message %s: %v", msg.ID, err)
+		return false
+	}
+	q.forget(ctx, subscriber, msg)
+	subscriber.logger.Printf("Quarantined message %s after %d attempts", msg.ID, attempt)
+	auditLog.Emit(auditEvent{
+		Id:       auditQuarantined,
+		Resource: subscriber.Config.Name,
+		Message:  fmt.Sprintf("Message %s from subscription %s quarantined to topic %s", msg.ID, subscriber.Config.Name, q.config.Topic),
+		Details:  map[string]string{"message_id": msg.ID, "topic": q.config.Topic, "attempts": strconv.Itoa(attempt), "error": truncate(handlerErr.Error(), maxAttributeValueBytes)},
+		Severity: logging.Warning,
+	})
+	return true
+}
+
+// truncate cuts value to at most limit bytes, on a rune boundary.
+func truncate(value string, limit int) string {
+	if len(value) <= limit {
+		return value
+	}
+	for limit > 0 && !utf8.RuneStart(value[limit]) {
+		limit--
+	}
+	return value[:limit]
+}
+
+type quarantinedMessage struct {
+	Id          string            `json:"id"`
+	PublishTime time.Time         `json:"publish_time"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	Attributes  map[string]string `json:"attributes"`
+	Data        []byte            `json:"data"`
+}
+
+type requeueResponse struct {
+	Requeued int      `json:"requeued"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+type QuarantineHandler struct {
+	subscribers *SubscriberSet
+}
+
+func newQuarantineHandler(subscribers *SubscriberSet) *QuarantineHandler {
+	return &QuarantineHandler{subscribers: subscribers}
+}
+
+func (h *QuarantineHandler) lookup(w http.ResponseWriter, r *http.Request) (*Quarantine, int, bool) {
+	subscriber, ok := h.subscribers.Lookup(r.PathValue("subscription"))
+	if !ok || subscriber.quarantine == nil {
+		http.Error(w, "No quarantine configured for subscription", http.StatusNotFound)
+		return nil, 0, false
+	}
+	limit := defaultQuarantineListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return nil, 0, false
+		}
+		limit = parsed
+	}
+	return subscriber.quarantine, limit, true
+}
+
+// List returns up to limit quarantined messages without removing them.
+func (h *QuarantineHandler) List(w http.ResponseWriter, r *http.Request) {
+	quarantine, limit, ok := h.lookup(w, r)
+	if !ok {
+		return
+	}
+	listed := []quarantinedMessage{}
+	err := pullMessages(r.Context(), quarantine.subscription(), limit, quarantinePullWait, func(messages []*pubsub.Message) {
+		for _, msg := range messages {
+			listed = append(listed, quarantinedMessage{
+				Id:          msg.ID,
+				PublishTime: msg.PublishTime,
+				OrderingKey: msg.OrderingKey,
+				Attributes:  msg.Attributes,
+				Data:        msg.Data,
+			})
+			msg.Nack()
+		}
+	})
+	if err != nil {
+		http.Error(w, "Failed to pull quarantined messages: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listed)
+}
+
+// Requeue republishes quarantined messages to the subscription's topic with
+// the quarantine metadata stripped. When id query parameters are given only
+// those quarantine message IDs are requeued.
+func (h *QuarantineHandler) Requeue(w http.ResponseWriter, r *http.Request) {
+	quarantine, limit, ok := h.lookup(w, r)
+	if !ok {
+		return
+	}
+	var ids map[string]bool
+	if values := r.URL.Query()["id"]; len(values) > 0 {
+		ids = make(map[string]bool, len(values))
+		for _, id := range values {
+			ids[id] = true
+		}
+	}
+
+	var response requeueResponse
+	err := pullMessages(r.Context(), quarantine.subscription(), limit, quarantinePullWait, func(messages []*pubsub.Message) {
+		for _, msg := range messages {
+			if ids != nil && !ids[msg.ID] {
+				msg.Nack()
+				continue
+			}
+			attributes := make(map[string]string, len(msg.Attributes))
+			for key, value := range msg.Attributes {
+				if !strings.HasPrefix(key, quarantineAttributePrefix) {
+					attributes[key] = value
+				}
+			}
+			_, err := quarantine.source.Publish(r.Context(), &pubsub.Message{
+				Data:       msg.Data,
+				Attributes: attributes,
+			}).Get(r.Context())
+			if err != nil {
+				response.Failed++
+				response.Errors = append(response.Errors, fmt.Sprintf("%s: %v", msg.ID, err))
+				msg.Nack()
+				continue
+			}
+			response.Requeued++
+			msg.Ack()
+		}
+	})
+	if err != nil {
+		http.Error(w, "Failed to pull quarantined messages: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const usageKeyPrefix = "usage/"
+
+type QuotaConfig struct {
+	// Enabled counts what each API key publishes, per UTC hour and day, and
+	// rejects its publishes with 429 once it's over its budget. Counts are
+	// kept in the store, so with the redis or firestore backend budgets
+	// hold across instances; with memory they're per instance.
+	Enabled bool `yaml:"enabled"`
+	// Default is the budget of keys that don't have one of their own.
+	Default PublishBudget `yaml:"default"`
+}
+
+// PublishBudget limits the messages and bytes a key can publish. Zero
+// doesn't limit.
+type PublishBudget struct {
+	HourlyMessages int64 `yaml:"hourly_messages" json:"hourly_messages,omitempty"`
+	HourlyBytes    int64 `yaml:"hourly_bytes" json:"hourly_bytes,omitempty"`
+	DailyMessages  int64 `yaml:"daily_messages" json:"daily_messages,omitempty"`
+	DailyBytes     int64 `yaml:"daily_bytes" json:"daily_bytes,omitempty"`
+}
+
+func (b PublishBudget) validate() error {
+	if b.HourlyMessages < 0 || b.HourlyBytes < 0 || b.DailyMessages < 0 || b.DailyBytes < 0 {
+		return fmt.Errorf("budget limits can't be negative")
+	}
+	return nil
+}
+
+type usageWindow struct {
+	name   string
+	length time.Duration
+}
+
+var usageWindows = []usageWindow{{"hour", time.Hour}, {"day", 24 * time.Hour}}
+
+// limits are the window's message and byte limits in budget.
+func (w usageWindow) limits(budget PublishBudget) (int64, int64) {
+	if w.length == time.Hour {
+		return budget.HourlyMessages, budget.HourlyBytes
+	}
+	return budget.DailyMessages, budget.DailyBytes
+}
+
+// QuotaExceededError is answered with 429 and Retry-After.
+type QuotaExceededError struct {
+	Window     string
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("the API key's %s budget is used up for this %s", e.Limit, e.Window)
+}
+
+// PublishQuotas budgets what each API key publishes. It fails open: if the
+// store can't be reached, publishes go ahead uncounted.
+type PublishQuotas struct {
+	logger  *log.Logger
+	config  QuotaConfig
+	store   Store
+	budgets map[string]PublishBudget
+}
+
+func newPublishQuotas(config Config, store Store, authorizer *Authorizer) *PublishQuotas {
+	quotas := &PublishQuotas{logger: newLogger("quota"), config: config.Quotas, store: store, budgets: make(map[string]PublishBudget)}
+	for _, key := range authorizer.keys {
+		budget := config.Quotas.Default
+		if key.Budget != nil {
+			budget = *key.Budget
+		}
+		quotas.budgets[key.Name] = budget
+	}
+	return quotas
+}
+
+func usageKey(window usageWindow, start time.Time, caller string, counter string) string {
+	return usageKeyPrefix + window.name + "/" + strconv.FormatInt(start.Unix(), 10) + "/" + caller + "/" + counter
+}
+
+// messageSize is what a message counts against a byte budget: its data and
+// attributes, as Pub/Sub bills them.
+func messageSize(msg *pubsub.Message) int64 {
+	size := len(msg.Data) + len(msg.OrderingKey)
+	for key, value := range msg.Attributes {
+		size += len(key) + len(value)
+	}
+	return int64(size)
+}
+
+// Reserve counts msg against the budget of the key that's publishing it,
+// returning a QuotaExceededError if it doesn't fit, or a release function
+// to call with the outcome of the publish, which refunds it if it failed.
+// Requests without a key aren't counted.
+func (q *PublishQuotas) Reserve(ctx context.Context, msg *pubsub.Message) (func(err error), error) {
+	release := func(error) {}
+	caller, ok := CallerFrom(ctx)
+	if !q.config.Enabled || !ok {
+		return release, nil
+	}
+	budget := q.budgets[caller.Name]
+	now := time.Now().UTC()
+	size := messageSize(msg)
+	type increment struct {
+		key   string
+		delta int64
+	}
+	var done []increment
+	// The request's context may be done by the time it's called.
+	refundCtx := context.WithoutCancel(ctx)
+	refund := func() {
+		for _, increment := range done {
+			if _, err := q.store.Increment(refundCtx, increment.key, -increment.delta, 0); err != nil {
+				q.logger.Printf("Failed to refund %s's usage: %v", caller.Name, err)
+			}
+		}
+	}
+	for _, window := range usageWindows {
+		start := now.Truncate(window.length)
+		// Kept a window longer, so the previous one can still be reported.
+		ttl := start.Add(2 * window.length).Sub(now)
+		messageLimit, byteLimit := window.limits(budget)
+		for _, counter := range []struct {
+			name  string
+			delta int64
+			limit int64
+		}{{"messages", 1, messageLimit}, {"bytes", size, byteLimit}} {
+			key := usageKey(window, start, caller.Name, counter.name)
+			total, err := q.store.Increment(ctx, key, counter.delta, ttl)
+			if err != nil {
+				refund()
+				publishQuota.WithLabelValues(caller.Name, "error").Inc()
+				q.logger.Printf("Publishing for %s without counting its usage: %v", caller.Name, err)
+				return release, nil
+			}
+			done = append(done, increment{key, counter.delta})
+			if counter.limit > 0 && total > counter.limit {
+				refund()
+				publishQuota.WithLabelValues(caller.Name, "exceeded").Inc()
+				return release, &QuotaExceededError{Window: window.name, Limit: window.name + "ly " + counter.name, RetryAfter: start.Add(window.length).Sub(now)}
+			}
+		}
+	}
+	publishQuota.WithLabelValues(caller.Name, "ok").Inc()
+	return func(err error) {
+		if err != nil {
+			refund()
+		}
+	}, nil
+}
+
+// writeQuotaExceeded responds 429 with Retry-After if err is a
+// QuotaExceededError, reporting whether it did.
+func writeQuotaExceeded(w http.ResponseWriter, err error) bool {
+	var exceeded *QuotaExceededError
+	if !errors.As(err, &exceeded) {
+		return false
+	}
+	seconds := int(math.Ceil(exceeded.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(unavailableResponse{Error: exceeded.Error(), Reason: "quota", RetryAfterSeconds: seconds})
+	return true
+}
+
+type windowUsage struct {
+	Start    time.Time `json:"start"`
+	Messages int64     `json:"messages"`
+	Bytes    int64     `json:"bytes"`
+}
+
+type callerUsage struct {
+	Caller string                 `json:"caller"`
+	Budget PublishBudget          `json:"budget"`
+	Usage  map[string]windowUsage `json:"usage"`
+}
+
+type UsageHandler struct {
+	quotas *PublishQuotas
+}
+
+func newUsageHandler(quotas *PublishQuotas) *UsageHandler {
+	return &UsageHandler{quotas: quotas}
+}
+
+// List reports what each API key has published in the current hour and
+// day, against its budget.
+func (h *UsageHandler) List(w http.ResponseWriter, r *http.Request) {
+	if !h.quotas.config.Enabled {
+		http.Error(w, "Quotas aren't enabled", http.StatusNotFound)
+		return
+	}
+	now := time.Now().UTC()
+	usage := make([]callerUsage, 0, len(h.quotas.budgets))
+	for caller, budget := range h.quotas.budgets {
+		report := callerUsage{Caller: caller, Budget: budget, Usage: make(map[string]windowUsage, len(usageWindows))}
+		for _, window := range usageWindows {
+			start := now.Truncate(window.length)
+			counts := windowUsage{Start: start}
+			for _, counter := range []struct {
+				name  string
+				value *int64
+			}{{"messages", &counts.Messages}, {"bytes", &counts.Bytes}} {
+				data, err := h.quotas.store.Get(r.Context(), usageKey(window, start, caller, counter.name))
+				if errors.Is(err, ErrNotFound) {
+					continue
+				} else if err != nil {
+					http.Error(w, "Failed to read usage: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				*counter.value, _ = strconv.ParseInt(string(data), 10, 64)
+			}
+			report.Usage[window.name] = counts
+		}
+		usage = append(usage, report)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Caller < usage[j].Caller })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
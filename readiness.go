@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"go.uber.org/fx"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	readinessModeUnready  = "unready"
+	readinessModeDegraded = "degraded"
+
+	backlogMessagesMetric = "pubsub.googleapis.com/subscription/num_undelivered_messages"
+	backlogAgeMetric      = "pubsub.googleapis.com/subscription/oldest_unacked_message_age"
+	// backlogLookback covers Cloud Monitoring's sampling delay for Pub/Sub
+	// metrics, so there's a recent point to read.
+	backlogLookback = 5 * time.Minute
+)
+
+type ReadinessConfig struct {
+	// Mode is unready (the default), which fails /readyz with 503 while a
+	// subscription's backlog is over its limits, or degraded, which keeps
+	// returning 200 and reports the degraded status in the body.
+	Mode string `yaml:"mode"`
+	// Interval is how often backlogs are read from Cloud Monitoring.
+	Interval time.Duration `yaml:"interval"`
+}
+
+type backlogStatus struct {
+	Subscription string `json:"subscription"`
+	// Known is false until Cloud Monitoring has reported on the
+	// subscription. Unknown backlogs never gate readiness.
+	Known                   bool       `json:"known"`
+	Messages                int64      `json:"messages"`
+	OldestUnackedAgeSeconds int64      `json:"oldest_unacked_age_seconds"`
+	Exceeded                bool       `json:"exceeded"`
+	CheckedAt               *time.Time `json:"checked_at,omitempty"`
+}
+
+type readinessResponse struct {
+	Status        string          `json:"status"`
+	Subscriptions []backlogStatus `json:"subscriptions"`
+}
+
+// BacklogMonitor polls the backlog of subscriptions with max_backlog or
+// max_backlog_age set and serves /readyz from it, so a load balancer can
+// shift traffic away while consumers catch up. It also polls those with
+// stall detection, which only read it.
+type BacklogMonitor struct {
+	logger  *log.Logger
+	config  ReadinessConfig
+	project string
+	gated   map[string]SubscriptionConfig
+	// watched are the subscriptions polled for stall detection alone.
+	watched map[string]backlogStatus
+
+	mu       sync.RWMutex
+	statuses map[string]backlogStatus
+}
+
+func newBacklogMonitor(lifecycle fx.Lifecycle, config Config, params PubSubParams) *BacklogMonitor {
+	monitor := &BacklogMonitor{
+		logger:   newLogger("readiness"),
+		config:   config.Readiness,
+		project:  params.Config.ProjectId,
+		gated:    make(map[string]SubscriptionConfig),
+		watched:  make(map[string]backlogStatus),
+		statuses: make(map[string]backlogStatus),
+	}
+	for _, subscription := range config.Subscriptions {
+		if subscription.MaxBacklog > 0 || subscription.MaxBacklogAge > 0 {
+			monitor.gated[subscription.Id] = subscription
+			monitor.statuses[subscription.Id] = backlogStatus{Subscription: subscription.Name}
+		} else if subscription.Stall != nil {
+			monitor.watched[subscription.Id] = backlogStatus{Subscription: subscription.Name}
+		}
+	}
+	if len(monitor.gated) == 0 && len(monitor.watched) == 0 {
+		return monitor
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var client *monitoring.MetricClient
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(startCtx context.Context) error {
+				if os.Getenv("PUBSUB_EMULATOR_HOST") != "" || params.Config.ProjectId == localProjectId {
+					monitor.logger.Println("Backlog readiness gating and stall detection are disabled without Cloud Monitoring")
+					close(done)
+					return nil
+				}
+				var err error
+				if client, err = monitoring.NewMetricClient(startCtx, params.clientOptions()...); err != nil {
+					return fmt.Errorf("connecting to Cloud Monitoring: %w", err)
+				}
+				go monitor.run(ctx, client, done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				if client != nil {
+					return client.Close()
+				}
+				return nil
+			},
+		},
+	)
+	return monitor
+}
+
+func (m *BacklogMonitor) run(ctx context.Context, client *monitoring.MetricClient, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := m.poll(ctx, client); err != nil && ctx.Err() == nil {
+			// Readiness keeps the last known backlogs rather than failing
+			// because monitoring is unavailable.
+			m.logger.Printf("Failed to read subscription backlogs: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// latest returns the newest point of metric for each gated or watched
+// subscription.
+func (m *BacklogMonitor) latest(ctx context.Context, client *monitoring.MetricClient, metric string) (map[string]int64, error) {
+	ids := make([]string, 0, len(m.gated)+len(m.watched))
+	for id := range m.gated {
+		ids = append(ids, id)
+	}
+	for id := range m.watched {
+		ids = append(ids, id)
+	}
+	return latestSubscriptionMetric(ctx, client, m.project, metric, ids)
+}
+
+// latestSubscriptionMetric returns the newest point of metric for each of
+// the subscriptions with the Pub/Sub IDs ids that Cloud Monitoring has one
+// for.
+func latestSubscriptionMetric(ctx context.Context, client *monitoring.MetricClient, project string, metric string, ids []string) (map[string]int64, error) {
+	quoted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		quoted = append(quoted, fmt.Sprintf("%q", id))
+	}
+	sort.Strings(quoted)
+	now := time.Now()
+	series := client.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
+		Name: "projects/" + project,
+		Filter: fmt.Sprintf(`metric.type = %q AND resource.type = "pubsub_subscription" AND resource.labels.subscription_id = one_of(%s)`,
+			metric, strings.Join(quoted, ", ")),
+		Interval: &monitoringpb.TimeInterval{
+			StartTime: timestamppb.New(now.Add(-backlogLookback)),
+			EndTime:   timestamppb.New(now),
+		},
+		View: monitoringpb.ListTimeSeriesRequest_FULL,
+	})
+	values := make(map[string]int64)
+	for {
+		timeSeries, err := series.Next()
+		if err == iterator.Done {
+			return values, nil
+		} else if err != nil {
+			return nil, err
+		}
+		// Points are returned newest first.
+		if len(timeSeries.Points) > 0 {
+			values[timeSeries.Resource.Labels["subscription_id"]] = timeSeries.Points[0].Value.GetInt64Value()
+		}
+	}
+}
+
+func (m *BacklogMonitor) poll(ctx context.Context, client *monitoring.MetricClient) error {
+	messages, err := m.latest(ctx, client, backlogMessagesMetric)
+	if err != nil {
+		return err
+	}
+	ages, err := m.latest(ctx, client, backlogAgeMetric)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, subscription := range m.gated {
+		count, ok := messages[id]
+		age, ageOk := ages[id]
+		if !ok && !ageOk {
+			continue
+		}
+		checkedAt := time.Now().UTC()
+		status := backlogStatus{
+			Subscription:            subscription.Name,
+			Known:                   true,
+			Messages:                count,
+			OldestUnackedAgeSeconds: age,
+			CheckedAt:               &checkedAt,
+		}
+		status.Exceeded = (subscription.MaxBacklog > 0 && count > subscription.MaxBacklog) ||
+			(subscription.MaxBacklogAge > 0 && time.Duration(age)*time.Second > subscription.MaxBacklogAge)
+		if status.Exceeded && !m.statuses[id].Exceeded {
+			m.logger.Printf("Subscription %s backlog over limit: %d messages, oldest %ds", subscription.Name, count, age)
+		} else if !status.Exceeded && m.statuses[id].Exceeded {
+			m.logger.Printf("Subscription %s backlog back within limits", subscription.Name)
+		}
+		m.statuses[id] = status
+		exceeded := 0.0
+		if status.Exceeded {
+			exceeded = 1
+		}
+		subscriberBacklogExceeded.WithLabelValues(subscription.Name).Set(exceeded)
+	}
+	for id, status := range m.watched {
+		count, ok := messages[id]
+		age, ageOk := ages[id]
+		if !ok && !ageOk {
+			continue
+		}
+		checkedAt := time.Now().UTC()
+		m.watched[id] = backlogStatus{Subscription: status.Subscription, Known: true, Messages: count, OldestUnackedAgeSeconds: age, CheckedAt: &checkedAt}
+	}
+	return nil
+}
+
+// Backlog returns the last backlog read for the subscription with the
+// Pub/Sub ID id, which isn't known until Cloud Monitoring has reported it.
+func (m *BacklogMonitor) Backlog(id string) backlogStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if status, ok := m.statuses[id]; ok {
+		return status
+	}
+	return m.watched[id]
+}
+
+func (m *BacklogMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	response, ready := m.report()
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// report returns the backlog of each monitored subscription and whether the
+// instance should take traffic, which it only shouldn't in unready mode.
+func (m *BacklogMonitor) report() (readinessResponse, bool) {
+	response := readinessResponse{Status: "ready", Subscriptions: []backlogStatus{}}
+	m.mu.RLock()
+	for _, status := range m.statuses {
+		response.Subscriptions = append(response.Subscriptions, status)
+		if status.Exceeded {
+			response.Status = readinessModeDegraded
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(response.Subscriptions, func(i, j int) bool {
+		return response.Subscriptions[i].Subscription < response.Subscriptions[j].Subscription
+	})
+
+	if response.Status != "ready" && m.config.Mode == readinessModeUnready {
+		response.Status = readinessModeUnready
+		return response, false
+	}
+	return response, true
+}
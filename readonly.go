@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+const (
+	readOnlyKey = "read-only"
+	// unavailableReadOnly is the reason publishes are rejected with while
+	// read-only.
+	unavailableReadOnly = "read_only"
+	// readOnlyRefresh is how soon the other instances sharing the store
+	// notice a toggle.
+	readOnlyRefresh = 5 * time.Second
+)
+
+var errReadOnly = errors.New("the service is read-only")
+
+// readOnlyState is the toggle as it's kept in the store.
+type readOnlyState struct {
+	ReadOnly bool      `json:"read_only"`
+	Reason   string    `json:"reason,omitempty"`
+	By       string    `json:"by,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+// ReadOnly rejects publishes and admin mutations with 503, for maintenance
+// windows and incident containment, while health checks, metrics, reads and
+// consumption carry on. Publishes the service makes itself, for campaigns,
+// publish groups, callbacks and outboxes, fail with an UnavailableError, so
+// they're left for once it's off. It's on if the config sets read_only or an admin
+// toggled it on. The toggle is kept in the store, so with a shared backend
+// it applies to every instance within readOnlyRefresh; with memory it only
+// applies to the instance serving the request.
+type ReadOnly struct {
+	logger     *log.Logger
+	store      Store
+	configured bool
+
+	mu      sync.RWMutex
+	toggled readOnlyState
+}
+
+func newReadOnly(lifecycle fx.Lifecycle, config Config, store Store) *ReadOnly {
+	readOnly := &ReadOnly{logger: newLogger("read-only"), store: store, configured: config.ReadOnly}
+	if readOnly.configured {
+		readOnlyMode.Set(1)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(startCtx context.Context) error {
+				// Read before serving, so a restart doesn't briefly accept
+				// mutations.
+				readOnly.refresh(startCtx)
+				go readOnly.run(ctx, done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				return nil
+			},
+		},
+	)
+	return readOnly
+}
+
+func (r *ReadOnly) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(readOnlyRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.refresh(ctx)
+	}
+}
+
+// refresh reads the toggle from the store, keeping the last known state if
+// it can't.
+func (r *ReadOnly) refresh(ctx context.Context) {
+	var state readOnlyState
+	data, err := r.store.Get(ctx, readOnlyKey)
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		if ctx.Err() == nil {
+			r.logger.Printf("Failed to read the read-only toggle: %v", err)
+		}
+		return
+	}
+	r.set(state)
+}
+
+func (r *ReadOnly) set(state readOnlyState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if state.ReadOnly != r.toggled.ReadOnly {
+		by := state.By
+		if by == "" {
+			by = "an unauthenticated caller"
+		}
+		if state.ReadOnly {
+			r.logger.Printf("Read-only mode turned on by %s: %s", by, state.Reason)
+		} else {
+			r.logger.Printf("Read-only mode turned off by %s", by)
+		}
+	}
+	r.toggled = state
+	if r.configured || state.ReadOnly {
+		readOnlyMode.Set(1)
+	} else {
+		readOnlyMode.Set(0)
+	}
+}
+
+type readOnlyStatus struct {
+	ReadOnly bool `json:"read_only"`
+	// Configured is whether the config sets read_only, which the toggle
+	// can't turn off.
+	Configured bool `json:"configured"`
+	// Toggled is the admin toggle, if it was ever set.
+	Toggled *readOnlyState `json:"toggled,omitempty"`
+}
+
+func (r *ReadOnly) status() readOnlyStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	status := readOnlyStatus{ReadOnly: r.configured || r.toggled.ReadOnly, Configured: r.configured}
+	if !r.toggled.Since.IsZero() {
+		toggled := r.toggled
+		status.Toggled = &toggled
+	}
+	return status
+}
+
+// Enabled reports whether mutations are rejected.
+func (r *ReadOnly) Enabled() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.configured || r.toggled.ReadOnly
+}
+
+// Wrap rejects requests to route while read-only, unless it's safe to
+// serve: reads, and mutating routes marked AllowReadOnly.
+func (r *ReadOnly) Wrap(route Route) http.Handler {
+	switch route.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions:
+		return route.Handler
+	}
+	if route.AllowReadOnly {
+		return route.Handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.Enabled() {
+			route.Handler.ServeHTTP(w, req)
+			return
+		}
+		readOnlyRejections.WithLabelValues(route.Pattern()).Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(unavailableResponse{Error: errReadOnly.Error(), Reason: unavailableReadOnly})
+	})
+}
+
+type readOnlyUpdate struct {
+	ReadOnly bool `json:"read_only"`
+	// Reason is logged and reported with the status, e.g. a maintenance
+	// ticket.
+	Reason string `json:"reason"`
+}
+
+type ReadOnlyHandler struct {
+	readOnly *ReadOnly
+}
+
+func newReadOnlyHandler(readOnly *ReadOnly) *ReadOnlyHandler {
+	return &ReadOnlyHandler{readOnly: readOnly}
+}
+
+func (h *ReadOnlyHandler) Get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.readOnly.status())
+}
+
+// Put toggles read-only mode, for every instance sharing the store.
+func (h *ReadOnlyHandler) Put(w http.ResponseWriter, r *http.Request) {
+	var update readOnlyUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&update); err != nil {
+		http.Error(w, "Invalid update: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !update.ReadOnly && h.readOnly.configured {
+		http.Error(w, "read_only is set in the config", http.StatusConflict)
+		return
+	}
+	state := readOnlyState{ReadOnly: update.ReadOnly, Reason: update.Reason, Since: time.Now().UTC()}
+	if caller, ok := CallerFrom(r.Context()); ok {
+		state.By = caller.Name
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = h.readOnly.store.Set(r.Context(), readOnlyKey, data, 0)
+	}
+	if err != nil {
+		http.Error(w, "Failed to save the toggle: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.readOnly.set(state)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.readOnly.status())
+}
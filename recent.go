@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultRecentSize  = 1000
+	defaultRecentLimit = 100
+	// tailBuffer is how many messages a tail can fall behind by before
+	// it misses some, which it can tell from gaps in the sequence.
+	tailBuffer        = 256
+	tailKeepAlive     = 15 * time.Second
+	recentEventStream = "text/event-stream"
+)
+
+type RecentConfig struct {
+	// Size is how many recently published messages are kept, the newest
+	// replacing the oldest. Defaults to 1000; set a negative value to keep
+	// none.
+	Size int `yaml:"size"`
+	// Bodies keeps the start of each payload as well as its metadata.
+	Bodies bool `yaml:"bodies"`
+	// RedactFields are JSON object keys whose values are replaced, at any
+	// depth, in the bodies kept, e.g. email or password. With any set,
+	// bodies that aren't JSON aren't kept.
+	RedactFields []string `yaml:"redact_fields"`
+}
+
+type recentMessage struct {
+	// Sequence numbers every publish this instance has made, so a tail can
+	// tell when it missed some.
+	Sequence    uint64            `json:"sequence"`
+	Topic       string            `json:"topic"`
+	MessageId   string            `json:"message_id,omitempty"`
+	PublishedAt time.Time         `json:"published_at"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Size        int               `json:"size"`
+	Error       string            `json:"error,omitempty"`
+	// Preview is the start of the payload, with RedactFields replaced,
+	// when bodies are kept.
+	Preview   string `json:"preview,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// RecentMessages is a ring buffer of what this instance has published
+// lately, for seeing what the service is emitting without a subscription.
+type RecentMessages struct {
+	config RecentConfig
+	redact map[string]bool
+
+	mu       sync.Mutex
+	messages []recentMessage
+	// next is the index the next message is written to, and sequence the
+	// number it gets.
+	next     int
+	sequence uint64
+	tails    map[chan recentMessage]bool
+	closed   bool
+}
+
+func newRecentMessages(config Config) *RecentMessages {
+	recent := &RecentMessages{config: config.Recent, tails: make(map[chan recentMessage]bool)}
+	if recent.config.Size > 0 {
+		recent.messages = make([]recentMessage, 0, recent.config.Size)
+	}
+	if len(recent.config.RedactFields) > 0 {
+		recent.redact = make(map[string]bool, len(recent.config.RedactFields))
+		for _, field := range recent.config.RedactFields {
+			recent.redact[field] = true
+		}
+	}
+	return recent
+}
+
+// Record keeps a publish of msg to topic, whether or not it succeeded, and
+// sends it to every tail that's keeping up.
+func (r *RecentMessages) Record(topic string, msg *pubsub.Message, messageId string, err error) {
+	if r.config.Size <= 0 {
+		return
+	}
+	recent := recentMessage{
+		Topic:       topic,
+		MessageId:   messageId,
+		PublishedAt: time.Now().UTC(),
+		OrderingKey: msg.OrderingKey,
+		Attributes:  msg.Attributes,
+		Size:        len(msg.Data),
+	}
+	if err != nil {
+		recent.Error = err.Error()
+	}
+	if r.config.Bodies {
+		if data, ok := r.redacted(msg.Data); ok {
+			recent.Preview, recent.Encoding, recent.Truncated = previewData(data)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sequence++
+	recent.Sequence = r.sequence
+	if len(r.messages) < r.config.Size {
+		r.messages = append(r.messages, recent)
+	} else {
+		r.messages[r.next] = recent
+	}
+	r.next = (r.next + 1) % r.config.Size
+	for tail := range r.tails {
+		select {
+		case tail <- recent:
+		default:
+		}
+	}
+}
+
+// redacted returns data with the redacted fields replaced, or false if it
+// can't be redacted.
+func (r *RecentMessages) redacted(data []byte) ([]byte, bool) {
+	if r.redact == nil {
+		return data, true
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, false
+	}
+	redacted, err := json.Marshal(r.redactValue(value))
+	return redacted, err == nil
+}
+
+func (r *RecentMessages) redactValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if r.redact[key] {
+				value[key] = redacted
+			} else {
+				value[key] = r.redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, element := range value {
+			value[i] = r.redactValue(element)
+		}
+	}
+	return value
+}
+
+// List returns up to limit of the kept messages, newest first, only those
+// published to topic if it's set.
+func (r *RecentMessages) List(topic string, limit int) []recentMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	messages := []recentMessage{}
+	for i := 0; i < len(r.messages) && len(messages) < limit; i++ {
+		// Walk back from the newest, wrapping around.
+		recent := r.messages[(r.next-1-i+2*len(r.messages))%len(r.messages)]
+		if topic == "" || recent.Topic == topic {
+			messages = append(messages, recent)
+		}
+	}
+	return messages
+}
+
+// tail returns a channel receiving every message published from now on,
+// until untail, or closeTails closes it.
+func (r *RecentMessages) tail() (chan recentMessage, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, false
+	}
+	tail := make(chan recentMessage, tailBuffer)
+	r.tails[tail] = true
+	recentTails.Inc()
+	return tail, true
+}
+
+func (r *RecentMessages) untail(tail chan recentMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tails[tail] {
+		delete(r.tails, tail)
+		close(tail)
+		recentTails.Dec()
+	}
+}
+
+// closeTails ends every tail, so open streams don't hold up the HTTP
+// server's shutdown.
+func (r *RecentMessages) closeTails() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for tail := range r.tails {
+		delete(r.tails, tail)
+		close(tail)
+		recentTails.Dec()
+	}
+}
+
+type RecentHandler struct {
+	recent *RecentMessages
+}
+
+func newRecentHandler(recent *RecentMessages) *RecentHandler {
+	return &RecentHandler{recent: recent}
+}
+
+func (h *RecentHandler) List(w http.ResponseWriter, r *http.Request) {
+	limit := defaultRecentLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.recent.List(r.URL.Query().Get("topic"), limit))
+}
+
+// Tail streams messages as they're published, as Server-Sent Events with
+// the sequence as the event ID, until the client goes away.
+func (h *RecentHandler) Tail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+	tail, ok := h.recent.tail()
+	if !ok {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.recent.untail(tail)
+	topic := r.URL.Query().Get("topic")
+
+	w.Header().Set("Content-Type", recentEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case recent, ok := <-tail:
+			if !ok {
+				return
+			}
+			if topic != "" && recent.Topic != topic {
+				continue
+			}
+			data, err := json.Marshal(recent)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: publish\ndata: %s\n\n", recent.Sequence, data)
+		case <-keepAlive.C:
+			// A comment, so proxies don't close an idle stream.
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
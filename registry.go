@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type RegisteredTopic struct {
+	Config TopicConfig
+
+	exists *TopicExistsCache
+	// swapping serializes swaps, so a handle from a client that was
+	// rotated out can't replace one from its successor.
+	swapping sync.Mutex
+	// draining counts the replaced handles still flushing.
+	draining sync.WaitGroup
+	mu       sync.RWMutex
+	// client is the client handles are created from, replaced when the
+	// client is rotated.
+	client      *pubsub.Client
+	topic       *pubsub.Topic
+	secondary   *pubsub.Topic
+	orderingKey []jsonPathSegment
+	transform   Transform
+	attributes  AttributeCheck
+	batcher     *AdaptiveBatcher
+	failover    *Failover
+	breaker     *CircuitBreaker
+	hedger      *Hedger
+	bulkhead    *Bulkhead
+	outbox      *Outbox
+	recent      *RecentMessages
+	usage       *UsageLedger
+	readOnly    *ReadOnly
+	sampler     *DebugSampler
+	deletion    topicDeletion
+
+	// lanes are the handles of the priority lanes with topics of their
+	// own, swapped along with topic.
+	lanes         map[string]*pubsub.Topic
+	priorityField []jsonPathSegment
+}
+
+// Handle returns the topic handle currently used for publishing. Adaptive
+// batching may replace it at any time, so callers shouldn't hold on to it.
+func (t *RegisteredTopic) Handle() *pubsub.Topic {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.topic
+}
+
+// currentClient returns the client the topic's handles are created from.
+func (t *RegisteredTopic) currentClient() *pubsub.Client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.client
+}
+
+// Ordered reports whether messages to the topic carry ordering keys.
+func (t *RegisteredTopic) Ordered() bool {
+	return t.orderingKey != nil
+}
+
+// Transform applies the topic's configured transforms to msg.
+func (t *RegisteredTopic) Transform(msg *pubsub.Message) error {
+	if t.transform == nil {
+		return nil
+	}
+	return t.transform(msg)
+}
+
+// CheckAttributes applies the configured attribute policies to the
+// attributes of a message about to be published.
+func (t *RegisteredTopic) CheckAttributes(attributes map[string]string) error {
+	if t.attributes == nil {
+		return nil
+	}
+	return t.attributes(attributes)
+}
+
+// OrderingKeyFor derives the ordering key for data from the topic's
+// configured field, returning "" when none is configured or it's absent.
+func (t *RegisteredTopic) OrderingKeyFor(data []byte) string {
+	if t.orderingKey == nil {
+		return ""
+	}
+	key, _ := extractJSONPath(data, t.orderingKey)
+	return key
+}
+
+// stampPriority sets msg's priority attribute to the lane it's published
+// in, from the attribute or the payload's priority field.
+func (t *RegisteredTopic) stampPriority(msg *pubsub.Message) string {
+	priority := t.Config.Priority
+	value, ok := msg.Attributes[priority.Attribute]
+	if !ok && t.priorityField != nil {
+		value, _ = extractJSONPath(msg.Data, t.priorityField)
+	}
+	lane := priority.Default
+	if priorityLanes[value] {
+		lane = value
+	}
+	if msg.Attributes == nil {
+		msg.Attributes = make(map[string]string, 1)
+	}
+	msg.Attributes[priority.Attribute] = lane
+	return lane
+}
+
+// Publish publishes msg and waits for the server to assign it an ID. With
+// failover configured, the message that trips the failover is retried on
+// the secondary.
+//
+// Publishes rejected by flow control, an open circuit breaker or the
+// topic's concurrency limit, or while the topic is deleted or the service
+// read-only, fail with an
+// UnavailableError without waiting. With the spill shedding policy, those
+// flow control rejects are saved to the outbox instead, failing with a
+// SpilledError.
+func (t *RegisteredTopic) Publish(ctx context.Context, msg *pubsub.Message) (string, error) {
+	messageId, err := t.send(ctx, msg)
+	var unavailable *UnavailableError
+	if errors.As(err, &unavailable) && unavailable.Reason == unavailableFlowControl {
+		if t.outbox != nil {
+			return t.outbox.spill(ctx, msg, unavailable.Err)
+		}
+		publishShed.WithLabelValues(t.Config.Name, sheddingReject).Inc()
+	}
+	return messageId, err
+}
+
+// send is Publish without shedding to the outbox.
+func (t *RegisteredTopic) send(ctx context.Context, msg *pubsub.Message) (string, error) {
+	if t.readOnly != nil && t.readOnly.Enabled() {
+		return "", &UnavailableError{Reason: unavailableReadOnly, RetryAfter: readOnlyRefresh, Err: errReadOnly}
+	}
+	if err := t.bulkhead.acquire(); err != nil {
+		return "", err
+	}
+	defer t.bulkhead.release()
+	if err := t.checkDeleted(ctx); err != nil {
+		return "", err
+	}
+	if t.Config.Priority != nil {
+		priorityMessages.WithLabelValues(t.Config.Name, t.stampPriority(msg)).Inc()
+	}
+	if retryAfter, err := googleCredentials.allow(); err != nil {
+		return "", &UnavailableError{Reason: unavailableAuth, RetryAfter: retryAfter, Err: err}
+	}
+	if t.breaker != nil {
+		if retryAfter, ok := t.breaker.allow(); !ok {
+			return "", &UnavailableError{Reason: unavailableCircuitOpen, RetryAfter: retryAfter, Err: errCircuitOpen}
+		}
+	}
+	messageId, err := t.publishWithFailover(ctx, msg)
+	t.recent.Record(t.Config.Name, msg, messageId, err)
+	if err == nil {
+		t.usage.Record(ctx, t.Config.Name, msg)
+	}
+	if t.sampler != nil && err == nil {
+		t.sampler.Sample(msg, messageId)
+	}
+	googleCredentials.record(err)
+	if t.breaker != nil {
+		// Failing credentials say nothing about the topic.
+		t.breaker.record(err, ctx.Err() != nil || isAuthError(err))
+	}
+	if isFlowControlError(err) {
+		return "", &UnavailableError{Reason: unavailableFlowControl, RetryAfter: t.Config.FlowControl.RetryAfter, Err: err}
+	}
+	if isAuthError(err) {
+		return "", &UnavailableError{Reason: unavailableAuth, RetryAfter: credentialsProbeInterval, Err: err}
+	}
+	if t.Deleted() && status.Code(err) == codes.NotFound {
+		return "", t.deletedError(err)
+	}
+	return messageId, err
+}
+
+func (t *RegisteredTopic) publishWithFailover(ctx context.Context, msg *pubsub.Message) (string, error) {
+	if t.failover == nil {
+		return t.publish(ctx, msg, publishTargetPrimary)
+	}
+	target := t.failover.target()
+	messageId, err := t.publish(ctx, msg, target)
+	if target == publishTargetPrimary {
+		if err == nil {
+			t.failover.recordSuccess()
+		} else if ctx.Err() == nil && !isFlowControlError(err) && t.failover.recordFailure(t, err) {
+			return t.publish(ctx, msg, publishTargetSecondary)
+		}
+	}
+	return messageId, err
+}
+
+func (t *RegisteredTopic) publish(ctx context.Context, msg *pubsub.Message, target string) (string, error) {
+	// The read lock is only held while the message is enqueued, so swap can't
+	// stop a handle that is still accepting this message.
+	t.mu.RLock()
+	topic := t.topic
+	if target == publishTargetSecondary {
+		topic = t.secondary
+	} else if lane, ok := t.lanes[msg.Attributes[t.priorityAttribute()]]; ok {
+		topic = lane
+	}
+	hedged := t.hedger != nil && msg.OrderingKey == ""
+	if hedged {
+		t.hedger.stamp(msg)
+	}
+	started := time.Now()
+	result := topic.Publish(ctx, msg)
+	t.mu.RUnlock()
+	var (
+		messageId string
+		err       error
+	)
+	if hedged {
+		messageId, err = t.hedger.get(ctx, result, func() *pubsub.PublishResult {
+			return topic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: msg.Attributes})
+		})
+	} else {
+		messageId, err = result.Get(ctx)
+	}
+	latency := time.Since(started)
+	if err != nil {
+		publishLatency.WithLabelValues(t.Config.Name, "error").Observe(latency.Seconds())
+		t.exists.invalidateOnNotFound(topic, err)
+		if status.Code(err) == codes.NotFound && target == publishTargetPrimary && topic.ID() == t.Config.Id {
+			t.markDeleted()
+		}
+		if msg.OrderingKey != "" {
+			// A failed publish pauses its ordering key until resumed.
+			topic.ResumePublish(msg.OrderingKey)
+		}
+		return "", err
+	}
+	publishLatency.WithLabelValues(t.Config.Name, "ok").Observe(latency.Seconds())
+	publishTargetMessages.WithLabelValues(t.Config.Name, target).Inc()
+	if t.batcher != nil {
+		t.batcher.observe(latency)
+	}
+	return messageId, nil
+}
+
+// swap replaces the publishing handle with one using settings and flushes
+// the previous handle in the background.
+func (t *RegisteredTopic) swap(settings pubsub.PublishSettings) {
+	t.swapping.Lock()
+	defer t.swapping.Unlock()
+	t.Config.Publish.apply(&settings)
+	t.Config.FlowControl.apply(&settings)
+	t.Config.Isolation.apply(&settings)
+	client := t.currentClient()
+	topic := client.Topic(t.Config.Id)
+	topic.PublishSettings = settings
+	topic.EnableMessageOrdering = t.Ordered()
+	var secondary *pubsub.Topic
+	if t.failover != nil {
+		secondary = t.failover.client.Topic(t.failover.config.Topic)
+		secondary.PublishSettings = settings
+		secondary.EnableMessageOrdering = t.Ordered()
+	}
+	var lanes map[string]*pubsub.Topic
+	if t.Config.Priority != nil && len(t.Config.Priority.Topics) > 0 {
+		lanes = make(map[string]*pubsub.Topic, len(t.Config.Priority.Topics))
+		for lane, id := range t.Config.Priority.Topics {
+			handle := client.Topic(id)
+			handle.PublishSettings = settings
+			handle.EnableMessageOrdering = t.Ordered()
+			lanes[lane] = handle
+		}
+	}
+	t.mu.Lock()
+	previous, previousSecondary, previousLanes := t.topic, t.secondary, t.lanes
+	t.topic, t.secondary, t.lanes = topic, secondary, lanes
+	t.mu.Unlock()
+	for _, handle := range []*pubsub.Topic{previous, previousSecondary} {
+		if handle != nil {
+			t.drain(handle)
+		}
+	}
+	for _, handle := range previousLanes {
+		t.drain(handle)
+	}
+}
+
+// drain flushes a replaced handle in the background.
+func (t *RegisteredTopic) drain(handle *pubsub.Topic) {
+	t.draining.Add(1)
+	go func() {
+		defer t.draining.Done()
+		handle.Stop()
+	}()
+}
+
+// rotate moves publishing to handles from client, once the handles from
+// the previous client have been flushed.
+func (t *RegisteredTopic) rotate(client *pubsub.Client) {
+	settings := pubsub.DefaultPublishSettings
+	if t.batcher != nil {
+		settings = t.batcher.settings()
+	}
+	t.mu.Lock()
+	t.client = client
+	t.mu.Unlock()
+	t.swap(settings)
+}
+
+// priorityAttribute is the attribute carrying the lane messages are
+// published in, or "" without priority lanes.
+func (t *RegisteredTopic) priorityAttribute() string {
+	if t.Config.Priority == nil {
+		return ""
+	}
+	return t.Config.Priority.Attribute
+}
+
+// stop flushes the topic's current handles.
+func (t *RegisteredTopic) stop() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	t.topic.Stop()
+	if t.secondary != nil {
+		t.secondary.Stop()
+	}
+	for _, lane := range t.lanes {
+		lane.Stop()
+	}
+	if t.sampler != nil {
+		t.sampler.stop()
+	}
+}
+
+type TopicRegistry struct {
+	logger *log.Logger
+	topics map[string]*RegisteredTopic
+	// secondaries holds the failover clients, by project and endpoint.
+	secondaries map[[2]string]*pubsub.Client
+}
+
+func newTopicRegistry(lifecycle fx.Lifecycle, config Config, client *pubsub.Client, params PubSubParams, exists *TopicExistsCache, recent *RecentMessages, usage *UsageLedger, readOnly *ReadOnly, store Store) *TopicRegistry {
+	registry := &TopicRegistry{
+		logger:      newLogger("registry"),
+		topics:      make(map[string]*RegisteredTopic, len(config.Topics)),
+		secondaries: make(map[[2]string]*pubsub.Client),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	lifecycle.Append(
+		fx.Hook{
+			// Topic handles can only be created once the client has
+			// connected, which happens in its own OnStart hook.
+			OnStart: func(startCtx context.Context) error {
+				for _, topicConfig := range config.Topics {
+					registered := &RegisteredTopic{
+						Config: topicConfig,
+						client: client,
+						exists: exists,
+						recent: recent,
+						usage:  usage,
+						// Checked on every publish, so the service's own
+						// publishes stop too.
+						readOnly: readOnly,
+						// Flow control and the circuit breaker are per
+						// topic too, as each has its own handle.
+						bulkhead: newBulkhead(topicConfig.Name, topicConfig.Isolation),
+					}
+					if topicConfig.OrderingKey != "" {
+						registered.orderingKey, _ = parseJSONPath(topicConfig.OrderingKey)
+					}
+					if topicConfig.Priority != nil && topicConfig.Priority.Field != "" {
+						registered.priorityField, _ = parseJSONPath(topicConfig.Priority.Field)
+					}
+					if len(topicConfig.Transforms) > 0 {
+						registered.transform, _ = compileTransforms(topicConfig.Transforms)
+					}
+					registered.attributes, _ = compileAttributePolicies(config.AttributePolicy, topicConfig.AttributePolicy)
+					if topicConfig.DebugSample != nil {
+						registered.sampler = newDebugSampler(client, topicConfig)
+					}
+					if topicConfig.CircuitBreaker != nil {
+						registered.breaker = newCircuitBreaker(topicConfig.Name, *topicConfig.CircuitBreaker)
+					}
+					if topicConfig.Hedge != nil {
+						registered.hedger = newHedger(topicConfig.Name, *topicConfig.Hedge)
+					}
+					settings := pubsub.DefaultPublishSettings
+					if topicConfig.AdaptiveBatching != nil {
+						registered.batcher = newAdaptiveBatcher(registered, *topicConfig.AdaptiveBatching)
+						settings = registered.batcher.settings()
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							registered.batcher.run(ctx)
+						}()
+					}
+					if failoverConfig := topicConfig.Failover; failoverConfig != nil {
+						secondary, err := registry.secondaryClient(startCtx, params, *failoverConfig)
+						if err != nil {
+							return fmt.Errorf("topic %s: failover client: %w", topicConfig.Name, err)
+						}
+						registered.failover = &Failover{config: *failoverConfig, client: secondary}
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							registered.failover.probe(ctx, registered)
+						}()
+					}
+					if flowControl := topicConfig.FlowControl; flowControl != nil && flowControl.Shedding == sheddingSpill {
+						registered.outbox = newOutbox(registered, store)
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							registered.outbox.run(ctx)
+						}()
+					}
+					registered.swap(settings)
+					registry.topics[topicConfig.Name] = registered
+					registry.logger.Printf("Registered topic %s (%s)", topicConfig.Name, topicConfig.Id)
+				}
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				wg.Wait()
+				for _, registered := range registry.topics {
+					registered.stop()
+				}
+				for _, secondary := range registry.secondaries {
+					secondary.Close()
+				}
+				return nil
+			},
+		},
+	)
+	return registry
+}
+
+func (r *TopicRegistry) secondaryClient(ctx context.Context, params PubSubParams, config FailoverConfig) (*pubsub.Client, error) {
+	key := [2]string{config.Project, config.Endpoint}
+	if client, ok := r.secondaries[key]; ok {
+		return client, nil
+	}
+	options := append(params.clientOptions(), publishRPCOption)
+	if config.Endpoint != "" {
+		options = append(options, option.WithEndpoint(config.Endpoint))
+	}
+	client, err := pubsub.NewClient(ctx, config.Project, options...)
+	if err != nil {
+		return nil, err
+	}
+	r.secondaries[key] = client
+	return client, nil
+}
+
+func (r *TopicRegistry) Lookup(name string) (*RegisteredTopic, bool) {
+	registered, ok := r.topics[name]
+	return registered, ok
+}
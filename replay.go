@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+)
+
+// Attributes stamped on the messages the replay command republishes. A
+// replay resends a message into the same flow, so its lineage is kept as
+// is.
+const (
+	isReplayAttribute          = "is_replay"
+	replayedMessageIdAttribute = "replayed_message_id"
+	replayedPublishedAttribute = "replayed_published_at"
+	// replayTransformedAttribute names the function that fixed a message
+	// replayed with -transform.
+	replayTransformedAttribute = "replay_transformed_by"
+)
+
+type replayResult struct {
+	Replayed int `json:"replayed"`
+	// Resumed are messages an earlier, interrupted run already replayed.
+	Resumed int `json:"resumed"`
+	// OutOfRange are messages published after the end of the range, or
+	// before its start, which are acked without replaying.
+	OutOfRange int `json:"out_of_range"`
+	Failed     int `json:"failed"`
+	// Transformed are the replayed messages run through -transform, and
+	// Filtered those it dropped, which are acked without replaying.
+	Transformed int `json:"transformed,omitempty"`
+	Filtered    int `json:"filtered,omitempty"`
+	// Previewed are the messages shown by a -dry-run.
+	Previewed int `json:"previewed,omitempty"`
+}
+
+// replayPreview is what -dry-run shows of each message it would replay.
+type replayPreview struct {
+	MessageId string      `json:"message_id"`
+	Original  restMessage `json:"original"`
+	// Transformed is the message as it would be replayed, unless the
+	// transform dropped it or failed.
+	Transformed *restMessage `json:"transformed,omitempty"`
+	Filtered    bool         `json:"filtered,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// replayTransform fixes messages forward as they're replayed, with a
+// JavaScript UDF run by the same Pub/Sub engine as single message
+// transforms.
+type replayTransform struct {
+	client     *TransformClient
+	transforms []messageTransform
+}
+
+// apply returns msg as transformed, or nil if the UDF dropped it by
+// returning null.
+func (t *replayTransform) apply(ctx context.Context, msg *pubsub.Message) (*restMessage, error) {
+	steps, err := t.client.Test(ctx, t.transforms, restMessage{Data: msg.Data, Attributes: msg.Attributes})
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("the transform returned no result")
+	}
+	last := steps[len(steps)-1]
+	if last.FailureReason != "" {
+		return nil, fmt.Errorf("the transform failed: %s", last.FailureReason)
+	}
+	return last.TransformedMessage, nil
+}
+
+func (t *replayTransform) function() string {
+	return t.transforms[len(t.transforms)-1].JavaScriptUDF.FunctionName
+}
+
+// replayCheckpoint is what the replay command saves to its state file, so
+// a run that's interrupted can be started again without republishing what
+// it already had.
+type replayCheckpoint struct {
+	Subscription string    `json:"subscription"`
+	Topic        string    `json:"topic"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	// Replayed are the IDs of the source messages republished so far.
+	Replayed  []string  `json:"replayed"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type replayOptions struct {
+	subscription string
+	to           string
+	start        time.Time
+	end          time.Time
+	idle         time.Duration
+	progress     time.Duration
+	state        string
+	transform    *replayTransform
+	// dryRun previews up to preview messages, transformed, on stdout
+	// without publishing or acking anything.
+	dryRun  bool
+	preview int
+}
+
+// readReplayCheckpoint reads the state file at path, or returns nil if
+// there isn't one yet.
+func readReplayCheckpoint(path string) (*replayCheckpoint, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var checkpoint replayCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &checkpoint, nil
+}
+
+// save writes the checkpoint through a temporary file, so one interrupted
+// mid-write doesn't lose the last.
+func (c replayCheckpoint) save(path string) error {
+	c.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// replayMessages seeks the replay subscription to the start of the range
+// and republishes every message published within it to the destination,
+// acking each once its copy is published. Messages outside the range are
+// acked and left, so the subscription must be dedicated to replays. It
+// stops once no message within the range has arrived for the idle period.
+//
+// With a transform, each message is republished as the transform returns
+// it. Messages it fails on are left on the subscription like those that
+// fail to publish. A dry run writes a replayPreview of each message to
+// stdout instead, nacking everything, and stops early once it has shown
+// the preview number.
+func replayMessages(ctx context.Context, source *pubsub.Subscription, destination *pubsub.Topic, options replayOptions, logger *log.Logger) (replayResult, error) {
+	checkpoint := replayCheckpoint{Subscription: options.subscription, Topic: options.to, Start: options.start, End: options.end}
+	saved, err := readReplayCheckpoint(options.state)
+	if err != nil {
+		return replayResult{}, err
+	}
+	if saved != nil {
+		if saved.Subscription != checkpoint.Subscription || saved.Topic != checkpoint.Topic || !saved.Start.Equal(checkpoint.Start) || !saved.End.Equal(checkpoint.End) {
+			return replayResult{}, fmt.Errorf("%s is the state of a replay from %s to %s between %s and %s; use another -state file", options.state, saved.Subscription, saved.Topic, saved.Start.Format(time.RFC3339), saved.End.Format(time.RFC3339))
+		}
+		checkpoint = *saved
+	}
+	replayed := make(map[string]bool, len(checkpoint.Replayed))
+	for _, id := range checkpoint.Replayed {
+		replayed[id] = true
+	}
+	if len(replayed) > 0 {
+		logger.Printf("Resuming a replay that republished %d messages, last saved at %s", len(replayed), checkpoint.UpdatedAt.Format(time.RFC3339))
+	}
+	var (
+		mu     sync.Mutex
+		result replayResult
+		// failed are left on the subscription for another run, and don't
+		// count as activity when they come back.
+		failed = make(map[string]bool)
+	)
+	save := func() {
+		if options.state == "" || options.dryRun {
+			return
+		}
+		mu.Lock()
+		saved := checkpoint
+		saved.Replayed = make([]string, 0, len(replayed))
+		for id := range replayed {
+			saved.Replayed = append(saved.Replayed, id)
+		}
+		mu.Unlock()
+		if err := saved.save(options.state); err != nil {
+			logger.Printf("Failed to save the replay state to %s: %v", options.state, err)
+		}
+	}
+
+	if err := source.SeekToTime(ctx, options.start); err != nil {
+		return result, fmt.Errorf("seeking %s to %s: %w", source.ID(), options.start.Format(time.RFC3339), err)
+	}
+	logger.Printf("Seeked %s to %s, replaying until %s", source.ID(), options.start.Format(time.RFC3339), options.end.Format(time.RFC3339))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lastSeen := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		lastProgress := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			idle := time.Since(lastSeen) >= options.idle
+			progress := result
+			mu.Unlock()
+			if time.Since(lastProgress) >= options.progress {
+				lastProgress = time.Now()
+				logger.Printf("Replayed %d messages, %d out of range, %d failed", progress.Replayed, progress.OutOfRange, progress.Failed)
+				save()
+			}
+			if idle {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	var (
+		previews = json.NewEncoder(os.Stdout)
+		// previewed are the messages a dry run has shown, which are nacked
+		// and come back.
+		previewed = make(map[string]bool)
+	)
+	err = source.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		if msg.PublishTime.Before(options.start) || msg.PublishTime.After(options.end) {
+			result.OutOfRange++
+			mu.Unlock()
+			if options.dryRun {
+				msg.Nack()
+			} else {
+				msg.Ack()
+			}
+			return
+		}
+		if options.dryRun && (previewed[msg.ID] || result.Previewed >= options.preview) {
+			mu.Unlock()
+			msg.Nack()
+			return
+		}
+		if failed[msg.ID] {
+			mu.Unlock()
+			msg.Nack()
+			return
+		}
+		lastSeen = time.Now()
+		if replayed[msg.ID] {
+			result.Resumed++
+			mu.Unlock()
+			msg.Ack()
+			return
+		}
+		if options.dryRun {
+			previewed[msg.ID] = true
+			result.Previewed++
+			if result.Previewed >= options.preview {
+				cancel()
+			}
+		}
+		mu.Unlock()
+
+		data, original := msg.Data, msg.Attributes
+		var (
+			transformed *restMessage
+			err         error
+		)
+		if options.transform != nil {
+			transformed, err = options.transform.apply(context.WithoutCancel(ctx), msg)
+			if err == nil && transformed != nil {
+				data, original = transformed.Data, transformed.Attributes
+			}
+		} else {
+			transformed = &restMessage{Data: msg.Data, Attributes: msg.Attributes}
+		}
+		if options.dryRun {
+			preview := replayPreview{MessageId: msg.ID, Original: restMessage{Data: msg.Data, Attributes: msg.Attributes}, Transformed: transformed, Filtered: err == nil && transformed == nil}
+			if err != nil {
+				preview.Error = err.Error()
+			}
+			mu.Lock()
+			previews.Encode(preview)
+			mu.Unlock()
+			msg.Nack()
+			return
+		}
+		if err != nil || transformed == nil {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.Printf("Failed to transform message %s: %v", msg.ID, err)
+				failed[msg.ID] = true
+				result.Failed++
+				msg.Nack()
+				return
+			}
+			// Dropped by the transform, which counts as replayed, so a
+			// resumed run doesn't transform it again.
+			replayed[msg.ID] = true
+			result.Filtered++
+			msg.Ack()
+			return
+		}
+
+		attributes := make(map[string]string, len(original)+4)
+		for key, value := range original {
+			attributes[key] = value
+		}
+		if options.transform != nil {
+			attributes[replayTransformedAttribute] = options.transform.function()
+		}
+		attributes[isReplayAttribute] = "true"
+		attributes[replayedMessageIdAttribute] = msg.ID
+		attributes[replayedPublishedAttribute] = msg.PublishTime.UTC().Format(time.RFC3339Nano)
+		// Publishing isn't cancelled with the receive once the replay goes
+		// idle, so a copy that was sent is always recorded and acked.
+		publishCtx := context.WithoutCancel(ctx)
+		_, err = destination.Publish(publishCtx, &pubsub.Message{Data: data, Attributes: attributes, OrderingKey: msg.OrderingKey}).Get(publishCtx)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			logger.Printf("Failed to replay message %s: %v", msg.ID, err)
+			failed[msg.ID] = true
+			result.Failed++
+			if msg.OrderingKey != "" {
+				destination.ResumePublish(msg.OrderingKey)
+			}
+			msg.Nack()
+			return
+		}
+		replayed[msg.ID] = true
+		result.Replayed++
+		if options.transform != nil {
+			result.Transformed++
+		}
+		msg.Ack()
+	})
+	cancel()
+	<-done
+	save()
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	return result, err
+}
+
+// parseReplayTime parses an RFC 3339 timestamp, or a duration before now
+// such as 2h.
+func parseReplayTime(value string, now time.Time) (time.Time, error) {
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func replayCommand(logger *log.Logger) fx.Option {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	var options replayOptions
+	flags.StringVar(&options.subscription, "subscription", "", "replay subscription ID, dedicated to replays, on the topic to replay from")
+	flags.StringVar(&options.to, "to", "", "topic ID to republish to")
+	start := flags.String("start", "", "publish time to replay from, as RFC 3339 or a duration ago such as 2h; defaults to the -state file's")
+	end := flags.String("end", "", "publish time to replay until, as RFC 3339 or a duration ago; defaults to the -state file's, then now")
+	flags.DurationVar(&options.idle, "idle", 30*time.Second, "stop once no message within the range has arrived for this long")
+	flags.DurationVar(&options.progress, "progress", 10*time.Second, "how often to report progress and save the state")
+	flags.StringVar(&options.state, "state", "", "file to save progress to; run again with the same -subscription, -to and file to resume")
+	transformPath := flags.String("transform", "", "JavaScript file with a UDF to fix each message with before it's replayed, run like a single message transform")
+	transformFunction := flags.String("transform-function", "transform", "name of the -transform UDF")
+	flags.BoolVar(&options.dryRun, "dry-run", false, "print messages as they would be replayed, transformed, without publishing or acking anything")
+	flags.IntVar(&options.preview, "preview", 20, "how many messages a -dry-run shows")
+	flags.Parse(commandArgs)
+	if options.subscription == "" || options.to == "" {
+		logger.Fatal("replay needs -subscription and -to")
+	}
+	if options.dryRun && options.preview <= 0 {
+		logger.Fatal("-preview must be positive")
+	}
+	var transforms []messageTransform
+	if *transformPath != "" {
+		var err error
+		transforms, err = messageTransforms([]MessageTransformConfig{{FunctionName: *transformFunction, CodePath: *transformPath}})
+		if err != nil {
+			logger.Fatalf("Invalid -transform: %v", err)
+		}
+	}
+	saved, err := readReplayCheckpoint(options.state)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	now := time.Now().UTC()
+	switch {
+	case *start != "":
+		if options.start, err = parseReplayTime(*start, now); err != nil {
+			logger.Fatalf("Invalid -start: %v", err)
+		}
+	case saved != nil:
+		options.start = saved.Start
+	default:
+		logger.Fatal("replay needs -start")
+	}
+	switch {
+	case *end != "":
+		if options.end, err = parseReplayTime(*end, now); err != nil {
+			logger.Fatalf("Invalid -end: %v", err)
+		}
+	case saved != nil:
+		options.end = saved.End
+	default:
+		options.end = now
+	}
+	if !options.start.Before(options.end) {
+		logger.Fatal("-start must be before -end")
+	}
+
+	return fx.Options(
+		fx.Provide(newPubSubParams(logger), newPubSubClient),
+		fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, client *pubsub.Client, params PubSubParams) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				if transforms != nil {
+					transformClient, err := newTransformClient(params)
+					if err != nil {
+						return err
+					}
+					if err := transformClient.Validate(ctx, transforms[0]); err != nil {
+						return fmt.Errorf("invalid -transform: %w", err)
+					}
+					options.transform = &replayTransform{client: transformClient, transforms: transforms}
+				}
+
+				source := client.Subscription(options.subscription)
+				sourceConfig, err := source.Config(ctx)
+				if err != nil {
+					return fmt.Errorf("subscription %s: %w", options.subscription, err)
+				}
+				if sourceConfig.Topic != nil && sourceConfig.Topic.ID() == options.to && options.end.After(time.Now()) {
+					return fmt.Errorf("replaying %s into its own topic until %s would replay the replayed messages again", options.subscription, options.end.Format(time.RFC3339))
+				}
+				if retention := sourceConfig.RetentionDuration; retention > 0 && options.start.Before(time.Now().Add(-retention)) {
+					logger.Printf("Warning: %s only retains messages for %s, so those published before %s are gone", options.subscription, retention, time.Now().Add(-retention).Format(time.RFC3339))
+				}
+				if !sourceConfig.RetainAckedMessages {
+					logger.Printf("Warning: %s doesn't retain acked messages, so only those still unacked can be replayed", options.subscription)
+				}
+
+				destination := client.Topic(options.to)
+				destination.EnableMessageOrdering = true
+				defer destination.Stop()
+				exists, err := destination.Exists(ctx)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					return fmt.Errorf("topic %s does not exist", options.to)
+				}
+
+				result, err := replayMessages(ctx, source, destination, options, logger)
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				encoder.Encode(result)
+				if err != nil {
+					return err
+				}
+				if result.Failed > 0 {
+					return fmt.Errorf("%d messages failed to replay; run again to retry them", result.Failed)
+				}
+				return nil
+			})
+		}),
+	)
+}
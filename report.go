@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+	"go.uber.org/fx"
+)
+
+const (
+	reportPeriodDaily  = "daily"
+	reportPeriodWeekly = "weekly"
+
+	reportFormatJSON = "json"
+	reportFormatCSV  = "csv"
+
+	// defaultPricePerTiB is Pub/Sub's list price for message throughput, in
+	// USD per TiB.
+	defaultPricePerTiB = 40
+	// minBillableBytes is the least Pub/Sub bills a message for.
+	minBillableBytes = 1000
+
+	usageLedgerKeyPrefix = "usage-ledger/"
+	reportKeyPrefix      = "usage-reports/"
+	// usageLedgerRetention is how long a day's counts are kept, long enough
+	// for the weekly report of the week it's in.
+	usageLedgerRetention = 9 * 24 * time.Hour
+	// reportCheckInterval is how often the reporter checks whether a period
+	// has ended that hasn't been reported.
+	reportCheckInterval = 5 * time.Minute
+
+	// anonymousCaller is who publishes without an API key are counted
+	// against.
+	anonymousCaller = "anonymous"
+)
+
+// ReportsConfig generates usage and cost reports: what each topic had
+// published, by API key, with an estimate of what Pub/Sub bills for it.
+// Publishes are counted per day in the store, so with the redis or
+// firestore backend a report covers every instance sharing it, and only
+// one of them sends it.
+type ReportsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Period is daily, the default, reporting each UTC day once it's over,
+	// or weekly, reporting each Monday to Sunday week.
+	Period string `yaml:"period"`
+	// Format is json, the default, or csv.
+	Format string `yaml:"format"`
+	// Destination is the gs://bucket/prefix reports are written under, as
+	// usage-{period}-{YYYY-MM-DD}.{format}, dated by the period's start.
+	Destination string `yaml:"destination"`
+	// Email sends each report through the email pipeline.
+	Email *ReportEmailConfig `yaml:"email"`
+	// PricePerTiB is the throughput price costs are estimated with, in USD.
+	// Defaults to 40.
+	PricePerTiB float64 `yaml:"price_per_tib"`
+}
+
+type ReportEmailConfig struct {
+	// Topic is the configured email events topic the report is published
+	// to.
+	Topic string   `yaml:"topic"`
+	From  string   `yaml:"from"`
+	To    []string `yaml:"to"`
+}
+
+func (c *ReportsConfig) validate(topics map[string]bool) error {
+	if !c.Enabled {
+		return nil
+	}
+	switch c.Period {
+	case "":
+		c.Period = reportPeriodDaily
+	case reportPeriodDaily, reportPeriodWeekly:
+	default:
+		return fmt.Errorf("unknown period %q", c.Period)
+	}
+	switch c.Format {
+	case "":
+		c.Format = reportFormatJSON
+	case reportFormatJSON, reportFormatCSV:
+	default:
+		return fmt.Errorf("unknown format %q", c.Format)
+	}
+	if c.PricePerTiB == 0 {
+		c.PricePerTiB = defaultPricePerTiB
+	} else if c.PricePerTiB < 0 {
+		return errors.New("price_per_tib can't be negative")
+	}
+	if c.Destination == "" && c.Email == nil {
+		return errors.New("needs a destination, email, or both")
+	}
+	if c.Destination != "" && !strings.HasPrefix(c.Destination, "gs://") {
+		return fmt.Errorf("destination %q isn't a gs:// URI", c.Destination)
+	}
+	if c.Email != nil && (!topics[c.Email.Topic] || len(c.Email.To) == 0) {
+		return errors.New("email needs a configured topic and recipients")
+	}
+	return nil
+}
+
+// UsageLedger counts what each API key publishes to each topic, per UTC
+// day, for the usage reports. Unlike quotas, it counts every publish that
+// succeeded, whatever published it.
+type UsageLedger struct {
+	logger *log.Logger
+	store  Store
+}
+
+// newUsageLedger returns nil, which counts nothing, unless reports are
+// enabled.
+func newUsageLedger(config Config, store Store) *UsageLedger {
+	if !config.Reports.Enabled {
+		return nil
+	}
+	return &UsageLedger{logger: newLogger("usage"), store: store}
+}
+
+func usageLedgerKey(day time.Time, topic string, caller string, counter string) string {
+	return usageLedgerKeyPrefix + strconv.FormatInt(day.Unix(), 10) + "/" + topic + "/" + caller + "/" + counter
+}
+
+// Record counts msg, just published to topic. Failing to count it is only
+// logged, as the publish has already happened.
+func (l *UsageLedger) Record(ctx context.Context, topic string, msg *pubsub.Message) {
+	if l == nil {
+		return
+	}
+	caller := anonymousCaller
+	if identity, ok := CallerFrom(ctx); ok {
+		caller = identity.Name
+	}
+	now := time.Now().UTC()
+	day := now.Truncate(24 * time.Hour)
+	ttl := day.Add(usageLedgerRetention).Sub(now)
+	size := messageSize(msg)
+	ctx = context.WithoutCancel(ctx)
+	for _, counter := range []struct {
+		name  string
+		delta int64
+	}{{"messages", 1}, {"bytes", size}, {"billable_bytes", max(size, minBillableBytes)}} {
+		if _, err := l.store.Increment(ctx, usageLedgerKey(day, topic, caller, counter.name), counter.delta, ttl); err != nil {
+			l.logger.Printf("Failed to count %s's publish to %s: %v", caller, topic, err)
+			return
+		}
+	}
+}
+
+type usageReport struct {
+	Period      string    `json:"period"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	GeneratedAt time.Time `json:"generated_at"`
+	PricePerTiB float64   `json:"price_per_tib_usd"`
+	// EstimatedCost is the sum of the topics' estimates.
+	EstimatedCost float64            `json:"estimated_cost_usd"`
+	Topics        []topicUsageReport `json:"topics"`
+}
+
+type topicUsageReport struct {
+	Topic string `json:"topic"`
+	usageCounts
+	// Subscriptions are the configured subscriptions to the topic, each of
+	// which is billed for delivering what was published again.
+	Subscriptions int `json:"subscriptions"`
+	// Backlog is the undelivered messages of the topic's subscriptions when
+	// the report was generated, if Cloud Monitoring reported them.
+	Backlog *int64              `json:"backlog,omitempty"`
+	Callers []callerUsageReport `json:"callers"`
+}
+
+type callerUsageReport struct {
+	Caller string `json:"caller"`
+	usageCounts
+}
+
+type usageCounts struct {
+	Messages      int64 `json:"messages"`
+	Bytes         int64 `json:"bytes"`
+	BillableBytes int64 `json:"billable_bytes"`
+	// EstimatedCost is the billable bytes published and delivered to each
+	// subscription, at the configured price.
+	EstimatedCost float64 `json:"estimated_cost_usd"`
+}
+
+func (c *usageCounts) add(counter string, value int64) {
+	switch counter {
+	case "messages":
+		c.Messages += value
+	case "bytes":
+		c.Bytes += value
+	case "billable_bytes":
+		c.BillableBytes += value
+	}
+}
+
+// UsageReporter generates a report once each period is over, and delivers
+// it to Cloud Storage, by email, or both. Instances sharing the store take
+// a marker for each period, so it's sent once.
+type UsageReporter struct {
+	logger     *log.Logger
+	config     ReportsConfig
+	topics     []TopicConfig
+	project    string
+	store      Store
+	registry   *TopicRegistry
+	storage    *storage.Client
+	monitoring *monitoring.MetricClient
+	// subscriptions are the Pub/Sub IDs of each topic's subscriptions, by
+	// the topic's Pub/Sub ID.
+	subscriptions map[string][]string
+}
+
+func newUsageReporter(lifecycle fx.Lifecycle, config Config, store Store, registry *TopicRegistry, params PubSubParams) *UsageReporter {
+	reporter := &UsageReporter{
+		logger:        newLogger("reports"),
+		config:        config.Reports,
+		topics:        config.Topics,
+		project:       params.Config.ProjectId,
+		store:         store,
+		registry:      registry,
+		subscriptions: make(map[string][]string),
+	}
+	if !config.Reports.Enabled {
+		return reporter
+	}
+	for _, subscription := range config.Subscriptions {
+		reporter.subscriptions[subscription.Topic] = append(reporter.subscriptions[subscription.Topic], subscription.Id)
+	}
+	if config.Reports.Destination != "" {
+		reporter.storage = newStorageClient(lifecycle, params)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(startCtx context.Context) error {
+				if os.Getenv("PUBSUB_EMULATOR_HOST") != "" || params.Config.ProjectId == localProjectId {
+					reporter.logger.Println("Usage reports leave out backlogs without Cloud Monitoring")
+				} else {
+					client, err := monitoring.NewMetricClient(startCtx, params.clientOptions()...)
+					if err != nil {
+						return fmt.Errorf("connecting to Cloud Monitoring: %w", err)
+					}
+					reporter.monitoring = client
+				}
+				go reporter.run(ctx, done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				if reporter.monitoring != nil {
+					return reporter.monitoring.Close()
+				}
+				return nil
+			},
+		},
+	)
+	return reporter
+}
+
+// lastPeriod returns the bounds of the latest period that's over at now.
+func (r *UsageReporter) lastPeriod(now time.Time) (time.Time, time.Time) {
+	end := now.UTC().Truncate(24 * time.Hour)
+	if r.config.Period == reportPeriodWeekly {
+		// Weeks start on Monday.
+		end = end.AddDate(0, 0, -(int(end.Weekday())+6)%7)
+		return end.AddDate(0, 0, -7), end
+	}
+	return end.AddDate(0, 0, -1), end
+}
+
+func (r *UsageReporter) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(reportCheckInterval)
+	defer ticker.Stop()
+	for {
+		start, end := r.lastPeriod(time.Now())
+		r.report(ctx, start, end)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// report generates and delivers the report for the period from start to
+// end, unless an instance already has.
+func (r *UsageReporter) report(ctx context.Context, start time.Time, end time.Time) {
+	marker := reportKeyPrefix + r.config.Period + "/" + strconv.FormatInt(start.Unix(), 10)
+	claimed, err := r.store.SetIfAbsent(ctx, marker, []byte(time.Now().UTC().Format(time.RFC3339)), usageLedgerRetention)
+	if err != nil || !claimed {
+		if err != nil && ctx.Err() == nil {
+			r.logger.Printf("Failed to check whether the %s report from %s was sent: %v", r.config.Period, start.Format(time.DateOnly), err)
+		}
+		return
+	}
+	report, err := r.generate(ctx, start, end)
+	if err == nil {
+		err = r.deliver(ctx, report)
+	}
+	if err != nil {
+		// Cleared, so the next check tries again.
+		r.store.Delete(context.WithoutCancel(ctx), marker)
+		usageReports.WithLabelValues(r.config.Period, "error").Inc()
+		r.logger.Printf("Failed to send the %s report from %s: %v", r.config.Period, start.Format(time.DateOnly), err)
+		return
+	}
+	usageReports.WithLabelValues(r.config.Period, "ok").Inc()
+	r.logger.Printf("Sent the %s report from %s, estimating $%.2f", r.config.Period, start.Format(time.DateOnly), report.EstimatedCost)
+}
+
+// generate adds up the counts of the days from start to end into a report.
+func (r *UsageReporter) generate(ctx context.Context, start time.Time, end time.Time) (usageReport, error) {
+	report := usageReport{Period: r.config.Period, Start: start, End: end, GeneratedAt: time.Now().UTC(), PricePerTiB: r.config.PricePerTiB}
+	counts := make(map[string]map[string]*usageCounts)
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		prefix := usageLedgerKeyPrefix + strconv.FormatInt(day.Unix(), 10) + "/"
+		entries, err := r.store.List(ctx, prefix, 0)
+		if err != nil {
+			return report, err
+		}
+		for _, entry := range entries {
+			// Cut from the end, in case the topic name has slashes.
+			rest := strings.TrimPrefix(entry.Key, prefix)
+			rest, counter := path.Split(rest)
+			topic, caller := path.Split(strings.TrimSuffix(rest, "/"))
+			topic = strings.TrimSuffix(topic, "/")
+			value, err := strconv.ParseInt(string(entry.Value), 10, 64)
+			if err != nil || topic == "" {
+				continue
+			}
+			if counts[topic] == nil {
+				counts[topic] = make(map[string]*usageCounts)
+			}
+			if counts[topic][caller] == nil {
+				counts[topic][caller] = &usageCounts{}
+			}
+			counts[topic][caller].add(counter, value)
+		}
+	}
+
+	var backlogs map[string]int64
+	if r.monitoring != nil {
+		var ids []string
+		for _, subscriptions := range r.subscriptions {
+			ids = append(ids, subscriptions...)
+		}
+		if len(ids) > 0 {
+			var err error
+			if backlogs, err = latestSubscriptionMetric(ctx, r.monitoring, r.project, backlogMessagesMetric, ids); err != nil {
+				// The report is still worth sending without them.
+				r.logger.Printf("Failed to read subscription backlogs for the report: %v", err)
+			}
+		}
+	}
+
+	tib := float64(int64(1) << 40)
+	for _, topic := range r.topics {
+		topicReport := topicUsageReport{Topic: topic.Name, Subscriptions: len(r.subscriptions[topic.Id]), Callers: []callerUsageReport{}}
+		// Published once, then delivered to each subscription.
+		deliveries := float64(1 + topicReport.Subscriptions)
+		for caller, callerCounts := range counts[topic.Name] {
+			callerCounts.EstimatedCost = float64(callerCounts.BillableBytes) * deliveries / tib * r.config.PricePerTiB
+			topicReport.Callers = append(topicReport.Callers, callerUsageReport{Caller: caller, usageCounts: *callerCounts})
+			topicReport.Messages += callerCounts.Messages
+			topicReport.Bytes += callerCounts.Bytes
+			topicReport.BillableBytes += callerCounts.BillableBytes
+			topicReport.EstimatedCost += callerCounts.EstimatedCost
+		}
+		sort.Slice(topicReport.Callers, func(i, j int) bool { return topicReport.Callers[i].Caller < topicReport.Callers[j].Caller })
+		for _, id := range r.subscriptions[topic.Id] {
+			if backlog, ok := backlogs[id]; ok {
+				if topicReport.Backlog == nil {
+					topicReport.Backlog = new(int64)
+				}
+				*topicReport.Backlog += backlog
+			}
+		}
+		report.EstimatedCost += topicReport.EstimatedCost
+		usageReportEstimatedCost.WithLabelValues(r.config.Period, topic.Name).Set(topicReport.EstimatedCost)
+		report.Topics = append(report.Topics, topicReport)
+	}
+	return report, nil
+}
+
+// encodeUsageReport encodes report as JSON, or as CSV with a row for each
+// topic and API key, and one for the topic's totals with caller *, which
+// is the only one with the backlog.
+func encodeUsageReport(report usageReport, format string) ([]byte, error) {
+	var buffer bytes.Buffer
+	if format == reportFormatJSON {
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(report)
+		return buffer.Bytes(), err
+	}
+	writer := csv.NewWriter(&buffer)
+	writer.Write([]string{"topic", "caller", "messages", "bytes", "billable_bytes", "estimated_cost_usd", "backlog"})
+	row := func(topic string, caller string, counts usageCounts, backlog string) {
+		writer.Write([]string{
+			topic,
+			caller,
+			strconv.FormatInt(counts.Messages, 10),
+			strconv.FormatInt(counts.Bytes, 10),
+			strconv.FormatInt(counts.BillableBytes, 10),
+			strconv.FormatFloat(counts.EstimatedCost, 'f', 6, 64),
+			backlog,
+		})
+	}
+	for _, topic := range report.Topics {
+		backlog := ""
+		if topic.Backlog != nil {
+			backlog = strconv.FormatInt(*topic.Backlog, 10)
+		}
+		row(topic.Topic, "*", topic.usageCounts, backlog)
+		for _, caller := range topic.Callers {
+			row(topic.Topic, caller.Caller, caller.usageCounts, "")
+		}
+	}
+	writer.Flush()
+	return buffer.Bytes(), writer.Error()
+}
+
+func (r *UsageReporter) deliver(ctx context.Context, report usageReport) error {
+	data, err := encodeUsageReport(report, r.config.Format)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("usage-%s-%s.%s", report.Period, report.Start.Format(time.DateOnly), r.config.Format)
+	if r.config.Destination != "" {
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(r.config.Destination, "gs://"), "/")
+		writer := r.storage.Bucket(bucket).Object(path.Join(prefix, name)).NewWriter(ctx)
+		writer.ContentType = "application/json"
+		if r.config.Format == reportFormatCSV {
+			writer.ContentType = "text/csv"
+		}
+		if _, err := writer.Write(data); err != nil {
+			writer.Close()
+			return fmt.Errorf("writing gs://%s: %w", path.Join(bucket, prefix, name), err)
+		}
+		if err := writer.Close(); err != nil {
+			return fmt.Errorf("writing gs://%s: %w", path.Join(bucket, prefix, name), err)
+		}
+	}
+	if email := r.config.Email; email != nil {
+		topic, _ := r.registry.Lookup(email.Topic)
+		msg, err := emailevents.Encode(emailevents.SendEmailRequest{
+			From:     email.From,
+			To:       email.To,
+			Subject:  fmt.Sprintf("Pub/Sub %s usage report from %s", report.Period, report.Start.Format(time.DateOnly)),
+			TextBody: summarizeUsageReport(report) + "\n" + name + ":\n\n" + string(data),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := topic.Publish(ctx, msg); err != nil {
+			return fmt.Errorf("emailing the report: %w", err)
+		}
+	}
+	return nil
+}
+
+// summarizeUsageReport is a table of each topic's totals, for reading in an
+// email.
+func summarizeUsageReport(report usageReport) string {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "Usage from %s to %s, estimated at $%.2f per TiB.\n\n", report.Start.Format(time.DateOnly), report.End.Format(time.DateOnly), report.PricePerTiB)
+	writer := tabwriter.NewWriter(&buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TOPIC\tMESSAGES\tBYTES\tBACKLOG\tESTIMATED COST")
+	for _, topic := range report.Topics {
+		backlog := "-"
+		if topic.Backlog != nil {
+			backlog = strconv.FormatInt(*topic.Backlog, 10)
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%s\t$%.2f\n", topic.Topic, topic.Messages, topic.Bytes, backlog, topic.EstimatedCost)
+	}
+	fmt.Fprintf(writer, "Total\t\t\t\t$%.2f\n", report.EstimatedCost)
+	writer.Flush()
+	return buffer.String()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	retryAttributePrefix = "retry_"
+	retryNotBeforeAttr   = retryAttributePrefix + "not_before"
+	retryStageAttr       = retryAttributePrefix + "stage"
+)
+
+var defaultRetryDelays = []time.Duration{5 * time.Second, time.Minute, 10 * time.Minute}
+
+// RetryConfig sends failed messages through a chain of delay stages before
+// giving up on them. Each stage has its own topic and subscription, named
+// after the delay, e.g. orders.retry.1m; a message published to a stage is
+// handled again once its delay has passed, and failing again moves it to
+// the next stage. After the last stage it goes to the dead letter topic.
+// The stage topics and subscriptions are created on startup if missing.
+type RetryConfig struct {
+	// Delays defaults to 5s, 1m and 10m.
+	Delays []time.Duration `yaml:"delays"`
+	// DeadLetterTopic defaults to <topic>.dlq. DeadLetterSubscription, by
+	// default <subscription>.dlq, retains its messages.
+	DeadLetterTopic        string `yaml:"dead_letter_topic"`
+	DeadLetterSubscription string `yaml:"dead_letter_subscription"`
+}
+
+type retryStage struct {
+	Delay        time.Duration
+	Topic        string
+	Subscription string
+}
+
+// retryName appends a stage suffix to name, so a 90s delay on orders is
+// orders.retry.1m30s.
+func retryName(name string, delay time.Duration) string {
+	return name + ".retry." + delayName(delay)
+}
+
+// delayName formats delay without zero units, e.g. 1m rather than 1m0s.
+func delayName(delay time.Duration) string {
+	name := delay.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return name
+}
+
+// retryStages returns the stages of subscription's retry chain, in order.
+func retryStages(subscription SubscriptionConfig) []retryStage {
+	stages := make([]retryStage, len(subscription.Retry.Delays))
+	for i, delay := range subscription.Retry.Delays {
+		stages[i] = retryStage{
+			Delay:        delay,
+			Topic:        retryName(subscription.Topic, delay),
+			Subscription: retryName(subscription.Id, delay),
+		}
+	}
+	return stages
+}
+
+// stageSubscription returns the config of the subscriber consuming stage,
+// which runs the same handler as subscription.
+func stageSubscription(subscription SubscriptionConfig, stage retryStage) SubscriptionConfig {
+	subscription.Name = retryName(subscription.Name, stage.Delay)
+	subscription.Id = stage.Subscription
+	subscription.Topic = stage.Topic
+	subscription.MaxBacklog, subscription.MaxBacklogAge = 0, 0
+	subscription.Stall = nil
+	subscription.MessageTransforms = nil
+	return subscription
+}
+
+// RetryChain is shared by a subscription's subscriber and the subscribers
+// of its stages.
+type RetryChain struct {
+	subscription SubscriptionConfig
+	stages       []retryStage
+	topics       []*pubsub.Topic
+	deadLetter   *pubsub.Topic
+}
+
+func newRetryChain(subscription SubscriptionConfig) *RetryChain {
+	return &RetryChain{subscription: subscription, stages: retryStages(subscription)}
+}
+
+// connect provisions the chain's topology and creates its topic handles,
+// once the client has connected.
+func (c *RetryChain) connect(ctx context.Context, client *pubsub.Client) error {
+	if err := provisionRetryTopology(ctx, client, c.subscription); err != nil {
+		return fmt.Errorf("subscription %s: provisioning retry topology: %w", c.subscription.Name, err)
+	}
+	for _, stage := range c.stages {
+		c.topics = append(c.topics, client.Topic(stage.Topic))
+	}
+	c.deadLetter = client.Topic(c.subscription.Retry.DeadLetterTopic)
+	return nil
+}
+
+// wait holds msg until its stage's delay has passed. Holding it keeps its
+// lease extended, so it isn't redelivered meanwhile.
+func (c *RetryChain) wait(ctx context.Context, msg *pubsub.Message) error {
+	notBefore, err := time.Parse(time.RFC3339Nano, msg.Attributes[retryNotBeforeAttr])
+	if err != nil {
+		// Published to the stage by something other than this chain.
+		return nil
+	}
+	timer := time.NewTimer(time.Until(notBefore))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Fail publishes msg, which failed at stage (0 being the subscription
+// itself), to the next stage or, after the last or for a permanent error,
+// to the dead letter topic. It returns where msg went, a delay or
+// dead_letter, or "" if publishing failed and msg should be nacked instead.
+func (c *RetryChain) Fail(ctx context.Context, subscriber *Subscriber, stage int, msg *pubsub.Message, handlerErr error) string {
+	attributes := make(map[string]string, len(msg.Attributes)+6)
+	for key, value := range msg.Attributes {
+		attributes[key] = value
+	}
+	if stage == 0 {
+		attributes[retryAttributePrefix+"subscription"] = c.subscription.Id
+		attributes[retryAttributePrefix+"message_id"] = msg.ID
+	}
+	attributes[retryAttributePrefix+"error"] = truncate(handlerErr.Error(), maxAttributeValueBytes)
+	attributes[retryAttributePrefix+"at"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	topic, target := c.deadLetter, "dead_letter"
+	delete(attributes, retryNotBeforeAttr)
+	if stage < len(c.stages) && !isPermanent(handlerErr) {
+		next := c.stages[stage]
+		topic, target = c.topics[stage], delayName(next.Delay)
+		attributes[retryStageAttr] = strconv.Itoa(stage + 1)
+		attributes[retryNotBeforeAttr] = time.Now().Add(next.Delay).UTC().Format(time.RFC3339Nano)
+	}
+
+	// Stage topics aren't ordered, so the ordering key is dropped.
+	_, err := topic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attributes}).Get(ctx)
+	if err != nil {
+		subscriber.logger.Printf("Failed to publish message %s to retry %s: %v", msg.ID, target, err)
+		return ""
+	}
+	retriedMessages.WithLabelValues(subscriber.Config.Name, target).Inc()
+	if target == "dead_letter" {
+		auditLog.Emit(auditEvent{
+			Id:       auditDeadLettered,
+			Resource: c.subscription.Name,
+			Message:  fmt.Sprintf("Message %s from subscription %s reached dead letter topic %s", msg.ID, c.subscription.Name, c.subscription.Retry.DeadLetterTopic),
+			Details:  map[string]string{"message_id": msg.ID, "topic": c.subscription.Retry.DeadLetterTopic, "error": truncate(handlerErr.Error(), maxAttributeValueBytes)},
+			Severity: logging.Warning,
+		})
+	}
+	return target
+}
+
+// provisionRetryTopology creates the stage and dead letter topics and
+// subscriptions of subscription's retry chain that don't exist yet.
+func provisionRetryTopology(ctx context.Context, client *pubsub.Client, subscription SubscriptionConfig) error {
+	ensure := func(topicId string, subscriptionId string, ackDeadline time.Duration) error {
+		topic := client.Topic(topicId)
+		exists, err := topic.Exists(ctx)
+		if err != nil {
+			return fmt.Errorf("topic %s: %w", topicId, err)
+		}
+		if !exists {
+			if topic, err = client.CreateTopic(ctx, topicId); err != nil {
+				return fmt.Errorf("topic %s: %w", topicId, err)
+			}
+		}
+		exists, err = client.Subscription(subscriptionId).Exists(ctx)
+		if err != nil {
+			return fmt.Errorf("subscription %s: %w", subscriptionId, err)
+		}
+		if !exists {
+			_, err = client.CreateSubscription(ctx, subscriptionId, pubsub.SubscriptionConfig{Topic: topic, AckDeadline: ackDeadline})
+			if err != nil {
+				return fmt.Errorf("subscription %s: %w", subscriptionId, err)
+			}
+		}
+		return nil
+	}
+	for _, stage := range retryStages(subscription) {
+		if err := ensure(stage.Topic, stage.Subscription, time.Minute); err != nil {
+			return err
+		}
+	}
+	return ensure(subscription.Retry.DeadLetterTopic, subscription.Retry.DeadLetterSubscription, 0)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	vkit "cloud.google.com/go/pubsub/apiv1"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	retryKindPublish = "publish"
+	retryKindWebhook = "webhook"
+
+	defaultRetryBudgetMinRetries = 10
+	defaultRetryBudgetWindow     = 10 * time.Second
+)
+
+// RetryBudgetConfig caps retries at a fraction of requests, shared by the
+// Pub/Sub client's publish RPC retries and webhook delivery retries, so a
+// partial outage doesn't turn every failure into several more requests.
+// Once the budget is spent, failures aren't retried until requests that
+// succeed, or the window passing, earn more.
+type RetryBudgetConfig struct {
+	// Ratio is how many retries are allowed per request over the window,
+	// e.g. 0.1 allows one retry for every ten requests. Zero, the default,
+	// doesn't limit retries.
+	Ratio float64 `yaml:"ratio"`
+	// MinRetries are allowed per window on top of Ratio, so an instance
+	// with little traffic can still retry. Defaults to 10.
+	MinRetries int `yaml:"min_retries"`
+	// Window is how long requests and retries count against the budget.
+	// Defaults to 10s.
+	Window time.Duration `yaml:"window"`
+}
+
+func (c *RetryBudgetConfig) validate() error {
+	if c.MinRetries == 0 {
+		c.MinRetries = defaultRetryBudgetMinRetries
+	}
+	if c.Window == 0 {
+		c.Window = defaultRetryBudgetWindow
+	}
+	if c.Ratio < 0 || c.MinRetries < 0 || c.Window < 0 {
+		return fmt.Errorf("ratio, min_retries and window can't be negative")
+	}
+	return nil
+}
+
+// RetryBudget counts requests and retries over a sliding window,
+// approximated by weighting the previous fixed window by how much of it
+// still overlaps.
+type RetryBudget struct {
+	mu     sync.Mutex
+	config RetryBudgetConfig
+
+	start            time.Time
+	requests         float64
+	retries          float64
+	previousRequests float64
+	previousRetries  float64
+}
+
+// retryBudget is shared by everything that retries. It doesn't limit
+// retries until applyRetryBudget configures it.
+var retryBudget = &RetryBudget{}
+
+// applyRetryBudget configures the shared retry budget from config.
+func applyRetryBudget(config Config) {
+	retryBudget.mu.Lock()
+	defer retryBudget.mu.Unlock()
+	retryBudget.config = config.RetryBudget
+}
+
+// Request counts a first attempt of kind, which earns retries.
+func (b *RetryBudget) Request(kind string) {
+	retryBudgetRequests.WithLabelValues(kind).Inc()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.config.Ratio == 0 {
+		return
+	}
+	b.roll(time.Now())
+	b.requests++
+	retryBudgetAvailable.Set(b.available(time.Now()))
+}
+
+// Retry reports whether a failed attempt of kind may be retried, counting
+// the retry if so.
+func (b *RetryBudget) Retry(kind string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.config.Ratio == 0 {
+		retryBudgetRetries.WithLabelValues(kind, "allowed").Inc()
+		return true
+	}
+	now := time.Now()
+	b.roll(now)
+	if b.available(now) < 1 {
+		retryBudgetRetries.WithLabelValues(kind, "denied").Inc()
+		return false
+	}
+	b.retries++
+	retryBudgetRetries.WithLabelValues(kind, "allowed").Inc()
+	retryBudgetAvailable.Set(b.available(now))
+	return true
+}
+
+// roll starts a new window if the current one has ended.
+func (b *RetryBudget) roll(now time.Time) {
+	elapsed := now.Sub(b.start)
+	if elapsed < b.config.Window {
+		return
+	}
+	if elapsed < 2*b.config.Window {
+		b.previousRequests, b.previousRetries = b.requests, b.retries
+	} else {
+		b.previousRequests, b.previousRetries = 0, 0
+	}
+	b.requests, b.retries = 0, 0
+	b.start = now
+}
+
+// available is how many more retries the budget allows now.
+func (b *RetryBudget) available(now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(b.start))/float64(b.config.Window)
+	requests := b.requests + b.previousRequests*overlap
+	retries := b.retries + b.previousRetries*overlap
+	return float64(b.config.MinRetries) + b.config.Ratio*requests - retries
+}
+
+// budgetedRetryer retries what retryer would, while the budget allows.
+type budgetedRetryer struct {
+	retryer gax.Retryer
+	budget  *RetryBudget
+	kind    string
+}
+
+func (r budgetedRetryer) Retry(err error) (time.Duration, bool) {
+	pause, ok := r.retryer.Retry(err)
+	if !ok || !r.budget.Retry(r.kind) {
+		return 0, false
+	}
+	return pause, true
+}
+
+// publisherCallOptions retry Publish RPCs on the same codes and with the
+// same backoff as the client does by default, within the retry budget.
+func publisherCallOptions() *vkit.PublisherCallOptions {
+	return &vkit.PublisherCallOptions{
+		Publish: []gax.CallOption{
+			gax.WithRetry(func() gax.Retryer {
+				// Called once per RPC, before its first attempt.
+				retryBudget.Request(retryKindPublish)
+				return budgetedRetryer{
+					retryer: gax.OnCodes([]codes.Code{
+						codes.Aborted,
+						codes.Canceled,
+						codes.Internal,
+						codes.ResourceExhausted,
+						codes.Unknown,
+						codes.Unavailable,
+						codes.DeadlineExceeded,
+					}, gax.Backoff{
+						Initial:    100 * time.Millisecond,
+						Max:        60 * time.Second,
+						Multiplier: 4,
+					}),
+					budget: retryBudget,
+					kind:   retryKindPublish,
+				}
+			}),
+		},
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Pub/Sub's bounds on a retry policy's backoffs, and what it uses for one
+// that's left unset.
+const (
+	maxRetryBackoff            = 600 * time.Second
+	defaultMinimumRetryBackoff = 10 * time.Second
+	defaultMaximumRetryBackoff = maxRetryBackoff
+)
+
+func (p *RetryPolicy) validate() error {
+	if p.MinimumBackoff < 0 || p.MinimumBackoff > maxRetryBackoff || p.MaximumBackoff < 0 || p.MaximumBackoff > maxRetryBackoff {
+		return fmt.Errorf("retry_policy backoffs must be between 0s and %s", maxRetryBackoff)
+	}
+	if minimum, maximum := p.effective(); minimum > maximum {
+		return fmt.Errorf("retry_policy minimum_backoff %s is more than maximum_backoff %s", minimum, maximum)
+	}
+	return nil
+}
+
+// effective returns the backoffs Pub/Sub applies, with its defaults for
+// those left unset.
+func (p *RetryPolicy) effective() (time.Duration, time.Duration) {
+	minimum, maximum := p.MinimumBackoff, p.MaximumBackoff
+	if minimum == 0 {
+		minimum = defaultMinimumRetryBackoff
+	}
+	if maximum == 0 {
+		maximum = defaultMaximumRetryBackoff
+	}
+	return minimum, maximum
+}
+
+func (p *RetryPolicy) String() string {
+	minimum, maximum := p.effective()
+	return fmt.Sprintf("backoff between %s and %s", minimum, maximum)
+}
+
+// pubsubRetryPolicy converts policy for the client, leaving unset backoffs
+// to Pub/Sub.
+func pubsubRetryPolicy(policy *RetryPolicy) *pubsub.RetryPolicy {
+	if policy == nil {
+		return nil
+	}
+	converted := &pubsub.RetryPolicy{}
+	if policy.MinimumBackoff > 0 {
+		converted.MinimumBackoff = policy.MinimumBackoff
+	}
+	if policy.MaximumBackoff > 0 {
+		converted.MaximumBackoff = policy.MaximumBackoff
+	}
+	return converted
+}
+
+// liveRetryPolicy converts the client's policy back, nil meaning the
+// subscription redelivers straight away.
+func liveRetryPolicy(policy *pubsub.RetryPolicy) *RetryPolicy {
+	if policy == nil {
+		return nil
+	}
+	converted := &RetryPolicy{}
+	if backoff, ok := policy.MinimumBackoff.(time.Duration); ok {
+		converted.MinimumBackoff = backoff
+	}
+	if backoff, ok := policy.MaximumBackoff.(time.Duration); ok {
+		converted.MaximumBackoff = backoff
+	}
+	return converted
+}
+
+// retryPolicyDrifted reports whether live doesn't apply the backoffs
+// declared. Subscriptions without a declared policy aren't managed.
+func retryPolicyDrifted(declared *RetryPolicy, live *RetryPolicy) bool {
+	if declared == nil {
+		return false
+	}
+	if live == nil {
+		return true
+	}
+	declaredMinimum, declaredMaximum := declared.effective()
+	liveMinimum, liveMaximum := live.effective()
+	return declaredMinimum != liveMinimum || declaredMaximum != liveMaximum
+}
+
+// verifyRetryPolicies warns about subscriptions whose live retry policy
+// isn't the one declared, once at startup, whether or not the reconciler
+// runs. It never fails startup: healing is the reconciler's job.
+func verifyRetryPolicies(ctx context.Context, logger *log.Logger, client *pubsub.Client, declared Topology) {
+	for _, subscription := range declared.Subscriptions {
+		if subscription.RetryPolicy == nil {
+			continue
+		}
+		live, err := client.Subscription(subscription.Name).Config(ctx)
+		if err != nil {
+			logger.Printf("Couldn't verify the retry policy of subscription %s: %v", subscription.Name, err)
+			continue
+		}
+		if policy := liveRetryPolicy(live.RetryPolicy); retryPolicyDrifted(subscription.RetryPolicy, policy) {
+			topologyDrift.WithLabelValues(driftKindRetryPolicy, subscription.Name, "mismatched").Set(1)
+			logger.Printf("Drift in retry_policy %s: %s", subscription.Name, retryPolicyDetail(subscription.RetryPolicy, policy))
+		}
+	}
+}
+
+func retryPolicyDetail(declared *RetryPolicy, live *RetryPolicy) string {
+	if live == nil {
+		return fmt.Sprintf("redelivers immediately instead of with %s", declared)
+	}
+	return fmt.Sprintf("live %s instead of %s", live, declared)
+}
+
+type retryPolicyStatus struct {
+	Subscription string `json:"subscription"`
+	// Live is the policy the subscription has, or null if it redelivers
+	// straight away.
+	Live *retryPolicyBody `json:"live"`
+	// Declared is the policy in the config, or null if it doesn't manage
+	// one.
+	Declared *retryPolicyBody `json:"declared"`
+	// Drifted is whether the drift reconciler would change the live policy.
+	Drifted bool `json:"drifted"`
+}
+
+// retryPolicyBody is a retry policy in the admin API, in whole seconds.
+type retryPolicyBody struct {
+	MinimumBackoffSeconds int `json:"minimum_backoff_seconds"`
+	MaximumBackoffSeconds int `json:"maximum_backoff_seconds"`
+}
+
+func newRetryPolicyBody(policy *RetryPolicy) *retryPolicyBody {
+	if policy == nil {
+		return nil
+	}
+	minimum, maximum := policy.effective()
+	return &retryPolicyBody{MinimumBackoffSeconds: int(minimum.Seconds()), MaximumBackoffSeconds: int(maximum.Seconds())}
+}
+
+func (b retryPolicyBody) policy() *RetryPolicy {
+	return &RetryPolicy{
+		MinimumBackoff: time.Duration(b.MinimumBackoffSeconds) * time.Second,
+		MaximumBackoff: time.Duration(b.MaximumBackoffSeconds) * time.Second,
+	}
+}
+
+// GetRetryPolicy returns a subscriber's live retry policy alongside the
+// declared one.
+func (h *SubscriberAdminHandler) GetRetryPolicy(w http.ResponseWriter, r *http.Request) {
+	subscriber, ok := h.subscribers.Lookup(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Unknown subscriber", http.StatusNotFound)
+		return
+	}
+	h.writeRetryPolicy(w, r, subscriber)
+}
+
+// PutRetryPolicy sets a subscriber's retry policy in GCP. Unless the config
+// is changed to match, it shows up as drift, and a reconciler healing retry
+// policies puts the declared one back.
+func (h *SubscriberAdminHandler) PutRetryPolicy(w http.ResponseWriter, r *http.Request) {
+	subscriber, ok := h.subscribers.Lookup(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Unknown subscriber", http.StatusNotFound)
+		return
+	}
+	var body retryPolicyBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&body); err != nil {
+		http.Error(w, "Invalid retry policy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy := body.policy()
+	if err := policy.validate(); err != nil {
+		http.Error(w, "Invalid retry policy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err := h.client.Subscription(subscriber.Config.Id).Update(r.Context(), pubsub.SubscriptionConfigToUpdate{RetryPolicy: pubsubRetryPolicy(policy)})
+	if err != nil {
+		http.Error(w, "Failed to update the retry policy: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(subscriber.logger, r).Printf("Set the retry policy to %s", policy)
+	h.writeRetryPolicy(w, r, subscriber)
+}
+
+func (h *SubscriberAdminHandler) writeRetryPolicy(w http.ResponseWriter, r *http.Request, subscriber *Subscriber) {
+	live, err := h.client.Subscription(subscriber.Config.Id).Config(r.Context())
+	if status.Code(err) == codes.NotFound {
+		http.Error(w, "The subscription doesn't exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to read the subscription: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	policy := liveRetryPolicy(live.RetryPolicy)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retryPolicyStatus{
+		Subscription: subscriber.Config.Id,
+		Live:         newRetryPolicyBody(policy),
+		Declared:     newRetryPolicyBody(subscriber.Config.RetryPolicy),
+		Drifted:      retryPolicyDrifted(subscriber.Config.RetryPolicy, policy),
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+)
+
+const (
+	// clientVerifyTimeout bounds checking that a standby client can reach
+	// every topic and subscription before traffic moves to it.
+	clientVerifyTimeout = 30 * time.Second
+	clientVerifyWorkers = 8
+)
+
+type clientRotation struct {
+	// CredentialsPath is the service account key file the new client
+	// authenticates with, e.g. a newly mounted secret version.
+	CredentialsPath string `json:"credentials_path"`
+	// Endpoint overrides the Pub/Sub endpoint, e.g. a regional one.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+type clientRotationResponse struct {
+	CredentialsPath string    `json:"credentials_path"`
+	Endpoint        string    `json:"endpoint,omitempty"`
+	Topics          int       `json:"topics"`
+	Subscribers     int       `json:"subscribers"`
+	RotatedAt       time.Time `json:"rotated_at"`
+	// SharedCredentials is whether the service's other clients, such as
+	// the reconciler's and the failover secondaries', switch to the new key
+	// too, which they do when they authenticate with a key file rather
+	// than application default credentials.
+	SharedCredentials bool `json:"shared_credentials"`
+}
+
+// ClientRotator rotates the Pub/Sub client publishing and subscribing go
+// through, so credentials can be replaced without a restart. A rotation
+// builds a standby client with the new credentials, checks it can reach
+// every registered topic and subscription, and only then moves the topics'
+// publish handles and the subscribers' receive loops to it, draining those
+// of the previous client. It applies to the instance that receives it.
+type ClientRotator struct {
+	logger      *log.Logger
+	params      PubSubParams
+	registry    *TopicRegistry
+	subscribers *SubscriberSet
+	drain       time.Duration
+
+	// mu runs one rotation at a time. current is the client traffic goes
+	// through, and original the one the service started with, which the
+	// rest of the service keeps using and so is never closed here. Nor is
+	// current on shutdown: the registry and subscribers flush through it
+	// after the rotator would stop.
+	mu       sync.Mutex
+	original *pubsub.Client
+	current  *pubsub.Client
+}
+
+func newClientRotator(config Config, params PubSubParams, client *pubsub.Client, registry *TopicRegistry, subscribers *SubscriberSet) *ClientRotator {
+	return &ClientRotator{
+		logger:      newLogger("rotation"),
+		params:      params,
+		registry:    registry,
+		subscribers: subscribers,
+		drain:       config.Shutdown.Timeout,
+		original:    client,
+		current:     client,
+	}
+}
+
+// standby creates a client authenticating with rotation's key file.
+func (c *ClientRotator) standby(ctx context.Context, rotation clientRotation) (*pubsub.Client, error) {
+	options := []option.ClientOption{option.WithCredentialsFile(rotation.CredentialsPath), option.WithUserAgent(c.params.userAgent()), publishRPCOption}
+	if rotation.Endpoint != "" {
+		options = append(options, option.WithEndpoint(rotation.Endpoint))
+	}
+	return pubsub.NewClientWithConfig(ctx, c.params.Config.ProjectId, &pubsub.ClientConfig{PublisherCallOptions: publisherCallOptions()}, options...)
+}
+
+// verify checks that client can see every registered topic and subscribed
+// subscription, which needs working credentials and the same access as
+// the current client.
+func (c *ClientRotator) verify(ctx context.Context, client *pubsub.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, clientVerifyTimeout)
+	defer cancel()
+	var checks []func() error
+	for _, registered := range c.registry.topics {
+		id := registered.Config.Id
+		checks = append(checks, func() error {
+			if exists, err := client.Topic(id).Exists(ctx); err != nil {
+				return fmt.Errorf("topic %s: %w", id, err)
+			} else if !exists {
+				return fmt.Errorf("topic %s doesn't exist", id)
+			}
+			return nil
+		})
+	}
+	for _, subscriber := range c.subscribers.subscribers {
+		id := subscriber.Config.Id
+		checks = append(checks, func() error {
+			if exists, err := client.Subscription(id).Exists(ctx); err != nil {
+				return fmt.Errorf("subscription %s: %w", id, err)
+			} else if !exists {
+				return fmt.Errorf("subscription %s doesn't exist", id)
+			}
+			return nil
+		})
+	}
+	errs := make([]error, len(checks))
+	slots := make(chan struct{}, clientVerifyWorkers)
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = check()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Rotate switches traffic to a client with the credentials in the request,
+// leaving it on the current client if the new one can't reach every topic
+// and subscription. The previous client is closed once its messages are
+// flushed and settled, unless it's the one the service started with.
+func (c *ClientRotator) Rotate(w http.ResponseWriter, r *http.Request) {
+	var rotation clientRotation
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&rotation); err != nil {
+		http.Error(w, "Invalid rotation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rotation.CredentialsPath == "" {
+		http.Error(w, "Invalid rotation: credentials_path is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(rotation.CredentialsPath); err != nil {
+		http.Error(w, "Invalid rotation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger := requestLogger(c.logger, r)
+	if !c.mu.TryLock() {
+		http.Error(w, "A rotation is already in progress", http.StatusConflict)
+		return
+	}
+	defer c.mu.Unlock()
+
+	client, err := c.standby(r.Context(), rotation)
+	if err != nil {
+		clientRotations.WithLabelValues("failed").Inc()
+		http.Error(w, "Failed to create the standby client: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := c.verify(r.Context(), client); err != nil {
+		client.Close()
+		clientRotations.WithLabelValues("failed").Inc()
+		logger.Printf("Not rotating to credentials %s: %v", rotation.CredentialsPath, err)
+		http.Error(w, "The standby client can't reach Pub/Sub: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	previous := c.current
+	c.current = client
+	for _, registered := range c.registry.topics {
+		registered.rotate(client)
+	}
+	shared := googleCredentials.Use(rotation.CredentialsPath)
+	logger.Printf("Publishing through a client with credentials %s", rotation.CredentialsPath)
+	// Draining outlives the request, so it isn't cut short by the caller
+	// hanging up.
+	drainCtx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), c.drain)
+	defer cancel()
+	if err := c.subscribers.rotate(drainCtx, client); err != nil {
+		logger.Printf("Rotated, but %v", err)
+	} else {
+		logger.Printf("Subscribing through a client with credentials %s", rotation.CredentialsPath)
+	}
+	if previous != c.original {
+		go c.close(previous)
+	}
+
+	clientRotations.WithLabelValues("ok").Inc()
+	auditLog.Emit(auditEvent{
+		Id:       auditClientRotated,
+		Resource: c.params.Config.ProjectId,
+		Message:  fmt.Sprintf("Pub/Sub client rotated to credentials %s", rotation.CredentialsPath),
+		Details:  map[string]string{"credentials_path": rotation.CredentialsPath, "endpoint": rotation.Endpoint},
+		Severity: logging.Notice,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clientRotationResponse{
+		CredentialsPath:   rotation.CredentialsPath,
+		Endpoint:          rotation.Endpoint,
+		Topics:            len(c.registry.topics),
+		Subscribers:       len(c.subscribers.subscribers),
+		RotatedAt:         time.Now().UTC(),
+		SharedCredentials: shared,
+	})
+}
+
+// close closes a client rotated out once the topics' replaced handles are
+// flushed, or the drain timeout has passed.
+func (c *ClientRotator) close(client *pubsub.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.drain)
+	defer cancel()
+	flushed := make(chan struct{})
+	go func() {
+		for _, registered := range c.registry.topics {
+			registered.draining.Wait()
+		}
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		c.logger.Printf("Closing the previous client before its publishes were flushed: %v", ctx.Err())
+	}
+	if err := client.Close(); err != nil {
+		c.logger.Printf("Failed to close the previous client: %v", err)
+	}
+}
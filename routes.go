@@ -0,0 +1,868 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"gcp-pubsub-test/healthcheck"
+)
+
+// Route is an HTTP endpoint together with the documentation used to build
+// the OpenAPI description served at /openapi.json.
+type Route struct {
+	Method  string
+	Path    string
+	Handler http.Handler
+	// Scope is the API key scope the route requires, e.g. publish:{topic}.
+	// Routes without one are open to anyone who can reach the service.
+	Scope string
+	// AllowReadOnly serves a route that isn't a read in read-only mode, for
+	// dry runs and the controls operators need during an incident.
+	AllowReadOnly bool
+	Doc           RouteDoc
+}
+
+type RouteDoc struct {
+	Summary     string
+	Tag         string
+	Query       []QueryParameterDoc
+	RequestBody interface{}
+	// RequestMediaTypes are the schemas of the media types, other than
+	// JSON, the body may be sent as.
+	RequestMediaTypes map[string]openAPISchema
+	Responses         []ResponseDoc
+	// Undocumented routes are served but left out of the OpenAPI document.
+	Undocumented bool
+}
+
+type QueryParameterDoc struct {
+	Name        string
+	Description string
+	Type        string
+	Repeated    bool
+}
+
+type ResponseDoc struct {
+	Status      int
+	Description string
+	// Body is a value of the JSON response type. Responses without one are
+	// documented as plain text.
+	Body interface{}
+}
+
+// Pattern returns the ServeMux pattern for the route.
+func (r Route) Pattern() string {
+	if r.Method == "" {
+		return r.Path
+	}
+	return r.Method + " " + r.Path
+}
+
+// metricsHandler serves OpenMetrics to scrapers that ask for it, which is
+// the only format carrying exemplars.
+var metricsHandler = promhttp.InstrumentMetricHandler(
+	prometheus.DefaultRegisterer,
+	promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+)
+
+var limitParameter = QueryParameterDoc{Name: "limit", Description: "Maximum number of messages to pull.", Type: "integer"}
+
+func newRoutes(health *healthcheck.Registry, config Config, recorder *LifecycleRecorder, readiness *BacklogMonitor, publish *PublishHandler, eventarc *EventarcHandler, subscribers *SubscriberAdminHandler, quarantine *QuarantineHandler, transforms *TransformAdminHandler, templates *EmailTemplateHandler, catalog *Catalog, campaigns *CampaignHandler, failures *FailureHandler, recent *RecentHandler, logLevels *LogLevelHandler, readOnly *ReadOnlyHandler, reconciler *Reconciler, usage *UsageHandler, suppressions *SuppressionHandler, diagnostics *Diagnostics, groups *PublishGroups, router *Router, deepHealth *DeepHealth, rotator *ClientRotator) []Route {
+	routes := []Route{
+		{
+			Method: http.MethodGet,
+			Path:   "/",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("Hello, Cloud Run!"))
+			}),
+			Doc: RouteDoc{Summary: "Greeting", Tag: "health", Responses: []ResponseDoc{{Status: http.StatusOK, Description: "Greeting text."}}},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/health",
+			Handler: healthHandler(health),
+			Doc: RouteDoc{
+				Summary: "Check Pub/Sub and its credentials, the configured topics and the store",
+				Tag:     "health",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Every dependency is healthy.", Body: healthcheck.Report{}},
+					{Status: http.StatusServiceUnavailable, Description: "A check failed or timed out, or with status auth_unhealthy, authentication with Google Cloud is failing.", Body: healthcheck.Report{}},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/health/deep",
+			Handler: deepHealth,
+			Doc: RouteDoc{
+				Summary: "Publish a probe and wait for the designated consumer to echo it back",
+				Tag:     "health",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The probe was echoed back in time.", Body: healthcheck.Report{}},
+					{Status: http.StatusNotFound, Description: "Deep health isn't configured."},
+					{Status: http.StatusServiceUnavailable, Description: "The probe couldn't be published, or wasn't echoed back in time.", Body: healthcheck.Report{}},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/readyz",
+			Handler: readiness,
+			Doc: RouteDoc{
+				Summary: "Report readiness based on subscription backlogs",
+				Tag:     "health",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Ready, or degraded in degraded mode.", Body: readinessResponse{}},
+					{Status: http.StatusServiceUnavailable, Description: "A subscription's backlog is over its limits.", Body: readinessResponse{}},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/catalog",
+			Handler: catalog,
+			Doc: RouteDoc{
+				Summary:   "List the event types published and consumed, with their topics, consumers, schemas and samples",
+				Tag:       "catalog",
+				Responses: []ResponseDoc{{Status: http.StatusOK, Description: "Event types, sorted by type.", Body: []catalogEvent{}}},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/metrics",
+			Handler: metricsHandler,
+			Doc:     RouteDoc{Summary: "Prometheus metrics, with metrics.backend prometheus, the default", Tag: "debug", Responses: []ResponseDoc{{Status: http.StatusOK, Description: "Metrics in the Prometheus text format."}}},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/debug/lifecycle",
+			Handler: recorder,
+			Doc:     RouteDoc{Summary: "History of fx lifecycle hook executions", Tag: "debug", Responses: []ResponseDoc{{Status: http.StatusOK, Description: "Hook executions, oldest first.", Body: []LifecycleEvent{}}}},
+		},
+		publishRoute(publish),
+		idempotentPublishRoute(publish),
+		{
+			Method:  http.MethodPost,
+			Path:    "/publish-groups",
+			Scope:   "publish:*",
+			Handler: groups,
+			Doc: RouteDoc{
+				Summary:     "Publish several messages, to any registered topics, all or none, followed by a completion marker on each topic",
+				Tag:         "publish",
+				RequestBody: publishGroupRequest{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Every message and marker was published.", Body: publishGroupResponse{}},
+					{Status: http.StatusAccepted, Description: "The group was staged but some messages failed to publish; the relay publishes them.", Body: publishGroupResponse{}},
+					{Status: http.StatusBadRequest, Description: "The request body or a message in it is invalid, so nothing was published."},
+					{Status: http.StatusForbidden, Description: "The API key lacks the publish scope of a message's topic."},
+					{Status: http.StatusNotFound, Description: "A message's topic isn't registered."},
+					{Status: http.StatusUnprocessableEntity, Description: "An email event references an unknown template."},
+					{Status: http.StatusTooManyRequests, Description: "The API key's publish budget can't fit the group; retry after Retry-After.", Body: unavailableResponse{}},
+					{Status: http.StatusInternalServerError, Description: "The group couldn't be staged, so nothing was published."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/eventarc",
+			Handler: eventarc,
+			Doc: RouteDoc{
+				Summary: "Receive a CloudEvent from an Eventarc trigger and republish it to the routed topic",
+				Tag:     "publish",
+				Responses: []ResponseDoc{
+					{Status: http.StatusNoContent, Description: "The event was republished, or dropped because no route matched."},
+					{Status: http.StatusAccepted, Description: "The routed topic was at its flow control limit, so the event was saved to its outbox to be republished once there's room.", Body: spilledResponse{}},
+					{Status: http.StatusBadRequest, Description: "The request isn't a valid CloudEvent."},
+					{Status: http.StatusTooManyRequests, Description: "Pub/Sub failed with RESOURCE_EXHAUSTED; retry after Retry-After.", Body: publishErrorResponse{}},
+					{Status: http.StatusInternalServerError, Description: "Republishing failed, with the gRPC code in the body; NOT_FOUND, PERMISSION_DENIED and DEADLINE_EXCEEDED map to 404, 403 and 504.", Body: publishErrorResponse{}},
+					{Status: http.StatusServiceUnavailable, Description: "Flow control or the topic's concurrency limit is saturated, the circuit breaker is open, the topic was deleted, or Pub/Sub failed with UNAVAILABLE; retry after Retry-After.", Body: unavailableResponse{}},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/email/templates",
+			Scope:   "admin:templates",
+			Handler: http.HandlerFunc(templates.List),
+			Doc: RouteDoc{
+				Summary: "List the latest version of every email template",
+				Tag:     "email",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Templates.", Body: []EmailTemplate{}},
+					{Status: http.StatusInternalServerError, Description: "The template storage failed."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/email/templates/{id}",
+			Scope:   "admin:templates",
+			Handler: http.HandlerFunc(templates.Get),
+			Doc: RouteDoc{
+				Summary: "Get a version of an email template",
+				Tag:     "email",
+				Query:   []QueryParameterDoc{{Name: "version", Description: "Version to get; defaults to the latest.", Type: "integer"}},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The template.", Body: EmailTemplate{}},
+					{Status: http.StatusBadRequest, Description: "The version is invalid."},
+					{Status: http.StatusNotFound, Description: "The template or version doesn't exist."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/email/templates/{id}/versions",
+			Scope:   "admin:templates",
+			Handler: http.HandlerFunc(templates.Versions),
+			Doc: RouteDoc{
+				Summary: "List every version of an email template",
+				Tag:     "email",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Versions, oldest first.", Body: []EmailTemplate{}},
+					{Status: http.StatusNotFound, Description: "The template doesn't exist."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPut,
+			Path:    "/email/templates/{id}",
+			Scope:   "admin:templates",
+			Handler: http.HandlerFunc(templates.Put),
+			Doc: RouteDoc{
+				Summary:     "Save a new version of an email template, creating it if needed",
+				Tag:         "email",
+				RequestBody: EmailTemplate{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusCreated, Description: "The saved version.", Body: EmailTemplate{}},
+					{Status: http.StatusBadRequest, Description: "The template is invalid or doesn't parse."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "/email/templates/{id}",
+			Scope:   "admin:templates",
+			Handler: http.HandlerFunc(templates.Delete),
+			Doc: RouteDoc{
+				Summary: "Delete every version of an email template",
+				Tag:     "email",
+				Responses: []ResponseDoc{
+					{Status: http.StatusNoContent, Description: "The template was deleted."},
+					{Status: http.StatusNotFound, Description: "The template doesn't exist."},
+				},
+			},
+		},
+		{
+			Method:        http.MethodPost,
+			Path:          "/email/templates/{id}/preview",
+			Scope:         "admin:templates",
+			Handler:       http.HandlerFunc(templates.Preview),
+			AllowReadOnly: true,
+			Doc: RouteDoc{
+				Summary:     "Render an email template with sample variables",
+				Tag:         "email",
+				RequestBody: templatePreviewRequest{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The rendered email.", Body: renderedEmail{}},
+					{Status: http.StatusNotFound, Description: "The template or version doesn't exist."},
+					{Status: http.StatusUnprocessableEntity, Description: "Rendering failed, e.g. a variable is missing."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/email/suppressions",
+			Scope:   "admin:suppressions",
+			Handler: http.HandlerFunc(suppressions.List),
+			Doc: RouteDoc{
+				Summary: "List the addresses email isn't sent to",
+				Tag:     "email",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Suppressions, by address.", Body: []Suppression{}},
+					{Status: http.StatusInternalServerError, Description: "The store failed."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/email/suppressions/{email}",
+			Scope:   "admin:suppressions",
+			Handler: http.HandlerFunc(suppressions.Get),
+			Doc: RouteDoc{
+				Summary: "Get why an address is suppressed",
+				Tag:     "email",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The suppression.", Body: Suppression{}},
+					{Status: http.StatusNotFound, Description: "The address isn't suppressed."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPut,
+			Path:    "/email/suppressions/{email}",
+			Scope:   "admin:suppressions",
+			Handler: http.HandlerFunc(suppressions.Put),
+			Doc: RouteDoc{
+				Summary:     "Suppress an address, so email events drop it from their recipients",
+				Tag:         "email",
+				RequestBody: Suppression{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The saved suppression.", Body: Suppression{}},
+					{Status: http.StatusBadRequest, Description: "The address or reason is invalid."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "/email/suppressions/{email}",
+			Scope:   "admin:suppressions",
+			Handler: http.HandlerFunc(suppressions.Delete),
+			Doc: RouteDoc{
+				Summary: "Stop suppressing an address",
+				Tag:     "email",
+				Responses: []ResponseDoc{
+					{Status: http.StatusNoContent, Description: "The suppression was removed."},
+					{Status: http.StatusNotFound, Description: "The address isn't suppressed."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/email/suppressions/import",
+			Scope:   "admin:suppressions",
+			Handler: http.HandlerFunc(suppressions.Import),
+			Doc: RouteDoc{
+				Summary:           "Suppress addresses in bulk, from a JSON array or a CSV of email,reason,note rows",
+				Tag:               "email",
+				RequestBody:       []Suppression{},
+				RequestMediaTypes: map[string]openAPISchema{"text/csv": {"type": "string", "description": "Rows of email,reason,note, where reason and note are optional, after an optional header row."}},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "How many addresses were suppressed.", Body: suppressionImportResult{}},
+					{Status: http.StatusBadRequest, Description: "A row is invalid; nothing was imported."},
+					{Status: http.StatusInternalServerError, Description: "The store failed part way; the rows before were imported."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/subscribers",
+			Scope:   "admin:subscribers",
+			Handler: http.HandlerFunc(subscribers.List),
+			Doc: RouteDoc{
+				Summary:   "List subscribers and whether they're paused",
+				Tag:       "admin",
+				Responses: []ResponseDoc{{Status: http.StatusOK, Description: "Subscribers by name.", Body: []subscriberStatus{}}},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/subscribers/{name}/pause",
+			Scope:   "admin:subscribers",
+			Handler: http.HandlerFunc(subscribers.Pause),
+			Doc: RouteDoc{
+				Summary: "Stop pulling new messages and wait for in-flight ones to finish",
+				Tag:     "admin",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The subscriber is paused and idle.", Body: subscriberStatus{}},
+					{Status: http.StatusAccepted, Description: "The subscriber is paused but still finishing in-flight messages."},
+					{Status: http.StatusNotFound, Description: "The subscriber doesn't exist."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/subscribers/{name}/resume",
+			Scope:   "admin:subscribers",
+			Handler: http.HandlerFunc(subscribers.Resume),
+			Doc: RouteDoc{
+				Summary: "Restart pulling messages for a paused subscriber",
+				Tag:     "admin",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The subscriber is receiving.", Body: subscriberStatus{}},
+					{Status: http.StatusAccepted, Description: "The subscriber is still finishing messages from before the pause; retry."},
+					{Status: http.StatusNotFound, Description: "The subscriber doesn't exist."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/subscriptions/{name}/peek",
+			Scope:   "admin:subscribers",
+			Handler: http.HandlerFunc(subscribers.Peek),
+			Doc: RouteDoc{
+				Summary: "Pull messages from a subscriber's backlog and nack them straight away",
+				Tag:     "admin",
+				Query:   []QueryParameterDoc{{Name: "limit", Description: "Maximum number of messages to pull, up to 100. Defaults to 10.", Type: "integer"}},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Messages with payload previews. They count as delivery attempts.", Body: []peekedMessage{}},
+					{Status: http.StatusBadRequest, Description: "The limit is invalid."},
+					{Status: http.StatusNotFound, Description: "The subscriber doesn't exist."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/subscriptions/{name}/retry-policy",
+			Scope:   "admin:subscribers",
+			Handler: http.HandlerFunc(subscribers.GetRetryPolicy),
+			Doc: RouteDoc{
+				Summary: "Compare a subscriber's live retry policy with the declared one",
+				Tag:     "admin",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The live and declared policies.", Body: retryPolicyStatus{}},
+					{Status: http.StatusNotFound, Description: "The subscriber or its subscription doesn't exist."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPut,
+			Path:    "/admin/subscriptions/{name}/retry-policy",
+			Scope:   "admin:subscribers",
+			Handler: http.HandlerFunc(subscribers.PutRetryPolicy),
+			Doc: RouteDoc{
+				Summary:     "Set a subscriber's retry policy in GCP, which drifts from the config unless it's updated to match",
+				Tag:         "admin",
+				RequestBody: retryPolicyBody{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The live and declared policies after the change.", Body: retryPolicyStatus{}},
+					{Status: http.StatusBadRequest, Description: "The backoffs are out of range."},
+					{Status: http.StatusNotFound, Description: "The subscriber or its subscription doesn't exist."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/loglevel",
+			Scope:   "admin:logging",
+			Handler: http.HandlerFunc(logLevels.Get),
+			Doc: RouteDoc{
+				Summary:   "Get the log levels of the instance serving the request",
+				Tag:       "admin",
+				Responses: []ResponseDoc{{Status: http.StatusOK, Description: "The default level and the levels set per logger.", Body: logLevelsStatus{}}},
+			},
+		},
+		{
+			Method:        http.MethodPut,
+			Path:          "/admin/loglevel",
+			Scope:         "admin:logging",
+			Handler:       http.HandlerFunc(logLevels.Put),
+			AllowReadOnly: true,
+			Doc: RouteDoc{
+				Summary:     "Set a logger's level, or the default, on the instance serving the request until it restarts",
+				Tag:         "admin",
+				RequestBody: logLevelUpdate{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The levels after the change.", Body: logLevelsStatus{}},
+					{Status: http.StatusBadRequest, Description: "The level is unknown."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/client/rotate",
+			Scope:   "admin:client",
+			Handler: http.HandlerFunc(rotator.Rotate),
+			Doc: RouteDoc{
+				Summary:     "Move publishing and subscribing on this instance to a new Pub/Sub client with other credentials, draining the current one",
+				Tag:         "admin",
+				RequestBody: clientRotation{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Traffic goes through the new client.", Body: clientRotationResponse{}},
+					{Status: http.StatusBadRequest, Description: "The request is invalid or the key file can't be read."},
+					{Status: http.StatusConflict, Description: "A rotation is already in progress."},
+					{Status: http.StatusUnprocessableEntity, Description: "The new client couldn't be created or can't reach every topic and subscription, so traffic stays on the current one."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/provision",
+			Scope:   "admin:provision",
+			Handler: http.HandlerFunc(reconciler.Provision),
+			Doc: RouteDoc{
+				Summary: "Reload the config file and create or fix the Pub/Sub resources it declares",
+				Tag:     "admin",
+				Query:   []QueryParameterDoc{{Name: "dry_run", Description: "Only return the changes that would be made.", Type: "boolean"}},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Each difference from the declared topology, what was done about it and, for push subscriptions created or repointed, whether their endpoint accepted a test push.", Body: provisionResponse{}},
+					{Status: http.StatusBadRequest, Description: "dry_run isn't a boolean."},
+					{Status: http.StatusUnprocessableEntity, Description: "The config file can't be loaded."},
+					{Status: http.StatusInternalServerError, Description: "The live topology can't be read."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/usage",
+			Scope:   "admin:usage",
+			Handler: http.HandlerFunc(usage.List),
+			Doc: RouteDoc{
+				Summary: "Get what each API key has published this hour and day, against its budget",
+				Tag:     "admin",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Usage by API key, sorted by key name.", Body: []callerUsage{}},
+					{Status: http.StatusNotFound, Description: "Quotas aren't enabled."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/routing",
+			Scope:   "admin:routing",
+			Handler: router,
+			Doc: RouteDoc{
+				Summary: "Get the topic aliases, splits and Eventarc routes in effect, and whether they come from the config or Firestore",
+				Tag:     "admin",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The routing table.", Body: RoutingTable{}},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/read-only",
+			Scope:   "admin:read_only",
+			Handler: http.HandlerFunc(readOnly.Get),
+			Doc: RouteDoc{
+				Summary:   "Get whether publishes and admin mutations are rejected",
+				Tag:       "admin",
+				Responses: []ResponseDoc{{Status: http.StatusOK, Description: "Read-only mode and who toggled it.", Body: readOnlyStatus{}}},
+			},
+		},
+		{
+			Method:        http.MethodPut,
+			Path:          "/admin/read-only",
+			Scope:         "admin:read_only",
+			Handler:       http.HandlerFunc(readOnly.Put),
+			AllowReadOnly: true,
+			Doc: RouteDoc{
+				Summary:     "Turn read-only mode on or off for every instance sharing the store",
+				Tag:         "admin",
+				RequestBody: readOnlyUpdate{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Read-only mode after the change.", Body: readOnlyStatus{}},
+					{Status: http.StatusBadRequest, Description: "The request body is invalid."},
+					{Status: http.StatusConflict, Description: "The config sets read_only, so it can't be turned off."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/recent",
+			Scope:   "admin:recent",
+			Handler: http.HandlerFunc(recent.List),
+			Doc: RouteDoc{
+				Summary: "List the messages this instance published most recently, newest first",
+				Tag:     "admin",
+				Query: []QueryParameterDoc{
+					{Name: "topic", Description: "Only list messages published to this topic.", Type: "string"},
+					{Name: "limit", Description: "Maximum number of messages to return. Defaults to 100.", Type: "integer"},
+				},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Recently published messages.", Body: []recentMessage{}},
+					{Status: http.StatusBadRequest, Description: "The limit is invalid."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/tail",
+			Scope:   "admin:recent",
+			Handler: http.HandlerFunc(recent.Tail),
+			Doc: RouteDoc{
+				Summary: "Stream messages as this instance publishes them, as Server-Sent Events",
+				Tag:     "admin",
+				Query: []QueryParameterDoc{
+					{Name: "topic", Description: "Only stream messages published to this topic.", Type: "string"},
+				},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "A text/event-stream of publish events, each a recently published message as JSON."},
+					{Status: http.StatusServiceUnavailable, Description: "The instance is shutting down."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/failures",
+			Scope:   "admin:failures",
+			Handler: http.HandlerFunc(failures.List),
+			Doc: RouteDoc{
+				Summary: "List publishes and consumed messages that were given up on, newest first",
+				Tag:     "admin",
+				Query: []QueryParameterDoc{
+					{Name: "kind", Description: "publish or consume.", Type: "string"},
+					{Name: "resource", Description: "The topic or subscription name.", Type: "string"},
+					{Name: "status", Description: "new, triaged, resolved or replayed.", Type: "string"},
+					{Name: "limit", Description: "Maximum number of failures to return. Defaults to 100.", Type: "integer"},
+				},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Failures.", Body: []Failure{}},
+					{Status: http.StatusBadRequest, Description: "The limit is invalid."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/failures/search",
+			Scope:   "admin:failures",
+			Handler: http.HandlerFunc(failures.Search),
+			Doc: RouteDoc{
+				Summary: "Search dead-lettered and quarantined messages by their metadata, newest first",
+				Tag:     "admin",
+				Query: []QueryParameterDoc{
+					{Name: "message_id", Description: "The ID of the message that failed.", Type: "string"},
+					{Name: "tenant", Description: "The message's tenant attribute.", Type: "string"},
+					{Name: "type", Description: "The message's event type attribute.", Type: "string"},
+					{Name: "destination", Description: "The dead letter or quarantine topic the message was moved to.", Type: "string"},
+					{Name: "resource", Description: "The subscription name.", Type: "string"},
+					{Name: "attribute", Description: "name=value, for an attribute in failures.index_attributes.", Type: "string"},
+					{Name: "error", Description: "Text the error contains, ignoring case.", Type: "string"},
+					{Name: "since", Description: "Only failures at or after this RFC 3339 time.", Type: "string"},
+					{Name: "until", Description: "Only failures before this RFC 3339 time.", Type: "string"},
+					{Name: "limit", Description: "Maximum number of failures to return. Defaults to 100.", Type: "integer"},
+				},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The metadata of matching failures; get one by ID for its data.", Body: []failureIndexEntry{}},
+					{Status: http.StatusBadRequest, Description: "The limit, attribute or a time is invalid."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/failures/{id}",
+			Scope:   "admin:failures",
+			Handler: http.HandlerFunc(failures.Get),
+			Doc: RouteDoc{
+				Summary: "Get a failure",
+				Tag:     "admin",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The failure.", Body: Failure{}},
+					{Status: http.StatusNotFound, Description: "The failure doesn't exist or has expired."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPatch,
+			Path:    "/admin/failures/{id}",
+			Scope:   "admin:failures",
+			Handler: http.HandlerFunc(failures.Update),
+			Doc: RouteDoc{
+				Summary:     "Change a failure's triage status or note",
+				Tag:         "admin",
+				RequestBody: failureUpdate{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The updated failure.", Body: Failure{}},
+					{Status: http.StatusBadRequest, Description: "The update is invalid."},
+					{Status: http.StatusNotFound, Description: "The failure doesn't exist or has expired."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/failures/{id}/replay",
+			Scope:   "admin:failures",
+			Handler: http.HandlerFunc(failures.Replay),
+			Doc: RouteDoc{
+				Summary: "Publish a failed message again and mark it replayed",
+				Tag:     "admin",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The replayed failure.", Body: Failure{}},
+					{Status: http.StatusNotFound, Description: "The failure doesn't exist or has expired."},
+					{Status: http.StatusConflict, Description: "The failure's data was truncated."},
+					{Status: http.StatusTooManyRequests, Description: "Pub/Sub failed with RESOURCE_EXHAUSTED; retry after Retry-After.", Body: publishErrorResponse{}},
+					{Status: http.StatusInternalServerError, Description: "Publishing failed, with the gRPC code in the body; PERMISSION_DENIED and DEADLINE_EXCEEDED map to 403 and 504.", Body: publishErrorResponse{}},
+					{Status: http.StatusServiceUnavailable, Description: "The topic can't take publishes right now; retry after Retry-After.", Body: unavailableResponse{}},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/quarantine/{subscription}",
+			Scope:   "admin:quarantine",
+			Handler: http.HandlerFunc(quarantine.List),
+			Doc: RouteDoc{
+				Summary: "List quarantined messages without removing them",
+				Tag:     "admin",
+				Query:   []QueryParameterDoc{limitParameter},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Quarantined messages.", Body: []quarantinedMessage{}},
+					{Status: http.StatusNotFound, Description: "The subscription has no quarantine."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/quarantine/{subscription}/requeue",
+			Scope:   "admin:quarantine",
+			Handler: http.HandlerFunc(quarantine.Requeue),
+			Doc: RouteDoc{
+				Summary: "Republish quarantined messages to the subscription's topic",
+				Tag:     "admin",
+				Query: []QueryParameterDoc{
+					limitParameter,
+					{Name: "id", Description: "Only requeue these quarantine message IDs.", Type: "string", Repeated: true},
+				},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "Requeue outcome.", Body: requeueResponse{}},
+					{Status: http.StatusNotFound, Description: "The subscription has no quarantine."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/transforms/{kind}/{id}",
+			Scope:   "admin:transforms",
+			Handler: http.HandlerFunc(transforms.Get),
+			Doc: RouteDoc{
+				Summary: "Get the message transforms on a topic or subscription",
+				Tag:     "admin",
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The resource's message transforms.", Body: []messageTransform{}},
+					{Status: http.StatusBadGateway, Description: "Pub/Sub rejected the request."},
+					{Status: http.StatusNotImplemented, Description: "Running against the emulator."},
+				},
+			},
+		},
+		{
+			Method:  http.MethodPut,
+			Path:    "/admin/transforms/{kind}/{id}",
+			Scope:   "admin:transforms",
+			Handler: http.HandlerFunc(transforms.Put),
+			Doc: RouteDoc{
+				Summary:     "Validate and replace the message transforms on a topic or subscription",
+				Tag:         "admin",
+				RequestBody: transformApplyRequest{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The transforms were applied, or validated for a dry run.", Body: []messageTransform{}},
+					{Status: http.StatusBadRequest, Description: "The request body is invalid."},
+					{Status: http.StatusUnprocessableEntity, Description: "A transform failed validation."},
+					{Status: http.StatusBadGateway, Description: "Pub/Sub rejected the update."},
+					{Status: http.StatusNotImplemented, Description: "Running against the emulator."},
+				},
+			},
+		},
+		{
+			Method:        http.MethodPost,
+			Path:          "/admin/transforms/test",
+			Scope:         "admin:transforms",
+			Handler:       http.HandlerFunc(transforms.Test),
+			AllowReadOnly: true,
+			Doc: RouteDoc{
+				Summary:     "Dry-run message transforms against sample messages",
+				Tag:         "admin",
+				RequestBody: transformTestRequest{},
+				Responses: []ResponseDoc{
+					{Status: http.StatusOK, Description: "The result of each transform on each message.", Body: []transformTestResult{}},
+					{Status: http.StatusBadRequest, Description: "The request body is invalid."},
+					{Status: http.StatusNotImplemented, Description: "Running against the emulator."},
+				},
+			},
+		},
+	}
+
+	if config.Campaigns.Enabled {
+		routes = append(routes, campaignRoutes(campaigns)...)
+	}
+	if config.HTTP.Debug {
+		routes = append(routes, debugRoutes(config, diagnostics)...)
+	}
+	return routes
+}
+
+// withDocs adds the OpenAPI description of routes, and the Swagger UI if
+// enabled, to the routes a server serves.
+func withDocs(config Config, routes []Route) []Route {
+	document := newOpenAPIDocument(routes)
+	routes = append(routes, Route{
+		Method:  http.MethodGet,
+		Path:    "/openapi.json",
+		Handler: document,
+		Doc:     RouteDoc{Undocumented: true},
+	})
+	if config.HTTP.SwaggerUI {
+		routes = append(routes, Route{
+			Method:  http.MethodGet,
+			Path:    "/docs",
+			Handler: swaggerUIHandler,
+			Doc:     RouteDoc{Undocumented: true},
+		})
+	}
+	return routes
+}
+
+// internal reports whether the route is an admin surface, which is served
+// only on the admin port when there is one: the admin API, debugging,
+// metrics and anything else needing an admin scope.
+func (r Route) internal() bool {
+	return strings.HasPrefix(r.Path, "/admin/") || strings.HasPrefix(r.Path, "/debug/") || r.Path == "/metrics" ||
+		strings.HasPrefix(r.Scope, "admin:")
+}
+
+// splitRoutes divides routes between the public and admin ports. Health
+// checks are served on both, so either can be probed.
+func splitRoutes(routes []Route) (public []Route, admin []Route) {
+	for _, route := range routes {
+		switch {
+		case route.Doc.Tag == "health":
+			public = append(public, route)
+			admin = append(admin, route)
+		case route.internal():
+			admin = append(admin, route)
+		default:
+			public = append(public, route)
+		}
+	}
+	return public, admin
+}
+
+// publishRoute is the publish endpoint, which the benchmarks also serve
+// on its own.
+func publishRoute(publish *PublishHandler) Route {
+	return Route{
+		Method:  http.MethodPost,
+		Path:    "/publish/{topic}",
+		Scope:   "publish:{topic}",
+		Handler: publish,
+		Doc: RouteDoc{
+			Summary:           "Publish a message, or forward a Pub/Sub push envelope, to a registered topic",
+			Tag:               "publish",
+			RequestBody:       publishRequest{},
+			RequestMediaTypes: publishMediaTypes,
+			Responses: []ResponseDoc{
+				{Status: http.StatusOK, Description: "The message was published, or with dedup enabled, was already published with the request's Idempotency-Key, which Idempotent-Replayed says.", Body: publishResponse{}},
+				{Status: http.StatusAccepted, Description: "With X-Callback-Url, the message is being published, and the result will be POSTed to the URL with the request ID. If the forwarded push message reached lineage.max_hops, it was recorded as a failure instead of published. Or, if the topic's flow control spills, the topic was at its limit, so the message was saved to its outbox, with the outbox_id, to be published once there's room.", Body: callbackAccepted{}},
+				{Status: http.StatusBadRequest, Description: "The request body is invalid, X-Callback-Url's host isn't in callbacks.allowed_hosts, or Pub/Sub rejected the message with INVALID_ARGUMENT."},
+				{Status: http.StatusForbidden, Description: "Pub/Sub denied the service permission to publish to the topic, with PERMISSION_DENIED.", Body: publishErrorResponse{}},
+				{Status: http.StatusNotFound, Description: "The topic isn't registered, an alias or a split, or Pub/Sub failed with NOT_FOUND."},
+				{Status: http.StatusUnsupportedMediaType, Description: "The Content-Type isn't JSON, Protobuf, plain text or multipart/form-data."},
+				{Status: http.StatusConflict, Description: "A publish with the same idempotency key is still in flight; retry."},
+				{Status: http.StatusUnprocessableEntity, Description: "The email event references an unknown template, or the idempotency key was used for a different message."},
+				{Status: http.StatusTooManyRequests, Description: "The API key's hourly or daily publish budget is used up, or Pub/Sub failed with RESOURCE_EXHAUSTED; retry after Retry-After.", Body: unavailableResponse{}},
+				{Status: http.StatusInternalServerError, Description: "Publishing failed, with the gRPC code in the body.", Body: publishErrorResponse{}},
+				{Status: http.StatusServiceUnavailable, Description: "Flow control or the topic's concurrency limit is saturated, the circuit breaker is open, the topic was deleted, or Pub/Sub failed with UNAVAILABLE; retry after Retry-After.", Body: unavailableResponse{}},
+				{Status: http.StatusGatewayTimeout, Description: "Pub/Sub failed with DEADLINE_EXCEEDED.", Body: publishErrorResponse{}},
+			},
+		},
+	}
+}
+
+// idempotentPublishRoute publishes under a key in the URL, so a retried PUT
+// returns the message it first published instead of publishing again.
+func idempotentPublishRoute(publish *PublishHandler) Route {
+	route := publishRoute(publish)
+	route.Method = http.MethodPut
+	route.Path = "/publish/{topic}/{key}"
+	route.Doc.Summary = "Publish a message under a key, once per key, to a registered topic"
+	route.Doc.Responses = append([]ResponseDoc{
+		{Status: http.StatusOK, Description: "The message was published with the key in its idempotency_key attribute, or was already published with the key, which Idempotent-Replayed says.", Body: publishResponse{}},
+	}, route.Doc.Responses[1:]...)
+	for i, response := range route.Doc.Responses {
+		if response.Status == http.StatusUnprocessableEntity {
+			route.Doc.Responses[i].Description = "The email event references an unknown template, or the key was used for a different message."
+		}
+	}
+	return route
+}
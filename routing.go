@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"go.uber.org/fx"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	routingSourceConfig    = "config"
+	routingSourceFirestore = "firestore"
+
+	defaultRoutingCollection = "routing"
+	defaultRoutingDocument   = "default"
+	// routingWatchRetry is how long after the document's watch fails it's
+	// watched again.
+	routingWatchRetry = 10 * time.Second
+)
+
+// RoutingConfig decides which configured topic what's published to a topic
+// name goes to, for the HTTP API and Eventarc.
+type RoutingConfig struct {
+	// Aliases map names callers publish to onto configured topics, so a
+	// topic can be replaced without its publishers changing.
+	Aliases map[string]string `yaml:"aliases"`
+	// Splits divide what's published to a name between topics by weight,
+	// e.g. for an A/B test of a new consumer.
+	Splits []TopicSplit `yaml:"splits"`
+	// Firestore, if set, takes the aliases, splits and Eventarc routes from
+	// a Firestore document instead, watched for changes, so they can be
+	// changed without redeploying. Each version of the document replaces
+	// them all, once it's validated against the configured topics; an
+	// invalid version is ignored. While the document doesn't exist, the
+	// config's are used.
+	Firestore *RoutingFirestoreConfig `yaml:"firestore"`
+}
+
+type RoutingFirestoreConfig struct {
+	// Project defaults to PROJECT_ID.
+	Project  string `yaml:"project"`
+	Database string `yaml:"database"`
+	// Collection and Document name the document, routing/default by
+	// default. It has the fields aliases, a map, and splits and
+	// eventarc_routes, arrays of maps with the fields of their config.
+	Collection string `yaml:"collection"`
+	Document   string `yaml:"document"`
+}
+
+type TopicSplit struct {
+	// Topic is the name published to. It may be a configured topic, whose
+	// messages are then split too, but not an alias.
+	Topic string `yaml:"topic" firestore:"topic" json:"topic"`
+	// Key is the attribute that keeps messages with the same value on the
+	// same variant. Messages without it are split at random.
+	Key      string         `yaml:"key" firestore:"key" json:"key,omitempty"`
+	Variants []SplitVariant `yaml:"variants" firestore:"variants" json:"variants"`
+}
+
+type SplitVariant struct {
+	// Topic is the configured topic the variant publishes to.
+	Topic  string `yaml:"topic" firestore:"topic" json:"topic"`
+	Weight int    `yaml:"weight" firestore:"weight" json:"weight"`
+}
+
+// RoutingTable is the routing in effect.
+type RoutingTable struct {
+	Aliases        map[string]string `firestore:"aliases" json:"aliases"`
+	Splits         []TopicSplit      `firestore:"splits" json:"splits"`
+	EventarcRoutes []EventarcRoute   `firestore:"eventarc_routes" json:"eventarc_routes"`
+	// Source is config or firestore, and UpdatedAt when the Firestore
+	// document was last changed.
+	Source    string     `firestore:"-" json:"source"`
+	UpdatedAt *time.Time `firestore:"-" json:"updated_at,omitempty"`
+
+	splits map[string]TopicSplit
+}
+
+// validate checks the table against the configured topics, and indexes its
+// splits.
+func (t *RoutingTable) validate(topics map[string]bool) error {
+	for alias, topic := range t.Aliases {
+		if topics[alias] {
+			return fmt.Errorf("alias %s is the name of a configured topic", alias)
+		}
+		if !topics[topic] {
+			return fmt.Errorf("alias %s: topic %s isn't configured", alias, topic)
+		}
+	}
+	t.splits = make(map[string]TopicSplit, len(t.Splits))
+	for _, split := range t.Splits {
+		if split.Topic == "" || len(split.Variants) == 0 {
+			return errors.New("splits need a topic and variants")
+		}
+		if _, ok := t.Aliases[split.Topic]; ok {
+			return fmt.Errorf("split %s: %s is an alias", split.Topic, split.Topic)
+		}
+		if _, ok := t.splits[split.Topic]; ok {
+			return fmt.Errorf("split %s: %s is split twice", split.Topic, split.Topic)
+		}
+		for _, variant := range split.Variants {
+			if !topics[variant.Topic] {
+				return fmt.Errorf("split %s: topic %s isn't configured", split.Topic, variant.Topic)
+			}
+			if variant.Weight <= 0 {
+				return fmt.Errorf("split %s: variant weights must be positive", split.Topic)
+			}
+		}
+		t.splits[split.Topic] = split
+	}
+	for i, route := range t.EventarcRoutes {
+		if route.Type == "" || !topics[route.Topic] {
+			return fmt.Errorf("eventarc route %d needs a type and a configured topic", i)
+		}
+		if err := route.validatePatterns(); err != nil {
+			return fmt.Errorf("eventarc route %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// pick returns the variant msg's attributes go to.
+func (s TopicSplit) pick(attributes map[string]string) string {
+	total := 0
+	for _, variant := range s.Variants {
+		total += variant.Weight
+	}
+	var point int
+	if value, ok := attributes[s.Key]; ok && s.Key != "" {
+		hash := fnv.New32a()
+		hash.Write([]byte(value))
+		point = int(hash.Sum32() % uint32(total))
+	} else {
+		point = rand.IntN(total)
+	}
+	for _, variant := range s.Variants {
+		if point < variant.Weight {
+			return variant.Topic
+		}
+		point -= variant.Weight
+	}
+	return s.Variants[len(s.Variants)-1].Topic
+}
+
+// Router resolves topic names with the routing table in effect, which the
+// Firestore document can replace at any time.
+type Router struct {
+	logger *log.Logger
+	topics map[string]bool
+	static *RoutingTable
+	table  atomic.Pointer[RoutingTable]
+}
+
+func newRouter(lifecycle fx.Lifecycle, config Config, params PubSubParams) (*Router, error) {
+	router := &Router{logger: newLogger("routing"), topics: make(map[string]bool, len(config.Topics))}
+	for _, topic := range config.Topics {
+		router.topics[topic.Name] = true
+	}
+	router.static = &RoutingTable{
+		Aliases:        config.Routing.Aliases,
+		Splits:         config.Routing.Splits,
+		EventarcRoutes: config.Eventarc.Routes,
+		Source:         routingSourceConfig,
+	}
+	if err := router.static.validate(router.topics); err != nil {
+		return nil, fmt.Errorf("routing: %w", err)
+	}
+	router.table.Store(router.static)
+
+	settings := config.Routing.Firestore
+	if settings == nil {
+		return router, nil
+	}
+	if params.Config.ProjectId == localProjectId && os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		router.logger.Println("Routing comes from the config without Firestore")
+		return router, nil
+	}
+	project := settings.Project
+	if project == "" {
+		project = params.Config.ProjectId
+	}
+	database := settings.Database
+	if database == "" {
+		database = firestore.DefaultDatabaseID
+	}
+	collection := settings.Collection
+	if collection == "" {
+		collection = defaultRoutingCollection
+	}
+	document := settings.Document
+	if document == "" {
+		document = defaultRoutingDocument
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var client *firestore.Client
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(startCtx context.Context) error {
+				var err error
+				client, err = firestore.NewClientWithDatabase(startCtx, project, database, params.clientOptions()...)
+				if err != nil {
+					return fmt.Errorf("routing: connecting to Firestore: %w", err)
+				}
+				go router.watch(ctx, client.Collection(collection).Doc(document), done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				return client.Close()
+			},
+		},
+	)
+	return router, nil
+}
+
+// watch applies each version of the routing document until ctx is done.
+func (r *Router) watch(ctx context.Context, doc *firestore.DocumentRef, done chan<- struct{}) {
+	defer close(done)
+	for {
+		snapshots := doc.Snapshots(ctx)
+		for {
+			snapshot, err := snapshots.Next()
+			if err != nil {
+				if ctx.Err() == nil && status.Code(err) != codes.Canceled {
+					routingUpdates.WithLabelValues("error").Inc()
+					r.logger.Printf("Failed to watch routing document %s, keeping the current routing: %v", doc.Path, err)
+				}
+				break
+			}
+			r.apply(snapshot)
+		}
+		snapshots.Stop()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(routingWatchRetry):
+		}
+	}
+}
+
+// apply replaces the routing table with a version of the document.
+func (r *Router) apply(snapshot *firestore.DocumentSnapshot) {
+	if !snapshot.Exists() {
+		if r.table.Swap(r.static) != r.static {
+			r.logger.Printf("Routing document %s doesn't exist, routing from the config", snapshot.Ref.Path)
+		}
+		routingUpdates.WithLabelValues("missing").Inc()
+		return
+	}
+	table := new(RoutingTable)
+	err := snapshot.DataTo(table)
+	if err == nil {
+		err = table.validate(r.topics)
+	}
+	if err != nil {
+		routingUpdates.WithLabelValues("invalid").Inc()
+		r.logger.Printf("Ignoring invalid version of routing document %s, keeping the current routing: %v", snapshot.Ref.Path, err)
+		return
+	}
+	table.Source = routingSourceFirestore
+	updatedAt := snapshot.UpdateTime.UTC()
+	table.UpdatedAt = &updatedAt
+	r.table.Store(table)
+	routingUpdates.WithLabelValues("applied").Inc()
+	r.logger.Printf("Applied routing document %s from %s: %d aliases, %d splits, %d Eventarc routes",
+		snapshot.Ref.Path, updatedAt.Format(time.RFC3339), len(table.Aliases), len(table.Splits), len(table.EventarcRoutes))
+}
+
+// Known reports whether name can be published to: whether it's a
+// configured topic, an alias or split.
+func (r *Router) Known(name string) bool {
+	table := r.table.Load()
+	_, aliased := table.Aliases[name]
+	_, split := table.splits[name]
+	return r.topics[name] || aliased || split
+}
+
+// Route returns the configured topic a message with attributes published
+// to name goes to.
+func (r *Router) Route(name string, attributes map[string]string) string {
+	table := r.table.Load()
+	topic := name
+	if split, ok := table.splits[name]; ok {
+		topic = split.pick(attributes)
+	} else if aliased, ok := table.Aliases[name]; ok {
+		topic = aliased
+	}
+	if topic != name {
+		routedMessages.WithLabelValues(name, topic).Inc()
+	}
+	return topic
+}
+
+// EventarcRoutes returns the Eventarc routes in effect.
+func (r *Router) EventarcRoutes() []EventarcRoute {
+	return r.table.Load().EventarcRoutes
+}
+
+// ServeHTTP reports the routing table in effect.
+func (r *Router) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.table.Load())
+}
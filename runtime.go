@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+type RuntimeConfig struct {
+	// MaxProcs overrides GOMAXPROCS. Zero derives it from the container CPU
+	// limit, rounded down and at least 1, so a fractional-CPU Cloud Run
+	// instance doesn't schedule more threads than it has quota for.
+	MaxProcs int `yaml:"max_procs"`
+	// GCPercent sets GOGC. Unset leaves the Go default.
+	GCPercent *int `yaml:"gc_percent"`
+	// MemoryLimitRatio sets the soft memory limit to this fraction of the
+	// container memory limit. MemoryLimit, in bytes, takes precedence.
+	MemoryLimitRatio float64 `yaml:"memory_limit_ratio"`
+	MemoryLimit      int64   `yaml:"memory_limit"`
+}
+
+// applyRuntimeConfig tunes the Go runtime for the container it runs in.
+// GOMAXPROCS, GOGC and GOMEMLIMIT set in the environment win over config,
+// as they do for the runtime itself.
+func applyRuntimeConfig(config Config) {
+	logger := newLogger("runtime")
+	settings := config.Runtime
+
+	cpuLimit, hasCPULimit := containerCPULimit()
+	if hasCPULimit {
+		containerCPULimitCores.Set(cpuLimit)
+	}
+	if _, ok := os.LookupEnv("GOMAXPROCS"); ok {
+		logger.Printf("Using GOMAXPROCS=%d from the environment", runtime.GOMAXPROCS(0))
+	} else if settings.MaxProcs > 0 {
+		runtime.GOMAXPROCS(settings.MaxProcs)
+		logger.Printf("Set GOMAXPROCS=%d from config", settings.MaxProcs)
+	} else if hasCPULimit {
+		procs := max(int(math.Floor(cpuLimit)), 1)
+		runtime.GOMAXPROCS(procs)
+		logger.Printf("Set GOMAXPROCS=%d from container CPU limit %g", procs, cpuLimit)
+	}
+
+	if _, ok := os.LookupEnv("GOGC"); !ok && settings.GCPercent != nil {
+		debug.SetGCPercent(*settings.GCPercent)
+		logger.Printf("Set GOGC=%d from config", *settings.GCPercent)
+	}
+
+	if _, ok := os.LookupEnv("GOMEMLIMIT"); !ok {
+		limit := settings.MemoryLimit
+		if limit == 0 && settings.MemoryLimitRatio > 0 {
+			if memory, ok := containerMemoryLimit(); ok {
+				limit = int64(float64(memory) * settings.MemoryLimitRatio)
+			} else {
+				logger.Println("memory_limit_ratio is set but the container has no memory limit")
+			}
+		}
+		if limit > 0 {
+			debug.SetMemoryLimit(limit)
+			logger.Printf("Set GOMEMLIMIT=%d from config", limit)
+		}
+	}
+
+	registerRuntimeMetrics()
+}
+
+// registerRuntimeMetrics replaces the default Go collector with one that
+// also exports the scheduler, GC and memory runtime/metrics, including the
+// effective GOMAXPROCS, GOGC and GOMEMLIMIT.
+func registerRuntimeMetrics() {
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.GoRuntimeMetricsRule{
+			Matcher: regexp.MustCompile(`^/(sched|gc|memory)/.*`),
+		}),
+	))
+}
+
+// containerCPULimit reads the CPU quota from cgroup v2, falling back to
+// cgroup v1. It reports false when the container has no CPU limit.
+func containerCPULimit() (float64, bool) {
+	if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, quotaErr := strconv.ParseFloat(fields[0], 64)
+			period, periodErr := strconv.ParseFloat(fields[1], 64)
+			if quotaErr == nil && periodErr == nil && period > 0 {
+				return quota / period, true
+			}
+		}
+		return 0, false
+	}
+	quota, err := readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil || quota <= 0 {
+		return 0, false
+	}
+	period, err := readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil || period <= 0 {
+		return 0, false
+	}
+	return float64(quota) / float64(period), true
+}
+
+// containerMemoryLimit reads the memory limit from cgroup v2, falling back
+// to cgroup v1, which reports an unlimited container as a value close to
+// MaxInt64 rather than "max".
+func containerMemoryLimit() (int64, bool) {
+	if data, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0, false
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		return limit, err == nil && limit > 0
+	}
+	limit, err := readCgroupInt("/sys/fs/cgroup/memory/memory.limit_in_bytes")
+	if err != nil || limit <= 0 || limit >= math.MaxInt64/2 {
+		return 0, false
+	}
+	return limit, true
+}
+
+func readCgroupInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
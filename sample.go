@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Diagnostic attributes added to the mirrored copies of sampled messages.
+const (
+	debugSourceTopicAttribute = "debug_source_topic"
+	debugMessageIdAttribute   = "debug_message_id"
+	debugPublishedAtAttribute = "debug_published_at"
+	// debugOrderingKeyAttribute keeps the ordering key, which the debug
+	// topic doesn't use, so one hot key can't hold up the rest.
+	debugOrderingKeyAttribute = "debug_ordering_key"
+	debugSizeAttribute        = "debug_size"
+	debugInstanceAttribute    = "debug_instance"
+)
+
+type DebugSampleConfig struct {
+	// Topic is the Pub/Sub topic ID a sample of the messages published is
+	// mirrored to, for inspecting real traffic without consuming from
+	// production subscriptions.
+	Topic string `yaml:"topic"`
+	// Rate is the fraction of messages mirrored, e.g. 0.001 for 0.1%.
+	Rate float64 `yaml:"rate"`
+}
+
+// DebugSampler mirrors a random sample of a topic's successful publishes to
+// its debug topic, in the background so sampling adds no latency. Mirroring
+// is best effort: failures are counted, not retried.
+type DebugSampler struct {
+	config   DebugSampleConfig
+	source   string
+	instance string
+	topic    *pubsub.Topic
+}
+
+func newDebugSampler(client *pubsub.Client, topic TopicConfig) *DebugSampler {
+	instance := os.Getenv("K_REVISION")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return &DebugSampler{
+		config:   *topic.DebugSample,
+		source:   topic.Name,
+		instance: instance,
+		topic:    client.Topic(topic.DebugSample.Topic),
+	}
+}
+
+// Sample mirrors msg, published as messageId, if it's picked.
+func (s *DebugSampler) Sample(msg *pubsub.Message, messageId string) {
+	if rand.Float64() >= s.config.Rate {
+		return
+	}
+	attributes := make(map[string]string, len(msg.Attributes)+6)
+	for key, value := range msg.Attributes {
+		attributes[key] = value
+	}
+	attributes[debugSourceTopicAttribute] = s.source
+	attributes[debugMessageIdAttribute] = messageId
+	attributes[debugPublishedAtAttribute] = time.Now().UTC().Format(time.RFC3339Nano)
+	attributes[debugSizeAttribute] = strconv.Itoa(len(msg.Data))
+	if msg.OrderingKey != "" {
+		attributes[debugOrderingKeyAttribute] = msg.OrderingKey
+	}
+	if s.instance != "" {
+		attributes[debugInstanceAttribute] = s.instance
+	}
+	// Not the request's context, which ends before the mirror is sent.
+	ctx := context.Background()
+	result := s.topic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attributes})
+	go func() {
+		if _, err := result.Get(ctx); err != nil {
+			debugSampledMessages.WithLabelValues(s.source, "error").Inc()
+			return
+		}
+		debugSampledMessages.WithLabelValues(s.source, "ok").Inc()
+	}()
+}
+
+func (s *DebugSampler) stop() {
+	s.topic.Stop()
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// importPaths are protoc -I directories.
+type importPaths []string
+
+func (p *importPaths) String() string {
+	return strings.Join(*p, string(os.PathListSeparator))
+}
+
+func (p *importPaths) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// buildDescriptors compiles files with protoc into a descriptor set that
+// includes everything they import.
+func buildDescriptors(ctx context.Context, protoc string, includes importPaths, files []string) (*protoregistry.Files, error) {
+	dir, err := os.MkdirTemp("", "schema")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "descriptors.pb")
+	args := []string{"--include_imports", "--descriptor_set_out=" + out}
+	if len(includes) == 0 {
+		includes = importPaths{"."}
+	}
+	for _, include := range includes {
+		args = append(args, "-I", include)
+	}
+	command := exec.CommandContext(ctx, protoc, append(args, files...)...)
+	command.Stderr = os.Stderr
+	if err := command.Run(); err != nil {
+		return nil, fmt.Errorf("running %s: %w", protoc, err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("reading descriptor set: %w", err)
+	}
+	return protodesc.NewFiles(&set)
+}
+
+// findMessage returns the message called name, or without a name the only
+// top-level message of file.
+func findMessage(files *protoregistry.Files, file string, name string) (protoreflect.MessageDescriptor, error) {
+	if name != "" {
+		descriptor, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, fmt.Errorf("message %s: %w", name, err)
+		}
+		message, ok := descriptor.(protoreflect.MessageDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%s isn't a message", name)
+		}
+		return message, nil
+	}
+	var found protoreflect.FileDescriptor
+	files.RangeFiles(func(descriptor protoreflect.FileDescriptor) bool {
+		if filepath.Base(descriptor.Path()) == filepath.Base(file) {
+			found = descriptor
+		}
+		return found == nil
+	})
+	if found == nil {
+		return nil, fmt.Errorf("%s isn't in the descriptor set", file)
+	}
+	if found.Messages().Len() != 1 {
+		return nil, fmt.Errorf("%s has %d top-level messages; pick one with -message", file, found.Messages().Len())
+	}
+	return found.Messages().Get(0), nil
+}
+
+// schemaDefinition renders message as a single self-contained .proto, as
+// Pub/Sub schemas can't import other files and must have exactly one
+// top-level message. The types it uses from elsewhere, including the
+// well-known ones, are nested inside it, which leaves the wire format
+// unchanged.
+func schemaDefinition(message protoreflect.MessageDescriptor) (string, error) {
+	file := message.ParentFile()
+	if file.Syntax() != protoreflect.Proto2 && file.Syntax() != protoreflect.Proto3 {
+		return "", fmt.Errorf("%s: only proto2 and proto3 syntax are supported", file.Path())
+	}
+	r := &schemaRenderer{root: message, names: make(map[protoreflect.FullName]string)}
+	if err := r.collect(message); err != nil {
+		return "", err
+	}
+
+	r.printf("syntax = %q;\n", file.Syntax().String())
+	if file.Package() != "" {
+		r.printf("package %s;\n", file.Package())
+	}
+	r.printf("\n")
+	r.printf("message %s {\n", message.Name())
+	if err := r.messageBody(message, 1); err != nil {
+		return "", err
+	}
+	for _, dependency := range r.dependencies {
+		if err := r.declaration(dependency, r.names[dependency.FullName()], 1); err != nil {
+			return "", err
+		}
+	}
+	r.printf("}\n")
+	return r.out.String(), nil
+}
+
+type schemaRenderer struct {
+	root protoreflect.MessageDescriptor
+	// dependencies are the top-level types from outside root it uses, in
+	// the order they're found, and names what they're renamed to inside it.
+	dependencies []protoreflect.Descriptor
+	names        map[protoreflect.FullName]string
+	out          strings.Builder
+}
+
+func (r *schemaRenderer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&r.out, format, args...)
+}
+
+// collect finds every type message uses, directly or through other types,
+// that isn't declared inside root.
+func (r *schemaRenderer) collect(message protoreflect.MessageDescriptor) error {
+	if message.ParentFile().Syntax() != r.root.ParentFile().Syntax() {
+		return fmt.Errorf("%s is %s but %s is %s; a schema can't mix them", message.FullName(), message.ParentFile().Syntax(), r.root.FullName(), r.root.ParentFile().Syntax())
+	}
+	fields := message.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		var used protoreflect.Descriptor
+		if field.Enum() != nil {
+			used = field.Enum()
+		} else if field.Message() != nil {
+			used = field.Message()
+		} else {
+			continue
+		}
+		top := topLevel(used)
+		if top.FullName() == r.root.FullName() {
+			continue
+		}
+		if _, ok := r.names[top.FullName()]; ok {
+			continue
+		}
+		name := string(top.Name())
+		for _, taken := range r.names {
+			if taken == name {
+				name = strings.ReplaceAll(string(top.FullName()), ".", "_")
+			}
+		}
+		r.names[top.FullName()] = name
+		r.dependencies = append(r.dependencies, top)
+		if message, ok := top.(protoreflect.MessageDescriptor); ok {
+			if err := r.collect(message); err != nil {
+				return err
+			}
+		}
+	}
+	nested := message.Messages()
+	for i := 0; i < nested.Len(); i++ {
+		if err := r.collect(nested.Get(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topLevel returns the message or enum declared at the top of a file that
+// descriptor is, or is nested in.
+func topLevel(descriptor protoreflect.Descriptor) protoreflect.Descriptor {
+	for {
+		if _, ok := descriptor.Parent().(protoreflect.FileDescriptor); ok {
+			return descriptor
+		}
+		descriptor = descriptor.Parent()
+	}
+}
+
+// reference is the fully qualified name a field refers to descriptor by,
+// once its dependencies are nested inside root.
+func (r *schemaRenderer) reference(descriptor protoreflect.Descriptor) string {
+	top := topLevel(descriptor)
+	if top.FullName() == r.root.FullName() {
+		return "." + string(descriptor.FullName())
+	}
+	suffix := strings.TrimPrefix(string(descriptor.FullName()), string(top.FullName()))
+	return "." + string(r.root.FullName()) + "." + r.names[top.FullName()] + suffix
+}
+
+func (r *schemaRenderer) declaration(descriptor protoreflect.Descriptor, name string, depth int) error {
+	if enum, ok := descriptor.(protoreflect.EnumDescriptor); ok {
+		r.enum(enum, name, depth)
+		return nil
+	}
+	indent := strings.Repeat("  ", depth)
+	message := descriptor.(protoreflect.MessageDescriptor)
+	r.printf("%smessage %s {\n", indent, name)
+	if err := r.messageBody(message, depth+1); err != nil {
+		return err
+	}
+	r.printf("%s}\n", indent)
+	return nil
+}
+
+func (r *schemaRenderer) messageBody(message protoreflect.MessageDescriptor, depth int) error {
+	indent := strings.Repeat("  ", depth)
+	oneofs := message.Oneofs()
+	for i := 0; i < oneofs.Len(); i++ {
+		oneof := oneofs.Get(i)
+		if oneof.IsSynthetic() {
+			continue
+		}
+		r.printf("%soneof %s {\n", indent, oneof.Name())
+		for j := 0; j < oneof.Fields().Len(); j++ {
+			if err := r.field(oneof.Fields().Get(j), depth+1); err != nil {
+				return err
+			}
+		}
+		r.printf("%s}\n", indent)
+	}
+	fields := message.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		if oneof := field.ContainingOneof(); oneof != nil && !oneof.IsSynthetic() {
+			continue
+		}
+		if err := r.field(field, depth); err != nil {
+			return err
+		}
+	}
+	// Message ranges are stored with an exclusive end.
+	ranges := make([][2]int32, message.ReservedRanges().Len())
+	for i := range ranges {
+		bounds := message.ReservedRanges().Get(i)
+		ranges[i] = [2]int32{int32(bounds[0]), int32(bounds[1]) - 1}
+	}
+	r.reserved(ranges, message.ReservedNames(), depth)
+
+	enums := message.Enums()
+	for i := 0; i < enums.Len(); i++ {
+		r.enum(enums.Get(i), string(enums.Get(i).Name()), depth)
+	}
+	nested := message.Messages()
+	for i := 0; i < nested.Len(); i++ {
+		// Map entries are declared by their map fields.
+		if nested.Get(i).IsMapEntry() {
+			continue
+		}
+		if err := r.declaration(nested.Get(i), string(nested.Get(i).Name()), depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *schemaRenderer) field(field protoreflect.FieldDescriptor, depth int) error {
+	indent := strings.Repeat("  ", depth)
+	if field.Kind() == protoreflect.GroupKind {
+		return fmt.Errorf("%s: groups aren't supported", field.FullName())
+	}
+	var label string
+	switch {
+	case field.IsMap():
+		label = fmt.Sprintf("map<%s, %s>", r.fieldType(field.MapKey()), r.fieldType(field.MapValue()))
+	case field.Cardinality() == protoreflect.Repeated:
+		label = "repeated " + r.fieldType(field)
+	case field.Cardinality() == protoreflect.Required:
+		label = "required " + r.fieldType(field)
+	case field.ContainingOneof() != nil && !field.ContainingOneof().IsSynthetic():
+		label = r.fieldType(field)
+	case field.HasOptionalKeyword() || field.ParentFile().Syntax() == protoreflect.Proto2:
+		label = "optional " + r.fieldType(field)
+	default:
+		label = r.fieldType(field)
+	}
+
+	var options []string
+	fieldProto := protodesc.ToFieldDescriptorProto(field)
+	if fieldProto.DefaultValue != nil {
+		value := fieldProto.GetDefaultValue()
+		if field.Kind() == protoreflect.StringKind {
+			value = strconv.Quote(value)
+		} else if field.Kind() == protoreflect.BytesKind {
+			value = `"` + value + `"`
+		}
+		options = append(options, "default = "+value)
+	}
+	if fieldOptions := fieldProto.GetOptions(); fieldOptions != nil && fieldOptions.Packed != nil {
+		options = append(options, fmt.Sprintf("packed = %t", fieldOptions.GetPacked()))
+	}
+	if fieldProto.GetOptions().GetDeprecated() {
+		options = append(options, "deprecated = true")
+	}
+	suffix := ""
+	if len(options) > 0 {
+		suffix = " [" + strings.Join(options, ", ") + "]"
+	}
+	r.printf("%s%s %s = %d%s;\n", indent, label, field.Name(), field.Number(), suffix)
+	return nil
+}
+
+func (r *schemaRenderer) fieldType(field protoreflect.FieldDescriptor) string {
+	switch field.Kind() {
+	case protoreflect.EnumKind:
+		return r.reference(field.Enum())
+	case protoreflect.MessageKind:
+		return r.reference(field.Message())
+	default:
+		return field.Kind().String()
+	}
+}
+
+func (r *schemaRenderer) enum(enum protoreflect.EnumDescriptor, name string, depth int) {
+	indent := strings.Repeat("  ", depth)
+	r.printf("%senum %s {\n", indent, name)
+	if protodesc.ToEnumDescriptorProto(enum).GetOptions().GetAllowAlias() {
+		r.printf("%s  option allow_alias = true;\n", indent)
+	}
+	values := enum.Values()
+	for i := 0; i < values.Len(); i++ {
+		r.printf("%s  %s = %d;\n", indent, values.Get(i).Name(), values.Get(i).Number())
+	}
+	ranges := make([][2]int32, enum.ReservedRanges().Len())
+	for i := range ranges {
+		bounds := enum.ReservedRanges().Get(i)
+		ranges[i] = [2]int32{int32(bounds[0]), int32(bounds[1])}
+	}
+	r.reserved(ranges, enum.ReservedNames(), depth+1)
+	r.printf("%s}\n", indent)
+}
+
+// reserved renders reserved numbers and names. ranges have an inclusive
+// end.
+func (r *schemaRenderer) reserved(ranges [][2]int32, names protoreflect.Names, depth int) {
+	indent := strings.Repeat("  ", depth)
+	if len(ranges) > 0 {
+		numbers := make([]string, len(ranges))
+		for i, bounds := range ranges {
+			if bounds[0] == bounds[1] {
+				numbers[i] = strconv.Itoa(int(bounds[0]))
+			} else {
+				numbers[i] = fmt.Sprintf("%d to %d", bounds[0], bounds[1])
+			}
+		}
+		r.printf("%sreserved %s;\n", indent, strings.Join(numbers, ", "))
+	}
+	if names.Len() > 0 {
+		quoted := make([]string, names.Len())
+		for i := range quoted {
+			quoted[i] = strconv.Quote(string(names.Get(i)))
+		}
+		sort.Strings(quoted)
+		r.printf("%sreserved %s;\n", indent, strings.Join(quoted, ", "))
+	}
+}
+
+type schemaPushResult struct {
+	Schema   string `json:"schema"`
+	Revision string `json:"revision"`
+	// Action is created, committed or unchanged.
+	Action string `json:"action"`
+	Topic  string `json:"topic"`
+	// Bound is false when the topic already used the schema.
+	Bound bool `json:"bound"`
+}
+
+// pushSchema creates the schema from definition, or commits it as a new
+// revision if it differs from the latest one, then binds it to the topic.
+func pushSchema(ctx context.Context, client *pubsub.Client, schemas *pubsub.SchemaClient, project string, schemaId string, topicId string, definition string, encoding pubsub.SchemaEncoding, logger *log.Logger) (schemaPushResult, error) {
+	name := fmt.Sprintf("projects/%s/schemas/%s", project, schemaId)
+	result := schemaPushResult{Schema: name, Topic: topicId}
+	config := pubsub.SchemaConfig{Name: name, Type: pubsub.SchemaProtocolBuffer, Definition: definition}
+	existing, err := schemas.Schema(ctx, schemaId, pubsub.SchemaViewFull)
+	switch {
+	case status.Code(err) == codes.NotFound:
+		created, err := schemas.CreateSchema(ctx, schemaId, config)
+		if err != nil {
+			return result, fmt.Errorf("creating schema %s: %w", schemaId, err)
+		}
+		result.Action, result.Revision = "created", created.RevisionID
+		logger.Printf("Created schema %s at revision %s", schemaId, created.RevisionID)
+	case err != nil:
+		return result, fmt.Errorf("reading schema %s: %w", schemaId, err)
+	case existing.Type != pubsub.SchemaProtocolBuffer:
+		return result, fmt.Errorf("schema %s isn't a protocol buffer schema", schemaId)
+	case existing.Definition == definition:
+		result.Action, result.Revision = "unchanged", existing.RevisionID
+		logger.Printf("Schema %s is unchanged at revision %s", schemaId, existing.RevisionID)
+	default:
+		committed, err := schemas.CommitSchema(ctx, schemaId, config)
+		if err != nil {
+			return result, fmt.Errorf("committing schema %s: %w", schemaId, err)
+		}
+		result.Action, result.Revision = "committed", committed.RevisionID
+		logger.Printf("Committed schema %s revision %s", schemaId, committed.RevisionID)
+	}
+
+	topic := client.Topic(topicId)
+	defer topic.Stop()
+	topicConfig, err := topic.Config(ctx)
+	if err != nil {
+		return result, fmt.Errorf("reading topic %s: %w", topicId, err)
+	}
+	if settings := topicConfig.SchemaSettings; settings != nil {
+		if resourceId(settings.Schema) != schemaId {
+			return result, fmt.Errorf("topic %s is bound to schema %s; unbind it first", topicId, resourceId(settings.Schema))
+		}
+		// A pinned last revision would reject messages of the new one.
+		if settings.Encoding == encoding && settings.LastRevisionID == "" {
+			return result, nil
+		}
+	}
+	if _, err := topic.Update(ctx, pubsub.TopicConfigToUpdate{SchemaSettings: &pubsub.SchemaSettings{Schema: name, Encoding: encoding}}); err != nil {
+		return result, fmt.Errorf("binding schema %s to topic %s: %w", schemaId, topicId, err)
+	}
+	result.Bound = true
+	logger.Printf("Bound schema %s to topic %s", schemaId, topicId)
+	return result, nil
+}
+
+// schemaCommand runs "schema push", which compiles .proto files, pushes one
+// message of them as a Pub/Sub schema and binds it to a topic.
+func schemaCommand(logger *log.Logger) fx.Option {
+	if len(commandArgs) == 0 || commandArgs[0] != "push" {
+		logger.Fatal("usage: schema push -topic ID [-schema ID] [-message NAME] FILE.proto...")
+	}
+	flags := flag.NewFlagSet("schema push", flag.ExitOnError)
+	topicId := flags.String("topic", "", "topic to bind the schema to")
+	schemaId := flags.String("schema", "", "schema ID, defaulting to the topic ID")
+	message := flags.String("message", "", "fully qualified message to push, defaulting to the only message of the first file")
+	encodingName := flags.String("encoding", "binary", "encoding the topic validates, binary or json")
+	protoc := flags.String("protoc", "protoc", "protoc binary to build the descriptor set with")
+	var includes importPaths
+	flags.Var(&includes, "I", "protoc import path, defaulting to the working directory; repeatable")
+	dryRun := flags.Bool("dry-run", false, "print the schema definition without pushing it")
+	flags.Parse(commandArgs[1:])
+	files := flags.Args()
+	if len(files) == 0 || (*topicId == "" && !*dryRun) {
+		logger.Fatal("schema push needs -topic and at least one .proto file")
+	}
+	if *schemaId == "" {
+		*schemaId = *topicId
+	}
+	encodings := map[string]pubsub.SchemaEncoding{"binary": pubsub.EncodingBinary, "json": pubsub.EncodingJSON}
+	encoding, ok := encodings[*encodingName]
+	if !ok {
+		logger.Fatalf("Unknown encoding %q", *encodingName)
+	}
+
+	definition := func(ctx context.Context) (string, error) {
+		descriptors, err := buildDescriptors(ctx, *protoc, includes, files)
+		if err != nil {
+			return "", err
+		}
+		root, err := findMessage(descriptors, files[0], *message)
+		if err != nil {
+			return "", err
+		}
+		return schemaDefinition(root)
+	}
+	if *dryRun {
+		return fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				definition, err := definition(ctx)
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Print(definition)
+				return err
+			})
+		})
+	}
+
+	return fx.Options(
+		fx.Provide(newPubSubParams(logger), newPubSubClient),
+		fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, params PubSubParams, client *pubsub.Client) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				definition, err := definition(ctx)
+				if err != nil {
+					return err
+				}
+				schemas, err := pubsub.NewSchemaClient(ctx, params.Config.ProjectId, params.clientOptions()...)
+				if err != nil {
+					return err
+				}
+				defer schemas.Close()
+				result, err := pushSchema(ctx, client, schemas, params.Config.ProjectId, *schemaId, *topicId, definition, encoding, logger)
+				if result.Action == "" {
+					return err
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if encodeErr := encoder.Encode(result); encodeErr != nil && err == nil {
+					err = encodeErr
+				}
+				return err
+			})
+		}),
+	)
+}
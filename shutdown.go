@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+type ShutdownConfig struct {
+	// Timeout is how long the service has to shut down after SIGTERM,
+	// Cloud Run's grace period before it kills the container. Defaults to
+	// 10s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// stopTimeout bounds stopping the app. The shutdown sequence sets it from
+// config; other commands keep fx's default.
+var stopTimeout = fx.DefaultTimeout
+
+// HTTPServers serve the routes from start until the shutdown sequence
+// stops them: the public API on :8080 and, with http.admin_port set, the
+// admin surfaces on their own port, so they're never reachable through the
+// public Cloud Run URL.
+type HTTPServers struct {
+	public *http.Server
+	admin  *http.Server
+}
+
+func newHTTPServers(lifecycle fx.Lifecycle, config Config, routes []Route, firewall *Firewall, authorizer *Authorizer, readOnly *ReadOnly, recent *RecentMessages, serverTLS *ServerTLS) *HTTPServers {
+	logger := newLogger("http")
+	servers := &HTTPServers{}
+	routes = slices.Clone(routes)
+	for i, route := range routes {
+		routes[i].Handler = serverTLS.Wrap(route)
+	}
+	public := routes
+	if config.HTTP.AdminPort != 0 {
+		var admin []Route
+		public, admin = splitRoutes(routes)
+		servers.admin = &http.Server{
+			Addr:    fmt.Sprintf(":%d", config.HTTP.AdminPort),
+			Handler: newMux(withDocs(config, admin), firewall, authorizer, readOnly),
+		}
+	}
+	servers.public = &http.Server{Addr: ":8080", Handler: newMux(withDocs(config, public), firewall, authorizer, readOnly)}
+	for _, server := range servers.all() {
+		// Shutdown waits for every request to finish, which streams never do.
+		server.RegisterOnShutdown(recent.closeTails)
+		server.TLSConfig = serverTLS.config
+		lifecycle.Append(
+			fx.Hook{
+				OnStart: func(context.Context) error {
+					listener, err := net.Listen("tcp", server.Addr)
+					if err != nil {
+						return err
+					}
+					go func() {
+						serve := server.Serve
+						if server.TLSConfig != nil {
+							// The certificate is already in TLSConfig.
+							serve = func(listener net.Listener) error { return server.ServeTLS(listener, "", "") }
+						}
+						if err := serve(listener); !errors.Is(err, http.ErrServerClosed) {
+							logger.Fatal(err)
+						}
+					}()
+					return nil
+				},
+				OnStop: server.Shutdown,
+			},
+		)
+	}
+	return servers
+}
+
+func (s *HTTPServers) all() []*http.Server {
+	if s.admin == nil {
+		return []*http.Server{s.public}
+	}
+	return []*http.Server{s.public, s.admin}
+}
+
+// Shutdown stops accepting requests on every server and waits for those in
+// flight.
+func (s *HTTPServers) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, server := range s.all() {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type shutdownStage struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// ShutdownSequence stops the service in a fixed order when it's asked to
+// stop, e.g. by Cloud Run's SIGTERM: it reports NOT_SERVING to gRPC health
+// watchers, stops accepting HTTP requests and waits for those in flight,
+// pauses the subscribers until their messages are settled, then flushes
+// the publishers' buffered messages. The
+// remaining stop hooks, which close the clients, then run in fx's usual
+// order. Each stage is logged with how long it took, and the whole stop is
+// bounded by the configured timeout.
+type ShutdownSequence struct {
+	logger  *log.Logger
+	timeout time.Duration
+	stages  []shutdownStage
+}
+
+func newShutdownSequence(lifecycle fx.Lifecycle, config Config, grpcServer *GRPCServer, servers *HTTPServers, subscribers *SubscriberSet, registry *TopicRegistry) *ShutdownSequence {
+	sequence := &ShutdownSequence{
+		logger:  newLogger("shutdown"),
+		timeout: config.Shutdown.Timeout,
+		stages: []shutdownStage{
+			{name: "grpc", stop: grpcServer.stop},
+			{name: "http", stop: servers.Shutdown},
+			{name: "subscribers", stop: subscribers.stop},
+			{name: "publishers", stop: registry.flush},
+		},
+	}
+	stopTimeout = sequence.timeout
+	// Appended after the hooks of everything it stops, so it stops first.
+	lifecycle.Append(fx.Hook{OnStop: sequence.run})
+	return sequence
+}
+
+// run runs each stage in turn, carrying on past failures so a stuck stage
+// doesn't stop the rest from flushing what they can.
+func (s *ShutdownSequence) run(ctx context.Context) error {
+	started := time.Now()
+	deadline, _ := ctx.Deadline()
+	s.logger.Printf("Shutting down, %s left", time.Until(deadline).Round(time.Millisecond))
+	var errs []error
+	for _, stage := range s.stages {
+		stageStarted := time.Now()
+		err := stage.stop(ctx)
+		duration := time.Since(stageStarted)
+		if err != nil {
+			s.logger.Printf("Shutdown stage %s failed after %s: %v", stage.name, duration, err)
+			errs = append(errs, fmt.Errorf("%s: %w", stage.name, err))
+			continue
+		}
+		s.logger.Printf("Shutdown stage %s finished in %s", stage.name, duration)
+	}
+	s.logger.Printf("Stopped serving in %s, closing clients", time.Since(started))
+	return errors.Join(errs...)
+}
+
+// flush sends every topic's buffered messages, waiting until ctx is done.
+func (r *TopicRegistry) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, registered := range r.topics {
+			registered.flush()
+		}
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("publishers still flushing: %w", ctx.Err())
+	}
+}
+
+func (t *RegisteredTopic) flush() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	t.topic.Flush()
+	if t.secondary != nil {
+		t.secondary.Flush()
+	}
+	for _, lane := range t.lanes {
+		lane.Flush()
+	}
+	if t.sampler != nil {
+		t.sampler.topic.Flush()
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+	"google.golang.org/api/option"
+	httptransport "google.golang.org/api/transport/http"
+)
+
+// Single Message Transforms (SMTs) are JavaScript UDFs that Pub/Sub runs
+// server side on messages published to a topic or delivered from a
+// subscription. The Go client version this module can use predates them, so
+// they're managed through the Pub/Sub REST API directly.
+const (
+	pubsubRESTEndpoint  = "https://pubsub.googleapis.com/v1/"
+	maxTransformSamples = 100
+)
+
+type MessageTransformConfig struct {
+	FunctionName string `yaml:"function_name"`
+	// Code is the JavaScript source. CodePath reads it from a file instead.
+	Code     string `yaml:"code"`
+	CodePath string `yaml:"code_path"`
+	Disabled bool   `yaml:"disabled"`
+}
+
+type javaScriptUDF struct {
+	FunctionName string `json:"functionName"`
+	Code         string `json:"code"`
+}
+
+type messageTransform struct {
+	JavaScriptUDF *javaScriptUDF `json:"javascriptUdf,omitempty"`
+	Disabled      bool           `json:"disabled,omitempty"`
+}
+
+type restMessage struct {
+	Data       []byte            `json:"data,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type transformedMessage struct {
+	MessageTransform   messageTransform `json:"messageTransform"`
+	TransformedMessage *restMessage     `json:"transformedMessage,omitempty"`
+	FailureReason      string           `json:"failureReason,omitempty"`
+}
+
+// messageTransforms loads the configured transforms, reading code from
+// files where given.
+func messageTransforms(configs []MessageTransformConfig) ([]messageTransform, error) {
+	transforms := make([]messageTransform, len(configs))
+	for i, config := range configs {
+		code := config.Code
+		if config.CodePath != "" {
+			data, err := os.ReadFile(config.CodePath)
+			if err != nil {
+				return nil, fmt.Errorf("message transform %d: %w", i, err)
+			}
+			code = string(data)
+		}
+		if config.FunctionName == "" || code == "" {
+			return nil, fmt.Errorf("message transform %d needs function_name and code or code_path", i)
+		}
+		transforms[i] = messageTransform{
+			JavaScriptUDF: &javaScriptUDF{FunctionName: config.FunctionName, Code: code},
+			Disabled:      config.Disabled,
+		}
+	}
+	return transforms, nil
+}
+
+type TransformClient struct {
+	http     *http.Client
+	endpoint string
+	project  string
+}
+
+func newTransformClient(params PubSubParams) (*TransformClient, error) {
+	options := append(params.clientOptions(), option.WithScopes(pubsub.ScopePubSub))
+	client, _, err := httptransport.NewClient(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	return &TransformClient{http: client, endpoint: pubsubRESTEndpoint, project: params.Config.ProjectId}, nil
+}
+
+func (c *TransformClient) call(ctx context.Context, method string, path string, body interface{}, response interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &failure) == nil && failure.Error.Message != "" {
+			return fmt.Errorf("%s %s: %s", method, path, failure.Error.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(data, response)
+}
+
+// Validate checks that transform compiles and defines its function.
+func (c *TransformClient) Validate(ctx context.Context, transform messageTransform) error {
+	return c.call(ctx, http.MethodPost, "projects/"+c.project+":validateMessageTransform", map[string]interface{}{
+		"messageTransform": transform,
+	}, nil)
+}
+
+// Test runs transforms on msg without publishing anything and returns the
+// result after each transform.
+func (c *TransformClient) Test(ctx context.Context, transforms []messageTransform, msg restMessage) ([]transformedMessage, error) {
+	var response struct {
+		TransformedMessages []transformedMessage `json:"transformedMessages"`
+	}
+	err := c.call(ctx, http.MethodPost, "projects/"+c.project+":testMessageTransforms", map[string]interface{}{
+		"message":           msg,
+		"messageTransforms": map[string]interface{}{"messageTransforms": transforms},
+	}, &response)
+	return response.TransformedMessages, err
+}
+
+// resourcePath returns the REST path of a topic or subscription; kind is
+// "topics" or "subscriptions".
+func (c *TransformClient) resourcePath(kind string, id string) (string, error) {
+	if kind != "topics" && kind != "subscriptions" {
+		return "", fmt.Errorf("unknown resource kind %q", kind)
+	}
+	return "projects/" + c.project + "/" + kind + "/" + url.PathEscape(id), nil
+}
+
+func (c *TransformClient) Get(ctx context.Context, kind string, id string) ([]messageTransform, error) {
+	path, err := c.resourcePath(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	var resource struct {
+		MessageTransforms []messageTransform `json:"messageTransforms"`
+	}
+	if err := c.call(ctx, http.MethodGet, path, nil, &resource); err != nil {
+		return nil, err
+	}
+	if resource.MessageTransforms == nil {
+		resource.MessageTransforms = []messageTransform{}
+	}
+	return resource.MessageTransforms, nil
+}
+
+// Apply replaces the transforms on a topic or subscription.
+func (c *TransformClient) Apply(ctx context.Context, kind string, id string, transforms []messageTransform) error {
+	path, err := c.resourcePath(kind, id)
+	if err != nil {
+		return err
+	}
+	field := strings.TrimSuffix(kind, "s")
+	return c.call(ctx, http.MethodPatch, path, map[string]interface{}{
+		field: map[string]interface{}{
+			"name":              path,
+			"messageTransforms": transforms,
+		},
+		"updateMask": "messageTransforms",
+	}, nil)
+}
+
+type transformTestRequest struct {
+	Transforms []MessageTransformConfig `json:"transforms"`
+	Messages   []restMessage            `json:"messages"`
+}
+
+type transformTestResult struct {
+	Message restMessage          `json:"message"`
+	Steps   []transformedMessage `json:"steps,omitempty"`
+	Error   string               `json:"error,omitempty"`
+}
+
+type transformApplyRequest struct {
+	Transforms []MessageTransformConfig `json:"transforms"`
+	// DryRun validates the transforms without changing the resource.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+type TransformAdminHandler struct {
+	logger *log.Logger
+	client *TransformClient
+}
+
+// newTransformAdminHandler leaves the client unset against the emulator and
+// in local mode, neither of which implements message transforms.
+func newTransformAdminHandler(params PubSubParams) (*TransformAdminHandler, error) {
+	handler := &TransformAdminHandler{logger: newLogger("transforms")}
+	if os.Getenv("PUBSUB_EMULATOR_HOST") != "" || params.Config.ProjectId == localProjectId {
+		return handler, nil
+	}
+	client, err := newTransformClient(params)
+	if err != nil {
+		return nil, err
+	}
+	handler.client = client
+	return handler, nil
+}
+
+func (h *TransformAdminHandler) available(w http.ResponseWriter) bool {
+	if h.client == nil {
+		http.Error(w, "Message transforms aren't supported by the emulator", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+func (h *TransformAdminHandler) Get(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	transforms, err := h.client.Get(r.Context(), r.PathValue("kind"), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to get message transforms: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transforms)
+}
+
+// Put validates each transform and then replaces the resource's transforms
+// with them, unless dry_run is set.
+func (h *TransformAdminHandler) Put(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	var request transformApplyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	transforms, err := messageTransforms(request.Transforms)
+	if err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i, transform := range transforms {
+		if err := h.client.Validate(r.Context(), transform); err != nil {
+			http.Error(w, fmt.Sprintf("Message transform %d is invalid: %v", i, err), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	kind, id := r.PathValue("kind"), r.PathValue("id")
+	if !request.DryRun {
+		if err := h.client.Apply(r.Context(), kind, id, transforms); err != nil {
+			http.Error(w, "Failed to apply message transforms: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		requestLogger(h.logger, r).Printf("Applied %d message transforms to %s/%s", len(transforms), kind, id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transforms)
+}
+
+// Test runs the given transforms against sample messages.
+func (h *TransformAdminHandler) Test(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	var request transformTestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	transforms, err := messageTransforms(request.Transforms)
+	if err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.Messages) == 0 || len(request.Messages) > maxTransformSamples {
+		http.Error(w, fmt.Sprintf("Between 1 and %d messages are required", maxTransformSamples), http.StatusBadRequest)
+		return
+	}
+	results := make([]transformTestResult, len(request.Messages))
+	for i, msg := range request.Messages {
+		results[i].Message = msg
+		steps, err := h.client.Test(r.Context(), transforms, msg)
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+		results[i].Steps = steps
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// syncTransforms applies the message transforms in the config to their
+// topics and subscriptions. With -dry-run it only validates them and runs
+// them against the -samples file, a JSON array of {data, attributes}.
+func syncTransforms(logger *log.Logger) fx.Option {
+	flags := flag.NewFlagSet("sync-transforms", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "validate and test without applying")
+	samplesPath := flags.String("samples", "", "JSON file of sample messages to test against")
+	flags.Parse(commandArgs)
+
+	return fx.Options(
+		fx.Provide(newPubSubParams(logger), newConfig(logger)),
+		fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, params PubSubParams, config Config) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				client, err := newTransformClient(params)
+				if err != nil {
+					return err
+				}
+				var samples []restMessage
+				if *samplesPath != "" {
+					data, err := os.ReadFile(*samplesPath)
+					if err != nil {
+						return err
+					}
+					if err := json.Unmarshal(data, &samples); err != nil {
+						return fmt.Errorf("parsing %s: %w", *samplesPath, err)
+					}
+				}
+
+				type target struct {
+					kind, id string
+					configs  []MessageTransformConfig
+				}
+				var targets []target
+				for _, topic := range config.Topics {
+					targets = append(targets, target{"topics", topic.Id, topic.MessageTransforms})
+				}
+				for _, subscription := range config.Subscriptions {
+					targets = append(targets, target{"subscriptions", subscription.Id, subscription.MessageTransforms})
+				}
+
+				failed := false
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				for _, target := range targets {
+					if len(target.configs) == 0 {
+						continue
+					}
+					name := target.kind + "/" + target.id
+					transforms, err := messageTransforms(target.configs)
+					if err != nil {
+						return fmt.Errorf("%s: %w", name, err)
+					}
+					for i, transform := range transforms {
+						if err := client.Validate(ctx, transform); err != nil {
+							logger.Printf("%s: message transform %d is invalid: %v", name, i, err)
+							failed = true
+						}
+					}
+					for _, sample := range samples {
+						steps, err := client.Test(ctx, transforms, sample)
+						if err != nil {
+							logger.Printf("%s: testing sample failed: %v", name, err)
+							failed = true
+							continue
+						}
+						encoder.Encode(map[string]interface{}{"resource": name, "message": sample, "steps": steps})
+					}
+					if failed || *dryRun {
+						continue
+					}
+					if err := client.Apply(ctx, target.kind, target.id, transforms); err != nil {
+						return fmt.Errorf("%s: %w", name, err)
+					}
+					logger.Printf("Applied %d message transforms to %s", len(transforms), name)
+				}
+				if failed {
+					return errors.New("some message transforms are invalid; nothing further was applied")
+				}
+				return nil
+			})
+		}),
+	)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+// stallCheckInterval is how often receive streams are checked for stalls.
+const stallCheckInterval = 30 * time.Second
+
+type StallConfig struct {
+	// After is how long the receive stream can go without delivering or
+	// settling a message, while the subscription's oldest unacked message
+	// is at least as old, before it's taken as stalled. Defaults to 5m.
+	After time.Duration `yaml:"after"`
+}
+
+// StallDetector restarts receive streams that have stopped delivering
+// although their subscription has a backlog, which a streaming pull can do
+// without returning an error, e.g. when its connection is left half open.
+// The client doesn't surface the stream's heartbeats, so a stream is taken
+// as silent once nothing has been delivered or settled. Backlogs come from
+// the BacklogMonitor, so streams are only restarted with Cloud Monitoring.
+type StallDetector struct {
+	logger      *log.Logger
+	subscribers *SubscriberSet
+	backlogs    *BacklogMonitor
+	watched     []*Subscriber
+}
+
+func newStallDetector(lifecycle fx.Lifecycle, config Config, subscribers *SubscriberSet, backlogs *BacklogMonitor) *StallDetector {
+	detector := &StallDetector{logger: newLogger("stall"), subscribers: subscribers, backlogs: backlogs}
+	for _, subscription := range config.Subscriptions {
+		if subscription.Stall == nil {
+			continue
+		}
+		if subscriber, ok := subscribers.Lookup(subscription.Name); ok {
+			detector.watched = append(detector.watched, subscriber)
+		}
+	}
+	if len(detector.watched) == 0 {
+		return detector
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(context.Context) error {
+				go detector.run(ctx, done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				return nil
+			},
+		},
+	)
+	return detector
+}
+
+func (d *StallDetector) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(stallCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, subscriber := range d.watched {
+			d.check(subscriber)
+		}
+	}
+}
+
+// check restarts subscriber's receive stream if it's stalled. Streams that
+// are paused, backing off or already restarting aren't running, so they're
+// left alone.
+func (d *StallDetector) check(subscriber *Subscriber) {
+	subscriber.mu.Lock()
+	running := subscriber.cancel != nil
+	maxOutstanding := subscriber.subscription.ReceiveSettings.MaxOutstandingMessages
+	subscriber.mu.Unlock()
+	if !running {
+		return
+	}
+	after := subscriber.Config.Stall.After
+	silent := time.Since(time.Unix(0, subscriber.activity.Load()))
+	if silent < after {
+		return
+	}
+	backlog := d.backlogs.Backlog(subscriber.Config.Id)
+	if !backlog.Known || backlog.Messages == 0 || time.Duration(backlog.OldestUnackedAgeSeconds)*time.Second < after {
+		return
+	}
+	subscriber.logger.Printf("Receive stream stalled: nothing delivered for %s with %d messages undelivered, the oldest %ds old; restarting it",
+		silent.Round(time.Second), backlog.Messages, backlog.OldestUnackedAgeSeconds)
+	subscriberStallRestarts.WithLabelValues(subscriber.Config.Name).Inc()
+	// The new stream gets a full period before it's checked again.
+	subscriber.active()
+	go d.subscribers.restart(subscriber, 0, maxOutstanding)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+var ErrNotFound = errors.New("not found")
+
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// Store is the key-value persistence shared by subsystems that need state to
+// outlive a single request, and, depending on the backend, a single
+// instance. A ttl of zero means the key never expires.
+type Store interface {
+	// Get returns ErrNotFound if key doesn't exist or has expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetIfAbsent stores value only if key doesn't exist, and reports
+	// whether it did.
+	SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Increment atomically adds delta to the integer at key, creating it
+	// with ttl if missing, and returns the new value.
+	Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	Delete(ctx context.Context, key string) error
+	// List returns up to limit entries whose key starts with prefix, in key
+	// order. A limit of zero returns every match.
+	List(ctx context.Context, prefix string, limit int) ([]KeyValue, error)
+	Close() error
+}
+
+func newStore(lifecycle fx.Lifecycle, config Config, params PubSubParams) (Store, error) {
+	var (
+		store Store
+		err   error
+	)
+	switch config.Store.Backend {
+	case "", "memory":
+		store = newMemoryStore()
+	case "redis":
+		store, err = newRedisStore(config.Store)
+	case "firestore":
+		store, err = newFirestoreStore(config.Store, params)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", config.Store.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.Store.Prefix != "" {
+		store = prefixedStore{Store: store, prefix: config.Store.Prefix}
+	}
+	lifecycle.Append(
+		fx.Hook{
+			OnStop: func(ctx context.Context) error {
+				return store.Close()
+			},
+		},
+	)
+	return store, nil
+}
+
+// prefixedStore namespaces every key so several deployments can share one
+// backend.
+type prefixedStore struct {
+	Store
+	prefix string
+}
+
+func (s prefixedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.Store.Get(ctx, s.prefix+key)
+}
+
+func (s prefixedStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.Store.Set(ctx, s.prefix+key, value, ttl)
+}
+
+func (s prefixedStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.Store.SetIfAbsent(ctx, s.prefix+key, value, ttl)
+}
+
+func (s prefixedStore) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	return s.Store.Increment(ctx, s.prefix+key, delta, ttl)
+}
+
+func (s prefixedStore) Delete(ctx context.Context, key string) error {
+	return s.Store.Delete(ctx, s.prefix+key)
+}
+
+func (s prefixedStore) List(ctx context.Context, prefix string, limit int) ([]KeyValue, error) {
+	entries, err := s.Store.List(ctx, s.prefix+prefix, limit)
+	for i := range entries {
+		entries[i].Key = entries[i].Key[len(s.prefix):]
+	}
+	return entries, err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// firestoreStore keeps one document per key. Document IDs are the base64url
+// encoded key, since keys may contain characters Firestore doesn't allow in
+// IDs; the raw key is stored in a field for prefix queries. Expired
+// documents are ignored on read, and can be removed by configuring a
+// Firestore TTL policy on the expires_at field.
+type firestoreStore struct {
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+}
+
+type firestoreEntry struct {
+	Key       string     `firestore:"key"`
+	Value     []byte     `firestore:"value"`
+	ExpiresAt *time.Time `firestore:"expires_at"`
+}
+
+func (e firestoreEntry) expired() bool {
+	return e.ExpiresAt != nil && !time.Now().Before(*e.ExpiresAt)
+}
+
+func newFirestoreEntry(key string, value []byte, ttl time.Duration) firestoreEntry {
+	entry := firestoreEntry{Key: key, Value: value}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		entry.ExpiresAt = &expires
+	}
+	return entry
+}
+
+func newFirestoreStore(config StoreConfig, params PubSubParams) (*firestoreStore, error) {
+	project := config.Firestore.Project
+	if project == "" {
+		project = params.Config.ProjectId
+	}
+	database := config.Firestore.Database
+	if database == "" {
+		database = firestore.DefaultDatabaseID
+	}
+	collection := config.Firestore.Collection
+	if collection == "" {
+		collection = "gcp-pubsub-test"
+	}
+	client, err := firestore.NewClientWithDatabase(context.Background(), project, database, params.clientOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreStore{client: client, collection: client.Collection(collection)}, nil
+}
+
+func (s *firestoreStore) doc(key string) *firestore.DocumentRef {
+	return s.collection.Doc(base64.RawURLEncoding.EncodeToString([]byte(key)))
+}
+
+func (s *firestoreStore) read(snapshot *firestore.DocumentSnapshot, err error) (firestoreEntry, bool, error) {
+	var entry firestoreEntry
+	if status.Code(err) == codes.NotFound {
+		return entry, false, nil
+	} else if err != nil {
+		return entry, false, err
+	}
+	if err := snapshot.DataTo(&entry); err != nil {
+		return entry, false, err
+	}
+	return entry, !entry.expired(), nil
+}
+
+func (s *firestoreStore) Get(ctx context.Context, key string) ([]byte, error) {
+	entry, ok, err := s.read(s.doc(key).Get(ctx))
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrNotFound
+	}
+	return entry.Value, nil
+}
+
+func (s *firestoreStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := s.doc(key).Set(ctx, newFirestoreEntry(key, value, ttl))
+	return err
+}
+
+func (s *firestoreStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	doc := s.doc(key)
+	var stored bool
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		_, ok, err := s.read(tx.Get(doc))
+		if err != nil {
+			return err
+		}
+		stored = !ok
+		if ok {
+			return nil
+		}
+		return tx.Set(doc, newFirestoreEntry(key, value, ttl))
+	})
+	return stored, err
+}
+
+func (s *firestoreStore) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	doc := s.doc(key)
+	var current int64
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		entry, ok, err := s.read(tx.Get(doc))
+		if err != nil {
+			return err
+		}
+		current = 0
+		if ok {
+			if current, err = strconv.ParseInt(string(entry.Value), 10, 64); err != nil {
+				return err
+			}
+		} else {
+			entry = newFirestoreEntry(key, nil, ttl)
+		}
+		current += delta
+		entry.Value = []byte(strconv.FormatInt(current, 10))
+		return tx.Set(doc, entry)
+	})
+	return current, err
+}
+
+func (s *firestoreStore) Delete(ctx context.Context, key string) error {
+	_, err := s.doc(key).Delete(ctx)
+	return err
+}
+
+// List may return fewer than limit entries when some matches have expired
+// but not yet been removed.
+func (s *firestoreStore) List(ctx context.Context, prefix string, limit int) ([]KeyValue, error) {
+	query := s.collection.Where("key", ">=", prefix).Where("key", "<", prefix+"￿").OrderBy("key", firestore.Asc)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var entries []KeyValue
+	documents := query.Documents(ctx)
+	defer documents.Stop()
+	for {
+		snapshot, err := documents.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		entry, ok, err := s.read(snapshot, err)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, KeyValue{Key: entry.Key, Value: entry.Value})
+		}
+	}
+	return entries, nil
+}
+
+func (s *firestoreStore) Close() error {
+	return s.client.Close()
+}
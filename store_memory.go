@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// memoryStore keeps everything in process. State is lost on restart and not
+// shared between instances.
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	stop    chan struct{}
+}
+
+func newMemoryStore() *memoryStore {
+	store := &memoryStore{
+		entries: make(map[string]memoryEntry),
+		stop:    make(chan struct{}),
+	}
+	go store.expire()
+	return store
+}
+
+func expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (s *memoryStore) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, entry := range s.entries {
+				if entry.expired(now) {
+					delete(s.entries, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *memoryStore) lookup(key string) (memoryEntry, bool) {
+	entry, ok := s.entries[key]
+	if ok && entry.expired(time.Now()) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, ok
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), entry.value...), nil
+}
+
+func (s *memoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = memoryEntry{value: append([]byte(nil), value...), expiresAt: expiresAt(ttl)}
+	return nil
+}
+
+func (s *memoryStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); ok {
+		return false, nil
+	}
+	s.entries[key] = memoryEntry{value: append([]byte(nil), value...), expiresAt: expiresAt(ttl)}
+	return true, nil
+}
+
+func (s *memoryStore) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(key)
+	var current int64
+	if ok {
+		var err error
+		if current, err = strconv.ParseInt(string(entry.value), 10, 64); err != nil {
+			return 0, err
+		}
+	} else {
+		entry.expiresAt = expiresAt(ttl)
+	}
+	current += delta
+	entry.value = []byte(strconv.FormatInt(current, 10))
+	s.entries[key] = entry
+	return current, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *memoryStore) List(ctx context.Context, prefix string, limit int) ([]KeyValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []KeyValue
+	for key := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			if entry, ok := s.lookup(key); ok {
+				entries = append(entries, KeyValue{Key: key, Value: append([]byte(nil), entry.value...)})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) Close() error {
+	close(s.stop)
+	return nil
+}
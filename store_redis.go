@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// incrementScript increments a key and, only if the key has no expiry yet
+// (i.e. INCRBY just created it), applies the TTL in milliseconds.
+var incrementScript = redis.NewScript(`
+local value = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) == -1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return value
+`)
+
+type redisStore struct {
+	client *redis.Client
+}
+
+func newRedisStore(config StoreConfig) (*redisStore, error) {
+	if config.Redis.Address == "" {
+		return nil, errors.New("store: redis.address is required")
+	}
+	password := config.Redis.Password
+	if password == "" {
+		password = os.Getenv("REDIS_PASSWORD")
+	}
+	options := &redis.Options{
+		Addr:     config.Redis.Address,
+		Password: password,
+		DB:       config.Redis.DB,
+	}
+	if config.Redis.TLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return &redisStore{client: redis.NewClient(options)}, nil
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *redisStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s *redisStore) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	return incrementScript.Run(ctx, s.client, []string{key}, delta, ttl.Milliseconds()).Int64()
+}
+
+func (s *redisStore) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, key).Err()
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func (s *redisStore) List(ctx context.Context, prefix string, limit int) ([]KeyValue, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, redisGlobEscaper.Replace(prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]KeyValue, 0, len(keys))
+	for i, value := range values {
+		// Keys that expired between SCAN and MGET come back nil.
+		if value, ok := value.(string); ok {
+			entries = append(entries, KeyValue{Key: keys[i], Value: []byte(value)})
+		}
+	}
+	return entries, nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+)
+
+const (
+	timeoutPolicyNack   = "nack"
+	timeoutPolicyExtend = "extend"
+)
+
+var errHandlerTimeout = errors.New("handler timed out")
+
+type Subscriber struct {
+	Config SubscriptionConfig
+
+	logger       *log.Logger
+	messages     *MessageLogger
+	subscription *pubsub.Subscription
+	handler      Handler
+	batchHandler BatchHandler
+	dispatcher   *KeyedDispatcher
+	quarantine   *Quarantine
+	retry        *RetryChain
+	expiredTopic *pubsub.Topic
+	backoff      *ConsumptionBackoff
+	// lanes, with priority aging, shares handler slots with the other
+	// lanes of the subscription's topic, lane being the subscription's.
+	lanes *LaneScheduler
+	lane  string
+	set   *SubscriberSet
+	// maxOutstanding is the receive setting restored after a backoff probe.
+	maxOutstanding int
+	// retryStage is the 1-based retry stage this subscriber consumes, or 0
+	// for a configured subscription.
+	retryStage int
+
+	// mu guards the receive loop's state. done is closed once the current
+	// or most recent receive has returned and its messages are settled.
+	mu      sync.Mutex
+	started bool
+	paused  bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// activity is when, in Unix nanoseconds, the receive loop last started,
+	// delivered a message or settled one, for stall detection.
+	activity atomic.Int64
+}
+
+func (s *Subscriber) active() {
+	s.activity.Store(time.Now().UnixNano())
+}
+
+// handle runs the handler, turning a panic into an error and returning the
+// panicking goroutine's stack alongside it.
+func (s *Subscriber) handle(ctx context.Context, msg *pubsub.Message) (err error, stack string) {
+	ctx, span := startReceiveSpan(ctx, s.Config.Id, msg.ID, msg.Attributes)
+	defer func() {
+		endSpan(span, err)
+	}()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("handler panicked: %v", recovered)
+			stack = string(debug.Stack())
+		}
+	}()
+	msg, err = s.set.cipher.Open(msg)
+	if err != nil {
+		return err, ""
+	}
+	if s.Config.CloudEvents {
+		event, _, err := ParseCloudEvent(msg)
+		if err != nil {
+			return err, ""
+		}
+		ctx = context.WithValue(ctx, cloudEventContextKey{}, event)
+	}
+	ctx = s.set.identity.Extract(ctx, msg)
+	return s.handler(ctx, msg), ""
+}
+
+// handleWithTimeout runs handle under the subscription's deadline budget. The
+// handler's context carries the full budget as its deadline; once it passes,
+// the message is given up on even if the handler ignores cancellation, so
+// that a runaway handler can't hold the message until max extension.
+func (s *Subscriber) handleWithTimeout(ctx context.Context, msg *pubsub.Message) (error, string) {
+	return s.withTimeout(ctx, "message "+msg.ID, func(ctx context.Context) (error, string) {
+		return s.handle(ctx, msg)
+	})
+}
+
+// withTimeout runs handle, a handler run on what is being handled, under the
+// subscription's deadline budget.
+func (s *Subscriber) withTimeout(ctx context.Context, what string, handle func(ctx context.Context) (error, string)) (error, string) {
+	if s.Config.Timeout == 0 {
+		return handle(ctx)
+	}
+	budget := s.Config.Timeout
+	if s.Config.TimeoutPolicy == timeoutPolicyExtend {
+		budget += s.Config.TimeoutExtension
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	type result struct {
+		err   error
+		stack string
+	}
+	done := make(chan result, 1)
+	go func() {
+		err, stack := handle(ctx)
+		done <- result{err, stack}
+	}()
+
+	if s.Config.TimeoutPolicy == timeoutPolicyExtend {
+		timer := time.NewTimer(s.Config.Timeout)
+		select {
+		case r := <-done:
+			timer.Stop()
+			return r.err, r.stack
+		case <-timer.C:
+			s.logger.Printf("Handler %s exceeded %s for %s, extending by %s", s.Config.Handler, s.Config.Timeout, what, s.Config.TimeoutExtension)
+			handlerTimeouts.WithLabelValues(s.Config.Name, "extended").Inc()
+		}
+	}
+
+	select {
+	case r := <-done:
+		return r.err, r.stack
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// Shutting down: let the handler observe cancellation.
+			r := <-done
+			return r.err, r.stack
+		}
+		handlerTimeouts.WithLabelValues(s.Config.Name, "cancelled").Inc()
+		return fmt.Errorf("%w after %s", errHandlerTimeout, budget), ""
+	}
+}
+
+func (s *Subscriber) process(ctx context.Context, msg *pubsub.Message) error {
+	ctx = extractBaggage(ctx, msg.Attributes)
+	if s.retryStage > 0 {
+		if err := s.retry.wait(ctx, msg); err != nil {
+			msg.Nack()
+			return err
+		}
+	}
+	if s.expire(ctx, msg) || s.suppress(ctx, msg) {
+		return nil
+	}
+	if s.lanes != nil {
+		release, err := s.lanes.acquire(ctx, s.lane, msg.PublishTime)
+		if err != nil {
+			msg.Nack()
+			return err
+		}
+		defer release()
+	}
+	started := time.Now()
+	err, stack := s.handleWithTimeout(ctx, msg)
+	return s.settle(ctx, msg, err, stack, time.Since(started))
+}
+
+// suppress acks msg without handling it if it's an email event whose
+// recipients are all suppressed, reporting whether it did. Suppressed
+// recipients of the others are dropped from the event.
+func (s *Subscriber) suppress(ctx context.Context, msg *pubsub.Message) bool {
+	if !s.set.suppressions.Filter(msg) {
+		return false
+	}
+	s.messages.Log(msg, messageOutcome{Event: "handle", Resource: s.Config.Name, MessageId: msg.ID, Result: "suppressed", Context: ctx})
+	messagesProcessed.WithLabelValues(s.Config.Name, "suppressed").Inc()
+	msg.Ack()
+	return true
+}
+
+// settle acks msg, or on a handler error moves it along its retry chain,
+// quarantines it or nacks it, and returns the error.
+func (s *Subscriber) settle(ctx context.Context, msg *pubsub.Message, err error, stack string, duration time.Duration) error {
+	s.active()
+	outcome := messageOutcome{Event: "handle", Resource: s.Config.Name, MessageId: msg.ID, Duration: duration, Err: err, Context: ctx}
+	s.set.observeBackoff(ctx, s, err)
+	if err != nil {
+		if s.retry != nil {
+			if target := s.retry.Fail(ctx, s, s.retryStage, msg, err); target != "" {
+				if target == "dead_letter" {
+					subscription := s.retry.subscription
+					failure := newFailure(failureKindConsume, subscription.Name, subscription.Topic, msg, err)
+					failure.Destination = subscription.Retry.DeadLetterTopic
+					s.set.failures.Record(ctx, failure)
+				}
+				outcome.Result = "retry_" + target
+				s.messages.Log(msg, outcome)
+				messagesProcessed.WithLabelValues(s.Config.Name, "retried").Inc()
+				msg.Ack()
+				return err
+			}
+		}
+		if s.quarantine != nil && s.quarantine.Fail(ctx, s, msg, err, stack) {
+			failure := newFailure(failureKindConsume, s.Config.Name, s.Config.Topic, msg, err)
+			failure.Destination = s.Config.Quarantine.Topic
+			s.set.failures.Record(ctx, failure)
+			outcome.Result = "quarantined"
+			s.messages.Log(msg, outcome)
+			messagesProcessed.WithLabelValues(s.Config.Name, "quarantined").Inc()
+			msg.Ack()
+			return err
+		}
+		if delay := nackDelay(err); delay > 0 {
+			outcome.Result = "nack_delayed"
+			s.messages.Log(msg, outcome)
+			messagesProcessed.WithLabelValues(s.Config.Name, "nack_delayed").Inc()
+			nackAfter(ctx, msg, delay)
+			return err
+		}
+		s.messages.Log(msg, outcome)
+		messagesProcessed.WithLabelValues(s.Config.Name, "error").Inc()
+		msg.Nack()
+		return err
+	}
+	if s.quarantine != nil {
+		s.quarantine.forget(ctx, s, msg)
+	}
+	s.messages.Log(msg, outcome)
+	messagesProcessed.WithLabelValues(s.Config.Name, "ok").Inc()
+	msg.Ack()
+	return nil
+}
+
+func (s *Subscriber) receive(ctx context.Context) error {
+	s.logger.Printf("Receiving from %s with handler %s", s.Config.Id, s.Config.Handler)
+	s.active()
+	if s.batchHandler != nil {
+		return s.receiveBatches(ctx)
+	}
+	if s.dispatcher != nil {
+		err := s.subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+			s.active()
+			s.dispatcher.Dispatch(ctx, msg)
+		})
+		s.dispatcher.Wait()
+		return err
+	}
+	return s.subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		s.active()
+		s.process(ctx, msg)
+	})
+}
+
+type SubscriberSet struct {
+	subscribers  map[string]*Subscriber
+	failures     *FailureStore
+	identity     *Identity
+	suppressions *SuppressionList
+	cipher       *AttributeCipher
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newSubscriberSet(lifecycle fx.Lifecycle, config Config, client *pubsub.Client, store Store, messages *MessageLogger, failures *FailureStore, identity *Identity, suppressions *SuppressionList, cipher *AttributeCipher, handlers *HandlerRegistry) (*SubscriberSet, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	set := &SubscriberSet{
+		subscribers:  make(map[string]*Subscriber, len(config.Subscriptions)),
+		failures:     failures,
+		identity:     identity,
+		suppressions: suppressions,
+		cipher:       cipher,
+		ctx:          ctx,
+	}
+	var chains []*RetryChain
+	// The lane subscriptions of each topic with priority aging share a
+	// scheduler.
+	schedulers := make(map[string]*LaneScheduler)
+	for _, subscriptionConfig := range config.Subscriptions {
+		var (
+			handler      Handler
+			batchHandler BatchHandler
+			ok           bool
+		)
+		if subscriptionConfig.Webhook != nil {
+			sink, err := newWebhookSink(subscriptionConfig)
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("subscription %s: %w", subscriptionConfig.Name, err)
+			}
+			handler, ok = sink.Handle, true
+		} else {
+			subscriptionConfig.Handler, handler, batchHandler, ok = handlers.Resolve(subscriptionConfig)
+		}
+		if !ok {
+			cancel()
+			return nil, fmt.Errorf("subscription %s: unknown handler %q", subscriptionConfig.Name, subscriptionConfig.Handler)
+		}
+		subscriber := &Subscriber{
+			Config:       subscriptionConfig,
+			logger:       newLogger("subscriber:" + subscriptionConfig.Name),
+			messages:     messages,
+			handler:      handler,
+			batchHandler: batchHandler,
+			set:          set,
+		}
+		if topic, lane, ok := subscriptionLane(config, subscriptionConfig); ok && topic.Priority.Aging != nil && batchHandler == nil {
+			if schedulers[topic.Id] == nil {
+				schedulers[topic.Id] = newLaneScheduler(topic.Id, *topic.Priority.Aging)
+			}
+			subscriber.lanes, subscriber.lane = schedulers[topic.Id], lane
+		}
+		set.subscribers[subscriptionConfig.Name] = subscriber
+		if subscriptionConfig.Retry != nil {
+			// Each stage is consumed by its own subscriber running the
+			// same handler, sharing the chain.
+			subscriber.retry = newRetryChain(subscriptionConfig)
+			chains = append(chains, subscriber.retry)
+			for i, stage := range subscriber.retry.stages {
+				stageConfig := stageSubscription(subscriptionConfig, stage)
+				set.subscribers[stageConfig.Name] = &Subscriber{
+					Config:       stageConfig,
+					logger:       newLogger("subscriber:" + stageConfig.Name),
+					messages:     messages,
+					handler:      handler,
+					batchHandler: batchHandler,
+					retry:        subscriber.retry,
+					retryStage:   i + 1,
+					set:          set,
+				}
+			}
+		}
+	}
+
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(startCtx context.Context) error {
+				for _, chain := range chains {
+					if err := chain.connect(startCtx, client); err != nil {
+						return err
+					}
+				}
+				expiredTopics := make(map[string]*pubsub.Topic)
+				for _, subscriber := range set.subscribers {
+					subscriber.subscription = client.Subscription(subscriber.Config.Id)
+					if id := subscriber.Config.ExpiredTopic; id != "" {
+						if expiredTopics[id] == nil {
+							expiredTopics[id] = client.Topic(id)
+						}
+						subscriber.expiredTopic = expiredTopics[id]
+					}
+					if subscriber.Config.Quarantine != nil {
+						subscriber.quarantine = newQuarantine(client, store, subscriber.Config)
+					}
+					if subscriber.retryStage > 0 {
+						// Messages are held for their delay, so their lease
+						// has to be extended for at least that long.
+						delay := subscriber.retry.stages[subscriber.retryStage-1].Delay
+						subscriber.subscription.ReceiveSettings.MaxExtension = delay + subscriber.Config.Timeout + subscriber.Config.TimeoutExtension + 10*time.Minute
+					}
+					if subscriber.Config.MaxOutstandingMessages != 0 {
+						subscriber.subscription.ReceiveSettings.MaxOutstandingMessages = subscriber.Config.MaxOutstandingMessages
+					}
+					subscriber.maxOutstanding = subscriber.subscription.ReceiveSettings.MaxOutstandingMessages
+					if subscriber.Config.Backoff != nil {
+						subscriber.backoff = newConsumptionBackoff(*subscriber.Config.Backoff)
+					}
+					if subscriber.Config.Ordered {
+						subscriber.dispatcher = NewKeyedDispatcher(subscriber.Config.Name, subscriber.Config.MaxConcurrentKeys, subscriber.Config.MaxQueuedPerKey, subscriber.process)
+					}
+					subscriber.mu.Lock()
+					subscriber.started = true
+					if !subscriber.paused {
+						set.run(subscriber)
+					}
+					subscriber.mu.Unlock()
+				}
+				return nil
+			},
+			OnStop: set.stop,
+		},
+	)
+	set.cancel = cancel
+	return set, nil
+}
+
+// stop ends every receive loop and waits, until ctx is done, for the
+// messages in flight to be settled.
+func (set *SubscriberSet) stop(ctx context.Context) error {
+	set.cancel()
+	done := make(chan struct{})
+	go func() {
+		set.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run starts a receive loop for subscriber. Callers must hold subscriber.mu.
+func (set *SubscriberSet) run(subscriber *Subscriber) {
+	ctx, cancel := context.WithCancel(set.ctx)
+	done := make(chan struct{})
+	subscriber.cancel = cancel
+	subscriber.done = done
+	set.wg.Add(1)
+	go func() {
+		defer set.wg.Done()
+		defer close(done)
+		if err := subscriber.receive(ctx); err != nil {
+			subscriber.logger.Printf("Receive stopped: %v", err)
+		}
+	}()
+}
+
+// rotate moves every subscriber to a handle on its subscription from
+// client, waiting, until ctx is done, for the messages received through
+// the previous handle to be settled. Running subscribers start receiving
+// through the new handle before the old one stops, except for ordered
+// ones, which stop first, so a key's messages aren't handled on both at
+// once.
+func (set *SubscriberSet) rotate(ctx context.Context, client *pubsub.Client) error {
+	for _, subscriber := range set.subscribers {
+		subscription := client.Subscription(subscriber.Config.Id)
+		subscriber.mu.Lock()
+		subscription.ReceiveSettings = subscriber.subscription.ReceiveSettings
+		cancel, done := subscriber.cancel, subscriber.done
+		subscriber.cancel = nil
+		ordered := subscriber.dispatcher != nil
+		if cancel == nil || !ordered {
+			subscriber.subscription = subscription
+			if cancel != nil {
+				set.run(subscriber)
+			}
+		}
+		subscriber.mu.Unlock()
+		if cancel == nil {
+			continue
+		}
+		if ordered {
+			stopped := done
+			restarted := make(chan struct{})
+			go func() {
+				defer close(restarted)
+				<-stopped
+				subscriber.mu.Lock()
+				defer subscriber.mu.Unlock()
+				subscriber.subscription = subscription
+				if !subscriber.paused && subscriber.cancel == nil && set.ctx.Err() == nil {
+					set.run(subscriber)
+				}
+			}()
+			done = restarted
+		}
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return fmt.Errorf("subscriber %s is still settling messages from the previous client: %w", subscriber.Config.Name, ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (s *SubscriberSet) Lookup(name string) (*Subscriber, bool) {
+	subscriber, ok := s.subscribers[name]
+	return subscriber, ok
+}
+
+// Pause stops subscriber pulling new messages and waits, until ctx is done,
+// for the in-flight ones to be acked or nacked. The subscriber stays paused
+// even if ctx ends first.
+func (set *SubscriberSet) Pause(ctx context.Context, subscriber *Subscriber) error {
+	subscriber.mu.Lock()
+	if subscriber.paused {
+		subscriber.mu.Unlock()
+		return nil
+	}
+	subscriber.paused = true
+	cancel, done := subscriber.cancel, subscriber.done
+	subscriber.cancel = nil
+	subscriber.mu.Unlock()
+
+	subscriberPaused.WithLabelValues(subscriber.Config.Name).Set(1)
+	subscriber.logger.Printf("Pausing")
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		subscriber.logger.Printf("Paused, in-flight messages settled")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("paused, but in-flight messages are still being handled: %w", ctx.Err())
+	}
+}
+
+// Resume restarts a paused subscriber once its previous receive loop has
+// fully stopped, waiting for that until ctx is done.
+func (set *SubscriberSet) Resume(ctx context.Context, subscriber *Subscriber) error {
+	subscriber.mu.Lock()
+	defer subscriber.mu.Unlock()
+	if !subscriber.paused {
+		return nil
+	}
+	if subscriber.done != nil {
+		// Receive can't run twice at once on a subscription.
+		select {
+		case <-subscriber.done:
+		case <-ctx.Done():
+			return fmt.Errorf("still draining messages from before the pause: %w", ctx.Err())
+		}
+	}
+	subscriber.paused = false
+	subscriberPaused.WithLabelValues(subscriber.Config.Name).Set(0)
+	if subscriber.backoff != nil {
+		// Resuming by hand ends any backoff in progress.
+		subscriber.backoff.close()
+		subscriber.subscription.ReceiveSettings.MaxOutstandingMessages = subscriber.maxOutstanding
+		subscriberBackoffState.WithLabelValues(subscriber.Config.Name).Set(backoffStates[backoffClosed])
+	}
+	subscriber.logger.Printf("Resuming")
+	if subscriber.started {
+		set.run(subscriber)
+	}
+	return nil
+}
+
+type subscriberStatus struct {
+	Name         string `json:"name"`
+	Subscription string `json:"subscription"`
+	Handler      string `json:"handler"`
+	Paused       bool   `json:"paused"`
+	// Backoff is closed, open or probing for subscribers with a backoff.
+	Backoff string `json:"backoff,omitempty"`
+}
+
+func (s *Subscriber) status() subscriberStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := subscriberStatus{Name: s.Config.Name, Subscription: s.Config.Id, Handler: s.Config.Handler, Paused: s.paused}
+	if s.backoff != nil {
+		status.Backoff = s.backoff.current()
+	}
+	return status
+}
+
+type SubscriberAdminHandler struct {
+	subscribers *SubscriberSet
+	client      *pubsub.Client
+}
+
+func newSubscriberAdminHandler(subscribers *SubscriberSet, client *pubsub.Client) *SubscriberAdminHandler {
+	return &SubscriberAdminHandler{subscribers: subscribers, client: client}
+}
+
+func (h *SubscriberAdminHandler) List(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]subscriberStatus, 0, len(h.subscribers.subscribers))
+	for _, subscriber := range h.subscribers.subscribers {
+		statuses = append(statuses, subscriber.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func (h *SubscriberAdminHandler) Pause(w http.ResponseWriter, r *http.Request) {
+	h.control(w, r, h.subscribers.Pause)
+}
+
+func (h *SubscriberAdminHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	h.control(w, r, h.subscribers.Resume)
+}
+
+func (h *SubscriberAdminHandler) control(w http.ResponseWriter, r *http.Request, action func(context.Context, *Subscriber) error) {
+	subscriber, ok := h.subscribers.Lookup(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Unknown subscriber", http.StatusNotFound)
+		return
+	}
+	if err := action(r.Context(), subscriber); err != nil {
+		http.Error(w, err.Error(), http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriber.status())
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+	"go.uber.org/fx"
+)
+
+const (
+	suppressionKeyPrefix = "email-suppressions/"
+
+	suppressionReasonUnsubscribe = "unsubscribe"
+	suppressionReasonBounce      = "bounce"
+	suppressionReasonComplaint   = "complaint"
+	suppressionReasonManual      = "manual"
+
+	// suppressionEventType is the event_type of change notifications.
+	suppressionEventType = "email.suppression"
+
+	defaultSuppressionRefresh = time.Minute
+	maxSuppressionImport      = 100000
+)
+
+var suppressionReasons = map[string]bool{
+	suppressionReasonUnsubscribe: true,
+	suppressionReasonBounce:      true,
+	suppressionReasonComplaint:   true,
+	suppressionReasonManual:      true,
+}
+
+type SuppressionConfig struct {
+	// Topic, if set, is the Pub/Sub topic ID every change to the list is
+	// published to, as an email.suppression event.
+	Topic string `yaml:"topic"`
+	// Refresh is how often each instance reloads the list from the store,
+	// which is how changes made on other instances reach it. Defaults to 1m.
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+// Suppression is an address email must no longer be sent to.
+type Suppression struct {
+	Email string `json:"email"`
+	// Reason is unsubscribe, bounce, complaint or manual, the default.
+	Reason    string    `json:"reason"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// normalize validates s and lowercases its address, which is how it's
+// matched.
+func (s *Suppression) normalize() error {
+	address, err := mail.ParseAddress(s.Email)
+	if err != nil {
+		return fmt.Errorf("invalid email %q", s.Email)
+	}
+	s.Email = strings.ToLower(address.Address)
+	if s.Reason == "" {
+		s.Reason = suppressionReasonManual
+	}
+	if !suppressionReasons[s.Reason] {
+		return fmt.Errorf("unknown reason %q, use unsubscribe, bounce, complaint or manual", s.Reason)
+	}
+	return nil
+}
+
+// suppressionChange is the data of a change notification.
+type suppressionChange struct {
+	// Action is added or removed.
+	Action      string      `json:"action"`
+	Suppression Suppression `json:"suppression"`
+}
+
+// SuppressionList keeps the addresses email isn't sent to in the store,
+// e.g. Firestore, and a copy of them in memory for consumers to check every
+// email against.
+type SuppressionList struct {
+	logger *log.Logger
+	config SuppressionConfig
+	store  Store
+	topic  *pubsub.Topic
+
+	mu     sync.RWMutex
+	cached map[string]Suppression
+}
+
+func newSuppressionList(lifecycle fx.Lifecycle, config Config, store Store, client *pubsub.Client) *SuppressionList {
+	list := &SuppressionList{
+		logger: newLogger("suppressions"),
+		config: config.Suppression,
+		store:  store,
+		cached: make(map[string]Suppression),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lifecycle.Append(
+		fx.Hook{
+			OnStart: func(startCtx context.Context) error {
+				if list.config.Topic != "" {
+					list.topic = client.Topic(list.config.Topic)
+				}
+				if err := list.load(startCtx); err != nil {
+					return fmt.Errorf("loading email suppressions: %w", err)
+				}
+				go list.run(ctx, done)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				<-done
+				if list.topic != nil {
+					list.topic.Stop()
+				}
+				return nil
+			},
+		},
+	)
+	return list
+}
+
+func (l *SuppressionList) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(l.config.Refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.load(ctx); err != nil && ctx.Err() == nil {
+			l.logger.Printf("Failed to reload suppressions, keeping the previous list: %v", err)
+		}
+	}
+}
+
+// load replaces the cache with the list in the store.
+func (l *SuppressionList) load(ctx context.Context) error {
+	suppressions, err := l.List(ctx)
+	if err != nil {
+		return err
+	}
+	cached := make(map[string]Suppression, len(suppressions))
+	for _, s := range suppressions {
+		cached[s.Email] = s
+	}
+	l.mu.Lock()
+	l.cached = cached
+	l.mu.Unlock()
+	emailSuppressions.Set(float64(len(cached)))
+	return nil
+}
+
+func (l *SuppressionList) key(email string) string {
+	return suppressionKeyPrefix + email
+}
+
+// List returns every suppression from the store, ordered by address.
+func (l *SuppressionList) List(ctx context.Context) ([]Suppression, error) {
+	entries, err := l.store.List(ctx, suppressionKeyPrefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	suppressions := make([]Suppression, len(entries))
+	for i, entry := range entries {
+		if err := json.Unmarshal(entry.Value, &suppressions[i]); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Key, err)
+		}
+	}
+	return suppressions, nil
+}
+
+func (l *SuppressionList) Get(ctx context.Context, email string) (Suppression, error) {
+	var s Suppression
+	value, err := l.store.Get(ctx, l.key(strings.ToLower(email)))
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(value, &s)
+	return s, err
+}
+
+// Add stores s, replacing any suppression of the same address, and returns
+// it with CreatedAt set.
+func (l *SuppressionList) Add(ctx context.Context, s Suppression) (Suppression, error) {
+	if err := s.normalize(); err != nil {
+		return s, err
+	}
+	s.CreatedAt = time.Now().UTC()
+	value, err := json.Marshal(s)
+	if err != nil {
+		return s, err
+	}
+	if err := l.store.Set(ctx, l.key(s.Email), value, 0); err != nil {
+		return s, err
+	}
+	l.mu.Lock()
+	l.cached[s.Email] = s
+	emailSuppressions.Set(float64(len(l.cached)))
+	l.mu.Unlock()
+	l.notify(ctx, "added", s)
+	return s, nil
+}
+
+// Remove deletes the suppression of email, returning ErrNotFound if there
+// is none.
+func (l *SuppressionList) Remove(ctx context.Context, email string) error {
+	s, err := l.Get(ctx, email)
+	if err != nil {
+		return err
+	}
+	if err := l.store.Delete(ctx, l.key(s.Email)); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	delete(l.cached, s.Email)
+	emailSuppressions.Set(float64(len(l.cached)))
+	l.mu.Unlock()
+	l.notify(ctx, "removed", s)
+	return nil
+}
+
+// notify publishes a change to the topic, if there is one. Failing to only
+// loses the notification, as the change is already stored.
+func (l *SuppressionList) notify(ctx context.Context, action string, s Suppression) {
+	if l.topic == nil {
+		return
+	}
+	data, err := json.Marshal(suppressionChange{Action: action, Suppression: s})
+	if err == nil {
+		_, err = l.topic.Publish(ctx, &pubsub.Message{
+			Data:       data,
+			Attributes: map[string]string{emailevents.AttributeEventType: suppressionEventType},
+		}).Get(ctx)
+	}
+	if err != nil {
+		l.logger.Printf("Failed to publish the suppression of %s being %s: %v", s.Email, action, err)
+	}
+}
+
+// Suppressed reports whether email is on the list.
+func (l *SuppressionList) Suppressed(email string) bool {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.cached[strings.ToLower(address.Address)]
+	return ok
+}
+
+// Filter drops the suppressed recipients of msg, if it's an email event,
+// and reports whether none are left, so it shouldn't be sent at all.
+func (l *SuppressionList) Filter(msg *pubsub.Message) bool {
+	if msg.Attributes[emailevents.AttributeEventType] != emailevents.EventTypeSendEmail {
+		return false
+	}
+	l.mu.RLock()
+	empty := len(l.cached) == 0
+	l.mu.RUnlock()
+	if empty {
+		return false
+	}
+	request, err := emailevents.Decode(msg)
+	if err != nil {
+		// Left for the handler to fail.
+		return false
+	}
+	filter := func(recipients []string) []string {
+		kept := recipients[:0:0]
+		for _, recipient := range recipients {
+			if l.Suppressed(recipient) {
+				emailSuppressed.Inc()
+				continue
+			}
+			kept = append(kept, recipient)
+		}
+		return kept
+	}
+	count := len(request.To) + len(request.Cc) + len(request.Bcc)
+	request.To, request.Cc, request.Bcc = filter(request.To), filter(request.Cc), filter(request.Bcc)
+	remaining := len(request.To) + len(request.Cc) + len(request.Bcc)
+	if remaining == 0 {
+		return true
+	}
+	if remaining < count {
+		if encoded, err := emailevents.Encode(request); err == nil {
+			msg.Data = encoded.Data
+		}
+	}
+	return false
+}
+
+type suppressionImportResult struct {
+	Imported int `json:"imported"`
+}
+
+type SuppressionHandler struct {
+	logger       *log.Logger
+	suppressions *SuppressionList
+}
+
+func newSuppressionHandler(suppressions *SuppressionList) *SuppressionHandler {
+	return &SuppressionHandler{logger: newLogger("suppressions"), suppressions: suppressions}
+}
+
+func (h *SuppressionHandler) List(w http.ResponseWriter, r *http.Request) {
+	suppressions, err := h.suppressions.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to list suppressions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suppressions)
+}
+
+func (h *SuppressionHandler) Get(w http.ResponseWriter, r *http.Request) {
+	s, err := h.suppressions.Get(r.Context(), r.PathValue("email"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "The address isn't suppressed", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get suppression: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// Put suppresses the address in the path, with the reason and note in the
+// body, which may be empty.
+func (h *SuppressionHandler) Put(w http.ResponseWriter, r *http.Request) {
+	var s Suppression
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&s); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid suppression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Email = r.PathValue("email")
+	if err := s.normalize(); err != nil {
+		http.Error(w, "Invalid suppression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	saved, err := h.suppressions.Add(r.Context(), s)
+	if err != nil {
+		http.Error(w, "Failed to save suppression: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(h.logger, r).Printf("Suppressed %s (%s)", saved.Email, saved.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
+
+func (h *SuppressionHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	email := r.PathValue("email")
+	if err := h.suppressions.Remove(r.Context(), email); errors.Is(err, ErrNotFound) {
+		http.Error(w, "The address isn't suppressed", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to delete suppression: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(h.logger, r).Printf("Removed the suppression of %s", email)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Import adds suppressions in bulk, from a JSON array of suppressions or a
+// CSV of email,reason,note rows. Every row is validated before any is
+// stored.
+func (h *SuppressionHandler) Import(w http.ResponseWriter, r *http.Request) {
+	body := http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)
+	var suppressions []Suppression
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		suppressions, err = readSuppressionCSV(body)
+	} else {
+		err = json.NewDecoder(body).Decode(&suppressions)
+	}
+	if err == nil && len(suppressions) > maxSuppressionImport {
+		err = fmt.Errorf("at most %d suppressions can be imported at once", maxSuppressionImport)
+	}
+	for i := range suppressions {
+		if err != nil {
+			break
+		}
+		if err = suppressions[i].normalize(); err != nil {
+			err = fmt.Errorf("row %d: %w", i+1, err)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Invalid import: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result suppressionImportResult
+	for _, s := range suppressions {
+		if _, err := h.suppressions.Add(r.Context(), s); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to import %s after importing %d: %v", s.Email, result.Imported, err), http.StatusInternalServerError)
+			return
+		}
+		result.Imported++
+	}
+	requestLogger(h.logger, r).Printf("Imported %d suppressions", result.Imported)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// readSuppressionCSV reads email,reason,note rows, where reason and note
+// are optional. A first row starting with "email" is taken as a header.
+func readSuppressionCSV(r io.Reader) ([]Suppression, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var suppressions []Suppression
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return suppressions, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if row == 1 && strings.EqualFold(record[0], "email") {
+			continue
+		}
+		s := Suppression{Email: record[0]}
+		if len(record) > 1 {
+			s.Reason = record[1]
+		}
+		if len(record) > 2 {
+			s.Note = record[2]
+		}
+		suppressions = append(suppressions, s)
+	}
+}
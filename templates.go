@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/boxes-ltd/gcp-pubsub-test/client/emailevents"
+	"go.uber.org/fx"
+)
+
+const (
+	templateBackendStore = "store"
+	templateBackendGCS   = "gcs"
+
+	templateKeyPrefix = "email-templates/"
+)
+
+var templateIdPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,127}$`)
+
+type TemplatesConfig struct {
+	// Backend is store (the default), which keeps templates in the
+	// configured store, e.g. Firestore, or gcs.
+	Backend string `yaml:"backend"`
+	Bucket  string `yaml:"bucket"`
+	Prefix  string `yaml:"prefix"`
+}
+
+// EmailTemplate is one version of a template that email events reference by
+// template_id. Versions are immutable; updating a template adds a version.
+type EmailTemplate struct {
+	Id          string    `json:"id"`
+	Version     int       `json:"version"`
+	Description string    `json:"description,omitempty"`
+	Subject     string    `json:"subject"`
+	TextBody    string    `json:"text_body,omitempty"`
+	HtmlBody    string    `json:"html_body,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// validate parses every part of the template, so that broken templates are
+// rejected when they're saved rather than when an email is rendered.
+func (t EmailTemplate) validate() error {
+	if !templateIdPattern.MatchString(t.Id) {
+		return fmt.Errorf("invalid template id %q", t.Id)
+	}
+	if t.Subject == "" {
+		return errors.New("subject is required")
+	}
+	if t.TextBody == "" && t.HtmlBody == "" {
+		return errors.New("text_body or html_body is required")
+	}
+	_, err := t.Render(nil, false)
+	return err
+}
+
+type renderedEmail struct {
+	Subject  string `json:"subject"`
+	TextBody string `json:"text_body,omitempty"`
+	HtmlBody string `json:"html_body,omitempty"`
+}
+
+// Render executes the template with variables. When strict, a variable
+// the template uses but that isn't given is an error.
+func (t EmailTemplate) Render(variables map[string]string, strict bool) (renderedEmail, error) {
+	missingKey := "missingkey=zero"
+	if strict {
+		missingKey = "missingkey=error"
+	}
+	if variables == nil {
+		variables = map[string]string{}
+	}
+	var rendered renderedEmail
+	var err error
+	if rendered.Subject, err = renderText("subject", t.Subject, missingKey, variables); err != nil {
+		return rendered, err
+	}
+	if rendered.TextBody, err = renderText("text_body", t.TextBody, missingKey, variables); err != nil {
+		return rendered, err
+	}
+	if t.HtmlBody != "" {
+		parsed, err := htmltemplate.New("html_body").Option(missingKey).Parse(t.HtmlBody)
+		if err != nil {
+			return rendered, err
+		}
+		var b bytes.Buffer
+		if err := parsed.Execute(&b, variables); err != nil {
+			return rendered, err
+		}
+		rendered.HtmlBody = b.String()
+	}
+	return rendered, nil
+}
+
+func renderText(name string, text string, missingKey string, variables map[string]string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	parsed, err := template.New(name).Option(missingKey).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := parsed.Execute(&b, variables); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// TemplateRepository stores versioned email templates. Get with version 0
+// returns the latest version, and ErrNotFound if there is none.
+type TemplateRepository interface {
+	// List returns the latest version of every template.
+	List(ctx context.Context) ([]EmailTemplate, error)
+	Versions(ctx context.Context, id string) ([]EmailTemplate, error)
+	Get(ctx context.Context, id string, version int) (EmailTemplate, error)
+	// Save stores t as the next version of its template and returns it
+	// with Version and CreatedAt set.
+	Save(ctx context.Context, t EmailTemplate) (EmailTemplate, error)
+	// Delete removes every version of a template.
+	Delete(ctx context.Context, id string) error
+}
+
+func newTemplateRepository(lifecycle fx.Lifecycle, config Config, store Store, params PubSubParams) (TemplateRepository, error) {
+	switch config.Templates.Backend {
+	case "", templateBackendStore:
+		return storeTemplates{store: store}, nil
+	case templateBackendGCS:
+		if config.Templates.Bucket == "" {
+			return nil, errors.New("templates: the gcs backend needs a bucket")
+		}
+		return &gcsTemplates{
+			storage: newStorageClient(lifecycle, params),
+			bucket:  config.Templates.Bucket,
+			prefix:  config.Templates.Prefix,
+		}, nil
+	default:
+		return nil, fmt.Errorf("templates: unknown backend %q", config.Templates.Backend)
+	}
+}
+
+// storeTemplates keeps each version under its own key, with a counter per
+// template to allocate version numbers.
+type storeTemplates struct {
+	store Store
+}
+
+func (s storeTemplates) versionKey(id string, version int) string {
+	return fmt.Sprintf("%sversions/%s/%08d", templateKeyPrefix, id, version)
+}
+
+func (s storeTemplates) counterKey(id string) string {
+	return templateKeyPrefix + "counters/" + id
+}
+
+func (s storeTemplates) List(ctx context.Context) ([]EmailTemplate, error) {
+	entries, err := s.store.List(ctx, templateKeyPrefix+"versions/", 0)
+	if err != nil {
+		return nil, err
+	}
+	var templates []EmailTemplate
+	for _, entry := range entries {
+		var t EmailTemplate
+		if err := json.Unmarshal(entry.Value, &t); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Key, err)
+		}
+		// Keys sort by template and then version, so a template's latest
+		// version replaces the ones before it.
+		if n := len(templates); n > 0 && templates[n-1].Id == t.Id {
+			templates[n-1] = t
+		} else {
+			templates = append(templates, t)
+		}
+	}
+	return templates, nil
+}
+
+func (s storeTemplates) Versions(ctx context.Context, id string) ([]EmailTemplate, error) {
+	entries, err := s.store.List(ctx, templateKeyPrefix+"versions/"+id+"/", 0)
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]EmailTemplate, len(entries))
+	for i, entry := range entries {
+		if err := json.Unmarshal(entry.Value, &templates[i]); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Key, err)
+		}
+	}
+	return templates, nil
+}
+
+func (s storeTemplates) Get(ctx context.Context, id string, version int) (EmailTemplate, error) {
+	var t EmailTemplate
+	if version == 0 {
+		versions, err := s.Versions(ctx, id)
+		if err != nil {
+			return t, err
+		}
+		if len(versions) == 0 {
+			return t, ErrNotFound
+		}
+		return versions[len(versions)-1], nil
+	}
+	value, err := s.store.Get(ctx, s.versionKey(id, version))
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(value, &t)
+	return t, err
+}
+
+func (s storeTemplates) Save(ctx context.Context, t EmailTemplate) (EmailTemplate, error) {
+	version, err := s.store.Increment(ctx, s.counterKey(t.Id), 1, 0)
+	if err != nil {
+		return t, err
+	}
+	t.Version = int(version)
+	t.CreatedAt = time.Now().UTC()
+	value, err := json.Marshal(t)
+	if err != nil {
+		return t, err
+	}
+	return t, s.store.Set(ctx, s.versionKey(t.Id, t.Version), value, 0)
+}
+
+func (s storeTemplates) Delete(ctx context.Context, id string) error {
+	versions, err := s.Versions(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return ErrNotFound
+	}
+	for _, t := range versions {
+		if err := s.store.Delete(ctx, s.versionKey(id, t.Version)); err != nil {
+			return err
+		}
+	}
+	return s.store.Delete(ctx, s.counterKey(id))
+}
+
+// parseTemplateVersion reads the optional version query parameter.
+func parseTemplateVersion(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("version")
+	if value == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid version %q", value)
+	}
+	return version, nil
+}
+
+type templatePreviewRequest struct {
+	// Version defaults to the latest.
+	Version   int               `json:"version,omitempty"`
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+type EmailTemplateHandler struct {
+	logger    *log.Logger
+	templates TemplateRepository
+}
+
+func newEmailTemplateHandler(templates TemplateRepository) *EmailTemplateHandler {
+	return &EmailTemplateHandler{logger: newLogger("templates"), templates: templates}
+}
+
+func (h *EmailTemplateHandler) List(w http.ResponseWriter, r *http.Request) {
+	templates, err := h.templates.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to list templates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if templates == nil {
+		templates = []EmailTemplate{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+func (h *EmailTemplateHandler) Get(w http.ResponseWriter, r *http.Request) {
+	version, err := parseTemplateVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, ok := h.lookup(w, r, version)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func (h *EmailTemplateHandler) Versions(w http.ResponseWriter, r *http.Request) {
+	versions, err := h.templates.Versions(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to list template versions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		http.Error(w, "Unknown template", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// Put saves the body as a new version of the template, creating it if
+// it doesn't exist yet.
+func (h *EmailTemplateHandler) Put(w http.ResponseWriter, r *http.Request) {
+	var t EmailTemplate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&t); err != nil {
+		http.Error(w, "Invalid template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.Id = r.PathValue("id")
+	if err := t.validate(); err != nil {
+		http.Error(w, "Invalid template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	saved, err := h.templates.Save(r.Context(), t)
+	if err != nil {
+		http.Error(w, "Failed to save template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(h.logger, r).Printf("Saved template %s version %d", saved.Id, saved.Version)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(saved)
+}
+
+func (h *EmailTemplateHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := h.templates.Delete(r.Context(), id); errors.Is(err, ErrNotFound) {
+		http.Error(w, "Unknown template", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to delete template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(h.logger, r).Printf("Deleted template %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Preview renders a version of the template with the given variables, failing
+// on any variable the template uses that's missing.
+func (h *EmailTemplateHandler) Preview(w http.ResponseWriter, r *http.Request) {
+	var request templatePreviewRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&request); err != nil {
+		http.Error(w, "Invalid preview request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, ok := h.lookup(w, r, request.Version)
+	if !ok {
+		return
+	}
+	rendered, err := t.Render(request.Variables, true)
+	if err != nil {
+		http.Error(w, "Failed to render template: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rendered)
+}
+
+func (h *EmailTemplateHandler) lookup(w http.ResponseWriter, r *http.Request, version int) (EmailTemplate, bool) {
+	t, err := h.templates.Get(r.Context(), r.PathValue("id"), version)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Unknown template or version", http.StatusNotFound)
+		return t, false
+	} else if err != nil {
+		http.Error(w, "Failed to get template: "+err.Error(), http.StatusInternalServerError)
+		return t, false
+	}
+	return t, true
+}
+
+var errUnknownTemplate = errors.New("unknown email template")
+
+// checkEmailTemplate rejects email events that reference a template that
+// isn't managed here. Other messages pass unchecked.
+func checkEmailTemplate(ctx context.Context, templates TemplateRepository, msg *pubsub.Message) error {
+	if msg.Attributes[emailevents.AttributeEventType] != emailevents.EventTypeSendEmail {
+		return nil
+	}
+	request, err := emailevents.Decode(msg)
+	if err != nil || request.TemplateId == "" {
+		return nil
+	}
+	if _, err := templates.Get(ctx, request.TemplateId, 0); errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%w %q", errUnknownTemplate, request.TemplateId)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
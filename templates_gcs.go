@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// gcsTemplates stores each version as an object named
+// <prefix>/<id>/<version>.json. Versions are allocated by creating the
+// object only if it doesn't exist, retrying when a concurrent save wins.
+type gcsTemplates struct {
+	storage *storage.Client
+	bucket  string
+	prefix  string
+}
+
+const gcsTemplateSaveAttempts = 5
+
+func (g *gcsTemplates) object(id string, version int) *storage.ObjectHandle {
+	return g.storage.Bucket(g.bucket).Object(path.Join(g.prefix, id, fmt.Sprintf("%08d.json", version)))
+}
+
+func (g *gcsTemplates) read(ctx context.Context, object *storage.ObjectHandle) (EmailTemplate, error) {
+	var t EmailTemplate
+	reader, err := object.NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return t, ErrNotFound
+	} else if err != nil {
+		return t, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(data, &t)
+	return t, err
+}
+
+// versionNumbers returns the template's versions in ascending order.
+func (g *gcsTemplates) versionNumbers(ctx context.Context, id string) ([]int, error) {
+	var versions []int
+	it := g.storage.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: path.Join(g.prefix, id) + "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return versions, nil
+		} else if err != nil {
+			return nil, err
+		}
+		version, err := strconv.Atoi(strings.TrimSuffix(path.Base(attrs.Name), ".json"))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+}
+
+func (g *gcsTemplates) List(ctx context.Context) ([]EmailTemplate, error) {
+	prefix := ""
+	if g.prefix != "" {
+		prefix = strings.TrimSuffix(g.prefix, "/") + "/"
+	}
+	var templates []EmailTemplate
+	it := g.storage.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return templates, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if attrs.Prefix == "" {
+			continue
+		}
+		t, err := g.Get(ctx, strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, prefix), "/"), 0)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+}
+
+func (g *gcsTemplates) Versions(ctx context.Context, id string) ([]EmailTemplate, error) {
+	versions, err := g.versionNumbers(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]EmailTemplate, 0, len(versions))
+	for _, version := range versions {
+		t, err := g.read(ctx, g.object(id, version))
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+func (g *gcsTemplates) Get(ctx context.Context, id string, version int) (EmailTemplate, error) {
+	if version == 0 {
+		versions, err := g.versionNumbers(ctx, id)
+		if err != nil {
+			return EmailTemplate{}, err
+		}
+		if len(versions) == 0 {
+			return EmailTemplate{}, ErrNotFound
+		}
+		version = versions[len(versions)-1]
+	}
+	return g.read(ctx, g.object(id, version))
+}
+
+func (g *gcsTemplates) Save(ctx context.Context, t EmailTemplate) (EmailTemplate, error) {
+	for attempt := 0; attempt < gcsTemplateSaveAttempts; attempt++ {
+		versions, err := g.versionNumbers(ctx, t.Id)
+		if err != nil {
+			return t, err
+		}
+		t.Version = 1
+		if len(versions) > 0 {
+			t.Version = versions[len(versions)-1] + 1
+		}
+		t.CreatedAt = time.Now().UTC()
+		data, err := json.Marshal(t)
+		if err != nil {
+			return t, err
+		}
+
+		writeCtx, cancel := context.WithCancel(ctx)
+		writer := g.object(t.Id, t.Version).If(storage.Conditions{DoesNotExist: true}).NewWriter(writeCtx)
+		writer.ContentType = "application/json"
+		_, err = writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+		cancel()
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			continue
+		}
+		return t, err
+	}
+	return t, fmt.Errorf("template %s: gave up allocating a version after %d concurrent saves", t.Id, gcsTemplateSaveAttempts)
+}
+
+func (g *gcsTemplates) Delete(ctx context.Context, id string) error {
+	versions, err := g.versionNumbers(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return ErrNotFound
+	}
+	for _, version := range versions {
+		if err := g.object(id, version).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return err
+		}
+	}
+	return nil
+}
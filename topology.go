@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+	"google.golang.org/api/iterator"
+	"gopkg.in/yaml.v3"
+)
+
+// Topology is a declarative snapshot of the Pub/Sub resources this service
+// uses, either as declared in the config file or as they exist in GCP.
+type Topology struct {
+	Project       string                 `yaml:"project"`
+	Topics        []TopicTopology        `yaml:"topics"`
+	Subscriptions []SubscriptionTopology `yaml:"subscriptions"`
+}
+
+type TopicTopology struct {
+	Name             string            `yaml:"name"`
+	Labels           map[string]string `yaml:"labels,omitempty"`
+	MessageRetention time.Duration     `yaml:"message_retention,omitempty"`
+	IAM              []IAMBinding      `yaml:"iam,omitempty"`
+}
+
+type SubscriptionTopology struct {
+	Name              string            `yaml:"name"`
+	Topic             string            `yaml:"topic"`
+	Labels            map[string]string `yaml:"labels,omitempty"`
+	AckDeadline       time.Duration     `yaml:"ack_deadline,omitempty"`
+	RetentionDuration time.Duration     `yaml:"retention_duration,omitempty"`
+	Ordering          bool              `yaml:"ordering,omitempty"`
+	Filter            string            `yaml:"filter,omitempty"`
+	PushEndpoint      string            `yaml:"push_endpoint,omitempty"`
+	// PushServiceAccount and PushAudience are the OIDC token a push
+	// subscription authenticates its pushes with.
+	PushServiceAccount string       `yaml:"push_service_account,omitempty"`
+	PushAudience       string       `yaml:"push_audience,omitempty"`
+	DeadLetter         *DeadLetter  `yaml:"dead_letter,omitempty"`
+	RetryPolicy        *RetryPolicy `yaml:"retry_policy,omitempty"`
+	IAM                []IAMBinding `yaml:"iam,omitempty"`
+
+	// pushVerification is whether provisioning checks that PushEndpoint
+	// accepts pushes after creating or changing the subscription.
+	pushVerification bool
+}
+
+type DeadLetter struct {
+	Topic               string `yaml:"topic"`
+	MaxDeliveryAttempts int    `yaml:"max_delivery_attempts"`
+}
+
+type RetryPolicy struct {
+	MinimumBackoff time.Duration `yaml:"minimum_backoff,omitempty"`
+	MaximumBackoff time.Duration `yaml:"maximum_backoff,omitempty"`
+}
+
+type IAMBinding struct {
+	Role    string   `yaml:"role"`
+	Members []string `yaml:"members"`
+}
+
+// configTopology builds the topology declared by config. It can't know about
+// IAM or subscription settings the config doesn't manage.
+func configTopology(project string, config Config) Topology {
+	topology := Topology{Project: project}
+	topics := make(map[string]bool)
+	addTopic := func(name string) {
+		if name != "" && !topics[name] {
+			topics[name] = true
+			topology.Topics = append(topology.Topics, TopicTopology{Name: name})
+		}
+	}
+	for _, topic := range config.Topics {
+		addTopic(topic.Id)
+		if topic.DebugSample != nil {
+			addTopic(topic.DebugSample.Topic)
+		}
+		if topic.Priority != nil {
+			for _, lane := range []string{priorityHigh, priorityNormal, priorityBulk} {
+				addTopic(topic.Priority.Topics[lane])
+			}
+		}
+	}
+	for _, subscription := range config.Subscriptions {
+		addTopic(subscription.Topic)
+		topology.Subscriptions = append(topology.Subscriptions, SubscriptionTopology{
+			Name:        subscription.Id,
+			Topic:       subscription.Topic,
+			Ordering:    subscription.Ordered,
+			Filter:      subscriptionFilter(config, subscription),
+			DeadLetter:  subscription.DeadLetter,
+			RetryPolicy: subscription.RetryPolicy,
+		})
+		if subscription.DeadLetter != nil {
+			addTopic(subscription.DeadLetter.Topic)
+		}
+		if quarantine := subscription.Quarantine; quarantine != nil {
+			addTopic(quarantine.Topic)
+			topology.Subscriptions = append(topology.Subscriptions, SubscriptionTopology{
+				Name:  quarantine.Subscription,
+				Topic: quarantine.Topic,
+			})
+		}
+		if retry := subscription.Retry; retry != nil {
+			for _, stage := range retryStages(subscription) {
+				addTopic(stage.Topic)
+				topology.Subscriptions = append(topology.Subscriptions, SubscriptionTopology{
+					Name:        stage.Subscription,
+					Topic:       stage.Topic,
+					AckDeadline: time.Minute,
+				})
+			}
+			addTopic(retry.DeadLetterTopic)
+			topology.Subscriptions = append(topology.Subscriptions, SubscriptionTopology{
+				Name:  retry.DeadLetterSubscription,
+				Topic: retry.DeadLetterTopic,
+			})
+		}
+	}
+	for _, push := range config.PushSubscriptions {
+		addTopic(push.Topic)
+		topology.Subscriptions = append(topology.Subscriptions, SubscriptionTopology{
+			Name:               push.Id,
+			Topic:              push.Topic,
+			AckDeadline:        push.AckDeadline,
+			Filter:             push.Filter,
+			PushEndpoint:       push.Endpoint,
+			PushServiceAccount: push.ServiceAccount,
+			PushAudience:       push.Audience,
+			DeadLetter:         push.DeadLetter,
+			RetryPolicy:        push.RetryPolicy,
+			pushVerification:   !push.SkipVerification,
+		})
+		if push.DeadLetter != nil {
+			addTopic(push.DeadLetter.Topic)
+		}
+	}
+	return topology
+}
+
+func liveTopology(ctx context.Context, project string, client *pubsub.Client, includeIAM bool) (Topology, error) {
+	topology := Topology{Project: project}
+
+	topics := client.Topics(ctx)
+	for {
+		topic, err := topics.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return topology, fmt.Errorf("listing topics: %w", err)
+		}
+		config, err := topic.Config(ctx)
+		if err != nil {
+			return topology, fmt.Errorf("topic %s: %w", topic.ID(), err)
+		}
+		exported := TopicTopology{Name: topic.ID(), Labels: config.Labels}
+		if includeIAM {
+			if exported.IAM, err = iamBindings(ctx, topic.IAM()); err != nil {
+				return topology, fmt.Errorf("topic %s IAM: %w", topic.ID(), err)
+			}
+		}
+		if retention, ok := config.RetentionDuration.(time.Duration); ok {
+			exported.MessageRetention = retention
+		}
+		topology.Topics = append(topology.Topics, exported)
+	}
+
+	subscriptions := client.Subscriptions(ctx)
+	for {
+		subscription, err := subscriptions.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return topology, fmt.Errorf("listing subscriptions: %w", err)
+		}
+		config, err := subscription.Config(ctx)
+		if err != nil {
+			return topology, fmt.Errorf("subscription %s: %w", subscription.ID(), err)
+		}
+		exported := SubscriptionTopology{
+			Name:              subscription.ID(),
+			Labels:            config.Labels,
+			AckDeadline:       config.AckDeadline,
+			RetentionDuration: config.RetentionDuration,
+			Ordering:          config.EnableMessageOrdering,
+			Filter:            config.Filter,
+			PushEndpoint:      config.PushConfig.Endpoint,
+		}
+		exported.PushServiceAccount, exported.PushAudience = livePushAuth(config.PushConfig)
+		if includeIAM {
+			if exported.IAM, err = iamBindings(ctx, subscription.IAM()); err != nil {
+				return topology, fmt.Errorf("subscription %s IAM: %w", subscription.ID(), err)
+			}
+		}
+		if config.Topic != nil {
+			exported.Topic = config.Topic.ID()
+		}
+		if policy := config.DeadLetterPolicy; policy != nil {
+			exported.DeadLetter = &DeadLetter{
+				Topic:               resourceId(policy.DeadLetterTopic),
+				MaxDeliveryAttempts: policy.MaxDeliveryAttempts,
+			}
+		}
+		exported.RetryPolicy = liveRetryPolicy(config.RetryPolicy)
+		topology.Subscriptions = append(topology.Subscriptions, exported)
+	}
+	return topology, nil
+}
+
+func iamBindings(ctx context.Context, handle *iam.Handle) ([]IAMBinding, error) {
+	policy, err := handle.Policy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []IAMBinding
+	for _, role := range policy.Roles() {
+		members := policy.Members(role)
+		sort.Strings(members)
+		bindings = append(bindings, IAMBinding{Role: string(role), Members: members})
+	}
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].Role < bindings[j].Role })
+	return bindings, nil
+}
+
+// resourceId returns the last segment of a resource name such as
+// "projects/p/topics/t".
+func resourceId(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+func writeTopologyYAML(w io.Writer, topology Topology) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(topology); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+var terraformNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func terraformName(name string) string {
+	name = terraformNameInvalid.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func terraformDuration(duration time.Duration) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%ds", int64(duration.Seconds())))
+}
+
+func writeTerraform(w io.Writer, topology Topology) error {
+	var b strings.Builder
+	topics := make(map[string]bool, len(topology.Topics))
+	topicRef := func(name string) string {
+		if topics[name] {
+			return "google_pubsub_topic." + terraformName(name) + ".id"
+		}
+		return fmt.Sprintf("%q", "projects/"+topology.Project+"/topics/"+name)
+	}
+	writeLabels := func(labels map[string]string) {
+		if len(labels) == 0 {
+			return
+		}
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString("  labels = {\n")
+		for _, key := range keys {
+			fmt.Fprintf(&b, "    %q = %q\n", key, labels[key])
+		}
+		b.WriteString("  }\n")
+	}
+	writeBindings := func(kind string, resource string, attribute string, reference string, bindings []IAMBinding) {
+		for _, binding := range bindings {
+			fmt.Fprintf(&b, "resource \"google_pubsub_%s_iam_binding\" %q {\n", kind, terraformName(resource+"_"+resourceId(binding.Role)))
+			fmt.Fprintf(&b, "  %s = %s\n", attribute, reference)
+			fmt.Fprintf(&b, "  role = %q\n", binding.Role)
+			b.WriteString("  members = [\n")
+			for _, member := range binding.Members {
+				fmt.Fprintf(&b, "    %q,\n", member)
+			}
+			b.WriteString("  ]\n}\n\n")
+		}
+	}
+
+	for _, topic := range topology.Topics {
+		topics[topic.Name] = true
+		fmt.Fprintf(&b, "resource \"google_pubsub_topic\" %q {\n", terraformName(topic.Name))
+		fmt.Fprintf(&b, "  name = %q\n", topic.Name)
+		if topology.Project != "" {
+			fmt.Fprintf(&b, "  project = %q\n", topology.Project)
+		}
+		if topic.MessageRetention > 0 {
+			fmt.Fprintf(&b, "  message_retention_duration = %s\n", terraformDuration(topic.MessageRetention))
+		}
+		writeLabels(topic.Labels)
+		b.WriteString("}\n\n")
+		writeBindings("topic", topic.Name, "topic", "google_pubsub_topic."+terraformName(topic.Name)+".name", topic.IAM)
+	}
+
+	for _, subscription := range topology.Subscriptions {
+		fmt.Fprintf(&b, "resource \"google_pubsub_subscription\" %q {\n", terraformName(subscription.Name))
+		fmt.Fprintf(&b, "  name = %q\n", subscription.Name)
+		if topology.Project != "" {
+			fmt.Fprintf(&b, "  project = %q\n", topology.Project)
+		}
+		fmt.Fprintf(&b, "  topic = %s\n", topicRef(subscription.Topic))
+		if subscription.AckDeadline > 0 {
+			fmt.Fprintf(&b, "  ack_deadline_seconds = %d\n", int64(subscription.AckDeadline.Seconds()))
+		}
+		if subscription.RetentionDuration > 0 {
+			fmt.Fprintf(&b, "  message_retention_duration = %s\n", terraformDuration(subscription.RetentionDuration))
+		}
+		if subscription.Ordering {
+			b.WriteString("  enable_message_ordering = true\n")
+		}
+		if subscription.Filter != "" {
+			fmt.Fprintf(&b, "  filter = %q\n", subscription.Filter)
+		}
+		writeLabels(subscription.Labels)
+		if subscription.PushEndpoint != "" {
+			fmt.Fprintf(&b, "  push_config {\n    push_endpoint = %q\n", subscription.PushEndpoint)
+			if subscription.PushServiceAccount != "" {
+				b.WriteString("    oidc_token {\n")
+				fmt.Fprintf(&b, "      service_account_email = %q\n", subscription.PushServiceAccount)
+				if subscription.PushAudience != "" {
+					fmt.Fprintf(&b, "      audience = %q\n", subscription.PushAudience)
+				}
+				b.WriteString("    }\n")
+			}
+			b.WriteString("  }\n")
+		}
+		if deadLetter := subscription.DeadLetter; deadLetter != nil {
+			b.WriteString("  dead_letter_policy {\n")
+			fmt.Fprintf(&b, "    dead_letter_topic = %s\n", topicRef(deadLetter.Topic))
+			fmt.Fprintf(&b, "    max_delivery_attempts = %d\n", deadLetter.MaxDeliveryAttempts)
+			b.WriteString("  }\n")
+		}
+		if retry := subscription.RetryPolicy; retry != nil {
+			b.WriteString("  retry_policy {\n")
+			if retry.MinimumBackoff > 0 {
+				fmt.Fprintf(&b, "    minimum_backoff = %s\n", terraformDuration(retry.MinimumBackoff))
+			}
+			if retry.MaximumBackoff > 0 {
+				fmt.Fprintf(&b, "    maximum_backoff = %s\n", terraformDuration(retry.MaximumBackoff))
+			}
+			b.WriteString("  }\n")
+		}
+		b.WriteString("}\n\n")
+		writeBindings("subscription", subscription.Name, "subscription", "google_pubsub_subscription."+terraformName(subscription.Name)+".name", subscription.IAM)
+	}
+
+	_, err := io.WriteString(w, strings.TrimSuffix(b.String(), "\n"))
+	return err
+}
+
+func exportTopology(logger *log.Logger) fx.Option {
+	flags := flag.NewFlagSet("export-topology", flag.ExitOnError)
+	source := flags.String("source", "config", "where to read the topology from: config or live")
+	format := flags.String("format", "yaml", "output format: yaml or terraform")
+	output := flags.String("o", "-", "file to write to, or - for stdout")
+	includeIAM := flags.Bool("iam", true, "include IAM bindings when exporting live state")
+	flags.Parse(commandArgs)
+
+	var write func(io.Writer, Topology) error
+	switch *format {
+	case "yaml":
+		write = writeTopologyYAML
+	case "terraform":
+		write = writeTerraform
+	default:
+		logger.Fatalf("Unknown format %q", *format)
+	}
+
+	run := func(ctx context.Context, topology func(context.Context) (Topology, error)) error {
+		exported, err := topology(ctx)
+		if err != nil {
+			return err
+		}
+		w := io.Writer(os.Stdout)
+		if *output != "-" {
+			file, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+		}
+		return write(w, exported)
+	}
+
+	options := []fx.Option{fx.Provide(newPubSubParams(logger), newConfig(logger))}
+	switch *source {
+	case "config":
+		options = append(options, fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, params PubSubParams, config Config) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				return run(ctx, func(context.Context) (Topology, error) {
+					return configTopology(params.Config.ProjectId, config), nil
+				})
+			})
+		}))
+	case "live":
+		options = append(options, fx.Provide(newPubSubClient), fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, params PubSubParams, client *pubsub.Client) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				return run(ctx, func(ctx context.Context) (Topology, error) {
+					return liveTopology(ctx, params.Config.ProjectId, client, *includeIAM)
+				})
+			})
+		}))
+	default:
+		logger.Fatalf("Unknown source %q", *source)
+	}
+	return fx.Options(options...)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+)
+
+const tracerName = "gcp-pubsub-test"
+
+// traceAttributePrefix matches the prefix the Pub/Sub client library uses
+// when it injects trace context into message attributes, so producers with
+// client tracing enabled and this service interoperate.
+const traceAttributePrefix = "googclient_"
+
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// SampleRatio is the fraction of new traces that are sampled; traces
+	// started upstream follow the caller's decision. Defaults to 1.
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// LogSpans writes every finished span to the log, for local debugging.
+	LogSpans bool `yaml:"log_spans"`
+	// Baggage are the W3C baggage keys, e.g. campaign_id, copied from
+	// publish requests into message attributes and back into the context
+	// and log labels of the subscribers handling them. They're propagated
+	// even with tracing disabled.
+	Baggage []string `yaml:"baggage"`
+}
+
+// newTracerProvider installs the global tracer provider and the W3C trace
+// context and baggage propagators. With tracing disabled, spans are no-ops,
+// so only baggage is propagated, if configured.
+func newTracerProvider(lifecycle fx.Lifecycle, config Config) trace.TracerProvider {
+	baggageKeys = config.Tracing.Baggage
+	if !config.Tracing.Enabled {
+		if len(baggageKeys) > 0 {
+			otel.SetTextMapPropagator(propagation.Baggage{})
+		}
+		return otel.GetTracerProvider()
+	}
+	ratio := config.Tracing.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	}
+	if config.Tracing.LogSpans {
+		options = append(options, sdktrace.WithSyncer(logSpanExporter{logger: newLogger("trace")}))
+	}
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	lifecycle.Append(fx.Hook{OnStop: provider.Shutdown})
+	return provider
+}
+
+type logSpanExporter struct {
+	logger *log.Logger
+}
+
+func (e logSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, span := range spans {
+		var links []string
+		for _, link := range span.Links() {
+			links = append(links, link.SpanContext.TraceID().String()+"/"+link.SpanContext.SpanID().String())
+		}
+		parent := ""
+		if span.Parent().IsValid() {
+			parent = span.Parent().SpanID().String()
+		}
+		e.logger.Printf("span=%q trace_id=%s span_id=%s parent_id=%s kind=%s duration=%s links=%q status=%s",
+			span.Name(), span.SpanContext().TraceID(), span.SpanContext().SpanID(), parent, span.SpanKind(),
+			span.EndTime().Sub(span.StartTime()), strings.Join(links, ","), span.Status().Code)
+	}
+	return nil
+}
+
+func (e logSpanExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// attributeCarrier reads and writes trace context in message attributes.
+// It reads both prefixed and bare keys, and writes prefixed ones.
+type attributeCarrier map[string]string
+
+func (c attributeCarrier) Get(key string) string {
+	if value, ok := c[traceAttributePrefix+key]; ok {
+		return value
+	}
+	return c[key]
+}
+
+func (c attributeCarrier) Set(key string, value string) {
+	c[traceAttributePrefix+key] = value
+}
+
+func (c attributeCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, strings.TrimPrefix(key, traceAttributePrefix))
+	}
+	return keys
+}
+
+// requestContext returns the request's context with the caller's trace
+// context, from the traceparent header, as the remote parent, and its
+// baggage.
+func requestContext(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// startReceiveSpan starts the consumer span for a message delivered by a
+// subscription. Its parent is the trace in ctx, such as a push request's,
+// if any, and it links to the span that produced the message.
+func startReceiveSpan(ctx context.Context, subscription string, messageId string, attributes map[string]string) (context.Context, trace.Span) {
+	options := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "gcp_pubsub"),
+			attribute.String("messaging.operation", "receive"),
+			attribute.String("messaging.destination.name", subscription),
+			attribute.String("messaging.message.id", messageId),
+		),
+	}
+	if attributes != nil {
+		producer := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), attributeCarrier(attributes)))
+		if producer.IsValid() {
+			options = append(options, trace.WithLinks(trace.Link{SpanContext: producer}))
+		}
+	}
+	return otel.Tracer(tracerName).Start(ctx, fmt.Sprintf("%s receive", subscription), options...)
+}
+
+// startPublishSpan starts the producer span for publishing msg to topic and
+// injects its context into the message, replacing any context the message
+// carried from an earlier hop.
+func startPublishSpan(ctx context.Context, topic string, msg *pubsub.Message) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, fmt.Sprintf("%s send", topic),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "gcp_pubsub"),
+			attribute.String("messaging.operation", "publish"),
+			attribute.String("messaging.destination.name", topic),
+		),
+	)
+	if span.SpanContext().IsValid() {
+		if msg.Attributes == nil {
+			msg.Attributes = make(map[string]string)
+		}
+		otel.GetTextMapPropagator().Inject(ctx, attributeCarrier(msg.Attributes))
+	}
+	return ctx, span
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Transform rewrites a message before it's published.
+type Transform func(msg *pubsub.Message) error
+
+// transforms are Go transforms that topics can refer to by name with a func
+// step, for rewrites the declarative steps can't express.
+var transforms = map[string]Transform{}
+
+// TransformStep is one declarative rewrite applied to messages published to
+// a topic. Paths use the same JSONPath subset as ordering_key.
+type TransformStep struct {
+	// Op is one of set, remove, move, set_attribute, rename_attribute,
+	// remove_attribute or func.
+	Op string `yaml:"op"`
+	// Path is the payload field for set, remove and move, or the field
+	// copied into the attribute for set_attribute.
+	Path string `yaml:"path"`
+	// To is the destination field for move, or the new attribute name for
+	// rename_attribute.
+	To        string      `yaml:"to"`
+	Attribute string      `yaml:"attribute"`
+	Value     interface{} `yaml:"value"`
+	Func      string      `yaml:"func"`
+}
+
+// transformState holds the decoded payload across steps so that a chain of
+// field edits decodes and encodes the data once.
+type transformState struct {
+	msg      *pubsub.Message
+	value    interface{}
+	decoded  bool
+	modified bool
+}
+
+func (s *transformState) payload() (*interface{}, error) {
+	if !s.decoded {
+		decoder := json.NewDecoder(bytes.NewReader(s.msg.Data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&s.value); err != nil {
+			return nil, fmt.Errorf("payload isn't JSON: %w", err)
+		}
+		s.decoded = true
+	}
+	return &s.value, nil
+}
+
+// flush writes pending field edits back to the message data.
+func (s *transformState) flush() error {
+	if s.modified {
+		data, err := json.Marshal(s.value)
+		if err != nil {
+			return err
+		}
+		s.msg.Data = data
+	}
+	s.decoded, s.modified, s.value = false, false, nil
+	return nil
+}
+
+type compiledStep func(state *transformState) error
+
+// compileTransforms turns steps into a single Transform, validating paths
+// and names up front so that a bad config fails at startup.
+func compileTransforms(steps []TransformStep) (Transform, error) {
+	compiled := make([]compiledStep, len(steps))
+	for i, step := range steps {
+		var err error
+		if compiled[i], err = compileStep(step); err != nil {
+			return nil, fmt.Errorf("transform %d (%s): %w", i, step.Op, err)
+		}
+	}
+	return func(msg *pubsub.Message) error {
+		state := &transformState{msg: msg}
+		for i, step := range compiled {
+			if err := step(state); err != nil {
+				return fmt.Errorf("transform %d (%s): %w", i, steps[i].Op, err)
+			}
+		}
+		return state.flush()
+	}, nil
+}
+
+func compileStep(step TransformStep) (compiledStep, error) {
+	parse := func(expression string) ([]jsonPathSegment, error) {
+		if expression == "" {
+			return nil, errors.New("missing path")
+		}
+		return parseJSONPath(expression)
+	}
+	switch step.Op {
+	case "set":
+		path, err := parse(step.Path)
+		if err != nil {
+			return nil, err
+		}
+		value, err := jsonCompatible(step.Value)
+		if err != nil {
+			return nil, err
+		}
+		return func(state *transformState) error {
+			payload, err := state.payload()
+			if err != nil {
+				return err
+			}
+			state.modified = true
+			return setJSONPath(payload, path, value)
+		}, nil
+	case "remove":
+		path, err := parse(step.Path)
+		if err != nil {
+			return nil, err
+		}
+		return func(state *transformState) error {
+			payload, err := state.payload()
+			if err != nil {
+				return err
+			}
+			if _, ok := removeJSONPath(*payload, path); ok {
+				state.modified = true
+			}
+			return nil
+		}, nil
+	case "move":
+		from, err := parse(step.Path)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parse(step.To)
+		if err != nil {
+			return nil, err
+		}
+		return func(state *transformState) error {
+			payload, err := state.payload()
+			if err != nil {
+				return err
+			}
+			value, ok := removeJSONPath(*payload, from)
+			if !ok {
+				return nil
+			}
+			state.modified = true
+			return setJSONPath(payload, to, value)
+		}, nil
+	case "set_attribute":
+		if step.Attribute == "" {
+			return nil, errors.New("missing attribute")
+		}
+		if step.Path != "" {
+			path, err := parseJSONPath(step.Path)
+			if err != nil {
+				return nil, err
+			}
+			return func(state *transformState) error {
+				// Earlier edits must be visible to the lookup.
+				if err := state.flush(); err != nil {
+					return err
+				}
+				if value, ok := extractJSONPath(state.msg.Data, path); ok {
+					setAttribute(state.msg, step.Attribute, value)
+				}
+				return nil
+			}, nil
+		}
+		value := fmt.Sprint(step.Value)
+		return func(state *transformState) error {
+			setAttribute(state.msg, step.Attribute, value)
+			return nil
+		}, nil
+	case "rename_attribute":
+		if step.Attribute == "" || step.To == "" {
+			return nil, errors.New("needs attribute and to")
+		}
+		return func(state *transformState) error {
+			if value, ok := state.msg.Attributes[step.Attribute]; ok {
+				delete(state.msg.Attributes, step.Attribute)
+				state.msg.Attributes[step.To] = value
+			}
+			return nil
+		}, nil
+	case "remove_attribute":
+		if step.Attribute == "" {
+			return nil, errors.New("missing attribute")
+		}
+		return func(state *transformState) error {
+			delete(state.msg.Attributes, step.Attribute)
+			return nil
+		}, nil
+	case "func":
+		transform, ok := transforms[step.Func]
+		if !ok {
+			return nil, fmt.Errorf("unknown func %q", step.Func)
+		}
+		return func(state *transformState) error {
+			if err := state.flush(); err != nil {
+				return err
+			}
+			return transform(state.msg)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", step.Op)
+	}
+}
+
+func setAttribute(msg *pubsub.Message, name string, value string) {
+	if msg.Attributes == nil {
+		msg.Attributes = make(map[string]string)
+	}
+	msg.Attributes[name] = value
+}
+
+// jsonCompatible converts a value decoded from YAML, whose maps may have
+// non-string keys, into one encoding/json can marshal.
+func jsonCompatible(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			var err error
+			if converted[key], err = jsonCompatible(item); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v in value", key)
+			}
+			var err error
+			if converted[name], err = jsonCompatible(item); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if converted[i], err = jsonCompatible(item); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	default:
+		return value, nil
+	}
+}
+
+// setJSONPath sets the value at path, creating missing objects along the
+// way. Array elements must already exist.
+func setJSONPath(root *interface{}, path []jsonPathSegment, value interface{}) error {
+	if *root == nil {
+		*root = make(map[string]interface{})
+	}
+	current := *root
+	for i, segment := range path {
+		last := i == len(path)-1
+		switch container := current.(type) {
+		case []interface{}:
+			if segment.index < 0 || segment.index >= len(container) {
+				return fmt.Errorf("no array element to set at segment %d", i)
+			}
+			if last {
+				container[segment.index] = value
+				return nil
+			}
+			current = container[segment.index]
+		case map[string]interface{}:
+			if segment.index >= 0 {
+				return fmt.Errorf("can't index an object at segment %d", i)
+			}
+			if last {
+				container[segment.field] = value
+				return nil
+			}
+			next, ok := container[segment.field]
+			if !ok || next == nil {
+				next = make(map[string]interface{})
+				container[segment.field] = next
+			}
+			current = next
+		default:
+			return fmt.Errorf("can't set inside a scalar at segment %d", i)
+		}
+	}
+	return nil
+}
+
+// removeJSONPath deletes the field at path and returns its value. Array
+// elements can't be removed, only fields.
+func removeJSONPath(root interface{}, path []jsonPathSegment) (interface{}, bool) {
+	current := root
+	for i, segment := range path {
+		last := i == len(path)-1
+		if segment.index >= 0 {
+			array, ok := current.([]interface{})
+			if !ok || segment.index >= len(array) || last {
+				return nil, false
+			}
+			current = array[segment.index]
+			continue
+		}
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok := object[segment.field]
+		if !ok {
+			return nil, false
+		}
+		if last {
+			delete(object, segment.field)
+			return value, true
+		}
+		current = value
+	}
+	return nil, false
+}
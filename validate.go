@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"cloud.google.com/go/pubsub"
+	"go.uber.org/fx"
+	"golang.org/x/oauth2/google"
+)
+
+type validationCheck struct {
+	Check  string `json:"check"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type validationReport struct {
+	Checks []validationCheck `json:"checks"`
+}
+
+func (r *validationReport) add(check string, err error, detail string) {
+	result := validationCheck{Check: check, OK: err == nil, Detail: detail}
+	if err != nil {
+		result.Detail = err.Error()
+	}
+	r.Checks = append(r.Checks, result)
+}
+
+func (r *validationReport) failed() int {
+	failed := 0
+	for _, check := range r.Checks {
+		if !check.OK {
+			failed++
+		}
+	}
+	return failed
+}
+
+func writeValidationText(w io.Writer, report validationReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, check := range report.Checks {
+		status := "ok"
+		if !check.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", status, check.Check, check.Detail)
+	}
+	fmt.Fprintf(tw, "\n%d checks, %d failed\n", len(report.Checks), report.failed())
+	return tw.Flush()
+}
+
+func writeValidationJSON(w io.Writer, report validationReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// checkCredentials resolves the credentials the service would use and
+// fetches a token with them, unless an emulator is in use.
+func checkCredentials(ctx context.Context, params PubSubParams) (string, error) {
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		return "skipped, using emulator at " + host, nil
+	}
+	var (
+		credentials *google.Credentials
+		err         error
+	)
+	if path := params.Config.CredentialsPath; path != "" {
+		data, readErr := os.ReadFile(path)
+		if readErr != nil {
+			return "", readErr
+		}
+		credentials, err = google.CredentialsFromJSON(ctx, data, pubsub.ScopePubSub)
+	} else {
+		credentials, err = google.FindDefaultCredentials(ctx, pubsub.ScopePubSub)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := credentials.TokenSource.Token(); err != nil {
+		return "", fmt.Errorf("fetching token: %w", err)
+	}
+	if credentials.ProjectID != "" {
+		return "resolved for project " + credentials.ProjectID, nil
+	}
+	return "resolved", nil
+}
+
+// validateResources checks that every topic and subscription the config
+// refers to exists, and that subscriptions match their configured topic and
+// ordering. Nothing in the service creates them, so a missing one would fail
+// at runtime.
+func validateResources(ctx context.Context, report *validationReport, client *pubsub.Client, params PubSubParams, config Config) {
+	topics := make(map[string]string)
+	refer := func(id string, reference string) {
+		if _, ok := topics[id]; !ok && id != "" {
+			topics[id] = reference
+		}
+	}
+	for _, topic := range config.Topics {
+		refer(topic.Id, "topic "+topic.Name)
+		if topic.Priority != nil {
+			for lane, id := range topic.Priority.Topics {
+				refer(id, lane+" lane of topic "+topic.Name)
+			}
+		}
+	}
+	for _, subscription := range config.Subscriptions {
+		refer(subscription.Topic, "topic of subscription "+subscription.Name)
+		if subscription.Quarantine != nil {
+			refer(subscription.Quarantine.Topic, "quarantine topic of subscription "+subscription.Name)
+		}
+	}
+	ids := make([]string, 0, len(topics))
+	for id := range topics {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	schemas := make(map[string]bool)
+	for _, id := range ids {
+		check := fmt.Sprintf("topics/%s (%s)", id, topics[id])
+		topicConfig, err := client.Topic(id).Config(ctx)
+		if err != nil {
+			report.add(check, err, "")
+			continue
+		}
+		if schema := topicConfig.SchemaSettings; schema != nil {
+			schemas[schema.Schema] = true
+			report.add(check, nil, "exists, schema "+resourceId(schema.Schema))
+			continue
+		}
+		report.add(check, nil, "exists")
+	}
+
+	if len(schemas) > 0 {
+		schemaClient, err := pubsub.NewSchemaClient(ctx, params.Config.ProjectId, params.clientOptions()...)
+		if err != nil {
+			report.add("schema client", err, "")
+		} else {
+			defer schemaClient.Close()
+			for schema := range schemas {
+				_, err := schemaClient.Schema(ctx, resourceId(schema), pubsub.SchemaViewBasic)
+				report.add("schemas/"+resourceId(schema), err, "exists")
+			}
+		}
+	}
+
+	for _, subscription := range config.Subscriptions {
+		check := fmt.Sprintf("subscriptions/%s (subscription %s)", subscription.Id, subscription.Name)
+		report.add(check, checkSubscription(ctx, client, subscription.Id, subscription.Topic, subscription.Ordered), "exists")
+		if subscription.Quarantine != nil {
+			check := fmt.Sprintf("subscriptions/%s (quarantine of %s)", subscription.Quarantine.Subscription, subscription.Name)
+			report.add(check, checkSubscription(ctx, client, subscription.Quarantine.Subscription, subscription.Quarantine.Topic, false), "exists")
+		}
+	}
+}
+
+func checkSubscription(ctx context.Context, client *pubsub.Client, id string, topic string, ordered bool) error {
+	config, err := client.Subscription(id).Config(ctx)
+	if err != nil {
+		return err
+	}
+	if topic != "" && (config.Topic == nil || config.Topic.ID() != topic) {
+		attached := "a deleted topic"
+		if config.Topic != nil {
+			attached = config.Topic.ID()
+		}
+		return fmt.Errorf("attached to %s, config says %s", attached, topic)
+	}
+	if ordered && !config.EnableMessageOrdering {
+		return errors.New("message ordering is disabled but the config marks it ordered")
+	}
+	return nil
+}
+
+func validateConfig(logger *log.Logger) fx.Option {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	format := flags.String("format", "text", "report format: text or json")
+	flags.Parse(commandArgs)
+
+	var write func(io.Writer, validationReport) error
+	switch *format {
+	case "text":
+		write = writeValidationText
+	case "json":
+		write = writeValidationJSON
+	default:
+		logger.Fatalf("Unknown format %q", *format)
+	}
+
+	return fx.Options(
+		fx.Provide(newPubSubParams(logger)),
+		fx.Invoke(func(lifecycle fx.Lifecycle, shutdowner fx.Shutdowner, params PubSubParams) {
+			runOnce(lifecycle, shutdowner, logger, func(ctx context.Context) error {
+				var report validationReport
+				defer func() { write(os.Stdout, report) }()
+
+				// The checks run here rather than through newConfig and
+				// newPubSubClient so that failures end up in the report
+				// instead of aborting startup.
+				config, err := newConfig(logger)()
+				report.add("config "+envOrDefault("CONFIG_PATH", "config.yaml"), err, fmt.Sprintf("%d topics, %d subscriptions", len(config.Topics), len(config.Subscriptions)))
+				if err != nil {
+					return errors.New("config is invalid")
+				}
+				var projectErr error
+				if params.Config.ProjectId == "" {
+					projectErr = errors.New("PROJECT_ID is not set")
+				}
+				report.add("project", projectErr, params.Config.ProjectId)
+				detail, err := checkCredentials(ctx, params)
+				report.add("credentials", err, detail)
+				if projectErr != nil || err != nil {
+					return errors.New("can't connect to Pub/Sub")
+				}
+
+				client, err := pubsub.NewClient(ctx, params.Config.ProjectId, params.clientOptions()...)
+				report.add("pubsub connection", err, "connected")
+				if err != nil {
+					return errors.New("can't connect to Pub/Sub")
+				}
+				defer client.Close()
+				validateResources(ctx, &report, client, params, config)
+
+				if failed := report.failed(); failed > 0 {
+					return fmt.Errorf("%d checks failed", failed)
+				}
+				return nil
+			})
+		}),
+	)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	webhookHandler = "webhook"
+
+	webhookIdHeader        = "Webhook-Id"
+	webhookSignatureHeader = "Webhook-Signature"
+	// maxWebhookResponseBytes of an error response are kept for its error.
+	maxWebhookResponseBytes = 512
+)
+
+type WebhookConfig struct {
+	// URL, Headers and Body are text/template templates rendered with the
+	// message as a webhookMessage, e.g. "https://example.com/users/{{ .JSON.user_id }}".
+	// Body defaults to the message data as is.
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	// Timeout bounds each attempt. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxAttempts is how many times a message is sent before it's nacked,
+	// with the delay between attempts doubling from Backoff. Responses
+	// other than 408, 429 and 5xx aren't retried, and the message is
+	// quarantined, or sent to the retry chain's dead letter topic, straight
+	// away. Defaults to 3 attempts from 1s.
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	// Secret signs each request with HMAC-SHA256 in the Webhook-Signature
+	// header, as "t=<unix time>,v1=<hex signature of "<unix time>.<body>">".
+	// Defaults to the WEBHOOK_SECRET environment variable; without either,
+	// requests aren't signed.
+	Secret string `yaml:"secret"`
+}
+
+func (c *WebhookConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("webhook needs a url")
+	}
+	if c.Method == "" {
+		c.Method = http.MethodPost
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 3
+	}
+	if c.Backoff == 0 {
+		c.Backoff = time.Second
+	}
+	if c.Timeout < 0 || c.MaxAttempts < 0 || c.Backoff < 0 {
+		return fmt.Errorf("webhook timeout, max_attempts and backoff can't be negative")
+	}
+	if c.Secret == "" {
+		c.Secret = os.Getenv("WEBHOOK_SECRET")
+	}
+	_, err := c.compile()
+	return err
+}
+
+// webhookMessage is what webhook templates are rendered with.
+type webhookMessage struct {
+	Id   string
+	Data string
+	// JSON is Data decoded, or nil if it isn't JSON.
+	JSON         interface{}
+	Attributes   map[string]string
+	OrderingKey  string
+	PublishTime  time.Time
+	Subscription string
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+type webhookTemplates struct {
+	url     *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+}
+
+func (c WebhookConfig) compile() (webhookTemplates, error) {
+	parse := func(name string, text string) (*template.Template, error) {
+		parsed, err := template.New(name).Funcs(webhookFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", name, err)
+		}
+		return parsed, nil
+	}
+	templates := webhookTemplates{headers: make(map[string]*template.Template, len(c.Headers))}
+	var err error
+	if templates.url, err = parse("url", c.URL); err != nil {
+		return templates, err
+	}
+	for name, value := range c.Headers {
+		if templates.headers[name], err = parse("header "+name, value); err != nil {
+			return templates, err
+		}
+	}
+	if c.Body != "" {
+		if templates.body, err = parse("body", c.Body); err != nil {
+			return templates, err
+		}
+	}
+	return templates, nil
+}
+
+// WebhookSink is the handler of subscriptions with a webhook, which
+// delivers each message to an HTTP endpoint.
+type WebhookSink struct {
+	subscription string
+	config       WebhookConfig
+	templates    webhookTemplates
+	client       *http.Client
+}
+
+func newWebhookSink(subscription SubscriptionConfig) (*WebhookSink, error) {
+	templates, err := subscription.Webhook.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookSink{
+		subscription: subscription.Name,
+		config:       *subscription.Webhook,
+		templates:    templates,
+		client:       &http.Client{Timeout: subscription.Webhook.Timeout},
+	}, nil
+}
+
+// Handle delivers msg, retrying failed attempts that may succeed later.
+func (s *WebhookSink) Handle(ctx context.Context, msg *pubsub.Message) error {
+	request, err := s.render(msg)
+	if err != nil {
+		webhookDeliveries.WithLabelValues(s.subscription, "permanent").Inc()
+		return Permanent(err)
+	}
+	retryBudget.Request(retryKindWebhook)
+	delay := s.config.Backoff
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := s.send(ctx, msg, request)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(s.subscription, "ok").Inc()
+			return nil
+		}
+		if isPermanent(err) {
+			webhookDeliveries.WithLabelValues(s.subscription, "permanent").Inc()
+			return err
+		}
+		if attempt >= s.config.MaxAttempts || ctx.Err() != nil || !retryBudget.Retry(retryKindWebhook) {
+			webhookDeliveries.WithLabelValues(s.subscription, "failed").Inc()
+			if retryAfter > 0 {
+				return NackAfter(retryAfter, err)
+			}
+			return err
+		}
+		webhookDeliveries.WithLabelValues(s.subscription, "retry").Inc()
+		timer := time.NewTimer(max(delay, retryAfter))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
+
+type webhookRequest struct {
+	url     string
+	headers map[string]string
+	body    []byte
+}
+
+func (s *WebhookSink) render(msg *pubsub.Message) (webhookRequest, error) {
+	data := webhookMessage{
+		Id:           msg.ID,
+		Data:         string(msg.Data),
+		Attributes:   msg.Attributes,
+		OrderingKey:  msg.OrderingKey,
+		PublishTime:  msg.PublishTime,
+		Subscription: s.subscription,
+	}
+	if json.Valid(msg.Data) {
+		json.Unmarshal(msg.Data, &data.JSON)
+	}
+	render := func(parsed *template.Template) (string, error) {
+		var b strings.Builder
+		if err := parsed.Execute(&b, data); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+
+	request := webhookRequest{headers: make(map[string]string, len(s.templates.headers)), body: msg.Data}
+	var err error
+	if request.url, err = render(s.templates.url); err != nil {
+		return request, err
+	}
+	for name, parsed := range s.templates.headers {
+		if request.headers[name], err = render(parsed); err != nil {
+			return request, err
+		}
+	}
+	if s.templates.body != nil {
+		body, err := render(s.templates.body)
+		if err != nil {
+			return request, err
+		}
+		request.body = []byte(body)
+	}
+	return request, nil
+}
+
+// send makes one attempt at delivering request, returning the Retry-After
+// the endpoint asked for, if any.
+func (s *WebhookSink) send(ctx context.Context, msg *pubsub.Message, request webhookRequest) (time.Duration, error) {
+	httpRequest, err := http.NewRequestWithContext(ctx, s.config.Method, request.url, bytes.NewReader(request.body))
+	if err != nil {
+		return 0, Permanent(err)
+	}
+	if json.Valid(request.body) {
+		httpRequest.Header.Set("Content-Type", "application/json")
+	} else {
+		httpRequest.Header.Set("Content-Type", "application/octet-stream")
+	}
+	for name, value := range request.headers {
+		httpRequest.Header.Set(name, value)
+	}
+	// Lets the endpoint tell redeliveries apart from new messages.
+	httpRequest.Header.Set(webhookIdHeader, msg.ID)
+	if s.config.Secret != "" {
+		httpRequest.Header.Set(webhookSignatureHeader, signWebhook(s.config.Secret, time.Now(), request.body))
+	}
+
+	response, err := s.client.Do(httpRequest)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 300 {
+		io.Copy(io.Discard, response.Body)
+		return 0, nil
+	}
+	excerpt, _ := io.ReadAll(io.LimitReader(response.Body, maxWebhookResponseBytes))
+	err = fmt.Errorf("webhook responded %s: %s", response.Status, strings.TrimSpace(string(excerpt)))
+	switch {
+	case response.StatusCode == http.StatusRequestTimeout || response.StatusCode >= 500:
+		return 0, err
+	case response.StatusCode == http.StatusTooManyRequests:
+		seconds, _ := strconv.Atoi(response.Header.Get("Retry-After"))
+		return time.Duration(seconds) * time.Second, err
+	default:
+		return 0, Permanent(err)
+	}
+}
+
+// signWebhook returns the Webhook-Signature of body, sent at now.
+func signWebhook(secret string, now time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}